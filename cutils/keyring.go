@@ -0,0 +1,152 @@
+package cutils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LegacyKeyVersion is the version of master.key, the key file written before
+// master keys were versioned. Wrapped user keys without a version use it.
+const LegacyKeyVersion = 1
+
+var versionedKeyFile = regexp.MustCompile(`^master\.([0-9]+)\.key$`)
+
+// Keyring holds every master key version found in the key directory. New user
+// keys are wrapped with the active version, existing ones can be unwrapped
+// with any version still present.
+type Keyring struct {
+	keys   map[int][]byte
+	active int
+}
+
+func NewKeyring(keys map[int][]byte, active int) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("master key version %d is not available", active)
+	}
+	return &Keyring{keys: keys, active: active}, nil
+}
+
+// LoadKeyring reads master.key and every master.<version>.key file from the
+// key directory. The highest version is active unless activeVersion is set.
+// Two files holding the same version, such as master.key and master.1.key,
+// are an error rather than one silently replacing the other.
+func LoadKeyring(activeVersion int) (*Keyring, error) {
+	dirPath := GetKeyDirPath()
+	keys := make(map[int][]byte)
+	files := make(map[int]string)
+
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		version := 0
+		if entry.Name() == "master.key" {
+			version = LegacyKeyVersion
+		} else if match := versionedKeyFile.FindStringSubmatch(entry.Name()); match != nil {
+			version, _ = strconv.Atoi(match[1])
+		} else {
+			continue
+		}
+		if previous, ok := files[version]; ok {
+			return nil, fmt.Errorf("%s and %s both hold master key version %d", previous, entry.Name(), version)
+		}
+		files[version] = entry.Name()
+
+		key, err := readKeyFile(filepath.Join(dirPath, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		keys[version] = key
+	}
+
+	if len(keys) == 0 {
+		return &Keyring{keys: keys}, nil
+	}
+
+	if activeVersion == 0 {
+		for version := range keys {
+			if version > activeVersion {
+				activeVersion = version
+			}
+		}
+	}
+	return NewKeyring(keys, activeVersion)
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	encodedKey, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(encodedKey)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return key, nil
+}
+
+func (k *Keyring) IsEmpty() bool {
+	return len(k.keys) == 0
+}
+
+// Active returns the version and value of the key used to wrap new user keys.
+func (k *Keyring) Active() (int, []byte) {
+	return k.active, k.keys[k.active]
+}
+
+// Key returns the master key for version. Version 0 means the wrapped key was
+// stored before versioning and maps to LegacyKeyVersion.
+func (k *Keyring) Key(version int) ([]byte, bool) {
+	if version == 0 {
+		version = LegacyKeyVersion
+	}
+	key, ok := k.keys[version]
+	return key, ok
+}
+
+// Versions lists the available key versions in ascending order.
+func (k *Keyring) Versions() []int {
+	versions := make([]int, 0, len(k.keys))
+	for version := range k.keys {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// GenerateVersionedKeyFile writes a new random master key as version and
+// returns it. It refuses to overwrite an existing key file.
+func GenerateVersionedKeyFile(version int) []byte {
+	key := GenerateKey()
+	encodedKey := hex.EncodeToString(key)
+
+	dirPath := GetKeyDirPath()
+	os.MkdirAll(dirPath, 0744)
+
+	out, err := os.OpenFile(GetVersionedKeyPath(version), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer out.Close()
+
+	_, errWrite := out.WriteString(encodedKey)
+	if errWrite != nil {
+		log.Fatal(errWrite.Error())
+	}
+	return key
+}
+
+func GetVersionedKeyPath(version int) string {
+	return fmt.Sprintf("%s/master.%d.key", GetKeyDirPath(), version)
+}
@@ -0,0 +1,93 @@
+package cutils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyDir points the key directory to a fresh temporary one holding files,
+// which map file names to keys.
+func keyDir(t *testing.T, files map[string][]byte) {
+	t.Helper()
+	home := t.TempDir()
+	previous, hadHome := os.LookupEnv("HOME")
+	os.Setenv("HOME", home)
+	t.Cleanup(func() {
+		if hadHome {
+			os.Setenv("HOME", previous)
+		} else {
+			os.Unsetenv("HOME")
+		}
+	})
+
+	dir := filepath.Join(home, ".catena")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	legacy, second, third := GenerateKey(), GenerateKey(), GenerateKey()
+	keyDir(t, map[string][]byte{
+		"master.key":   legacy,
+		"master.2.key": second,
+		"master.3.key": third,
+		"notes.txt":    []byte("not a key"),
+	})
+
+	keyring, err := LoadKeyring(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, key := keyring.Active(); version != 3 || !bytes.Equal(key, third) {
+		t.Errorf("active key is version %d", version)
+	}
+	if got := keyring.Versions(); len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("Versions = %v", got)
+	}
+	// Keys wrapped before versioning use master.key
+	if key, ok := keyring.Key(0); !ok || !bytes.Equal(key, legacy) {
+		t.Error("version 0 does not map to master.key")
+	}
+
+	keyring, err = LoadKeyring(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := keyring.Active(); version != 2 {
+		t.Errorf("active key is version %d, want the configured 2", version)
+	}
+
+	if _, err := LoadKeyring(4); err == nil {
+		t.Error("a missing active version was accepted")
+	}
+}
+
+func TestLoadKeyringEmpty(t *testing.T) {
+	keyDir(t, nil)
+	keyring, err := LoadKeyring(0)
+	if err != nil || !keyring.IsEmpty() {
+		t.Fatalf("LoadKeyring = %v, %v", keyring, err)
+	}
+}
+
+func TestLoadKeyringDuplicateVersion(t *testing.T) {
+	keyDir(t, map[string][]byte{
+		"master.key":   GenerateKey(),
+		"master.1.key": GenerateKey(),
+	})
+	_, err := LoadKeyring(0)
+	if err == nil || !strings.Contains(err.Error(), "master key version 1") {
+		t.Fatalf("LoadKeyring = %v", err)
+	}
+}
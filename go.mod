@@ -4,15 +4,15 @@ go 1.16
 
 require (
 	github.com/asaskevich/govalidator v0.0.0-20210307081110-f21760c49a8d // indirect
-	github.com/gabriel-vasile/mimetype v1.2.0 // indirect
+	github.com/gabriel-vasile/mimetype v1.2.0
 	github.com/go-openapi/errors v0.20.0 // indirect
-	github.com/go-openapi/runtime v0.19.27 // indirect
+	github.com/go-openapi/runtime v0.19.27
 	github.com/go-openapi/validate v0.20.2 // indirect
-	github.com/gofiber/fiber/v2 v2.6.0 // indirect
+	github.com/gofiber/fiber/v2 v2.6.0
 	github.com/klauspost/compress v1.11.13 // indirect
 	github.com/mailru/easyjson v0.7.7 // indirect
-	github.com/ory/hydra-client-go v1.9.2 // indirect
-	github.com/valyala/fasthttp v1.22.0 // indirect
-	go.mongodb.org/mongo-driver v1.5.0 // indirect
+	github.com/ory/hydra-client-go v1.9.2
+	github.com/valyala/fasthttp v1.22.0
+	go.mongodb.org/mongo-driver v1.5.0
 	golang.org/x/net v0.0.0-20210326220855-61e056675ecf // indirect
 )
@@ -0,0 +1,97 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// call is one request to the node. fasthttp cannot cancel a request in
+// flight, so when the context ends first the call returns right away and the
+// request finishes in the background; its agent and response only go back
+// to the pools once it has.
+type call struct {
+	agent *fiber.Agent
+	resp  *fiber.Response
+
+	// pending receives the result of a request still running after do
+	// returned
+	pending chan error
+}
+
+func newCall() *call {
+	agent := fiber.AcquireAgent()
+	agent.UserAgent("IPFS API Server")
+
+	return &call{
+		agent: agent,
+		resp:  fiber.AcquireResponse(),
+	}
+}
+
+// do sends the request, giving up when ctx ends or timeout elapses.
+func (c *call) do(ctx context.Context, timeout time.Duration, endpoint string) error {
+	if err := c.agent.Parse(); err != nil {
+		return err
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return contextError(endpoint, err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	result := make(chan error, 1)
+	go func() {
+		// The deadline also bounds the request once nobody waits for it
+		if deadline.IsZero() {
+			result <- c.agent.HostClient.Do(c.agent.Request(), c.resp)
+		} else {
+			result <- c.agent.HostClient.DoDeadline(c.agent.Request(), c.resp, deadline)
+		}
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			if ctx.Err() != nil {
+				return contextError(endpoint, ctx.Err())
+			}
+			return unavailable(endpoint, err)
+		}
+		return nil
+	case <-ctx.Done():
+		c.pending = result
+		return contextError(endpoint, ctx.Err())
+	}
+}
+
+func (c *call) release() {
+	if c.pending == nil {
+		fiber.ReleaseResponse(c.resp)
+		fiber.ReleaseAgent(c.agent)
+		return
+	}
+
+	go func() {
+		<-c.pending
+		fiber.ReleaseResponse(c.resp)
+		fiber.ReleaseAgent(c.agent)
+	}()
+}
+
+// contextError reports a call cut short by its context. A deadline is a
+// timeout of the node, a cancellation comes from the caller.
+func contextError(endpoint string, err error) error {
+	if err == context.DeadlineExceeded {
+		return &transportError{endpoint: endpoint, kind: ErrTimeout, err: err}
+	}
+	return fmt.Errorf("ipfs: %s: %w", endpoint, err)
+}
@@ -1,99 +1,478 @@
 package ipfs
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/faizainur/ipfs-api/resilience"
 	"github.com/gofiber/fiber/v2"
 )
 
 const (
-	AddFileEndpoint = "add"
-	CatFileEndpoint = "cat"
+	AddFileEndpoint   = "add"
+	CatFileEndpoint   = "cat"
+	PinAddEndpoint    = "pin/add"
+	PinRemoveEndpoint = "pin/rm"
+	PinListEndpoint   = "pin/ls"
+	DagStatEndpoint   = "dag/stat"
+	VersionEndpoint   = "version"
+
+	FilesMkdirEndpoint  = "files/mkdir"
+	FilesCopyEndpoint   = "files/cp"
+	FilesMoveEndpoint   = "files/mv"
+	FilesListEndpoint   = "files/ls"
+	FilesStatEndpoint   = "files/stat"
+	FilesRemoveEndpoint = "files/rm"
+
+	KeyGenEndpoint      = "key/gen"
+	KeyListEndpoint     = "key/list"
+	NamePublishEndpoint = "name/publish"
+	NameResolveEndpoint = "name/resolve"
+	ResolveEndpoint     = "resolve"
 )
 
+// nonIdempotentEndpoints are not retried: repeating them after an attempt
+// that reached the node changes the result. pin/rm answers "not pinned" the
+// second time, the files/* calls that change the MFS fail on what the first
+// attempt already did, and key/gen fails on the key it created.
+var nonIdempotentEndpoints = map[string]bool{
+	PinRemoveEndpoint:   true,
+	FilesMkdirEndpoint:  true,
+	FilesCopyEndpoint:   true,
+	FilesMoveEndpoint:   true,
+	FilesRemoveEndpoint: true,
+	KeyGenEndpoint:      true,
+}
+
 type ipfsUploadResponse struct {
 	Name string `json:"name,omitempty"  bson:"name"  form:"name"  binding:"name"`
 	Hash string `json:"hash,omitempty"  bson:"hash"  form:"hash"  binding:"hash"`
 	Size string `json:"size,omitempty"  bson:"size"  form:"size"  binding:"size"`
+	// Replicas names the nodes of an IPFSPool that pinned the upload
+	Replicas []string `json:"replicas,omitempty"  bson:"replicas"  form:"replicas"  binding:"replicas"`
+}
+
+type versionResponse struct {
+	Version string `json:"Version"`
+}
+
+// Timeouts bounds each kind of call to the node. They apply on top of the
+// deadline of the context passed to the call, the earliest one wins.
+type Timeouts struct {
+	// Add bounds uploads, which stream the whole file to the node
+	Add time.Duration
+	// Cat bounds reads through the gateway
+	Cat time.Duration
+	// Pin bounds the pin/* calls. Pinning a DAG the node does not have yet
+	// fetches it from the network first.
+	Pin time.Duration
+	// Files bounds the files/* calls on the MFS of the node
+	Files time.Duration
+	// Name bounds the key/*, name/* and resolve calls. Publishing and
+	// resolving an IPNS name may go through the DHT.
+	Name time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	Add:   10 * time.Minute,
+	Cat:   2 * time.Minute,
+	Pin:   5 * time.Minute,
+	Files: time.Minute,
+	Name:  2 * time.Minute,
 }
 
 type IPFSClient struct {
 	apiServerUri     string
 	gatewayServerUri string
+
+	Timeouts Timeouts
+	// APIUpstream and GatewayUpstream retry and circuit break the calls to
+	// the RPC API and to the gateway. Calls are attempted once when unset.
+	APIUpstream     *resilience.Upstream
+	GatewayUpstream *resilience.Upstream
 }
 
 func NewClient(apiServerUri string, gatewayServerUri string) *IPFSClient {
 	return &IPFSClient{
 		apiServerUri:     apiServerUri,
 		gatewayServerUri: gatewayServerUri,
+		Timeouts:         DefaultTimeouts,
 	}
 }
 
-func (f *IPFSClient) FetchFile(cid string) ([]byte, error) {
-	uri := f.formFetchUri(cid)
+func (f *IPFSClient) FetchFile(ctx context.Context, cid string) ([]byte, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
 
-	agent := fiber.AcquireAgent()
-	resp := fiber.AcquireResponse()
+	var data []byte
+	err := f.GatewayUpstream.Do(ctx, true, func(ctx context.Context) error {
+		var err error
+		data, err = f.fetchFile(ctx, cid)
+		return err
+	})
+	return data, err
+}
 
-	defer func() {
-		fiber.ReleaseResponse(resp)
-		fiber.ReleaseAgent(agent)
-	}()
+func (f *IPFSClient) fetchFile(ctx context.Context, cid string) ([]byte, error) {
+	uri := f.formFetchUri(cid)
 
-	agent.UserAgent("IPFS API Server")
+	call := newCall()
+	defer call.release()
+	agent, resp := call.agent, call.resp
 
 	req := agent.Request()
 	req.Header.SetMethod(fiber.MethodGet)
 	req.SetRequestURI(uri)
 
-	if err := agent.Parse(); err != nil {
-		panic(err)
+	if err := call.do(ctx, f.Timeouts.Cat, "gateway"); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != fiber.StatusOK {
+		return nil, newAPIError("gateway", resp.StatusCode(), resp.Body())
+	}
+
+	data := make([]byte, len(resp.Body()))
+	copy(data, resp.Body())
+	return data, nil
+}
+
+// FetchFileRange fetches length bytes of cid starting at offset through an
+// HTTP Range request to the gateway.
+func (f *IPFSClient) FetchFileRange(ctx context.Context, cid string, offset int64, length int64) ([]byte, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err := f.GatewayUpstream.Do(ctx, true, func(ctx context.Context) error {
+		var err error
+		data, err = f.fetchFileRange(ctx, cid, offset, length)
+		return err
+	})
+	return data, err
+}
+
+func (f *IPFSClient) fetchFileRange(ctx context.Context, cid string, offset int64, length int64) ([]byte, error) {
+	call := newCall()
+	defer call.release()
+	agent, resp := call.agent, call.resp
+
+	req := agent.Request()
+	req.Header.SetMethod(fiber.MethodGet)
+	req.Header.SetByteRange(int(offset), int(offset+length-1))
+	req.SetRequestURI(f.formFetchUri(cid))
+
+	if err := call.do(ctx, f.Timeouts.Cat, "gateway"); err != nil {
+		return nil, err
+	}
+
+	body := resp.Body()
+	switch resp.StatusCode() {
+	case fiber.StatusPartialContent:
+	case fiber.StatusOK:
+		// The gateway ignored the range and sent the whole object
+		if offset >= int64(len(body)) {
+			body = nil
+		} else {
+			body = body[offset:]
+		}
+		if int64(len(body)) > length {
+			body = body[:length]
+		}
+	case fiber.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	default:
+		return nil, newAPIError("gateway", resp.StatusCode(), body)
 	}
 
-	if err := agent.HostClient.Do(req, resp); err != nil {
+	data := make([]byte, len(body))
+	copy(data, body)
+	return data, nil
+}
+
+// Cat reads cid through the RPC API instead of the gateway, for nodes whose
+// gateway is down or not exposed.
+func (f *IPFSClient) Cat(ctx context.Context, cid string) ([]byte, error) {
+	if err := ValidateCid(cid); err != nil {
 		return nil, err
 	}
+	return f.callApi(ctx, f.Timeouts.Cat, CatFileEndpoint, map[string]string{"arg": cid})
+}
+
+// CatRange reads length bytes of cid starting at offset through the RPC API.
+func (f *IPFSClient) CatRange(ctx context.Context, cid string, offset int64, length int64) ([]byte, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+	return f.callApi(ctx, f.Timeouts.Cat, CatFileEndpoint, map[string]string{
+		"arg":    cid,
+		"offset": strconv.FormatInt(offset, 10),
+		"length": strconv.FormatInt(length, 10),
+	})
+}
+
+// Version returns the version of the node. It is the cheapest call of the
+// RPC API, which makes it a good health check.
+func (f *IPFSClient) Version(ctx context.Context) (string, error) {
+	var jsonResponse versionResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Cat, VersionEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return "", err
+	}
+	return jsonResponse.Version, nil
+}
 
-	return resp.Body(), nil
+// UploadFile adds data to IPFS. Adding is content addressed, so a failed
+// attempt is safe to retry.
+func (f *IPFSClient) UploadFile(ctx context.Context, filename string, data []byte) (ipfsUploadResponse, error) {
+	var jsonResponse ipfsUploadResponse
+	err := f.APIUpstream.Do(ctx, true, func(ctx context.Context) error {
+		var err error
+		jsonResponse, err = f.uploadFile(ctx, filename, data)
+		return err
+	})
+	return jsonResponse, err
 }
 
-func (f *IPFSClient) UploadFile(filename string, data []byte) (ipfsUploadResponse, error) {
+func (f *IPFSClient) uploadFile(ctx context.Context, filename string, data []byte) (ipfsUploadResponse, error) {
 	var jsonResponse ipfsUploadResponse
 
 	file := fiber.AcquireFormFile()
 	file.Content = data
 	file.Name = filename
 
-	agent := fiber.AcquireAgent()
-	resp := fiber.AcquireResponse()
+	// The form file is copied into the request body by MultipartForm
+	defer fiber.ReleaseFormFile(file)
 
-	defer func() {
-		fiber.ReleaseFormFile(file)
-		fiber.ReleaseResponse(resp)
-		fiber.ReleaseAgent(agent)
-	}()
+	call := newCall()
+	defer call.release()
+	agent, resp := call.agent, call.resp
 
 	req := agent.Request()
 	req.Header.SetMethod(fiber.MethodPost)
 	req.SetRequestURI(f.formApiIpfsUri(AddFileEndpoint, nil))
 
-	agent.UserAgent("IPFS API Server")
 	agent.FileData(file).MultipartForm(nil)
 
-	if err := agent.Parse(); err != nil {
-		panic(err)
+	if err := call.do(ctx, f.Timeouts.Add, AddFileEndpoint); err != nil {
+		return ipfsUploadResponse{}, err
 	}
 
-	if err := agent.HostClient.Do(req, resp); err != nil {
-		return ipfsUploadResponse{}, err
+	if resp.StatusCode() != fiber.StatusOK {
+		return ipfsUploadResponse{}, newAPIError(AddFileEndpoint, resp.StatusCode(), resp.Body())
 	}
 
-	json.Unmarshal(resp.Body(), &jsonResponse)
+	if err := json.Unmarshal(resp.Body(), &jsonResponse); err != nil {
+		return ipfsUploadResponse{}, err
+	}
 
 	return jsonResponse, nil
 }
 
+// UploadStream adds the content of r to IPFS without buffering it. The
+// multipart body is produced on the fly and sent with chunked transfer
+// encoding, so memory use does not depend on the size of the file. r cannot
+// be read twice, so the upload is not retried.
+func (f *IPFSClient) UploadStream(ctx context.Context, filename string, r io.Reader) (ipfsUploadResponse, error) {
+	var jsonResponse ipfsUploadResponse
+	err := f.APIUpstream.Do(ctx, false, func(ctx context.Context) error {
+		entries, err := f.uploadFiles(ctx, false, func(multipartWriter *multipart.Writer) error {
+			return writeMultipartFile(multipartWriter, filename, r)
+		})
+		if err != nil {
+			return err
+		}
+		jsonResponse = entries[0]
+		return nil
+	})
+	return jsonResponse, err
+}
+
+// FileIterator returns the files of a multi file upload one after the other,
+// and io.EOF once there are no more. Each reader is read to the end before
+// the next file is asked for.
+type FileIterator func() (name string, r io.Reader, err error)
+
+// UploadDirectory streams every file of next to IPFS in a single request and
+// wraps them in a directory. It returns the entry of each file followed by
+// the one of the directory, which has no name. Like UploadStream, it is not
+// retried.
+func (f *IPFSClient) UploadDirectory(ctx context.Context, next FileIterator) ([]ipfsUploadResponse, error) {
+	var entries []ipfsUploadResponse
+	err := f.APIUpstream.Do(ctx, false, func(ctx context.Context) error {
+		var err error
+		entries, err = f.uploadFiles(ctx, true, func(multipartWriter *multipart.Writer) error {
+			return writeMultipartFiles(multipartWriter, next)
+		})
+		return err
+	})
+	return entries, err
+}
+
+// UploadMultipart adds the files of body, a multipart form of type
+// contentType built by the caller, and wraps them in a directory when wrap
+// is set. It returns one entry per file, then the one of the directory.
+func (f *IPFSClient) UploadMultipart(ctx context.Context, contentType string, body io.Reader, wrap bool) ([]ipfsUploadResponse, error) {
+	var entries []ipfsUploadResponse
+	err := f.APIUpstream.Do(ctx, false, func(ctx context.Context) error {
+		var err error
+		entries, err = f.addMultipart(ctx, contentType, body, wrap)
+		return err
+	})
+	return entries, err
+}
+
+// uploadFiles adds the files write puts in a multipart form, streaming the
+// form to the node as it is written.
+func (f *IPFSClient) uploadFiles(ctx context.Context, wrap bool, write func(multipartWriter *multipart.Writer) error) ([]ipfsUploadResponse, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(bodyWriter)
+
+	readErr := make(chan error, 1)
+	go func() {
+		err := write(multipartWriter)
+		if err == nil {
+			err = multipartWriter.Close()
+		}
+		readErr <- err
+		bodyWriter.CloseWithError(err)
+	}()
+
+	entries, err := f.addMultipart(ctx, multipartWriter.FormDataContentType(), bodyReader, wrap)
+
+	// Unblocks the writer goroutine if the request stopped reading early, and
+	// waits for it so the files are not read once this returns. Their errors
+	// tell a failure to read them apart from a failure of the node.
+	bodyReader.Close()
+	if writeErr := <-readErr; writeErr != nil && writeErr != io.ErrClosedPipe && err != nil {
+		return nil, writeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (f *IPFSClient) addMultipart(ctx context.Context, contentType string, body io.Reader, wrap bool) ([]ipfsUploadResponse, error) {
+	var queryString map[string]string
+	if wrap {
+		queryString = map[string]string{"wrap-with-directory": "true"}
+	}
+
+	call := newCall()
+	defer call.release()
+	agent, resp := call.agent, call.resp
+
+	req := agent.Request()
+	req.Header.SetMethod(fiber.MethodPost)
+	req.Header.SetContentType(contentType)
+	req.SetRequestURI(f.formApiIpfsUri(AddFileEndpoint, queryString))
+	req.SetBodyStream(body, -1)
+
+	if err := call.do(ctx, f.Timeouts.Add, AddFileEndpoint); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != fiber.StatusOK {
+		return nil, newAPIError(AddFileEndpoint, resp.StatusCode(), resp.Body())
+	}
+
+	// add answers with one JSON object per file, and one for the directory
+	entries := make([]ipfsUploadResponse, 0, 1)
+	decoder := json.NewDecoder(bytes.NewReader(resp.Body()))
+	for {
+		var entry ipfsUploadResponse
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return nil, newAPIError(AddFileEndpoint, resp.StatusCode(), []byte("no file was added"))
+	}
+	return entries, nil
+}
+
+func writeMultipartFile(multipartWriter *multipart.Writer, filename string, r io.Reader) error {
+	part, err := multipartWriter.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, r)
+	return err
+}
+
+func writeMultipartFiles(multipartWriter *multipart.Writer, next FileIterator) error {
+	for {
+		name, r, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeMultipartFile(multipartWriter, name, r); err != nil {
+			return err
+		}
+	}
+}
+
+// callApi sends a POST request to the given Kubo RPC endpoint and returns the
+// raw response body. Every /api/v0 endpoint only accepts POST, so whether a
+// call may be retried comes from nonIdempotentEndpoints. args are sent in
+// order as arg parameters, for the endpoints that take several.
+func (f *IPFSClient) callApi(ctx context.Context, timeout time.Duration, endpoint string, queryString map[string]string, args ...string) ([]byte, error) {
+	var body []byte
+	err := f.APIUpstream.Do(ctx, !nonIdempotentEndpoints[endpoint], func(ctx context.Context) error {
+		var err error
+		body, err = f.callApiOnce(ctx, timeout, endpoint, queryString, args...)
+		return err
+	})
+	return body, err
+}
+
+func (f *IPFSClient) callApiOnce(ctx context.Context, timeout time.Duration, endpoint string, queryString map[string]string, args ...string) ([]byte, error) {
+	call := newCall()
+	defer call.release()
+	agent, resp := call.agent, call.resp
+
+	req := agent.Request()
+	req.Header.SetMethod(fiber.MethodPost)
+	req.SetRequestURI(f.formApiIpfsUri(endpoint, queryString, args...))
+
+	if err := call.do(ctx, timeout, endpoint); err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, len(resp.Body()))
+	copy(body, resp.Body())
+
+	if resp.StatusCode() != fiber.StatusOK {
+		return nil, newAPIError(endpoint, resp.StatusCode(), body)
+	}
+
+	return body, nil
+}
+
 func (f *IPFSClient) formFetchUri(cid string) string {
 	var builder strings.Builder
 
@@ -103,18 +482,24 @@ func (f *IPFSClient) formFetchUri(cid string) string {
 	return builder.String()
 }
 
-func (f *IPFSClient) formApiIpfsUri(endpoint string, queryString map[string]string) string {
+func (f *IPFSClient) formApiIpfsUri(endpoint string, queryString map[string]string, args ...string) string {
 	var builder strings.Builder
 
 	builder.WriteString(f.apiServerUri)
 	builder.WriteString(endpoint)
 
-	if queryString != nil {
+	if queryString != nil || len(args) > 0 {
 		builder.WriteString("?")
+		for _, arg := range args {
+			builder.WriteString("arg=")
+			builder.WriteString(url.QueryEscape(arg))
+			builder.WriteString("&")
+		}
 		for key, val := range queryString {
 			builder.WriteString(key)
 			builder.WriteString("=")
-			builder.WriteString(val)
+			// MFS paths may hold any character
+			builder.WriteString(url.QueryEscape(val))
 			builder.WriteString("&")
 		}
 	}
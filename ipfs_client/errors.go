@@ -0,0 +1,128 @@
+package ipfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	// ErrUpstreamUnavailable means the IPFS node could not be reached.
+	ErrUpstreamUnavailable = errors.New("ipfs node is unavailable")
+	// ErrTimeout means the node did not answer in time. It is retryable and
+	// also matches ErrUpstreamUnavailable.
+	ErrTimeout = errors.New("ipfs node timed out")
+	// ErrConnectionRefused means nothing listens on the node's address. It is
+	// retryable and also matches ErrUpstreamUnavailable.
+	ErrConnectionRefused = errors.New("ipfs node refused the connection")
+	// ErrInvalidCID means a CID was rejected before it was sent to the node.
+	ErrInvalidCID = errors.New("invalid CID")
+)
+
+// maxErrorBodySize bounds how much of a non JSON error body is kept in an
+// APIError.
+const maxErrorBodySize = 512
+
+// APIError is a non 2xx answer of the RPC API or the gateway. For the RPC
+// API, Message, Code and Type come from the JSON error body Kubo sends.
+type APIError struct {
+	Endpoint   string
+	StatusCode int
+	Message    string `json:"Message"`
+	Code       int    `json:"Code"`
+	Type       string `json:"Type"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("ipfs: %s returned status %d: %s", e.Endpoint, e.StatusCode, e.Message)
+}
+
+// newAPIError decodes the error body of a response with the given status.
+func newAPIError(endpoint string, statusCode int, body []byte) *APIError {
+	apiErr := &APIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Message == "" {
+		message := strings.TrimSpace(string(body))
+		if len(message) > maxErrorBodySize {
+			message = message[:maxErrorBodySize]
+		}
+		apiErr = &APIError{Message: message}
+	}
+	apiErr.Endpoint = endpoint
+	apiErr.StatusCode = statusCode
+	return apiErr
+}
+
+// transportError is a request that got no answer from the node.
+type transportError struct {
+	endpoint string
+	kind     error
+	err      error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.kind.Error(), e.endpoint, e.err.Error())
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+func (e *transportError) Is(target error) bool {
+	return target == e.kind || target == ErrUpstreamUnavailable
+}
+
+// unavailable wraps an error of the HTTP client so it matches
+// ErrUpstreamUnavailable, and ErrTimeout or ErrConnectionRefused when it is
+// one of those.
+func unavailable(endpoint string, err error) error {
+	kind := ErrUpstreamUnavailable
+
+	var netErr net.Error
+	switch {
+	case err == fasthttp.ErrTimeout || err == fasthttp.ErrDialTimeout:
+		kind = ErrTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		kind = ErrTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		kind = ErrConnectionRefused
+	}
+	return &transportError{endpoint: endpoint, kind: kind, err: err}
+}
+
+// IsRetryable reports whether the request that failed with err may succeed
+// if sent again: the node timed out or refused the connection, or a gateway
+// in front of it reported it as temporarily unavailable.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrConnectionRefused) {
+		return true
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case fasthttp.StatusBadGateway, fasthttp.StatusServiceUnavailable, fasthttp.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// cidPattern accepts CIDv0 and CIDv1 in the multibase encodings Kubo prints:
+// base32 (b), base58btc (z) and base16 (f).
+var cidPattern = regexp.MustCompile(`^(Qm[1-9A-HJ-NP-Za-km-z]{44}|b[a-z2-7]{16,}|z[1-9A-HJ-NP-Za-km-z]{16,}|f[0-9a-f]{16,})$`)
+
+// ValidateCid returns ErrInvalidCID unless cid looks like a CID. It also
+// keeps user input from adding path segments or query parameters to the
+// requests sent to the node.
+func ValidateCid(cid string) error {
+	if !cidPattern.MatchString(cid) {
+		return fmt.Errorf("%w: %q", ErrInvalidCID, cid)
+	}
+	return nil
+}
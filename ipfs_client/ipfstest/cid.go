@@ -0,0 +1,279 @@
+package ipfstest
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// The importer below follows the defaults of `ipfs add`: 256 KiB fixed size
+// chunks arranged in a balanced DAG of at most 174 links per node. With CID
+// version 0 leaves are dag-pb UnixFS nodes, with version 1 they are raw
+// blocks, which is what Kubo does when cid-version=1 implies raw-leaves.
+const (
+	chunkSize    = 256 * 1024
+	maxLinks     = 174
+	codecRaw     = 0x55
+	codecDagPb   = 0x70
+	hashSha2_256 = 0x12
+
+	unixfsDirectory = 1
+	unixfsFile      = 2
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Block is one encoded block of a DAG.
+type Block struct {
+	Cid  string
+	Data []byte
+}
+
+// dagNode is a node of the DAG under construction.
+type dagNode struct {
+	cid      []byte
+	tsize    uint64
+	fileSize uint64
+}
+
+type importer struct {
+	cidVersion int
+	blocks     []Block
+}
+
+// CidV0 returns the CID `ipfs add` gives data with default settings.
+func CidV0(data []byte) string {
+	cid, _, _ := Import(data, 0)
+	return cid
+}
+
+// CidV1 returns the CID `ipfs add --cid-version=1` gives data.
+func CidV1(data []byte) string {
+	cid, _, _ := Import(data, 1)
+	return cid
+}
+
+// Import chunks data into a UnixFS DAG and returns the root CID, the
+// cumulative DAG size reported by `ipfs add` and every block.
+func Import(data []byte, cidVersion int) (string, uint64, []Block) {
+	imp := &importer{cidVersion: cidVersion}
+
+	var level []dagNode
+	for offset := 0; offset < len(data) || offset == 0; offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		level = append(level, imp.leaf(data[offset:end]))
+		if end == len(data) {
+			break
+		}
+	}
+
+	for len(level) > 1 {
+		var parents []dagNode
+		for start := 0; start < len(level); start += maxLinks {
+			end := start + maxLinks
+			if end > len(level) {
+				end = len(level)
+			}
+			parents = append(parents, imp.parent(level[start:end]))
+		}
+		level = parents
+	}
+
+	root := level[0]
+	return encodeCid(root.cid, imp.cidVersion), root.tsize, imp.blocks
+}
+
+func (imp *importer) leaf(chunk []byte) dagNode {
+	if imp.cidVersion == 1 {
+		cid := cidBytes(1, codecRaw, chunk)
+		imp.addBlock(cid, chunk)
+		return dagNode{cid: cid, tsize: uint64(len(chunk)), fileSize: uint64(len(chunk))}
+	}
+
+	block := encodePbNode(nil, encodeUnixfs(chunk, uint64(len(chunk)), nil))
+	cid := cidBytes(0, codecDagPb, block)
+	imp.addBlock(cid, block)
+	return dagNode{cid: cid, tsize: uint64(len(block)), fileSize: uint64(len(chunk))}
+}
+
+func (imp *importer) parent(children []dagNode) dagNode {
+	var fileSize, tsize uint64
+	blockSizes := make([]uint64, 0, len(children))
+	for _, child := range children {
+		fileSize += child.fileSize
+		tsize += child.tsize
+		blockSizes = append(blockSizes, child.fileSize)
+	}
+
+	block := encodePbNode(children, encodeUnixfs(nil, fileSize, blockSizes))
+	cid := cidBytes(imp.cidVersion, codecDagPb, block)
+	imp.addBlock(cid, block)
+	return dagNode{cid: cid, tsize: tsize + uint64(len(block)), fileSize: fileSize}
+}
+
+func (imp *importer) addBlock(cid []byte, data []byte) {
+	imp.blocks = append(imp.blocks, Block{Cid: encodeCid(cid, imp.cidVersion), Data: data})
+}
+
+// encodeUnixfs encodes the UnixFS Data message of a file node.
+func encodeUnixfs(data []byte, fileSize uint64, blockSizes []uint64) []byte {
+	buf := appendVarintField(nil, 1, unixfsFile)
+	if len(data) > 0 {
+		buf = appendBytesField(buf, 2, data)
+	}
+	buf = appendVarintField(buf, 3, fileSize)
+	for _, size := range blockSizes {
+		buf = appendVarintField(buf, 4, size)
+	}
+	return buf
+}
+
+// encodePbNode encodes a dag-pb PBNode, links first as the canonical form
+// requires.
+func encodePbNode(links []dagNode, data []byte) []byte {
+	var buf []byte
+	for _, link := range links {
+		encodedLink := appendBytesField(nil, 1, link.cid)
+		encodedLink = appendBytesField(encodedLink, 2, nil)
+		encodedLink = appendVarintField(encodedLink, 3, link.tsize)
+		buf = appendBytesField(buf, 2, encodedLink)
+	}
+	return appendBytesField(buf, 1, data)
+}
+
+func appendVarintField(buf []byte, field int, value uint64) []byte {
+	buf = appendUvarint(buf, uint64(field<<3))
+	return appendUvarint(buf, value)
+}
+
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	return append(buf, tmp[:n]...)
+}
+
+// cidBytes returns the binary CID of block: a bare sha2-256 multihash for
+// version 0, version and codec prefixed for version 1.
+func cidBytes(version int, codec uint64, block []byte) []byte {
+	sum := sha256.Sum256(block)
+	multihash := append([]byte{hashSha2_256, 32}, sum[:]...)
+	if version == 0 {
+		return multihash
+	}
+
+	buf := appendUvarint(nil, 1)
+	buf = appendUvarint(buf, codec)
+	return append(buf, multihash...)
+}
+
+// encodeCid renders a binary CID as text: base58btc for version 0, multibase
+// base32 ("b" prefix) for version 1.
+func encodeCid(cid []byte, version int) string {
+	if version == 0 {
+		return base58Encode(cid)
+	}
+	return "b" + base32Lower.EncodeToString(cid)
+}
+
+// DecodeCid parses a text CID and reports whether it is well formed.
+func DecodeCid(cid string) ([]byte, bool) {
+	switch {
+	case len(cid) == 46 && strings.HasPrefix(cid, "Qm"):
+		decoded, ok := base58Decode(cid)
+		return decoded, ok && len(decoded) == 34
+	case strings.HasPrefix(cid, "b"):
+		decoded, err := base32Lower.DecodeString(cid[1:])
+		return decoded, err == nil && len(decoded) > 4 && decoded[0] == 1
+	}
+	return nil, false
+}
+
+func base58Encode(data []byte) string {
+	value := new(big.Int).SetBytes(data)
+	base := big.NewInt(58)
+	mod := new(big.Int)
+
+	var out []byte
+	for value.Sign() > 0 {
+		value.DivMod(value, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(text string) ([]byte, bool) {
+	value := new(big.Int)
+	base := big.NewInt(58)
+	for _, char := range text {
+		index := strings.IndexRune(base58Alphabet, char)
+		if index < 0 {
+			return nil, false
+		}
+		value.Mul(value, base)
+		value.Add(value, big.NewInt(int64(index)))
+	}
+
+	decoded := value.Bytes()
+	for _, char := range text {
+		if char != rune(base58Alphabet[0]) {
+			break
+		}
+		decoded = append([]byte{0}, decoded...)
+	}
+	return decoded, true
+}
+
+// Link names an entry of a UnixFS directory.
+type Link struct {
+	Name  string
+	Cid   string
+	Tsize uint64
+}
+
+// ImportDirectory builds the UnixFS directory node holding links, sorted by
+// name the way `ipfs add --wrap-with-directory` does, and returns its CID,
+// cumulative size and block.
+func ImportDirectory(links []Link, cidVersion int) (string, uint64, Block) {
+	sorted := make([]Link, len(links))
+	copy(sorted, links)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var buf []byte
+	var tsize uint64
+	for _, link := range sorted {
+		cid, _ := DecodeCid(link.Cid)
+		encodedLink := appendBytesField(nil, 1, cid)
+		encodedLink = appendBytesField(encodedLink, 2, []byte(link.Name))
+		encodedLink = appendVarintField(encodedLink, 3, link.Tsize)
+		buf = appendBytesField(buf, 2, encodedLink)
+		tsize += link.Tsize
+	}
+	block := appendBytesField(buf, 1, appendVarintField(nil, 1, unixfsDirectory))
+
+	cid := encodeCid(cidBytes(cidVersion, codecDagPb, block), cidVersion)
+	return cid, tsize + uint64(len(block)), Block{Cid: cid, Data: block}
+}
@@ -0,0 +1,84 @@
+package ipfstest_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+)
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		cidVersion int
+		cid        string
+	}{
+		{"empty v0", nil, 0, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{"hello v0", []byte("hello world\n"), 0, "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"},
+		{"empty v1", nil, 1, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{"hello v1", []byte("hello world\n"), 1, "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cid, _, blocks := ipfstest.Import(test.data, test.cidVersion)
+			if cid != test.cid {
+				t.Fatalf("cid = %s, want %s", cid, test.cid)
+			}
+			if len(blocks) != 1 || blocks[0].Cid != cid {
+				t.Fatalf("blocks = %v, want the root block only", blocks)
+			}
+		})
+	}
+}
+
+func TestImportChunks(t *testing.T) {
+	// Four chunks of 256 KiB, the last one a single byte
+	data := bytes.Repeat([]byte{7}, 3*256*1024+1)
+
+	cid, size, blocks := ipfstest.Import(data, 1)
+	if len(blocks) != 5 {
+		t.Fatalf("got %d blocks, want 4 leaves and a root", len(blocks))
+	}
+	if blocks[len(blocks)-1].Cid != cid {
+		t.Fatalf("last block is %s, want the root %s", blocks[len(blocks)-1].Cid, cid)
+	}
+	if size <= uint64(len(data)) {
+		t.Fatalf("cumulative size %d does not cover the %d bytes of data", size, len(data))
+	}
+	// The three full leaves are the same chunk
+	if blocks[0].Cid != blocks[1].Cid || blocks[0].Cid == blocks[3].Cid {
+		t.Fatalf("leaves %s %s %s, want the first ones equal", blocks[0].Cid, blocks[1].Cid, blocks[3].Cid)
+	}
+	if ipfstest.CidV1(data) != cid || ipfstest.CidV0(data) == cid {
+		t.Fatal("CidV0 and CidV1 do not match Import")
+	}
+}
+
+func TestImportDirectory(t *testing.T) {
+	cid, _, _ := ipfstest.ImportDirectory(nil, 0)
+	if cid != "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn" {
+		t.Fatalf("empty directory is %s", cid)
+	}
+
+	a := ipfstest.Link{Name: "a", Cid: ipfstest.CidV0([]byte("a")), Tsize: 9}
+	b := ipfstest.Link{Name: "b", Cid: ipfstest.CidV0([]byte("b")), Tsize: 9}
+	first, _, _ := ipfstest.ImportDirectory([]ipfstest.Link{a, b}, 0)
+	second, _, _ := ipfstest.ImportDirectory([]ipfstest.Link{b, a}, 0)
+	if first != second {
+		t.Fatalf("directory CID depends on link order: %s and %s", first, second)
+	}
+}
+
+func TestDecodeCid(t *testing.T) {
+	for _, cid := range []string{ipfstest.CidV0([]byte("x")), ipfstest.CidV1([]byte("x"))} {
+		if _, ok := ipfstest.DecodeCid(cid); !ok {
+			t.Errorf("DecodeCid(%s) failed", cid)
+		}
+	}
+	for _, cid := range []string{"", "Qm0OIl", "not-a-cid"} {
+		if _, ok := ipfstest.DecodeCid(cid); ok {
+			t.Errorf("DecodeCid(%q) succeeded", cid)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package ipfstest
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// base36 is the alphabet of the base36 names the fake node makes up for its
+// keys.
+const base36 = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// newName makes up an IPNS name shaped like the ones Kubo prints for
+// ed25519 keys.
+func newName() string {
+	random := make([]byte, 50)
+	rand.Read(random)
+
+	var builder strings.Builder
+	builder.WriteString("k51qzi5uqu5d")
+	for _, b := range random {
+		builder.WriteByte(base36[int(b)%len(base36)])
+	}
+	return builder.String()
+}
+
+// Published returns the path the IPNS name points to on the node.
+func (n *Node) Published(name string) (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	value, ok := n.names[name]
+	return value, ok
+}
+
+func (n *Node) serveKeyGen(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("arg")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "argument \"name\" is required")
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.keys[name]; ok {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("key with name '%s' already exists", name))
+		return
+	}
+	n.keys[name] = newName()
+
+	writeJSON(w, map[string]interface{}{"Name": name, "Id": n.keys[name]})
+}
+
+func (n *Node) serveKeyList(w http.ResponseWriter, r *http.Request) {
+	type key struct {
+		Name string `json:"Name"`
+		Id   string `json:"Id"`
+	}
+
+	n.mutex.Lock()
+	keys := make([]key, 0, len(n.keys))
+	for name, id := range n.keys {
+		keys = append(keys, key{Name: name, Id: id})
+	}
+	n.mutex.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+
+	writeJSON(w, map[string]interface{}{"Keys": keys})
+}
+
+func (n *Node) serveNamePublish(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	value := path.Clean(query.Get("arg"))
+	key := query.Get("key")
+	if key == "" {
+		key = "self"
+	}
+
+	if _, err := n.resolvePath(value); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	name, ok := n.keys[key]
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "no key by the given name was found")
+		return
+	}
+	n.names[name] = value
+
+	writeJSON(w, map[string]interface{}{"Name": name, "Value": value})
+}
+
+func (n *Node) serveNameResolve(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Query().Get("arg"), "/ipns/")
+
+	n.mutex.Lock()
+	value, ok := n.names[name]
+	n.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "could not resolve name")
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"Path": value})
+}
+
+func (n *Node) serveResolve(w http.ResponseWriter, r *http.Request) {
+	cid, err := n.resolvePath(path.Clean(r.URL.Query().Get("arg")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"Path": "/ipfs/" + cid})
+}
+
+// resolvePath follows p, /ipfs/<cid> or /ipns/<name> followed by names,
+// through the directories of the node to the CID it leads to.
+func (n *Node) resolvePath(p string) (string, error) {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if len(segments) < 2 {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	cid := segments[1]
+	switch segments[0] {
+	case "ipfs":
+	case "ipns":
+		value, ok := n.names[cid]
+		if !ok {
+			return "", errors.New("could not resolve name")
+		}
+		cid = strings.TrimPrefix(value, "/ipfs/")
+	default:
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+
+	if _, ok := n.blocks[cid]; !ok {
+		return "", errors.New(notFoundMessage(cid))
+	}
+	for _, name := range segments[2:] {
+		child, ok := n.dirs[cid][name]
+		if !ok {
+			return "", fmt.Errorf("no link named %q under %s", name, cid)
+		}
+		cid = child
+	}
+	return cid, nil
+}
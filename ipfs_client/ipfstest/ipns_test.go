@@ -0,0 +1,94 @@
+package ipfstest_test
+
+import (
+	"context"
+	"testing"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+)
+
+func TestKeys(t *testing.T) {
+	_, client := newClient(t)
+	ctx := context.Background()
+
+	key, err := client.GenerateKey(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ipfs.ValidateName(key.Id); err != nil {
+		t.Fatalf("generated name %s: %v", key.Id, err)
+	}
+	if _, err := client.GenerateKey(ctx, "alice"); !ipfs.IsKeyExist(err) {
+		t.Fatalf("generating a key twice returned %v", err)
+	}
+
+	keys, err := client.ListKeys(ctx)
+	if err != nil || len(keys) != 2 || keys[0] != key || keys[1].Name != "self" {
+		t.Fatalf("ListKeys = %+v, %v", keys, err)
+	}
+}
+
+func TestPublishAndResolve(t *testing.T) {
+	node, client := newClient(t)
+	ctx := context.Background()
+	file := node.Add([]byte("index"), 0)
+	_, size, _ := ipfstest.Import([]byte("index"), 0)
+
+	// A directory holding the file, as an MFS folder is published
+	if err := client.MakeDirectory(ctx, "/site", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CopyPath(ctx, "/ipfs/"+file, "/site/index.html"); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := client.StatPath(ctx, "/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, _, _ := ipfstest.ImportDirectory([]ipfstest.Link{{Name: "index.html", Cid: file, Tsize: size}}, 0)
+	if stat.Hash != dir {
+		t.Fatalf("directory is %s, want %s", stat.Hash, dir)
+	}
+
+	key, err := client.GenerateKey(ctx, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := client.Publish(ctx, "site", dir, 0)
+	if err != nil || entry.Name != key.Id || entry.Value != "/ipfs/"+dir {
+		t.Fatalf("Publish = %+v, %v", entry, err)
+	}
+	if value, ok := node.Published(key.Id); !ok || value != "/ipfs/"+dir {
+		t.Fatalf("Published = %q, %v", value, ok)
+	}
+
+	resolved, err := client.ResolveName(ctx, key.Id)
+	if err != nil || resolved != "/ipfs/"+dir {
+		t.Fatalf("ResolveName = %q, %v", resolved, err)
+	}
+	resolved, err = client.ResolvePath(ctx, "/ipfs/"+dir+"/index.html")
+	if err != nil || resolved != file {
+		t.Fatalf("ResolvePath = %q, %v", resolved, err)
+	}
+	if _, err := client.ResolvePath(ctx, "/ipfs/"+dir+"/missing"); !ipfs.IsNotResolved(err) {
+		t.Fatalf("resolving a missing link returned %v", err)
+	}
+}
+
+func TestPublishErrors(t *testing.T) {
+	node, client := newClient(t)
+	ctx := context.Background()
+	cid := node.Add([]byte("data"), 0)
+
+	if _, err := client.Publish(ctx, "nobody", cid, 0); !ipfs.IsKeyNotFound(err) {
+		t.Fatalf("publishing with a missing key returned %v", err)
+	}
+	key, err := client.GenerateKey(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ResolveName(ctx, key.Id); !ipfs.IsNotResolved(err) {
+		t.Fatalf("resolving an unpublished name returned %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package ipfstest
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	errNotExist    = errors.New("file does not exist")
+	errExist       = errors.New("file already exists")
+	errEntryExists = errors.New("directory already has entry by that name")
+	errNotDir      = errors.New("not a directory")
+)
+
+// mfsNode is a file or a directory of the MFS. Files only have a CID, the
+// CID of a directory is computed when it is needed.
+type mfsNode struct {
+	cid      string
+	children map[string]*mfsNode
+}
+
+func newMfsDirectory() *mfsNode {
+	return &mfsNode{children: make(map[string]*mfsNode)}
+}
+
+func (m *mfsNode) isDirectory() bool {
+	return m.children != nil
+}
+
+func (m *mfsNode) clone() *mfsNode {
+	if !m.isDirectory() {
+		return &mfsNode{cid: m.cid}
+	}
+	copied := newMfsDirectory()
+	for name, child := range m.children {
+		copied.children[name] = child.clone()
+	}
+	return copied
+}
+
+// MfsPaths returns every path of the MFS, sorted.
+func (n *Node) MfsPaths() []string {
+	n.mfsMutex.Lock()
+	defer n.mfsMutex.Unlock()
+
+	var paths []string
+	var walk func(p string, node *mfsNode)
+	walk = func(p string, node *mfsNode) {
+		paths = append(paths, p)
+		for name, child := range node.children {
+			walk(path.Join(p, name), child)
+		}
+	}
+	walk("/", n.mfs)
+	sort.Strings(paths)
+	return paths
+}
+
+// resolve returns the node at the clean absolute path p.
+func (n *Node) resolve(p string) (*mfsNode, error) {
+	node := n.mfs
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !node.isDirectory() {
+			return nil, errNotDir
+		}
+		child, ok := node.children[name]
+		if !ok {
+			return nil, errNotExist
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// parent returns the directory holding p and the name of p in it.
+func (n *Node) parent(p string) (*mfsNode, string, error) {
+	dir, err := n.resolve(path.Dir(p))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDirectory() {
+		return nil, "", errNotDir
+	}
+	return dir, path.Base(p), nil
+}
+
+// importMfs builds the MFS node of cid from the blocks of the node.
+func (n *Node) importMfs(cid string) (*mfsNode, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var build func(cid string) (*mfsNode, error)
+	build = func(cid string) (*mfsNode, error) {
+		if entries, ok := n.dirs[cid]; ok {
+			dir := newMfsDirectory()
+			for name, child := range entries {
+				node, err := build(child)
+				if err != nil {
+					return nil, err
+				}
+				dir.children[name] = node
+			}
+			return dir, nil
+		}
+		if _, ok := n.files[cid]; ok {
+			return &mfsNode{cid: cid}, nil
+		}
+		return nil, errors.New(notFoundMessage(cid))
+	}
+	return build(cid)
+}
+
+// store computes the CID and cumulative size of node, storing the
+// directories it holds as blocks so they can be copied back from /ipfs/.
+func (n *Node) store(node *mfsNode) (string, uint64) {
+	if !node.isDirectory() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		return node.cid, n.sizes[node.cid]
+	}
+
+	links := make([]Link, 0, len(node.children))
+	for name, child := range node.children {
+		cid, size := n.store(child)
+		links = append(links, Link{Name: name, Cid: cid, Tsize: size})
+	}
+	return n.addDirectory(links, 0)
+}
+
+func (n *Node) serveFiles(endpoint string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	args := query["arg"]
+	if len(args) == 0 {
+		writeError(w, http.StatusBadRequest, "argument \"path\" is required")
+		return
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "/") {
+			writeError(w, http.StatusInternalServerError, "paths must start with a leading slash")
+			return
+		}
+	}
+
+	n.mfsMutex.Lock()
+	defer n.mfsMutex.Unlock()
+
+	var err error
+	switch endpoint {
+	case "files/mkdir":
+		err = n.mkdir(path.Clean(args[0]), query.Get("parents") == "true")
+	case "files/cp":
+		err = n.copy(args, false)
+	case "files/mv":
+		err = n.copy(args, true)
+	case "files/rm":
+		err = n.remove(path.Clean(args[0]), query.Get("recursive") == "true")
+	case "files/ls":
+		err = n.list(w, path.Clean(args[0]))
+	case "files/stat":
+		err = n.stat(w, path.Clean(args[0]))
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if endpoint != "files/ls" && endpoint != "files/stat" {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (n *Node) mkdir(p string, parents bool) error {
+	if p == "/" {
+		if parents {
+			return nil
+		}
+		return errExist
+	}
+
+	dir, name, err := n.parent(p)
+	if err == errNotExist && parents {
+		if err := n.mkdir(path.Dir(p), true); err != nil {
+			return err
+		}
+		dir, name, err = n.parent(p)
+	}
+	if err != nil {
+		return err
+	}
+
+	if existing, ok := dir.children[name]; ok {
+		if parents && existing.isDirectory() {
+			return nil
+		}
+		return errExist
+	}
+	dir.children[name] = newMfsDirectory()
+	return nil
+}
+
+// copy copies or moves args[0] to args[1]. Moving into a directory that
+// exists moves into it, as files/mv does.
+func (n *Node) copy(args []string, move bool) error {
+	if len(args) != 2 {
+		return errors.New("two paths are required")
+	}
+	source, dest := path.Clean(args[0]), path.Clean(args[1])
+
+	var node *mfsNode
+	var err error
+	if strings.HasPrefix(source, "/ipfs/") {
+		node, err = n.importMfs(strings.TrimPrefix(source, "/ipfs/"))
+	} else {
+		node, err = n.resolve(source)
+	}
+	if err != nil {
+		return err
+	}
+
+	if move {
+		if target, err := n.resolve(dest); err == nil && target.isDirectory() {
+			dest = path.Join(dest, path.Base(source))
+		}
+	}
+
+	dir, name, err := n.parent(dest)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[name]; ok {
+		return errEntryExists
+	}
+
+	if !move {
+		dir.children[name] = node.clone()
+		return nil
+	}
+	if source == "/" || strings.HasPrefix(dest, source+"/") {
+		return errors.New("cannot move a directory into itself")
+	}
+	sourceDir, sourceName, _ := n.parent(source)
+	delete(sourceDir.children, sourceName)
+	dir.children[name] = node
+	return nil
+}
+
+func (n *Node) remove(p string, recursive bool) error {
+	if p == "/" {
+		return errors.New("cannot delete root")
+	}
+
+	dir, name, err := n.parent(p)
+	if err != nil {
+		return err
+	}
+	node, ok := dir.children[name]
+	if !ok {
+		return errNotExist
+	}
+	if node.isDirectory() && !recursive {
+		return errors.New(p + " is a directory, use -r to remove directories")
+	}
+	delete(dir.children, name)
+	return nil
+}
+
+func (n *Node) list(w http.ResponseWriter, p string) error {
+	node, err := n.resolve(p)
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		Name string `json:"Name"`
+		Type int    `json:"Type"`
+		Size uint64 `json:"Size"`
+		Hash string `json:"Hash"`
+	}
+
+	var entries []entry
+	if !node.isDirectory() {
+		cid, size := n.store(node)
+		entries = append(entries, entry{Name: path.Base(p), Size: size, Hash: cid})
+	}
+	for name, child := range node.children {
+		cid, size := n.store(child)
+		listed := entry{Name: name, Size: size, Hash: cid}
+		if child.isDirectory() {
+			listed.Type = 1
+			listed.Size = 0
+		}
+		entries = append(entries, listed)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	writeJSON(w, map[string]interface{}{"Entries": entries})
+	return nil
+}
+
+func (n *Node) stat(w http.ResponseWriter, p string) error {
+	node, err := n.resolve(p)
+	if err != nil {
+		return err
+	}
+
+	cid, size := n.store(node)
+	nodeType, fileSize := "file", size
+	if node.isDirectory() {
+		nodeType, fileSize = "directory", 0
+	} else {
+		n.mutex.Lock()
+		fileSize = uint64(len(n.files[cid]))
+		n.mutex.Unlock()
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"Hash":           cid,
+		"Size":           fileSize,
+		"CumulativeSize": size,
+		"Blocks":         len(node.children),
+		"Type":           nodeType,
+	})
+	return nil
+}
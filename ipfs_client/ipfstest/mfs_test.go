@@ -0,0 +1,104 @@
+package ipfstest_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+)
+
+func TestMfs(t *testing.T) {
+	node, client := newClient(t)
+	ctx := context.Background()
+	cid := node.Add([]byte("report"), 0)
+
+	if err := client.MakeDirectory(ctx, "/users/alice/docs", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.MakeDirectory(ctx, "/users/alice", false); !ipfs.IsExist(err) {
+		t.Fatalf("making an existing directory returned %v", err)
+	}
+	if err := client.CopyPath(ctx, "/ipfs/"+cid, "/users/alice/docs/report.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CopyPath(ctx, "/ipfs/"+cid, "/users/alice/docs/report.txt"); !ipfs.IsExist(err) {
+		t.Fatalf("copying over an entry returned %v", err)
+	}
+
+	entries, err := client.ListDirectory(ctx, "/users/alice/docs")
+	if err != nil || len(entries) != 1 || entries[0].Name != "report.txt" || entries[0].Hash != cid || entries[0].Type != ipfs.MfsTypeFile {
+		t.Fatalf("ListDirectory = %+v, %v", entries, err)
+	}
+
+	stat, err := client.StatPath(ctx, "/users/alice/docs/report.txt")
+	if err != nil || stat.Hash != cid || stat.Type != ipfs.MfsTypeFile || stat.Size != 6 {
+		t.Fatalf("StatPath = %+v, %v", stat, err)
+	}
+
+	// files/mv into an existing directory moves into it
+	if err := client.MakeDirectory(ctx, "/users/alice/archive", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.MovePath(ctx, "/users/alice/docs/report.txt", "/users/alice/archive"); err != nil {
+		t.Fatal(err)
+	}
+	wantPaths := []string{
+		"/",
+		"/users",
+		"/users/alice",
+		"/users/alice/archive",
+		"/users/alice/archive/report.txt",
+		"/users/alice/docs",
+	}
+	if paths := node.MfsPaths(); !reflect.DeepEqual(paths, wantPaths) {
+		t.Fatalf("MfsPaths = %v, want %v", paths, wantPaths)
+	}
+
+	if err := client.RemovePath(ctx, "/users/alice", false); err == nil {
+		t.Fatal("removed a directory without recursive")
+	}
+	if err := client.RemovePath(ctx, "/users/alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StatPath(ctx, "/users/alice"); !ipfs.IsNotExist(err) {
+		t.Fatalf("stat of a removed path returned %v", err)
+	}
+}
+
+func TestMfsDirectoryCid(t *testing.T) {
+	node, client := newClient(t)
+	ctx := context.Background()
+	cid := node.Add([]byte("a"), 0)
+
+	if err := client.MakeDirectory(ctx, "/dir", false); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := client.StatPath(ctx, "/dir")
+	if err != nil || stat.Hash != "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn" {
+		t.Fatalf("empty directory stat = %+v, %v", stat, err)
+	}
+
+	if err := client.CopyPath(ctx, "/ipfs/"+cid, "/dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	stat, err = client.StatPath(ctx, "/dir")
+	if err != nil || stat.Type != ipfs.MfsTypeDirectory {
+		t.Fatalf("StatPath = %+v, %v", stat, err)
+	}
+	_, size, _ := ipfstest.Import([]byte("a"), 0)
+	want, _, _ := ipfstest.ImportDirectory([]ipfstest.Link{{Name: "a", Cid: cid, Tsize: size}}, 0)
+	if stat.Hash != want {
+		t.Fatalf("directory is %s, want %s", stat.Hash, want)
+	}
+
+	// A directory copied back from /ipfs/ keeps its content
+	if err := client.CopyPath(ctx, "/ipfs/"+stat.Hash, "/copy"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := client.ListDirectory(ctx, "/copy")
+	if err != nil || len(entries) != 1 || entries[0].Hash != cid {
+		t.Fatalf("ListDirectory of the copy = %+v, %v", entries, err)
+	}
+}
@@ -0,0 +1,575 @@
+// Package ipfstest runs an in-process fake IPFS node for tests. It serves the
+// subset of the Kubo RPC API and gateway the ipfs client uses, keeps every
+// block, its MFS and its IPNS names in memory, returns the same CIDs a real
+// node would and can be told to fail or stall on any endpoint.
+package ipfstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayEndpoint is the failure injection key of the /ipfs/ gateway.
+const GatewayEndpoint = "gateway"
+
+// Version is the version the fake node reports on /api/v0/version.
+const Version = "0.0.0-ipfstest"
+
+// Failure describes how an endpoint misbehaves. A zero Status with a Delay
+// only slows the endpoint down; Drop closes the connection without a
+// response. Times limits how many requests fail, zero meaning until cleared.
+type Failure struct {
+	Status  int
+	Message string
+	Delay   time.Duration
+	Drop    bool
+	Times   int
+}
+
+// Node is a fake IPFS node listening on a local port.
+type Node struct {
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	blocks   map[string][]byte
+	files    map[string][]byte
+	dirs     map[string]map[string]string
+	sizes    map[string]uint64
+	pins     map[string]string
+	keys     map[string]string
+	names    map[string]string
+	failures map[string]*Failure
+	calls    map[string]int
+
+	mfsMutex sync.Mutex
+	mfs      *mfsNode
+}
+
+type addResponse struct {
+	Name string `json:"Name"`
+	Hash string `json:"Hash"`
+	Size string `json:"Size"`
+}
+
+type apiErrorResponse struct {
+	Message string `json:"Message"`
+	Code    int    `json:"Code"`
+	Type    string `json:"Type"`
+}
+
+// NewNode starts a fake node. Close it when done.
+func NewNode() *Node {
+	node := &Node{
+		blocks:   make(map[string][]byte),
+		files:    make(map[string][]byte),
+		dirs:     make(map[string]map[string]string),
+		sizes:    make(map[string]uint64),
+		pins:     make(map[string]string),
+		keys:     map[string]string{"self": newName()},
+		names:    make(map[string]string),
+		failures: make(map[string]*Failure),
+		calls:    make(map[string]int),
+		mfs:      newMfsDirectory(),
+	}
+	node.server = httptest.NewServer(http.HandlerFunc(node.serveHTTP))
+	return node
+}
+
+// APIURL is the value to use for IPFS_API_SERVER_URI.
+func (n *Node) APIURL() string {
+	return n.server.URL + "/api/v0/"
+}
+
+// GatewayURL is the value to use for IPFS_GATEWAY_URI.
+func (n *Node) GatewayURL() string {
+	return n.server.URL + "/ipfs/"
+}
+
+// Close stops the node. Later requests get connection refused.
+func (n *Node) Close() {
+	n.server.Close()
+}
+
+// InjectFailure makes endpoint ("add", "pin/add", GatewayEndpoint...) fail
+// as described until ClearFailures is called or Times is used up.
+func (n *Node) InjectFailure(endpoint string, failure Failure) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.failures[endpoint] = &failure
+}
+
+func (n *Node) ClearFailures() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.failures = make(map[string]*Failure)
+}
+
+// Calls returns how many requests endpoint received, failed ones included.
+func (n *Node) Calls(endpoint string) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.calls[endpoint]
+}
+
+// Add stores data as `ipfs add` would without pinning it and returns its CID.
+func (n *Node) Add(data []byte, cidVersion int) string {
+	cid, _ := n.add(data, cidVersion)
+	return cid
+}
+
+// Content returns the file stored under cid.
+func (n *Node) Content(cid string) ([]byte, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	data, ok := n.files[cid]
+	return data, ok
+}
+
+// IsPinned reports whether cid is pinned and how.
+func (n *Node) IsPinned(cid string) (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	pinType, ok := n.pins[cid]
+	return pinType, ok
+}
+
+// RemoveBlock drops cid's blocks, as if the datastore lost them. Pins stay in
+// place so dag/stat reports them as bad.
+func (n *Node) RemoveBlock(cid string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.blocks, cid)
+	delete(n.files, cid)
+}
+
+func (n *Node) add(data []byte, cidVersion int) (string, uint64) {
+	cid, size, blocks := Import(data, cidVersion)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, block := range blocks {
+		n.blocks[block.Cid] = block.Data
+	}
+	n.files[cid] = data
+	n.sizes[cid] = size
+	return cid, size
+}
+
+func (n *Node) addDirectory(links []Link, cidVersion int) (string, uint64) {
+	cid, size, block := ImportDirectory(links, cidVersion)
+
+	entries := make(map[string]string, len(links))
+	for _, link := range links {
+		entries[link.Name] = link.Cid
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.blocks[cid] = block.Data
+	n.dirs[cid] = entries
+	n.sizes[cid] = size
+	return cid, size
+}
+
+func (n *Node) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var endpoint string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/v0/"):
+		endpoint = strings.TrimPrefix(r.URL.Path, "/api/v0/")
+	case strings.HasPrefix(r.URL.Path, "/ipfs/"):
+		endpoint = GatewayEndpoint
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if n.injectFailure(endpoint, w) {
+		return
+	}
+
+	if endpoint == GatewayEndpoint {
+		n.serveGateway(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch endpoint {
+	case "add":
+		n.serveAdd(w, r)
+	case "cat":
+		n.serveCat(w, r)
+	case "block/stat":
+		n.serveBlockStat(w, r)
+	case "pin/add":
+		n.servePinAdd(w, r)
+	case "pin/rm":
+		n.servePinRemove(w, r)
+	case "pin/ls":
+		n.servePinList(w, r)
+	case "dag/stat":
+		n.serveDagStat(w, r)
+	case "files/mkdir", "files/cp", "files/mv", "files/rm", "files/ls", "files/stat":
+		n.serveFiles(endpoint, w, r)
+	case "key/gen":
+		n.serveKeyGen(w, r)
+	case "key/list":
+		n.serveKeyList(w, r)
+	case "name/publish":
+		n.serveNamePublish(w, r)
+	case "name/resolve":
+		n.serveNameResolve(w, r)
+	case "resolve":
+		n.serveResolve(w, r)
+	case "version":
+		writeJSON(w, map[string]interface{}{"Version": Version, "System": "fake"})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown command %q", endpoint))
+	}
+}
+
+// injectFailure applies the failure configured for endpoint and reports
+// whether the request has been answered.
+func (n *Node) injectFailure(endpoint string, w http.ResponseWriter) bool {
+	n.mutex.Lock()
+	n.calls[endpoint]++
+	failure, ok := n.failures[endpoint]
+	var current Failure
+	if ok {
+		current = *failure
+		if failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				delete(n.failures, endpoint)
+			}
+		}
+	}
+	n.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if current.Delay > 0 {
+		time.Sleep(current.Delay)
+	}
+
+	if current.Drop {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return true
+			}
+		}
+	}
+
+	if current.Status == 0 {
+		return false
+	}
+
+	message := current.Message
+	if message == "" {
+		message = http.StatusText(current.Status)
+	}
+	writeError(w, current.Status, message)
+	return true
+}
+
+func (n *Node) serveAdd(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cidVersion := 0
+	if query.Get("cid-version") == "1" {
+		cidVersion = 1
+	}
+	pin := query.Get("pin") != "false"
+	wrap := query.Get("wrap-with-directory") == "true"
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		writeError(w, http.StatusBadRequest, "file argument 'path' is required")
+		return
+	}
+
+	var responses []addResponse
+	var links []Link
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		name := part.FileName()
+		cid, size := n.add(data, cidVersion)
+		responses = append(responses, addResponse{Name: name, Hash: cid, Size: strconv.FormatUint(size, 10)})
+		links = append(links, Link{Name: name, Cid: cid, Tsize: size})
+	}
+
+	if len(responses) == 0 {
+		writeError(w, http.StatusBadRequest, "file argument 'path' is required")
+		return
+	}
+
+	roots := responses
+	if wrap {
+		cid, size := n.addDirectory(links, cidVersion)
+		dir := addResponse{Hash: cid, Size: strconv.FormatUint(size, 10)}
+		responses = append(responses, dir)
+		roots = []addResponse{dir}
+	}
+
+	if pin {
+		n.mutex.Lock()
+		for _, root := range roots {
+			n.pins[root.Hash] = "recursive"
+		}
+		n.mutex.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	for _, response := range responses {
+		encoder.Encode(response)
+	}
+}
+
+func (n *Node) serveCat(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	data, ok := n.lookup(w, query.Get("arg"))
+	if !ok {
+		return
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > len(data) {
+		offset = len(data)
+	}
+	data = data[offset:]
+
+	if length, err := strconv.Atoi(query.Get("length")); err == nil && length < len(data) {
+		data = data[:length]
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+func (n *Node) serveBlockStat(w http.ResponseWriter, r *http.Request) {
+	cid := r.URL.Query().Get("arg")
+	if _, ok := DecodeCid(cid); !ok {
+		writeError(w, http.StatusInternalServerError, invalidPathMessage(cid))
+		return
+	}
+
+	n.mutex.Lock()
+	block, ok := n.blocks[cid]
+	n.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusInternalServerError, notFoundMessage(cid))
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"Key": cid, "Size": len(block)})
+}
+
+func (n *Node) servePinAdd(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cid := query.Get("arg")
+	if !n.exists(w, cid) {
+		return
+	}
+
+	pinType := "recursive"
+	if query.Get("recursive") == "false" {
+		pinType = "direct"
+	}
+
+	n.mutex.Lock()
+	n.pins[cid] = pinType
+	n.mutex.Unlock()
+
+	writeJSON(w, map[string]interface{}{"Pins": []string{cid}})
+}
+
+func (n *Node) servePinRemove(w http.ResponseWriter, r *http.Request) {
+	cid := r.URL.Query().Get("arg")
+	if _, ok := DecodeCid(cid); !ok {
+		writeError(w, http.StatusInternalServerError, invalidPathMessage(cid))
+		return
+	}
+
+	n.mutex.Lock()
+	_, ok := n.pins[cid]
+	delete(n.pins, cid)
+	n.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "not pinned or pinned indirectly")
+		return
+	}
+	writeJSON(w, map[string]interface{}{"Pins": []string{cid}})
+}
+
+func (n *Node) servePinList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pinType := query.Get("type")
+	if pinType == "" {
+		pinType = "all"
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	keys := make(map[string]map[string]string)
+	if cid := query.Get("arg"); cid != "" {
+		current, ok := n.pins[cid]
+		if !ok || (pinType != "all" && pinType != current) {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("path '%s' is not pinned", cid))
+			return
+		}
+		keys[cid] = map[string]string{"Type": current}
+	} else {
+		for cid, current := range n.pins {
+			if pinType == "all" || pinType == current {
+				keys[cid] = map[string]string{"Type": current}
+			}
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{"Keys": keys})
+}
+
+// serveDagStat answers as an offline dag/stat does, failing when the root
+// block of the DAG is gone.
+func (n *Node) serveDagStat(w http.ResponseWriter, r *http.Request) {
+	cid := r.URL.Query().Get("arg")
+	if _, ok := DecodeCid(cid); !ok {
+		writeError(w, http.StatusInternalServerError, invalidPathMessage(cid))
+		return
+	}
+
+	n.mutex.Lock()
+	_, ok := n.blocks[cid]
+	size := n.sizes[cid]
+	n.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusInternalServerError, notFoundMessage(cid))
+		return
+	}
+	writeJSON(w, map[string]interface{}{"Size": size})
+}
+
+func (n *Node) serveGateway(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/ipfs/"), "/", 2)
+	cid := segments[0]
+	if _, ok := DecodeCid(cid); !ok {
+		http.Error(w, invalidPathMessage(cid), http.StatusBadRequest)
+		return
+	}
+
+	n.mutex.Lock()
+	if len(segments) == 2 && segments[1] != "" {
+		cid = n.dirs[cid][segments[1]]
+	}
+	data, ok := n.files[cid]
+	n.mutex.Unlock()
+
+	if !ok {
+		http.Error(w, notFoundMessage(cid), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Etag", `"`+cid+`"`)
+	w.Header().Set("X-Ipfs-Path", r.URL.Path)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// lookup returns the file stored under cid, answering the request with a
+// Kubo style error if there is none.
+func (n *Node) lookup(w http.ResponseWriter, cid string) ([]byte, bool) {
+	if _, ok := DecodeCid(cid); !ok {
+		writeError(w, http.StatusInternalServerError, invalidPathMessage(cid))
+		return nil, false
+	}
+
+	n.mutex.Lock()
+	data, ok := n.files[cid]
+	_, isDir := n.dirs[cid]
+	n.mutex.Unlock()
+
+	if isDir {
+		writeError(w, http.StatusInternalServerError, "this dag node is a directory")
+		return nil, false
+	}
+	if !ok {
+		writeError(w, http.StatusInternalServerError, notFoundMessage(cid))
+		return nil, false
+	}
+	return data, true
+}
+
+func (n *Node) exists(w http.ResponseWriter, cid string) bool {
+	if _, ok := DecodeCid(cid); !ok {
+		writeError(w, http.StatusInternalServerError, invalidPathMessage(cid))
+		return false
+	}
+
+	n.mutex.Lock()
+	_, ok := n.blocks[cid]
+	n.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusInternalServerError, notFoundMessage(cid))
+	}
+	return ok
+}
+
+func invalidPathMessage(cid string) string {
+	return fmt.Sprintf("invalid path %q: invalid cid", cid)
+}
+
+func notFoundMessage(cid string) string {
+	return fmt.Sprintf("block was not found locally (offline): ipld: could not find %s", cid)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError answers with the error body Kubo uses.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiErrorResponse{Message: message, Code: 0, Type: "error"})
+}
@@ -0,0 +1,153 @@
+package ipfstest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+)
+
+// newClient starts a fake node and returns a client of it.
+func newClient(t *testing.T) (*ipfstest.Node, *ipfs.IPFSClient) {
+	t.Helper()
+	node := ipfstest.NewNode()
+	t.Cleanup(node.Close)
+	return node, ipfs.NewClient(node.APIURL(), node.GatewayURL())
+}
+
+func TestAddAndFetch(t *testing.T) {
+	node, client := newClient(t)
+	ctx := context.Background()
+	data := []byte("hello world\n")
+
+	added, err := client.UploadFile(ctx, "hello.txt", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Hash != ipfstest.CidV0(data) {
+		t.Fatalf("added %s, want %s", added.Hash, ipfstest.CidV0(data))
+	}
+	if pinType, ok := node.IsPinned(added.Hash); !ok || pinType != ipfs.PinTypeRecursive {
+		t.Fatalf("added file is pinned %q, %v", pinType, ok)
+	}
+
+	fetched, err := client.FetchFile(ctx, added.Hash)
+	if err != nil || !bytes.Equal(fetched, data) {
+		t.Fatalf("FetchFile = %q, %v", fetched, err)
+	}
+	part, err := client.FetchFileRange(ctx, added.Hash, 6, 5)
+	if err != nil || string(part) != "world" {
+		t.Fatalf("FetchFileRange = %q, %v", part, err)
+	}
+	part, err = client.CatRange(ctx, added.Hash, 0, 5)
+	if err != nil || string(part) != "hello" {
+		t.Fatalf("CatRange = %q, %v", part, err)
+	}
+
+	_, err = client.FetchFile(ctx, ipfstest.CidV0([]byte("missing")))
+	var apiErr *ipfs.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 404 {
+		t.Fatalf("fetching a missing CID returned %v", err)
+	}
+}
+
+func TestPins(t *testing.T) {
+	node, client := newClient(t)
+	ctx := context.Background()
+	cid := node.Add([]byte("pin me"), 1)
+
+	if _, ok := node.IsPinned(cid); ok {
+		t.Fatal("Add pinned the file")
+	}
+	if _, err := client.Pin(ctx, cid); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := client.ListPins(ctx, ipfs.PinTypeRecursive)
+	if err != nil || len(pins) != 1 || pins[0].Cid != cid {
+		t.Fatalf("ListPins = %v, %v", pins, err)
+	}
+
+	status, err := client.PinStatus(ctx, cid)
+	if err != nil || !status.Pinned || !status.Verified {
+		t.Fatalf("PinStatus = %+v, %v", status, err)
+	}
+	// A node that fails the DAG walk for another reason says nothing of the
+	// blocks
+	node.InjectFailure(ipfs.DagStatEndpoint, ipfstest.Failure{Status: 500, Message: "context deadline exceeded", Times: 1})
+	if status, err := client.PinStatus(ctx, cid); err == nil || ipfs.IsBlockNotFound(err) || status.BadNodes != nil {
+		t.Fatalf("PinStatus of a failing node = %+v, %v", status, err)
+	}
+	node.RemoveBlock(cid)
+	status, err = client.PinStatus(ctx, cid)
+	if err != nil || status.Verified || len(status.BadNodes) != 1 || status.BadNodes[0] != cid {
+		t.Fatalf("PinStatus of a lost block = %+v, %v", status, err)
+	}
+
+	if _, err := client.Unpin(ctx, cid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Unpin(ctx, cid); !ipfs.IsNotPinned(err) {
+		t.Fatalf("unpinning twice returned %v", err)
+	}
+}
+
+func TestInjectFailure(t *testing.T) {
+	node, client := newClient(t)
+	ctx := context.Background()
+	cid := node.Add([]byte("data"), 0)
+
+	node.InjectFailure("cat", ipfstest.Failure{Status: 500, Message: "boom", Times: 1})
+	_, err := client.Cat(ctx, cid)
+	var apiErr *ipfs.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 500 || apiErr.Message != "boom" {
+		t.Fatalf("first cat returned %v", err)
+	}
+	if _, err := client.Cat(ctx, cid); err != nil {
+		t.Fatalf("the failure outlived Times: %v", err)
+	}
+	if calls := node.Calls("cat"); calls != 2 {
+		t.Fatalf("Calls = %d, want 2", calls)
+	}
+
+	node.InjectFailure(ipfstest.GatewayEndpoint, ipfstest.Failure{Status: 502})
+	for i := 0; i < 2; i++ {
+		if _, err := client.FetchFile(ctx, cid); err == nil {
+			t.Fatal("gateway failure was not applied")
+		}
+	}
+	node.ClearFailures()
+	if _, err := client.FetchFile(ctx, cid); err != nil {
+		t.Fatalf("ClearFailures left the failure: %v", err)
+	}
+}
+
+func TestInjectFailureDrop(t *testing.T) {
+	node, client := newClient(t)
+
+	node.InjectFailure("version", ipfstest.Failure{Drop: true})
+	_, err := client.Version(context.Background())
+	if !errors.Is(err, ipfs.ErrUpstreamUnavailable) {
+		t.Fatalf("dropped request returned %v", err)
+	}
+}
+
+func TestInjectFailureDelay(t *testing.T) {
+	node, client := newClient(t)
+	cid := node.Add([]byte("slow"), 0)
+
+	node.InjectFailure(ipfstest.GatewayEndpoint, ipfstest.Failure{Delay: 200 * time.Millisecond})
+	client.Timeouts.Cat = 50 * time.Millisecond
+	if _, err := client.FetchFile(context.Background(), cid); !errors.Is(err, ipfs.ErrTimeout) {
+		t.Fatalf("stalled request returned %v", err)
+	}
+
+	client.Timeouts.Cat = time.Second
+	data, err := client.FetchFile(context.Background(), cid)
+	if err != nil || string(data) != "slow" {
+		t.Fatalf("a delay alone should not fail the request: %q, %v", data, err)
+	}
+}
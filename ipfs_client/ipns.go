@@ -0,0 +1,202 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KeyTypeEd25519 is the type of the keys GenerateKey creates. Their IPNS
+// names are printed in base36, starting with k51.
+const KeyTypeEd25519 = "ed25519"
+
+// ErrInvalidName means an IPNS name or a key name was rejected before it was
+// sent to the node.
+var ErrInvalidName = errors.New("invalid IPNS name")
+
+// ipnsNamePattern accepts the names Kubo prints for keys: libp2p-key CIDs in
+// base36 (k) or base32 (b), and the base58btc peer IDs of older nodes.
+var ipnsNamePattern = regexp.MustCompile(`^(k[0-9a-z]{16,}|b[a-z2-7]{16,}|12D3KooW[1-9A-HJ-NP-Za-km-z]{44}|Qm[1-9A-HJ-NP-Za-km-z]{44})$`)
+
+// keyNamePattern is what key names are limited to, which keeps them out of
+// the way of the "self" key of the node and of paths.
+var keyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type keyListResponse struct {
+	Keys []Key `json:"Keys"`
+}
+
+type pathResponse struct {
+	Path string `json:"Path"`
+}
+
+// Key is a key of the keystore of a node. Id is the IPNS name records signed
+// with it are published under.
+type Key struct {
+	Name string `json:"Name"`
+	Id   string `json:"Id"`
+}
+
+// NameEntry is an IPNS record as published: Name points to Value.
+type NameEntry struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// IsKeyExist reports whether err is the error the node answers key/gen with
+// when a key by that name already exists.
+func IsKeyExist(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "already exists")
+}
+
+// IsNotResolved reports whether err is the error the node answers
+// name/resolve and resolve with when a name has no record or a path has no
+// such link.
+func IsNotResolved(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(strings.Contains(apiErr.Message, "could not resolve") || strings.Contains(apiErr.Message, "no link named"))
+}
+
+// IsKeyNotFound reports whether err is the error the node answers
+// name/publish with when its keystore has no key by that name.
+func IsKeyNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "no key by the given name")
+}
+
+// ValidateName returns ErrInvalidName unless name looks like an IPNS name.
+func ValidateName(name string) error {
+	if !ipnsNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+func validateKeyName(key string) error {
+	if !keyNamePattern.MatchString(key) {
+		return fmt.Errorf("%w: key %q", ErrInvalidName, key)
+	}
+	return nil
+}
+
+// GenerateKey creates the key name in the keystore of the node.
+func (f *IPFSClient) GenerateKey(ctx context.Context, name string) (Key, error) {
+	if err := validateKeyName(name); err != nil {
+		return Key{}, err
+	}
+
+	var key Key
+
+	body, err := f.callApi(ctx, f.Timeouts.Name, KeyGenEndpoint, map[string]string{
+		"type": KeyTypeEd25519,
+	}, name)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if err := json.Unmarshal(body, &key); err != nil {
+		return Key{}, err
+	}
+	return key, nil
+}
+
+// ListKeys returns the keys in the keystore of the node, its own "self" key
+// included.
+func (f *IPFSClient) ListKeys(ctx context.Context) ([]Key, error) {
+	var jsonResponse keyListResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Name, KeyListEndpoint, map[string]string{"l": "true"})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	return jsonResponse.Keys, nil
+}
+
+// Publish points the IPNS name of key to /ipfs/<cid> for lifetime, the
+// default of the node when zero. The record is stored on the node even when
+// it has no peers to publish it to, and the node republishes it until
+// lifetime runs out.
+func (f *IPFSClient) Publish(ctx context.Context, key string, cid string, lifetime time.Duration) (NameEntry, error) {
+	if err := validateKeyName(key); err != nil {
+		return NameEntry{}, err
+	}
+	if err := ValidateCid(cid); err != nil {
+		return NameEntry{}, err
+	}
+
+	queryString := map[string]string{
+		"key":           key,
+		"allow-offline": "true",
+	}
+	if lifetime > 0 {
+		queryString["lifetime"] = lifetime.String()
+	}
+
+	var entry NameEntry
+
+	body, err := f.callApi(ctx, f.Timeouts.Name, NamePublishEndpoint, queryString, "/ipfs/"+cid)
+	if err != nil {
+		return NameEntry{}, err
+	}
+
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return NameEntry{}, err
+	}
+	return entry, nil
+}
+
+// ResolveName returns the path the IPNS name points to, /ipfs/<cid> for the
+// names Publish publishes.
+func (f *IPFSClient) ResolveName(ctx context.Context, name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+
+	var jsonResponse pathResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Name, NameResolveEndpoint, map[string]string{
+		"recursive": "true",
+	}, "/ipns/"+name)
+	if err != nil {
+		return "", err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return "", err
+	}
+	return jsonResponse.Path, nil
+}
+
+// ResolvePath returns the CID p leads to, following the links of the
+// directories in p. p is /ipfs/<cid> followed by names.
+func (f *IPFSClient) ResolvePath(ctx context.Context, p string) (string, error) {
+	if err := ValidateMfsPath(p); err != nil {
+		return "", err
+	}
+	segments := strings.SplitN(strings.TrimPrefix(p, "/ipfs/"), "/", 2)
+	if !strings.HasPrefix(p, "/ipfs/") || ValidateCid(segments[0]) != nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, p)
+	}
+
+	var jsonResponse pathResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Name, ResolveEndpoint, nil, p)
+	if err != nil {
+		return "", err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(jsonResponse.Path, "/ipfs/"), nil
+}
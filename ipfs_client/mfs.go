@@ -0,0 +1,188 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	MfsTypeFile      = "file"
+	MfsTypeDirectory = "directory"
+)
+
+// ErrInvalidPath means an MFS path was rejected before it was sent to the
+// node.
+var ErrInvalidPath = errors.New("invalid MFS path")
+
+type mfsListResponse struct {
+	Entries []struct {
+		Name string `json:"Name"`
+		Type int    `json:"Type"`
+		Size int64  `json:"Size"`
+		Hash string `json:"Hash"`
+	} `json:"Entries"`
+}
+
+// MfsEntry is an entry of a directory of the MFS. Type is MfsTypeFile or
+// MfsTypeDirectory.
+type MfsEntry struct {
+	Name string `json:"name"  bson:"name"  form:"name"  binding:"name"`
+	Type string `json:"type"  bson:"type"  form:"type"  binding:"type"`
+	Size int64  `json:"size"  bson:"size"  form:"size"  binding:"size"`
+	Hash string `json:"hash"  bson:"hash"  form:"hash"  binding:"hash"`
+}
+
+// MfsStat describes a file or a directory of the MFS. Size is the size of a
+// file, CumulativeSize that of the whole DAG under Hash.
+type MfsStat struct {
+	Hash           string `json:"Hash"`
+	Type           string `json:"Type"`
+	Size           int64  `json:"Size"`
+	CumulativeSize int64  `json:"CumulativeSize"`
+	Blocks         int    `json:"Blocks"`
+}
+
+// IsNotExist reports whether err is the error the node answers files/* calls
+// with when a path does not exist.
+func IsNotExist(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "does not exist")
+}
+
+// IsExist reports whether err is the error the node answers files/mkdir,
+// files/cp and files/mv with when the destination already exists.
+func IsExist(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(strings.Contains(apiErr.Message, "already exists") || strings.Contains(apiErr.Message, "already has entry"))
+}
+
+// ValidateMfsPath returns ErrInvalidPath unless p is an absolute, clean path
+// without control characters.
+func ValidateMfsPath(p string) error {
+	if !strings.HasPrefix(p, "/") || path.Clean(p) != p {
+		return fmt.Errorf("%w: %q", ErrInvalidPath, p)
+	}
+	for _, char := range p {
+		if unicode.IsControl(char) {
+			return fmt.Errorf("%w: %q", ErrInvalidPath, p)
+		}
+	}
+	return nil
+}
+
+// MakeDirectory creates the directory p in the MFS, and its missing parents
+// when parents is true, in which case p may already exist.
+func (f *IPFSClient) MakeDirectory(ctx context.Context, p string, parents bool) error {
+	if err := ValidateMfsPath(p); err != nil {
+		return err
+	}
+
+	_, err := f.callApi(ctx, f.Timeouts.Files, FilesMkdirEndpoint, map[string]string{
+		"parents": strconv.FormatBool(parents),
+	}, p)
+	return err
+}
+
+// CopyPath copies source to dest, which must not exist. source is an MFS
+// path or /ipfs/<cid>, which puts the DAG of cid in the MFS without fetching
+// more than its root.
+func (f *IPFSClient) CopyPath(ctx context.Context, source string, dest string) error {
+	if err := ValidateMfsPath(source); err != nil {
+		return err
+	}
+	if err := ValidateMfsPath(dest); err != nil {
+		return err
+	}
+
+	_, err := f.callApi(ctx, f.Timeouts.Files, FilesCopyEndpoint, nil, source, dest)
+	return err
+}
+
+// MovePath moves or renames source to dest.
+func (f *IPFSClient) MovePath(ctx context.Context, source string, dest string) error {
+	if err := ValidateMfsPath(source); err != nil {
+		return err
+	}
+	if err := ValidateMfsPath(dest); err != nil {
+		return err
+	}
+
+	_, err := f.callApi(ctx, f.Timeouts.Files, FilesMoveEndpoint, nil, source, dest)
+	return err
+}
+
+// ListDirectory returns the entries of the directory p, sorted by name.
+func (f *IPFSClient) ListDirectory(ctx context.Context, p string) ([]MfsEntry, error) {
+	if err := ValidateMfsPath(p); err != nil {
+		return nil, err
+	}
+
+	var jsonResponse mfsListResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Files, FilesListEndpoint, map[string]string{"long": "true"}, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+
+	entries := make([]MfsEntry, 0, len(jsonResponse.Entries))
+	for _, entry := range jsonResponse.Entries {
+		entryType := MfsTypeFile
+		if entry.Type == 1 {
+			entryType = MfsTypeDirectory
+		}
+		entries = append(entries, MfsEntry{
+			Name: entry.Name,
+			Type: entryType,
+			Size: entry.Size,
+			Hash: entry.Hash,
+		})
+	}
+	return entries, nil
+}
+
+// StatPath describes the file or directory p.
+func (f *IPFSClient) StatPath(ctx context.Context, p string) (MfsStat, error) {
+	if err := ValidateMfsPath(p); err != nil {
+		return MfsStat{}, err
+	}
+
+	var stat MfsStat
+
+	body, err := f.callApi(ctx, f.Timeouts.Files, FilesStatEndpoint, nil, p)
+	if err != nil {
+		return MfsStat{}, err
+	}
+
+	if err := json.Unmarshal(body, &stat); err != nil {
+		return MfsStat{}, err
+	}
+	return stat, nil
+}
+
+// RemovePath removes p from the MFS. A directory that is not empty is only
+// removed when recursive is true. The blocks stay in the repo until the node
+// runs garbage collection.
+func (f *IPFSClient) RemovePath(ctx context.Context, p string, recursive bool) error {
+	if err := ValidateMfsPath(p); err != nil {
+		return err
+	}
+	if p == "/" {
+		return fmt.Errorf("%w: the root cannot be removed", ErrInvalidPath)
+	}
+
+	_, err := f.callApi(ctx, f.Timeouts.Files, FilesRemoveEndpoint, map[string]string{
+		"recursive": strconv.FormatBool(recursive),
+	}, p)
+	return err
+}
@@ -0,0 +1,193 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	PinTypeAll       = "all"
+	PinTypeDirect    = "direct"
+	PinTypeIndirect  = "indirect"
+	PinTypeRecursive = "recursive"
+)
+
+type pinChangeResponse struct {
+	Pins []string `json:"Pins"`
+}
+
+type pinListResponse struct {
+	Keys map[string]struct {
+		Type string `json:"Type"`
+	} `json:"Keys"`
+}
+
+type PinInfo struct {
+	Cid  string `json:"cid,omitempty"  bson:"cid"  form:"cid"  binding:"cid"`
+	Type string `json:"type,omitempty"  bson:"type"  form:"type"  binding:"type"`
+}
+
+type PinStatus struct {
+	Cid      string   `json:"cid,omitempty"  bson:"cid"  form:"cid"  binding:"cid"`
+	Pinned   bool     `json:"pinned"  bson:"pinned"  form:"pinned"  binding:"pinned"`
+	Type     string   `json:"type,omitempty"  bson:"type"  form:"type"  binding:"type"`
+	Verified bool     `json:"verified"  bson:"verified"  form:"verified"  binding:"verified"`
+	BadNodes []string `json:"bad_nodes,omitempty"  bson:"bad_nodes"  form:"bad_nodes"  binding:"bad_nodes"`
+	// Nodes names the nodes of an IPFSPool that pin cid
+	Nodes []string `json:"nodes,omitempty"  bson:"nodes"  form:"nodes"  binding:"nodes"`
+}
+
+// IsBlockNotFound reports whether err is the error the node answers an
+// offline DAG walk with when it does not have one of the blocks.
+func IsBlockNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(strings.Contains(apiErr.Message, "not found locally") || strings.Contains(apiErr.Message, "could not find"))
+}
+
+// IsNotPinned reports whether err is the error the node answers pin/rm with
+// when the CID is not pinned.
+func IsNotPinned(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "not pinned")
+}
+
+// Pin recursively pins cid on the node so it survives garbage collection.
+func (f *IPFSClient) Pin(ctx context.Context, cid string) ([]string, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+
+	var jsonResponse pinChangeResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Pin, PinAddEndpoint, map[string]string{
+		"arg":       cid,
+		"recursive": "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	return jsonResponse.Pins, nil
+}
+
+// Unpin removes the recursive pin for cid. The blocks stay in the repo until
+// the node runs garbage collection.
+func (f *IPFSClient) Unpin(ctx context.Context, cid string) ([]string, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+
+	var jsonResponse pinChangeResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Pin, PinRemoveEndpoint, map[string]string{
+		"arg":       cid,
+		"recursive": "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	return jsonResponse.Pins, nil
+}
+
+// ListPins returns every pin of the given type (see the PinType constants).
+func (f *IPFSClient) ListPins(ctx context.Context, pinType string) ([]PinInfo, error) {
+	var jsonResponse pinListResponse
+
+	if pinType == "" {
+		pinType = PinTypeAll
+	}
+
+	body, err := f.callApi(ctx, f.Timeouts.Pin, PinListEndpoint, map[string]string{"type": pinType})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+
+	pins := make([]PinInfo, 0, len(jsonResponse.Keys))
+	for cid, info := range jsonResponse.Keys {
+		pins = append(pins, PinInfo{Cid: cid, Type: info.Type})
+	}
+	return pins, nil
+}
+
+// PinStatus reports whether cid is pinned and, for recursive pins, whether
+// every block of its DAG is in the node's datastore.
+func (f *IPFSClient) PinStatus(ctx context.Context, cid string) (PinStatus, error) {
+	if err := ValidateCid(cid); err != nil {
+		return PinStatus{}, err
+	}
+
+	status := PinStatus{Cid: cid}
+
+	var jsonResponse pinListResponse
+
+	body, err := f.callApi(ctx, f.Timeouts.Pin, PinListEndpoint, map[string]string{
+		"arg":  cid,
+		"type": PinTypeAll,
+	})
+	if IsNotPinned(err) {
+		return status, nil
+	}
+	if err != nil {
+		return PinStatus{}, err
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return PinStatus{}, err
+	}
+
+	info, ok := jsonResponse.Keys[cid]
+	if !ok {
+		return status, nil
+	}
+	status.Pinned = true
+	status.Type = info.Type
+
+	if status.Type != PinTypeRecursive {
+		// Only recursive pins hold the whole DAG
+		status.Verified = true
+		return status, nil
+	}
+
+	// dag/stat walks the DAG of cid and, offline, fails on the first block
+	// the node does not have
+	_, err = f.callApi(ctx, f.Timeouts.Pin, DagStatEndpoint, map[string]string{
+		"arg":      cid,
+		"progress": "false",
+		"offline":  "true",
+	})
+	var apiErr *APIError
+	switch {
+	case IsBlockNotFound(err) && errors.As(err, &apiErr):
+		status.BadNodes = []string{missingBlock(apiErr, cid)}
+	case err != nil:
+		return PinStatus{}, err
+	default:
+		status.Verified = true
+	}
+
+	return status, nil
+}
+
+// missingBlock returns the CID of the block dag/stat failed on, as named by
+// its error, or cid when the error names none.
+func missingBlock(apiErr *APIError, cid string) string {
+	for _, word := range strings.Fields(apiErr.Message) {
+		if candidate := strings.Trim(word, `'":,`); ValidateCid(candidate) == nil {
+			return candidate
+		}
+	}
+	return cid
+}
@@ -0,0 +1,638 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/faizainur/ipfs-api/resilience"
+)
+
+// replicateBufferSize is the size of the chunks copied to every replica of
+// an upload.
+const replicateBufferSize = 32 * 1024
+
+// errReplicaStopped unblocks the copy to a replica whose upload returned.
+var errReplicaStopped = errors.New("ipfs: replica upload stopped")
+
+// PoolNode is one IPFS node of an IPFSPool.
+type PoolNode struct {
+	Name   string
+	Client *IPFSClient
+}
+
+// NodeHealth is what the pool last saw of a node. A node turns unhealthy
+// when it could not be reached and healthy again as soon as it answers.
+type NodeHealth struct {
+	Name                string    `json:"name"`
+	Healthy             bool      `json:"healthy"`
+	Version             string    `json:"version,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastChecked         time.Time `json:"last_checked"`
+}
+
+type poolNode struct {
+	PoolNode
+
+	mutex  sync.Mutex
+	health NodeHealth
+}
+
+// IPFSPool spreads uploads over several IPFS nodes and pins each of them on
+// Replicas nodes, so one node going down does not lose access to the files.
+// Fetches try the gateway of the primary node, the first one, then those of
+// the other nodes, then the RPC API cat endpoint of every node. Healthy
+// nodes are always tried before unhealthy ones.
+type IPFSPool struct {
+	nodes    []*poolNode
+	replicas int
+
+	// next is the node the next upload starts from
+	next uint32
+}
+
+func NewPool(nodes []PoolNode, replicas int) (*IPFSPool, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("ipfs: a pool needs at least one node")
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	if replicas > len(nodes) {
+		replicas = len(nodes)
+	}
+
+	pool := &IPFSPool{replicas: replicas}
+	for _, node := range nodes {
+		pool.nodes = append(pool.nodes, &poolNode{
+			PoolNode: node,
+			health:   NodeHealth{Name: node.Name, Healthy: true},
+		})
+	}
+	return pool, nil
+}
+
+// Replicas is the number of nodes every upload is pinned on.
+func (p *IPFSPool) Replicas() int {
+	return p.replicas
+}
+
+// Health returns the health of every node, in the order of the pool.
+func (p *IPFSPool) Health() []NodeHealth {
+	health := make([]NodeHealth, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		node.mutex.Lock()
+		health = append(health, node.health)
+		node.mutex.Unlock()
+	}
+	return health
+}
+
+// Upstreams returns the names of the upstreams guarding the nodes.
+func (p *IPFSPool) Upstreams() []string {
+	names := make([]string, 0, 2*len(p.nodes))
+	for _, node := range p.nodes {
+		for _, upstream := range []*resilience.Upstream{node.Client.APIUpstream, node.Client.GatewayUpstream} {
+			if upstream != nil {
+				names = append(names, upstream.Name())
+			}
+		}
+	}
+	return names
+}
+
+// CheckHealth asks every node for its version and records whether it
+// answered.
+func (p *IPFSPool) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, node := range p.nodes {
+		wg.Add(1)
+		go func(node *poolNode) {
+			defer wg.Done()
+
+			version, err := node.Client.Version(ctx)
+			p.record(node, err)
+			if err == nil {
+				node.mutex.Lock()
+				node.health.Version = version
+				node.mutex.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+}
+
+// WatchHealth checks the health of the nodes every interval until stop is
+// closed, each check bounded by timeout.
+func (p *IPFSPool) WatchHealth(interval time.Duration, timeout time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				p.CheckHealth(ctx)
+				cancel()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// record updates the health of node after a call that returned err.
+func (p *IPFSPool) record(node *poolNode, err error) {
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, the node did nothing wrong
+		return
+	}
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	node.health.LastChecked = time.Now()
+	if isNodeFailure(err) {
+		node.health.Healthy = false
+		node.health.ConsecutiveFailures++
+		node.health.LastError = err.Error()
+		return
+	}
+	node.health.Healthy = true
+	node.health.ConsecutiveFailures = 0
+	node.health.LastError = ""
+}
+
+func (n *poolNode) healthy() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.health.Healthy
+}
+
+// isNodeFailure reports whether err means the node could not do its work,
+// as opposed to an answer it gave.
+func isNodeFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, resilience.ErrCircuitOpen) || IsRetryable(err)
+}
+
+// ordered returns the nodes starting from the one at start, healthy nodes
+// first.
+func (p *IPFSPool) ordered(start int) []*poolNode {
+	healthy := make([]*poolNode, 0, len(p.nodes))
+	unhealthy := make([]*poolNode, 0)
+	for i := range p.nodes {
+		node := p.nodes[(start+i)%len(p.nodes)]
+		if node.healthy() {
+			healthy = append(healthy, node)
+		} else {
+			unhealthy = append(unhealthy, node)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// canFallback reports whether a call that failed with err is worth sending
+// to another node.
+func canFallback(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, ErrInvalidCID) && !errors.Is(err, ErrInvalidPath) && !errors.Is(err, ErrInvalidName)
+}
+
+// fallback runs each attempt on every node in turn until one succeeds. The
+// error returned when all of them fail is the first answer of a node, or
+// the first error if no node answered.
+func (p *IPFSPool) fallback(ctx context.Context, attempts ...func(ctx context.Context, client *IPFSClient) error) error {
+	nodes := p.ordered(0)
+
+	var firstErr, firstAnswer error
+	for _, attempt := range attempts {
+		for _, node := range nodes {
+			err := attempt(ctx, node.Client)
+			p.record(node, err)
+			if err == nil {
+				return nil
+			}
+			if !canFallback(ctx, err) {
+				return err
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+			if firstAnswer == nil && !isNodeFailure(err) {
+				firstAnswer = err
+			}
+		}
+	}
+
+	if firstAnswer != nil {
+		return firstAnswer
+	}
+	return firstErr
+}
+
+func (p *IPFSPool) FetchFile(ctx context.Context, cid string) ([]byte, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err := p.fallback(ctx,
+		func(ctx context.Context, client *IPFSClient) error {
+			var err error
+			data, err = client.FetchFile(ctx, cid)
+			return err
+		},
+		func(ctx context.Context, client *IPFSClient) error {
+			var err error
+			data, err = client.Cat(ctx, cid)
+			return err
+		},
+	)
+	return data, err
+}
+
+func (p *IPFSPool) FetchFileRange(ctx context.Context, cid string, offset int64, length int64) ([]byte, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err := p.fallback(ctx,
+		func(ctx context.Context, client *IPFSClient) error {
+			var err error
+			data, err = client.FetchFileRange(ctx, cid, offset, length)
+			return err
+		},
+		func(ctx context.Context, client *IPFSClient) error {
+			var err error
+			data, err = client.CatRange(ctx, cid, offset, length)
+			return err
+		},
+	)
+	return data, err
+}
+
+type replicaResult struct {
+	node    *poolNode
+	entries []ipfsUploadResponse
+	err     error
+}
+
+// addFunc adds the content of r to the node of client.
+type addFunc func(ctx context.Context, client *IPFSClient, r io.Reader) ([]ipfsUploadResponse, error)
+
+// UploadStream streams r to Replicas nodes at once, starting from the next
+// node in turn, so uploads are spread over the pool. Nodes that fail are
+// dropped while the others carry on, and the upload succeeds as long as one
+// of them stored it. When fewer than Replicas nodes did, the other nodes
+// are asked to pin it, fetching it from the ones that have it.
+func (p *IPFSPool) UploadStream(ctx context.Context, filename string, r io.Reader) (ipfsUploadResponse, error) {
+	entries, err := p.upload(ctx, r, func(ctx context.Context, client *IPFSClient, r io.Reader) ([]ipfsUploadResponse, error) {
+		response, err := client.UploadStream(ctx, filename, r)
+		if err != nil {
+			return nil, err
+		}
+		return []ipfsUploadResponse{response}, nil
+	})
+	if err != nil {
+		return ipfsUploadResponse{}, err
+	}
+	return entries[0], nil
+}
+
+// UploadDirectory streams the files of next to Replicas nodes at once like
+// UploadStream, wrapped in a directory. It returns the entry of each file
+// followed by the one of the directory, all with the nodes that stored the
+// directory as Replicas.
+func (p *IPFSPool) UploadDirectory(ctx context.Context, next FileIterator) ([]ipfsUploadResponse, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(bodyWriter)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		err := writeMultipartFiles(multipartWriter, next)
+		if err == nil {
+			err = multipartWriter.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	// Unblocks the writer goroutine if the upload stopped reading early, and
+	// waits for it so next is not called once this returns
+	defer func() {
+		bodyReader.Close()
+		<-written
+	}()
+
+	contentType := multipartWriter.FormDataContentType()
+	return p.upload(ctx, bodyReader, func(ctx context.Context, client *IPFSClient, r io.Reader) ([]ipfsUploadResponse, error) {
+		return client.UploadMultipart(ctx, contentType, r, true)
+	})
+}
+
+// upload adds r with add on Replicas nodes and tops up the replicas with
+// pins of the root, the last entry the nodes answer with.
+func (p *IPFSPool) upload(ctx context.Context, r io.Reader, add addFunc) ([]ipfsUploadResponse, error) {
+	start := int(atomic.AddUint32(&p.next, 1)-1) % len(p.nodes)
+	nodes := p.ordered(start)
+
+	results, readErr := p.uploadReplicas(ctx, nodes[:p.replicas], r, add)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var entries []ipfsUploadResponse
+	var root string
+	var replicas []string
+	var firstErr error
+	for _, result := range results {
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		resultRoot := result.entries[len(result.entries)-1].Hash
+		if entries == nil {
+			entries, root = result.entries, resultRoot
+		}
+		// Nodes with another CID version or chunker stored a different DAG
+		if resultRoot == root {
+			replicas = append(replicas, result.node.Name)
+		}
+	}
+	if entries == nil {
+		return nil, firstErr
+	}
+
+	for _, node := range nodes[p.replicas:] {
+		if len(replicas) >= p.replicas || ctx.Err() != nil {
+			break
+		}
+		_, err := node.Client.Pin(ctx, root)
+		p.record(node, err)
+		if err == nil {
+			replicas = append(replicas, node.Name)
+		}
+	}
+
+	for i := range entries {
+		entries[i].Replicas = replicas
+	}
+	return entries, nil
+}
+
+// uploadReplicas adds the content of r to every node at once. It returns
+// the result of each upload and the error reading r, if any.
+func (p *IPFSPool) uploadReplicas(ctx context.Context, nodes []*poolNode, r io.Reader, add addFunc) ([]replicaResult, error) {
+	results := make([]replicaResult, len(nodes))
+	writers := make([]*io.PipeWriter, len(nodes))
+
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		pipeReader, pipeWriter := io.Pipe()
+		writers[i] = pipeWriter
+
+		wg.Add(1)
+		go func(i int, node *poolNode, pipeReader *io.PipeReader) {
+			defer wg.Done()
+
+			entries, err := add(ctx, node.Client, pipeReader)
+			pipeReader.CloseWithError(errReplicaStopped)
+			p.record(node, err)
+			results[i] = replicaResult{node: node, entries: entries, err: err}
+		}(i, node, pipeReader)
+	}
+
+	readErr := replicate(r, writers)
+	for _, writer := range writers {
+		writer.CloseWithError(readErr)
+	}
+	wg.Wait()
+
+	return results, readErr
+}
+
+// replicate copies r to every writer until r ends or every writer failed,
+// and returns the error of r. A writer that fails is left out from then on.
+// Writes are sequential, so the slowest replica sets the pace.
+func replicate(r io.Reader, writers []*io.PipeWriter) error {
+	live := make([]*io.PipeWriter, len(writers))
+	copy(live, writers)
+	remaining := len(live)
+
+	buf := make([]byte, replicateBufferSize)
+	for remaining > 0 {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, writer := range live {
+				if writer == nil {
+					continue
+				}
+				if _, err := writer.Write(buf[:n]); err != nil {
+					live[i] = nil
+					remaining--
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Files runs fn against the MFS of one node, healthy nodes first, and moves
+// on to the next node only when a node fails, not when it answers with an
+// error. Every node has an MFS of its own, so fn starts over on the next
+// node with whatever the MFS of that node holds.
+func (p *IPFSPool) Files(ctx context.Context, fn func(ctx context.Context, client *IPFSClient) error) error {
+	var firstErr error
+	for _, node := range p.ordered(0) {
+		err := fn(ctx, node.Client)
+		p.record(node, err)
+		if !isNodeFailure(err) || ctx.Err() != nil {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Primary returns the client of the primary node, the first one. Keys live
+// in the keystore of one node and cannot be exported over the RPC API, so
+// IPNS keys are generated and names published on that node only.
+func (p *IPFSPool) Primary() *IPFSClient {
+	return p.nodes[0].Client
+}
+
+// ResolvePath resolves the path p to a CID on the first node that can,
+// healthy nodes first.
+func (p *IPFSPool) ResolvePath(ctx context.Context, path string) (string, error) {
+	var cid string
+	err := p.fallback(ctx, func(ctx context.Context, client *IPFSClient) error {
+		var err error
+		cid, err = client.ResolvePath(ctx, path)
+		return err
+	})
+	return cid, err
+}
+
+// Pin pins cid on Replicas nodes, healthy ones first, and returns the pins
+// of the first node that pinned it.
+func (p *IPFSPool) Pin(ctx context.Context, cid string) ([]string, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+
+	var pins []string
+	var firstErr error
+	pinned := 0
+	for _, node := range p.ordered(0) {
+		if pinned >= p.replicas {
+			break
+		}
+
+		nodePins, err := node.Client.Pin(ctx, cid)
+		p.record(node, err)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !canFallback(ctx, err) {
+				break
+			}
+			continue
+		}
+
+		if pinned == 0 {
+			pins = nodePins
+		}
+		pinned++
+	}
+
+	if pinned == 0 {
+		return nil, firstErr
+	}
+	return pins, nil
+}
+
+// Unpin removes the pin of cid from every node. It fails with the error of a
+// node that could not unpin it, so the caller can try again and not leave a
+// pin behind. When no node pinned cid, it returns their "not pinned" error.
+func (p *IPFSPool) Unpin(ctx context.Context, cid string) ([]string, error) {
+	if err := ValidateCid(cid); err != nil {
+		return nil, err
+	}
+
+	var pins []string
+	var notPinnedErr error
+	for _, node := range p.nodes {
+		nodePins, err := node.Client.Unpin(ctx, cid)
+		p.record(node, err)
+		switch {
+		case err == nil:
+			if pins == nil {
+				pins = nodePins
+			}
+		case IsNotPinned(err):
+			notPinnedErr = err
+		default:
+			return nil, err
+		}
+	}
+
+	if pins == nil {
+		return nil, notPinnedErr
+	}
+	return pins, nil
+}
+
+// ListPins returns the pins of every node that answers, each CID once.
+func (p *IPFSPool) ListPins(ctx context.Context, pinType string) ([]PinInfo, error) {
+	pins := make([]PinInfo, 0)
+	seen := make(map[string]bool)
+
+	answered := false
+	var firstErr error
+	for _, node := range p.nodes {
+		nodePins, err := node.Client.ListPins(ctx, pinType)
+		p.record(node, err)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !canFallback(ctx, err) {
+				return nil, err
+			}
+			continue
+		}
+
+		answered = true
+		for _, pin := range nodePins {
+			if !seen[pin.Cid] {
+				seen[pin.Cid] = true
+				pins = append(pins, pin)
+			}
+		}
+	}
+
+	if !answered {
+		return nil, firstErr
+	}
+	return pins, nil
+}
+
+// PinStatus returns the status of cid on the first node that pins it, with
+// Nodes listing every node that does.
+func (p *IPFSPool) PinStatus(ctx context.Context, cid string) (PinStatus, error) {
+	if err := ValidateCid(cid); err != nil {
+		return PinStatus{}, err
+	}
+
+	var status PinStatus
+	answered := false
+	var firstErr error
+	for _, node := range p.ordered(0) {
+		nodeStatus, err := node.Client.PinStatus(ctx, cid)
+		p.record(node, err)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !canFallback(ctx, err) {
+				return PinStatus{}, err
+			}
+			continue
+		}
+
+		if !answered || (nodeStatus.Pinned && !status.Pinned) {
+			nodes := status.Nodes
+			status = nodeStatus
+			status.Nodes = nodes
+		}
+		answered = true
+		if nodeStatus.Pinned {
+			status.Nodes = append(status.Nodes, node.Name)
+		}
+	}
+
+	if !answered {
+		return PinStatus{}, firstErr
+	}
+	return status, nil
+}
@@ -0,0 +1,62 @@
+package ipfs
+
+import (
+	"context"
+	"io"
+)
+
+// rangeWindowSize is how much of an object a range reader fetches at once.
+const rangeWindowSize = 1024 * 1024
+
+// rangeReader reads a byte range of an object one window at a time, so only
+// one window is held in memory however large the range is.
+type rangeReader struct {
+	ctx       context.Context
+	pool      *IPFSPool
+	cid       string
+	offset    int64
+	remaining int64
+	buf       []byte
+}
+
+// NewRangeReader returns a reader of length bytes of cid starting at offset.
+// The bytes are fetched lazily with FetchFileRange as the reader is read.
+func (p *IPFSPool) NewRangeReader(ctx context.Context, cid string, offset int64, length int64) io.Reader {
+	return &rangeReader{
+		ctx:       ctx,
+		pool:      p,
+		cid:       cid,
+		offset:    offset,
+		remaining: length,
+	}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.remaining <= 0 {
+			return 0, io.EOF
+		}
+
+		window := r.remaining
+		if window > rangeWindowSize {
+			window = rangeWindowSize
+		}
+
+		data, err := r.pool.FetchFileRange(r.ctx, r.cid, r.offset, window)
+		if err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			// The object is shorter than the range
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		r.buf = data
+		r.offset += int64(len(data))
+		r.remaining -= int64(len(data))
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
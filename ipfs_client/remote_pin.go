@@ -0,0 +1,241 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/faizainur/ipfs-api/resilience"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Statuses of a request to a remote pinning service.
+const (
+	RemotePinQueued  = "queued"
+	RemotePinPinning = "pinning"
+	RemotePinPinned  = "pinned"
+	RemotePinFailed  = "failed"
+)
+
+const remotePinsEndpoint = "pins"
+
+// RemotePin is the object a remote pinning service is asked to pin.
+type RemotePin struct {
+	Cid     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// RemotePinStatus is the state of one pin request on a remote pinning
+// service.
+type RemotePinStatus struct {
+	RequestID string            `json:"requestid"`
+	Status    string            `json:"status"`
+	Created   time.Time         `json:"created"`
+	Pin       RemotePin         `json:"pin"`
+	Delegates []string          `json:"delegates"`
+	Info      map[string]string `json:"info,omitempty"`
+}
+
+// RemotePinQuery filters RemotePinClient.List. Zero values are not sent.
+type RemotePinQuery struct {
+	Cids     []string
+	Name     string
+	Statuses []string
+	Before   time.Time
+	After    time.Time
+	Limit    int
+}
+
+type remotePinResults struct {
+	Count   int               `json:"count"`
+	Results []RemotePinStatus `json:"results"`
+}
+
+type remotePinFailure struct {
+	Error struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	} `json:"error"`
+}
+
+// RemotePinClient speaks the IPFS Pinning Service API, which pinning
+// providers expose to keep content pinned on their own nodes.
+type RemotePinClient struct {
+	endpoint    string
+	accessToken string
+
+	// Timeout bounds each call to the service
+	Timeout time.Duration
+	// Upstream retries and circuit breaks the calls. Calls are attempted once
+	// when unset.
+	Upstream *resilience.Upstream
+}
+
+// NewRemotePinClient returns a client for the service at endpoint, the URL
+// the /pins paths are relative to, authenticated with accessToken.
+func NewRemotePinClient(endpoint string, accessToken string) *RemotePinClient {
+	return &RemotePinClient{
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		accessToken: accessToken,
+		Timeout:     30 * time.Second,
+	}
+}
+
+// Add asks the service to pin pin.Cid. Every call creates a new request, so
+// it is not retried.
+func (r *RemotePinClient) Add(ctx context.Context, pin RemotePin) (RemotePinStatus, error) {
+	if err := ValidateCid(pin.Cid); err != nil {
+		return RemotePinStatus{}, err
+	}
+
+	body, err := json.Marshal(pin)
+	if err != nil {
+		return RemotePinStatus{}, err
+	}
+
+	var status RemotePinStatus
+	err = r.do(ctx, false, fiber.MethodPost, r.pinsUri(""), nil, body, &status)
+	return status, err
+}
+
+// Get returns the current state of the request requestID.
+func (r *RemotePinClient) Get(ctx context.Context, requestID string) (RemotePinStatus, error) {
+	var status RemotePinStatus
+	err := r.do(ctx, true, fiber.MethodGet, r.pinsUri(requestID), nil, nil, &status)
+	return status, err
+}
+
+// List returns the requests matching query, and how many match in total.
+func (r *RemotePinClient) List(ctx context.Context, query RemotePinQuery) ([]RemotePinStatus, int, error) {
+	values := url.Values{}
+	if len(query.Cids) > 0 {
+		values.Set("cid", strings.Join(query.Cids, ","))
+	}
+	if query.Name != "" {
+		values.Set("name", query.Name)
+	}
+	if len(query.Statuses) > 0 {
+		values.Set("status", strings.Join(query.Statuses, ","))
+	}
+	if !query.Before.IsZero() {
+		values.Set("before", query.Before.UTC().Format(time.RFC3339))
+	}
+	if !query.After.IsZero() {
+		values.Set("after", query.After.UTC().Format(time.RFC3339))
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+
+	var results remotePinResults
+	if err := r.do(ctx, true, fiber.MethodGet, r.pinsUri(""), values, nil, &results); err != nil {
+		return nil, 0, err
+	}
+	return results.Results, results.Count, nil
+}
+
+// Replace swaps the object of the request requestID for pin. The service
+// answers with a new request, so it is not retried.
+func (r *RemotePinClient) Replace(ctx context.Context, requestID string, pin RemotePin) (RemotePinStatus, error) {
+	if err := ValidateCid(pin.Cid); err != nil {
+		return RemotePinStatus{}, err
+	}
+
+	body, err := json.Marshal(pin)
+	if err != nil {
+		return RemotePinStatus{}, err
+	}
+
+	var status RemotePinStatus
+	err = r.do(ctx, false, fiber.MethodPost, r.pinsUri(requestID), nil, body, &status)
+	return status, err
+}
+
+// Delete removes the request requestID, which unpins its object.
+func (r *RemotePinClient) Delete(ctx context.Context, requestID string) error {
+	return r.do(ctx, true, fiber.MethodDelete, r.pinsUri(requestID), nil, nil, nil)
+}
+
+// IsRemotePinNotFound reports whether err is the answer of a pinning service
+// to a request ID it does not know.
+func IsRemotePinNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Endpoint == remotePinsEndpoint && apiErr.StatusCode == fiber.StatusNotFound
+}
+
+func (r *RemotePinClient) do(ctx context.Context, idempotent bool, method string, uri string, query url.Values, body []byte, result interface{}) error {
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	return r.Upstream.Do(ctx, idempotent, func(ctx context.Context) error {
+		return r.doOnce(ctx, method, uri, body, result)
+	})
+}
+
+func (r *RemotePinClient) doOnce(ctx context.Context, method string, uri string, body []byte, result interface{}) error {
+	call := newCall()
+	defer call.release()
+	agent, resp := call.agent, call.resp
+
+	req := agent.Request()
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+r.accessToken)
+	if body != nil {
+		req.Header.SetContentType(fiber.MIMEApplicationJSON)
+		req.SetBody(body)
+	}
+
+	if err := call.do(ctx, r.Timeout, remotePinsEndpoint); err != nil {
+		return err
+	}
+
+	if resp.StatusCode() < 200 || resp.StatusCode() > 299 {
+		return newRemotePinError(resp.StatusCode(), resp.Body())
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Body(), result)
+}
+
+// newRemotePinError decodes the error body of the Pinning Service API, which
+// differs from the one of the RPC API.
+func newRemotePinError(statusCode int, body []byte) *APIError {
+	var failure remotePinFailure
+	if err := json.Unmarshal(body, &failure); err != nil || failure.Error.Reason == "" {
+		return newAPIError(remotePinsEndpoint, statusCode, body)
+	}
+
+	message := failure.Error.Reason
+	if failure.Error.Details != "" {
+		message += ": " + failure.Error.Details
+	}
+	return &APIError{
+		Endpoint:   remotePinsEndpoint,
+		StatusCode: statusCode,
+		Message:    message,
+		Type:       failure.Error.Reason,
+	}
+}
+
+func (r *RemotePinClient) pinsUri(requestID string) string {
+	var builder strings.Builder
+
+	builder.WriteString(r.endpoint)
+	builder.WriteString("/pins")
+	if requestID != "" {
+		builder.WriteString("/")
+		builder.WriteString(url.PathEscape(requestID))
+	}
+
+	return builder.String()
+}
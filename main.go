@@ -1,24 +1,67 @@
 package main
 
 import (
-	"encoding/hex"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/faizainur/ipfs-api/cutils"
 	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
 	"github.com/faizainur/ipfs-api/middlewares"
+	"github.com/faizainur/ipfs-api/resilience"
 	"github.com/faizainur/ipfs-api/services"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func main() {
-	app := fiber.New()
-	app.Use(cors.New())
+	if len(os.Args) > 1 && os.Args[1] == "rotate-master-key" {
+		rotateMasterKey()
+		return
+	}
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: middlewares.ErrorHandler,
+	})
+
+	// Hand request bodies to the handlers as a stream so large uploads are
+	// never held in memory as a whole
+	app.Server().StreamRequestBody = true
+	app.Server().DisablePreParseMultipartForm = true
+
+	app.Use(cors.New(cors.Config{
+		// tus clients discover the upload endpoints with plain OPTIONS
+		// requests, which are not preflights
+		Next: func(c *fiber.Ctx) bool {
+			return c.Method() == fiber.MethodOptions && c.Get(fiber.HeaderAccessControlRequestMethod) == ""
+		},
+		ExposeHeaders: strings.Join([]string{
+			fiber.HeaderLocation,
+			fiber.HeaderETag,
+			fiber.HeaderContentDisposition,
+			fiber.HeaderContentRange,
+			fiber.HeaderAcceptRanges,
+			"Tus-Resumable",
+			"Tus-Version",
+			"Tus-Extension",
+			"Tus-Max-Size",
+			"Upload-Offset",
+			"Upload-Length",
+			"Upload-Metadata",
+			"Upload-Expires",
+			"X-Upload-File-Id",
+			"X-Upload-Cid",
+		}, ","),
+	}))
 	app.Use(logger.New())
+	app.Use(middlewares.CloseUnreadBody)
 	app.Use(middleware)
 
 	// cutils.GenerateKeyFile()
@@ -33,60 +76,584 @@ func main() {
 	fmt.Println("IPFS API SERVER = ", ipfsApiServer)
 	fmt.Println("IPFS GATEWAY = ", ipfsGateway)
 
-	cryptoService := services.NewCryptoService(loadKey())
+	upstreams := resilience.NewRegistry()
+	ipfsPolicy := resilience.DefaultPolicy
+	ipfsPolicy.Retryable = ipfs.IsRetryable
+
+	db := connectDatabase()
+	cryptoService := services.NewCryptoService(loadKeyring(), newKeyStore(db))
 	authService := services.NewAuthService(jwtUri, adminHydraHost)
-	ipfsClient := ipfs.NewClient(ipfsApiServer, ipfsGateway)
+	authService.JwtUpstream = upstreams.Register("jwt-validation", resilience.DefaultPolicy)
+	authService.HydraUpstream = upstreams.Register("hydra", resilience.DefaultPolicy)
+	fileRepository := newFileRepository(db)
+	fileService := services.NewFileService(fileRepository)
+	grantService := services.NewGrantService(newGrantRepository(db))
+	ipfsPool := newIpfsPool(ipfsApiServer, ipfsGateway, upstreams, ipfsPolicy)
+	ipfsPool.WatchHealth(30*time.Second, 10*time.Second, nil)
+
+	folders := newFolderService(db, fileRepository, ipfsPool)
+	remotePins := newRemotePinService(fileRepository, upstreams)
+	pinRequests := newPinRequestService(db, fileRepository, ipfsPool)
+	versions := newFileVersionService(db, fileRepository, ipfsPool, remotePins)
+	versions.PinRequests = pinRequests
 
 	ipfsMiddleware := middlewares.IpfsMiddleware{
-		IpfsClient:    ipfsClient,
+		IpfsPool:      ipfsPool,
 		CryptoService: cryptoService,
+		FileService:   fileService,
+		RemotePins:    remotePins,
+		Uploads:       newUploadService(cryptoService),
+		Folders:       folders,
+		Names:         folders.Names,
+		Versions:      versions,
+		PinRequests:   pinRequests,
+	}
+
+	grantMiddleware := middlewares.GrantMiddleware{
+		GrantService: grantService,
+		FileService:  fileService,
+	}
+
+	pinningMiddleware := middlewares.PinningMiddleware{
+		PinRequestService: pinRequests,
+		Delegates:         splitEnv("PINNING_DELEGATES"),
+	}
+
+	healthMiddleware := middlewares.HealthMiddleware{
+		Registry: upstreams,
+		IpfsPool: ipfsPool,
 	}
 
 	authMiddleware := middlewares.AuthMiddleware{
-		AuthService: authService,
+		Authenticators: newAuthenticators(authService),
 	}
+	userAuth := authMiddleware.Authenticate(services.PrincipalUser)
+	clientAuth := authMiddleware.Authenticate(services.PrincipalClient)
+
+	app.Get("/metrics", healthMiddleware.Metrics)
 
 	v1 := app.Group("/v1")
 	{
 		v1.Get("/ping", ping)
+		v1.Get("/health", healthMiddleware.Live)
+		v1.Get("/health/ready", healthMiddleware.Ready)
 
 		// Testing endpoint
-		v1.Get("/secure", authMiddleware.ValidateJwtToken, securedEndpoint)
-		v1.Get("/secureOauth", authMiddleware.IntrospectAccessToken, securedEndpoint)
+		v1.Get("/secure", userAuth, securedEndpoint)
+		v1.Get("/secureOauth", clientAuth, securedEndpoint)
 
 		user := v1.Group("/user")
 		{
-			user.Get("/fetch", authMiddleware.ValidateJwtToken, ipfsMiddleware.FetchFile)
-			user.Post("/upload", authMiddleware.ValidateJwtToken, ipfsMiddleware.UploadFile)
+			user.Get("/fetch", userAuth, ipfsMiddleware.FetchFile)
+			user.Post("/upload", userAuth, ipfsMiddleware.UploadFile)
+
+			// Resumable uploads, speaking tus 1.0
+			user.Options("/uploads", ipfsMiddleware.UploadOptions)
+			user.Post("/uploads", userAuth, middlewares.TusResumable, ipfsMiddleware.CreateUpload)
+			user.Head("/uploads/:id", userAuth, middlewares.TusResumable, ipfsMiddleware.UploadStatus)
+			user.Patch("/uploads/:id", userAuth, middlewares.TusResumable, ipfsMiddleware.PatchUpload)
+			user.Delete("/uploads/:id", userAuth, middlewares.TusResumable, ipfsMiddleware.TerminateUpload)
+
+			user.Get("/files", userAuth, ipfsMiddleware.ListFiles)
+			user.Get("/files/:id", userAuth, ipfsMiddleware.GetFile)
+			user.Patch("/files/:id", userAuth, ipfsMiddleware.UpdateFile)
+			user.Delete("/files/:id", userAuth, ipfsMiddleware.DeleteFile)
+			user.Put("/files/:id/folder", userAuth, ipfsMiddleware.PutFileInFolder)
+			user.Get("/files/:id/versions", userAuth, ipfsMiddleware.ListVersions)
+			user.Post("/files/:id/versions", userAuth, ipfsMiddleware.AddVersion)
+			user.Get("/files/:id/versions/:version", userAuth, ipfsMiddleware.FetchVersion)
+			user.Post("/files/:id/versions/:version/restore", userAuth, ipfsMiddleware.RestoreVersion)
+
+			user.Get("/folders", userAuth, ipfsMiddleware.ListFolder)
+			user.Post("/folders", userAuth, ipfsMiddleware.CreateFolder)
+			user.Post("/folders/move", userAuth, ipfsMiddleware.MoveFolder)
+			user.Delete("/folders", userAuth, ipfsMiddleware.DeleteFolder)
+			user.Get("/name", userAuth, ipfsMiddleware.GetName)
+
+			user.Get("/grants", userAuth, grantMiddleware.ListGrants)
+			user.Post("/grants", userAuth, grantMiddleware.CreateGrant)
+			user.Delete("/grants/:id", userAuth, grantMiddleware.RevokeGrant)
+
+			user.Get("/pins", userAuth, ipfsMiddleware.ListPins)
+			user.Get("/pins/:cid", userAuth, ipfsMiddleware.PinStatus)
+			user.Post("/pins/:cid", userAuth, ipfsMiddleware.PinFile)
+			user.Delete("/pins/:cid", userAuth, ipfsMiddleware.UnpinFile)
 		}
 
 		bank := v1.Group("/bank")
 		{
-			bank.Get("/fetch", authMiddleware.IntrospectAccessToken, ipfsMiddleware.FetchFile)
+			bank.Get("/fetch", clientAuth, ipfsMiddleware.ResolveName, grantMiddleware.RequireGrant(services.ScopeFilesRead), ipfsMiddleware.FetchFile)
+		}
+
+		// IPFS Pinning Service API, with https://<host>/v1/pinning as the
+		// service endpoint
+		pinning := v1.Group("/pinning", pinningMiddleware.Errors, authMiddleware.Authenticate(), middlewares.RequireScope(services.ScopePinning))
+		{
+			pinning.Get("/pins", pinningMiddleware.ListPins)
+			pinning.Post("/pins", pinningMiddleware.AddPin)
+			pinning.Get("/pins/:requestid", pinningMiddleware.GetPin)
+			pinning.Post("/pins/:requestid", pinningMiddleware.ReplacePin)
+			pinning.Delete("/pins/:requestid", pinningMiddleware.RemovePin)
 		}
 
 	}
 
+	go rewrapUserKeys(cryptoService)
+
 	app.Listen(":4000")
 }
 
-func loadKey() []byte {
-	fmt.Println("Loading key...")
+func loadKeyring() *cutils.Keyring {
+	fmt.Println("Loading keys...")
+
+	activeVersion := 0
+	if value := os.Getenv("MASTER_KEY_VERSION"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatal("MASTER_KEY_VERSION must be a number")
+		}
+		activeVersion = version
+	}
 
-	key := make([]byte, 24)
-	encodedKey, err := ioutil.ReadFile(cutils.GetKeyPath())
+	keyring, err := cutils.LoadKeyring(activeVersion)
 	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if keyring.IsEmpty() {
 		// Key is not found
 		fmt.Println("Cannot find master key")
 		// Generating new key file
 		fmt.Println("Generating new master key file...")
-		key = cutils.GenerateKeyFile()
+		key := cutils.GenerateKeyFile()
 		fmt.Println("Key is generated and stored in ", cutils.GetKeyDirPath())
-		return key
+		keyring, err = cutils.NewKeyring(map[int][]byte{cutils.LegacyKeyVersion: key}, cutils.LegacyKeyVersion)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return keyring
+	}
+
+	version, _ := keyring.Active()
+	fmt.Println("Master key versions found:", keyring.Versions(), "active version:", version)
+	return keyring
+}
+
+// rotateMasterKey writes the next master key version. It becomes active on
+// the next start, which also re-wraps the user keys in the background.
+func rotateMasterKey() {
+	keyring, err := cutils.LoadKeyring(0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	nextVersion := cutils.LegacyKeyVersion
+	if versions := keyring.Versions(); len(versions) > 0 {
+		nextVersion = versions[len(versions)-1] + 1
+	}
+
+	cutils.GenerateVersionedKeyFile(nextVersion)
+	fmt.Println("Master key version", nextVersion, "is stored in", cutils.GetVersionedKeyPath(nextVersion))
+}
+
+func rewrapUserKeys(cryptoService *services.CryptoService) {
+	fmt.Println("Re-wrapping user keys with master key version", cryptoService.ActiveKeyVersion())
+
+	result, err := cryptoService.RewrapUserKeys(context.Background(), 100)
+	if err != nil {
+		log.Println("Re-wrapping user keys stopped:", err.Error())
+		return
+	}
+	fmt.Printf("Re-wrapped %d user keys, skipped %d\n", result.Rewrapped, result.Skipped)
+}
+
+// ipfsTimeouts reads the per operation timeouts of the IPFS client from
+// IPFS_ADD_TIMEOUT, IPFS_CAT_TIMEOUT, IPFS_PIN_TIMEOUT, IPFS_FILES_TIMEOUT
+// and IPFS_NAME_TIMEOUT, keeping the defaults for the ones not set.
+func ipfsTimeouts() ipfs.Timeouts {
+	timeouts := ipfs.DefaultTimeouts
+	for name, timeout := range map[string]*time.Duration{
+		"IPFS_ADD_TIMEOUT":   &timeouts.Add,
+		"IPFS_CAT_TIMEOUT":   &timeouts.Cat,
+		"IPFS_PIN_TIMEOUT":   &timeouts.Pin,
+		"IPFS_FILES_TIMEOUT": &timeouts.Files,
+		"IPFS_NAME_TIMEOUT":  &timeouts.Name,
+	} {
+		if value := os.Getenv(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				log.Fatal(name, " must be a duration such as 2m")
+			}
+			*timeout = duration
+		}
+	}
+	return timeouts
+}
+
+// newIpfsPool builds the pool of IPFS nodes from the comma separated API and
+// gateway URIs, paired by position. A single gateway URI is shared by every
+// node. IPFS_REPLICAS sets on how many nodes each upload is pinned, 1 by
+// default. Each node gets its own upstreams, ipfs-api and ipfs-gateway for
+// the first node and suffixed with the node number for the others.
+func newIpfsPool(apiServers string, gateways string, upstreams *resilience.Registry, policy resilience.Policy) *ipfs.IPFSPool {
+	apiUris := strings.Split(apiServers, ",")
+	gatewayUris := strings.Split(gateways, ",")
+	if len(gatewayUris) != 1 && len(gatewayUris) != len(apiUris) {
+		log.Fatal("IPFS_GATEWAY_URI must have one URI, or one per IPFS_API_SERVER_URI")
+	}
+
+	replicas := 1
+	if value := os.Getenv("IPFS_REPLICAS"); value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			log.Fatal("IPFS_REPLICAS must be a positive number")
+		}
+		replicas = count
+	}
+
+	timeouts := ipfsTimeouts()
+	nodes := make([]ipfs.PoolNode, 0, len(apiUris))
+	for i, apiUri := range apiUris {
+		gatewayUri := gatewayUris[0]
+		if len(gatewayUris) > 1 {
+			gatewayUri = gatewayUris[i]
+		}
+
+		name := "ipfs"
+		if i > 0 {
+			name = fmt.Sprintf("ipfs-%d", i)
+		}
+
+		client := ipfs.NewClient(strings.TrimSpace(apiUri), strings.TrimSpace(gatewayUri))
+		client.Timeouts = timeouts
+		client.APIUpstream = upstreams.Register(name+"-api", policy)
+		client.GatewayUpstream = upstreams.Register(name+"-gateway", policy)
+		nodes = append(nodes, ipfs.PoolNode{Name: name, Client: client})
+	}
+
+	pool, err := ipfs.NewPool(nodes, replicas)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if replicas > pool.Replicas() {
+		log.Println("IPFS_REPLICAS is larger than the number of IPFS nodes, pinning on", pool.Replicas())
+	}
+	return pool
+}
+
+// newRemotePinService configures pinning uploads on a remote pinning service
+// from REMOTE_PIN_ENDPOINT and REMOTE_PIN_TOKEN, and returns nil when the
+// endpoint is not set. REMOTE_PIN_ORIGINS lists the multiaddrs of our nodes,
+// comma separated, and REMOTE_PIN_INTERVAL how often pins are reconciled
+// (1m by default).
+func newRemotePinService(repository services.FileRepository, upstreams *resilience.Registry) *services.RemotePinService {
+	endpoint := os.Getenv("REMOTE_PIN_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+	fmt.Println("REMOTE PIN ENDPOINT = ", endpoint)
+
+	interval := time.Minute
+	if value := os.Getenv("REMOTE_PIN_INTERVAL"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal("REMOTE_PIN_INTERVAL must be a duration such as 1m")
+		}
+		interval = duration
+	}
+
+	client := ipfs.NewRemotePinClient(endpoint, os.Getenv("REMOTE_PIN_TOKEN"))
+	client.Upstream = upstreams.Register("remote-pin", resilience.DefaultPolicy)
+
+	remotePins := services.NewRemotePinService(client, repository)
+	remotePins.Origins = splitEnv("REMOTE_PIN_ORIGINS")
+	remotePins.Watch(interval, nil)
+	return remotePins
+}
+
+// newUploadService stages resumable uploads in UPLOAD_STAGING_DIR, a
+// directory under the system temporary directory by default.
+// UPLOAD_MAX_SIZE bounds the size of an upload in bytes, unlimited when not
+// set, and UPLOAD_EXPIRATION is how long an upload is kept after its last
+// chunk (24h by default).
+func newUploadService(cryptoService *services.CryptoService) *services.UploadService {
+	dir := os.Getenv("UPLOAD_STAGING_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "ipfs-api-uploads")
+	}
+
+	uploads, err := services.NewUploadService(dir, cryptoService)
+	if err != nil {
+		log.Fatal("Cannot create the upload staging directory: ", err.Error())
+	}
+
+	if value := os.Getenv("UPLOAD_MAX_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			log.Fatal("UPLOAD_MAX_SIZE must be a number of bytes")
+		}
+		uploads.MaxSize = size
+	}
+	if value := os.Getenv("UPLOAD_EXPIRATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal("UPLOAD_EXPIRATION must be a duration such as 24h")
+		}
+		uploads.Expiration = duration
+	}
+
+	uploads.Watch(time.Hour, nil)
+	return uploads
+}
+
+// newPinRequestService stores the requests of the Pinning Service API in
+// MongoDB, or in memory with STORAGE_BACKEND=memory. PINNING_QUOTA is how
+// many pins a tenant may hold, 1000 by default and 0 for no limit, and
+// PINNING_QUOTAS overrides it per tenant as a comma separated list of
+// tenant=quota.
+func newPinRequestService(client *mongo.Client, files services.FileRepository, pool *ipfs.IPFSPool) *services.PinRequestService {
+	var repository services.PinRequestRepository = services.NewMemoryPinRequestRepository()
+	if client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		mongoRepository := services.NewMongoPinRequestRepository(client.Database("ipfs"))
+		if err := mongoRepository.EnsureIndexes(ctx); err != nil {
+			log.Println("Cannot create pin request indexes:", err.Error())
+		}
+		repository = mongoRepository
+	}
+
+	pinRequests := services.NewPinRequestService(repository, files, pool)
+	pinRequests.DefaultQuota = 1000
+	if value := os.Getenv("PINNING_QUOTA"); value != "" {
+		quota, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || quota < 0 {
+			log.Fatal("PINNING_QUOTA must be a number")
+		}
+		pinRequests.DefaultQuota = quota
+	}
+
+	pinRequests.Quotas = make(map[string]int64)
+	for _, entry := range splitEnv("PINNING_QUOTAS") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			log.Fatal("PINNING_QUOTAS must be a list of tenant=quota")
+		}
+		quota, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || quota < 0 {
+			log.Fatal("PINNING_QUOTAS must be a list of tenant=quota")
+		}
+		pinRequests.Quotas[strings.TrimSpace(parts[0])] = quota
+	}
+
+	pinRequests.Watch(time.Minute, nil)
+	return pinRequests
+}
+
+// splitEnv returns the comma separated values of the environment variable
+// name, trimmed, or nil when it is not set.
+func splitEnv(name string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	values := strings.Split(value, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+// newAuthenticators builds the authentication chain: static API keys from
+// API_KEYS_FILE when set, user JWTs checked locally (JWT_VALIDATION_MODE=local)
+// or by the remote validation service, then Hydra token introspection.
+func newAuthenticators(authService *services.AuthService) []services.Authenticator {
+	authenticators := make([]services.Authenticator, 0, 3)
+
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		apiKeys, err := services.LoadAPIKeyAuthenticator(path)
+		if err != nil {
+			log.Fatal("Cannot load API keys: ", err.Error())
+		}
+		authenticators = append(authenticators, apiKeys)
+	}
+
+	if os.Getenv("JWT_VALIDATION_MODE") == "local" {
+		authenticators = append(authenticators, &services.JwksAuthenticator{Verifier: newJwtVerifier()})
+	} else {
+		authenticators = append(authenticators, &services.RemoteJwtAuthenticator{AuthService: authService})
+	}
+
+	return append(authenticators, &services.HydraAuthenticator{AuthService: authService})
+}
+
+// newJwtVerifier configures local JWT verification from JWKS_URI (a URL or a
+// file path), JWT_ISSUER, JWT_AUDIENCE, JWT_REQUIRED_CLAIMS (comma separated,
+// email by default) and JWKS_REFRESH_INTERVAL (15m by default).
+func newJwtVerifier() *services.JwtVerifier {
+	jwksUri := os.Getenv("JWKS_URI")
+	fmt.Println("JWT validation mode = local, JWKS URI = ", jwksUri)
+
+	refreshInterval := 15 * time.Minute
+	if value := os.Getenv("JWKS_REFRESH_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal("JWKS_REFRESH_INTERVAL must be a duration such as 15m")
+		}
+		refreshInterval = interval
+	}
+
+	jwks, err := services.NewJwksCache(jwksUri, refreshInterval, nil)
+	if err != nil {
+		log.Fatal("Cannot load JWKS: ", err.Error())
+	}
+
+	// The email is the subject of user principals, so it is always required
+	requiredClaims := []string{"email"}
+	for _, claim := range strings.Split(os.Getenv("JWT_REQUIRED_CLAIMS"), ",") {
+		if claim = strings.TrimSpace(claim); claim != "" && claim != "email" {
+			requiredClaims = append(requiredClaims, claim)
+		}
+	}
+
+	return services.NewJwtVerifier(jwks, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"), requiredClaims)
+}
+
+// connectDatabase returns the client for MONGODB_URI shared by the
+// repositories. With STORAGE_BACKEND=memory it returns nil and everything is
+// kept in memory instead, lost on restart, which is meant for development and
+// tests only.
+func connectDatabase() *mongo.Client {
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "", "mongodb":
+	case "memory":
+		log.Println("STORAGE_BACKEND is memory, nothing will outlive this process")
+		return nil
+	default:
+		log.Fatal("STORAGE_BACKEND must be mongodb or memory")
 	}
-	fmt.Println("Key found, using this key as m master key")
-	hex.Decode(key, encodedKey)
-	return key
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dbConfig := cutils.DbUtils{ConnectionString: os.Getenv("MONGODB_URI")}
+	client, err := dbConfig.Connect(ctx)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return client
+}
+
+func newKeyStore(client *mongo.Client) services.KeyStore {
+	if client == nil {
+		return services.NewMemoryKeyStore()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := services.NewMongoKeyStore(client.Database("crypto"))
+	if err := store.EnsureIndexes(ctx); err != nil {
+		log.Println("Cannot create key indexes:", err.Error())
+	}
+	return store
+}
+
+func newFileRepository(client *mongo.Client) services.FileRepository {
+	if client == nil {
+		return services.NewMemoryFileRepository()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	repository := services.NewMongoFileRepository(client.Database("ipfs"))
+	if err := repository.EnsureIndexes(ctx); err != nil {
+		log.Println("Cannot create file indexes:", err.Error())
+	}
+	return repository
+}
+
+// newFolderService keeps the folder roots of the users, and the IPNS names
+// that point to them, in MongoDB or in memory. IPNS_LIFETIME is how long a
+// published name stays valid, the default of the node when not set.
+func newFolderService(client *mongo.Client, files services.FileRepository, pool *ipfs.IPFSPool) *services.FolderService {
+	var repository services.FolderRepository = services.NewMemoryFolderRepository()
+	var nameRepository services.NameRepository = services.NewMemoryNameRepository()
+	if client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		mongoRepository := services.NewMongoFolderRepository(client.Database("ipfs"))
+		if err := mongoRepository.EnsureIndexes(ctx); err != nil {
+			log.Println("Cannot create folder indexes:", err.Error())
+		}
+		mongoNames := services.NewMongoNameRepository(client.Database("ipfs"))
+		if err := mongoNames.EnsureIndexes(ctx); err != nil {
+			log.Println("Cannot create name indexes:", err.Error())
+		}
+		repository, nameRepository = mongoRepository, mongoNames
+	}
+
+	names := services.NewNameService(nameRepository, repository, pool)
+	if value := os.Getenv("IPNS_LIFETIME"); value != "" {
+		lifetime, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal("IPNS_LIFETIME must be a duration such as 24h")
+		}
+		names.Lifetime = lifetime
+	}
+	names.Watch(time.Minute, nil)
+
+	folders := services.NewFolderService(repository, files, pool)
+	folders.Names = names
+	folders.Watch(time.Minute, nil)
+	return folders
+}
+
+// newFileVersionService keeps the versions of files in MongoDB or in memory.
+// FILE_VERSION_RETENTION is how many versions of a file stay pinned, 0 for
+// all of them, the default.
+func newFileVersionService(client *mongo.Client, files services.FileRepository, pool *ipfs.IPFSPool, remotePins *services.RemotePinService) *services.FileVersionService {
+	var repository services.FileVersionRepository = services.NewMemoryFileVersionRepository()
+	if client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		mongoRepository := services.NewMongoFileVersionRepository(client.Database("ipfs"))
+		if err := mongoRepository.EnsureIndexes(ctx); err != nil {
+			log.Println("Cannot create file version indexes:", err.Error())
+		}
+		repository = mongoRepository
+	}
+
+	versions := services.NewFileVersionService(repository, files, pool)
+	versions.RemotePins = remotePins
+	if value := os.Getenv("FILE_VERSION_RETENTION"); value != "" {
+		retention, err := strconv.Atoi(value)
+		if err != nil || retention < 0 {
+			log.Fatal("FILE_VERSION_RETENTION must be a number")
+		}
+		versions.Retention = retention
+	}
+	return versions
+}
+
+func newGrantRepository(client *mongo.Client) services.GrantRepository {
+	if client == nil {
+		return services.NewMemoryGrantRepository()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	repository := services.NewMongoGrantRepository(client.Database("ipfs"))
+	if err := repository.EnsureIndexes(ctx); err != nil {
+		log.Println("Cannot create grant indexes:", err.Error())
+	}
+	return repository
 }
 
 func ping(c *fiber.Ctx) error {
@@ -98,7 +665,5 @@ func ping(c *fiber.Ctx) error {
 }
 
 func securedEndpoint(c *fiber.Ctx) error {
-	return c.Status(200).JSON(fiber.Map{
-		"email": c.Locals("email"),
-	})
+	return c.Status(200).JSON(middlewares.GetPrincipal(c))
 }
@@ -1,58 +1,103 @@
 package middlewares
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/faizainur/ipfs-api/services"
 	"github.com/gofiber/fiber/v2"
 )
 
+const principalLocal = "principal"
+
+// AuthMiddleware authenticates requests with a chain of authenticators. The
+// first one to accept the credentials wins.
 type AuthMiddleware struct {
-	AuthService *services.AuthService
+	Authenticators []services.Authenticator
 }
 
-func (a *AuthMiddleware) ValidateJwtToken(c *fiber.Ctx) error {
-	authHeader := strings.Trim(c.Get("Authorization"), " ")
-	if len(authHeader) < 2 {
+// Authenticate returns a handler that requires a principal of one of kinds,
+// available to later handlers through GetPrincipal.
+func (a *AuthMiddleware) Authenticate(kinds ...services.PrincipalKind) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		credentials := requestCredentials(c)
+		if credentials.BearerToken == "" && credentials.APIKey == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"code":  fiber.StatusUnauthorized,
+				"error": "No credentials provided",
+			})
+		}
+
+		var upstreamErr error
+		for _, authenticator := range a.Authenticators {
+			principal, err := authenticator.Authenticate(c.Context(), credentials)
+			if err == nil {
+				if !isKind(principal.Kind, kinds) {
+					return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+						"code":  fiber.StatusForbidden,
+						"error": "This endpoint is not available to " + string(principal.Kind) + " credentials",
+					})
+				}
+				c.Locals(principalLocal, principal)
+				return c.Next()
+			}
+			if !errors.Is(err, services.ErrNoCredentials) && !errors.Is(err, services.ErrInvalidCredentials) {
+				upstreamErr = err
+			}
+		}
+
+		if upstreamErr != nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"code":  fiber.StatusServiceUnavailable,
+				"error": upstreamErr.Error(),
+			})
+		}
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"code":  fiber.StatusUnauthorized,
-			"error": "No JWT token provided",
+			"error": "Unauthorized Access",
 		})
 	}
+}
 
-	authToken := strings.Split(authHeader, " ")[1]
-	isValid, data, err := a.AuthService.ValidateJwt(authToken)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+// RequireScope stops requests whose principal lacks scope.
+func RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !GetPrincipal(c).HasScope(scope) {
+			return fiber.NewError(fiber.StatusForbidden, "This endpoint requires the "+scope+" scope")
+		}
+		return c.Next()
 	}
+}
 
-	if !isValid {
-		return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized Access")
+// GetPrincipal returns the principal set by Authenticate.
+func GetPrincipal(c *fiber.Ctx) *services.Principal {
+	principal, _ := c.Locals(principalLocal).(*services.Principal)
+	if principal == nil {
+		return &services.Principal{}
 	}
-	c.Locals("email", data.Email)
-	c.Locals("userUid", data.UserUid)
-	return c.Next()
+	return principal
 }
 
-func (a *AuthMiddleware) IntrospectAccessToken(c *fiber.Ctx) error {
-	authHeader := strings.Trim(c.Get("Authorization"), " ")
-	if len(authHeader) < 2 {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"code":  fiber.StatusUnauthorized,
-			"error": "No access token provided",
-		})
+func requestCredentials(c *fiber.Ctx) services.Credentials {
+	var credentials services.Credentials
+
+	authHeader := strings.Fields(c.Get(fiber.HeaderAuthorization))
+	if len(authHeader) == 2 && strings.EqualFold(authHeader[0], "Bearer") {
+		credentials.BearerToken = authHeader[1]
 	}
+	credentials.APIKey = strings.TrimSpace(c.Get("X-API-Key"))
+
+	return credentials
+}
 
-	accessToken := strings.Split(authHeader, " ")[1]
-	isActive, data, err := a.AuthService.IntrospectTokenOauth2(accessToken)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+func isKind(kind services.PrincipalKind, kinds []services.PrincipalKind) bool {
+	if len(kinds) == 0 {
+		return true
 	}
-	if !isActive {
-		return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized Access")
+	for _, allowed := range kinds {
+		if kind == allowed {
+			return true
+		}
 	}
-	c.Locals("clientId", data.ClientID)
-	c.Locals("scopes", data.Scope)
-	c.Locals("email", data.Sub)
-	return c.Next()
+	return false
 }
@@ -0,0 +1,142 @@
+package middlewares
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cidETag is the entity tag of the content of cid. A CID names immutable
+// content, so it is a strong validator as it is.
+func cidETag(cid string) string {
+	return `"` + cid + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. Weak
+// comparison applies, as RFC 7232 requires for If-None-Match.
+func etagMatches(header string, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setContentHeaders describes a downloaded file: its MIME type, and its
+// original name in Content-Disposition. Browsers display it inline unless
+// the download query parameter is true.
+func setContentHeaders(c *fiber.Ctx, name string, mimeType string) {
+	if mimeType == "" {
+		mimeType = fiber.MIMEOctetStream
+	}
+	c.Set(fiber.HeaderContentType, mimeType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+	disposition := "inline"
+	if c.Query("download") == "true" {
+		disposition = "attachment"
+	}
+	if name != "" {
+		// FormatMediaType encodes names that are not plain ASCII per RFC 2231
+		if formatted := mime.FormatMediaType(disposition, map[string]string{"filename": name}); formatted != "" {
+			disposition = formatted
+		}
+	}
+	c.Set(fiber.HeaderContentDisposition, disposition)
+}
+
+// byteRange returns the part of a file of size bytes the Range header asks
+// for, and the status to answer with. The whole file is sent when there is
+// no single valid byte range to serve, when a suffix range is longer than
+// the file, or when If-Range names another version.
+func byteRange(c *fiber.Ctx, etag string, size int64) (start int64, length int64, status int, err error) {
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	header := c.Get(fiber.HeaderRange)
+	if header == "" {
+		return 0, size, fiber.StatusOK, nil
+	}
+	if ifRange := c.Get(fiber.HeaderIfRange); ifRange != "" && ifRange != etag {
+		return 0, size, fiber.StatusOK, nil
+	}
+
+	start, end, satisfiable, ok := parseByteRange(header, size)
+	// Malformed and multiple ranges may be ignored, RFC 7233 section 3.1
+	if !ok {
+		return 0, size, fiber.StatusOK, nil
+	}
+	if !satisfiable {
+		c.Set(fiber.HeaderContentRange, "bytes */"+strconv.FormatInt(size, 10))
+		return 0, 0, 0, fiber.ErrRequestedRangeNotSatisfiable
+	}
+
+	c.Set(fiber.HeaderContentRange, "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(size, 10))
+	return start, end - start + 1, fiber.StatusPartialContent, nil
+}
+
+// parseByteRange parses a Range header holding a single byte range of a file
+// of size bytes. ok is false when the header is not one valid byte range, or
+// is a suffix range covering the whole file, satisfiable is false when the
+// range starts past the end of the file.
+func parseByteRange(header string, size int64) (start int64, end int64, satisfiable bool, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false, false
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		// -N asks for the last N bytes, all of them when the file is shorter
+		suffix, valid := parseRangeInt(last)
+		if !valid {
+			return 0, 0, false, false
+		}
+		if suffix == 0 {
+			return 0, 0, false, true
+		}
+		if suffix >= size {
+			return 0, 0, false, false
+		}
+		return size - suffix, size - 1, true, true
+	}
+
+	start, valid := parseRangeInt(first)
+	if !valid {
+		return 0, 0, false, false
+	}
+	end = size - 1
+	if last != "" {
+		end, valid = parseRangeInt(last)
+		if !valid || end < start {
+			return 0, 0, false, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false, true
+	}
+	return start, end, true, true
+}
+
+// parseRangeInt parses a position of a byte range, which is only digits.
+func parseRangeInt(value string) (int64, bool) {
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil
+}
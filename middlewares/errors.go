@@ -0,0 +1,114 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/resilience"
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+// statusClientClosedRequest answers requests whose client went away before
+// the upstream call they were waiting on finished.
+const statusClientClosedRequest = 499
+
+// errorStatuses maps the errors of the services and of the IPFS client to
+// the status they are answered with.
+var errorStatuses = []struct {
+	err    error
+	status int
+}{
+	{services.ErrFileNotFound, fiber.StatusNotFound},
+	{services.ErrGrantNotFound, fiber.StatusNotFound},
+	{services.ErrInvalidGrant, fiber.StatusBadRequest},
+	{services.ErrKeyNotFound, fiber.StatusNotFound},
+	{services.ErrPinRequestNotFound, fiber.StatusNotFound},
+	{services.ErrInvalidPinRequest, fiber.StatusBadRequest},
+	{services.ErrQuotaExceeded, fiber.StatusConflict},
+	{services.ErrUploadNotFound, fiber.StatusNotFound},
+	{services.ErrUploadOffsetMismatch, fiber.StatusConflict},
+	{services.ErrUploadLocked, fiber.StatusLocked},
+	{services.ErrUploadTooLarge, fiber.StatusRequestEntityTooLarge},
+	{services.ErrInvalidUpload, fiber.StatusBadRequest},
+	{services.ErrFolderNotFound, fiber.StatusNotFound},
+	{services.ErrFolderExists, fiber.StatusConflict},
+	{services.ErrFolderNotEmpty, fiber.StatusConflict},
+	{services.ErrFolderConflict, fiber.StatusConflict},
+	{services.ErrInvalidFolder, fiber.StatusBadRequest},
+	{services.ErrNameNotFound, fiber.StatusNotFound},
+	{services.ErrVersionNotFound, fiber.StatusNotFound},
+	{services.ErrVersionConflict, fiber.StatusConflict},
+	{services.ErrVersionUnpinned, fiber.StatusGone},
+	{services.ErrInvalidVersion, fiber.StatusBadRequest},
+	{services.ErrAccessDenied, fiber.StatusForbidden},
+	{services.ErrDecryptionFailed, fiber.StatusUnprocessableEntity},
+	{ipfs.ErrInvalidCID, fiber.StatusBadRequest},
+	{ipfs.ErrInvalidPath, fiber.StatusBadRequest},
+	{ipfs.ErrInvalidName, fiber.StatusBadRequest},
+	{ipfs.ErrTimeout, fiber.StatusGatewayTimeout},
+	{ipfs.ErrUpstreamUnavailable, fiber.StatusServiceUnavailable},
+	{resilience.ErrCircuitOpen, fiber.StatusServiceUnavailable},
+	{context.Canceled, statusClientClosedRequest},
+}
+
+// ErrorHandler is the error handler of the app. Handlers return errors as
+// they get them and it answers with the same {"code", "error"} body every
+// endpoint uses. Unexpected errors are logged and answered with a 500 that
+// does not reveal them.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	status, ok := errorStatus(err)
+	message := err.Error()
+	if !ok {
+		log.Printf("%s %s: %s", c.Method(), c.Path(), err.Error())
+		message = "Internal server error"
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"code":  status,
+		"error": message,
+	})
+}
+
+func errorStatus(err error) (int, bool) {
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code, true
+	}
+
+	// A CID the gateway does not know is not found for the user either,
+	// anything else the node answered with is a bad gateway
+	var apiErr *ipfs.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == fiber.StatusNotFound {
+			return fiber.StatusNotFound, true
+		}
+		return fiber.StatusBadGateway, true
+	}
+
+	for _, known := range errorStatuses {
+		if errors.Is(err, known.err) {
+			return known.status, true
+		}
+	}
+	return fiber.StatusInternalServerError, false
+}
+
+// ipfsError returns err for ErrorHandler, turning the connections to the
+// IPFS node that broke while a response was read into a 502. Other errors
+// are returned as they are, unexpected ones become an opaque 500.
+func ipfsError(err error) error {
+	if _, ok := errorStatus(err); ok {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fiber.NewError(fiber.StatusBadGateway, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package middlewares
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultFilesPerPage = 20
+	maxFilesPerPage     = 100
+)
+
+// ListFiles returns the files of the user, newest first. It accepts page and
+// per_page for pagination, name (substring), mime_type ("image/png" or
+// "image/*") and from/to (RFC 3339) as filters.
+func (f *IpfsMiddleware) ListFiles(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	page, err := queryInt(c, "page", 1)
+	if err != nil || page < 1 {
+		return badRequest(c, "page must be a positive number")
+	}
+	perPage, err := queryInt(c, "per_page", defaultFilesPerPage)
+	if err != nil || perPage < 1 || perPage > maxFilesPerPage {
+		return badRequest(c, "per_page must be between 1 and "+strconv.Itoa(maxFilesPerPage))
+	}
+
+	query := services.FileQuery{
+		Name:     c.Query("name"),
+		MimeType: strings.TrimSpace(c.Query("mime_type")),
+		Offset:   (page - 1) * perPage,
+		Limit:    perPage,
+	}
+	if query.From, err = queryTime(c, "from"); err != nil {
+		return badRequest(c, "from must be an RFC 3339 timestamp")
+	}
+	if query.To, err = queryTime(c, "to"); err != nil {
+		return badRequest(c, "to must be an RFC 3339 timestamp")
+	}
+
+	files, total, err := f.FileService.ListFiles(email, query)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"files":    files,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+func (f *IpfsMiddleware) GetFile(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	file, err := f.FileService.GetFile(email, c.Params("id"))
+	if err == services.ErrFileNotFound {
+		return fileNotFound(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(file)
+}
+
+type updateFileRequest struct {
+	Tags []string `json:"tags"  bson:"tags"  form:"tags"  binding:"tags"`
+}
+
+// UpdateFile replaces the tags of a file.
+func (f *IpfsMiddleware) UpdateFile(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	var request updateFileRequest
+	if err := c.BodyParser(&request); err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	file, err := f.FileService.GetFile(email, c.Params("id"))
+	if err == services.ErrFileNotFound {
+		return fileNotFound(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := f.FileService.UpdateTags(file, request.Tags); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(file)
+}
+
+// DeleteFile takes the file out of its folder, unpins its CID and those of
+// its earlier versions, locally and on the remote pinning service, and
+// removes its record and its history. The record is kept when a node or the
+// service cannot be reached so the delete can be retried.
+func (f *IpfsMiddleware) DeleteFile(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	file, err := f.FileService.GetFile(email, c.Params("id"))
+	if err == services.ErrFileNotFound {
+		return fileNotFound(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The pinned folders of the user would keep the file otherwise
+	if file.Folder != "" {
+		if err := f.Folders.PutFile(c.Context(), email, file, ""); err != nil {
+			return ipfsError(err)
+		}
+	}
+
+	if err := f.unpinUnused(c, file.Cid); err != nil {
+		return err
+	}
+
+	// The nodes pin the directory of a wrapped upload, which goes once its
+	// last file does
+	if file.Directory != "" {
+		count, err := f.FileService.CountDirectoryFiles(file.Directory)
+		if err != nil {
+			return err
+		}
+		if count <= 1 {
+			if err := f.unpinUnused(c, file.Directory); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := f.Versions.Remove(c.Context(), file); err != nil {
+		return ipfsError(err)
+	}
+
+	if f.RemotePins != nil {
+		if err := f.RemotePins.Remove(c.Context(), file); err != nil {
+			return ipfsError(err)
+		}
+	}
+
+	if err := f.FileService.DeleteFile(email, file.ID); err != nil && err != services.ErrFileNotFound {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// unpinUnused unpins cid from the nodes, unless a tenant of the Pinning
+// Service API asked for it to be pinned.
+func (f *IpfsMiddleware) unpinUnused(c *fiber.Ctx, cid string) error {
+	if f.PinRequests != nil {
+		requested, err := f.PinRequests.Requested(c.Context(), cid)
+		if err != nil || requested {
+			return err
+		}
+	}
+
+	if _, err := f.IpfsPool.Unpin(c.Context(), cid); err != nil && !ipfs.IsNotPinned(err) {
+		return ipfsError(err)
+	}
+	return nil
+}
+
+func queryInt(c *fiber.Ctx, key string, defaultValue int64) (int64, error) {
+	value := c.Query(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func queryTime(c *fiber.Ctx, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func badRequest(c *fiber.Ctx, message string) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"code":  fiber.StatusBadRequest,
+		"error": message,
+	})
+}
+
+func fileNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"code":  fiber.StatusNotFound,
+		"error": "File not found",
+	})
+}
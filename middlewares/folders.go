@@ -0,0 +1,95 @@
+package middlewares
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+type folderRequest struct {
+	Path string `json:"path"  form:"path"`
+}
+
+type moveFolderRequest struct {
+	From string `json:"from"  form:"from"`
+	To   string `json:"to"  form:"to"`
+}
+
+// ListFolder returns the folders and files in the folder at the path query
+// parameter, the top folder by default, and the CID of the folders of the
+// user as root.
+func (f *IpfsMiddleware) ListFolder(c *fiber.Ctx) error {
+	listing, err := f.Folders.List(c.Context(), GetPrincipal(c).Subject, c.Query("path"))
+	if err != nil {
+		return ipfsError(err)
+	}
+	return c.Status(fiber.StatusOK).JSON(listing)
+}
+
+// CreateFolder creates the folder at path, and the folders above it that
+// are missing.
+func (f *IpfsMiddleware) CreateFolder(c *fiber.Ctx) error {
+	var request folderRequest
+	if err := c.BodyParser(&request); err != nil {
+		return badRequest(c, err.Error())
+	}
+	if request.Path == "" {
+		return badRequest(c, "path is required")
+	}
+
+	folder, err := f.Folders.Create(c.Context(), GetPrincipal(c).Subject, request.Path)
+	if err != nil {
+		return ipfsError(err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(folder)
+}
+
+// MoveFolder moves or renames the folder at from to to.
+func (f *IpfsMiddleware) MoveFolder(c *fiber.Ctx) error {
+	var request moveFolderRequest
+	if err := c.BodyParser(&request); err != nil {
+		return badRequest(c, err.Error())
+	}
+	if request.From == "" || request.To == "" {
+		return badRequest(c, "from and to are required")
+	}
+
+	if err := f.Folders.Move(c.Context(), GetPrincipal(c).Subject, request.From, request.To); err != nil {
+		return ipfsError(err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DeleteFolder removes the folder at the path query parameter. A folder
+// that is not empty is only removed with recursive=true, and the files in it
+// are taken out of it, not deleted.
+func (f *IpfsMiddleware) DeleteFolder(c *fiber.Ctx) error {
+	if c.Query("path") == "" {
+		return badRequest(c, "path is required")
+	}
+
+	err := f.Folders.Remove(c.Context(), GetPrincipal(c).Subject, c.Query("path"), c.Query("recursive") == "true")
+	if err != nil {
+		return ipfsError(err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// PutFileInFolder moves a file to the folder at path, an empty path taking
+// it out of its folder.
+func (f *IpfsMiddleware) PutFileInFolder(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	var request folderRequest
+	if err := c.BodyParser(&request); err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	file, err := f.FileService.GetFile(email, c.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	if err := f.Folders.PutFile(c.Context(), email, file, request.Path); err != nil {
+		return ipfsError(err)
+	}
+	return c.Status(fiber.StatusOK).JSON(file)
+}
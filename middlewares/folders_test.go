@@ -0,0 +1,78 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/faizainur/ipfs-api/services"
+)
+
+// putInFolder puts the file id in the folder at path.
+func (s *testServer) putInFolder(t *testing.T, id string, path string) {
+	t.Helper()
+	s.doJSON(t, jsonRequest(http.MethodPut, "/v1/user/files/"+id+"/folder", folderRequest{Path: path}), http.StatusOK, nil)
+}
+
+// listFolder returns the listing of the folder at path.
+func (s *testServer) listFolder(t *testing.T, path string) services.FolderListing {
+	t.Helper()
+	var listing services.FolderListing
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/folders?path="+path, nil), http.StatusOK, &listing)
+	return listing
+}
+
+func TestFolders(t *testing.T) {
+	s := newTestServer(t)
+	file := s.upload(t, testFile{"report.pdf", []byte("report")})[0]
+
+	var folder services.Folder
+	s.doJSON(t, jsonRequest(http.MethodPost, "/v1/user/folders", folderRequest{Path: "/docs/2021"}), http.StatusCreated, &folder)
+	if folder.Path != "/docs/2021" || folder.Name != "2021" {
+		t.Fatalf("folder = %+v", folder)
+	}
+	// Creating a folder that exists leaves it as it is
+	s.doJSON(t, jsonRequest(http.MethodPost, "/v1/user/folders", folderRequest{Path: "/docs/2021"}), http.StatusCreated, nil)
+
+	s.putInFolder(t, file.ID, "/docs")
+	listing := s.listFolder(t, "/docs")
+	if len(listing.Folders) != 1 || listing.Folders[0].Name != "2021" {
+		t.Fatalf("folders = %+v", listing.Folders)
+	}
+	if len(listing.Files) != 1 || listing.Files[0].ID.Hex() != file.ID || listing.Files[0].Cid != file.Hash {
+		t.Fatalf("files = %+v", listing.Files)
+	}
+	if listing.Root == "" {
+		t.Fatal("listing has no root")
+	}
+
+	s.doJSON(t, jsonRequest(http.MethodPost, "/v1/user/folders/move", moveFolderRequest{From: "/docs", To: "/archive"}), http.StatusNoContent, nil)
+	var record services.UserFile
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+file.ID, nil), http.StatusOK, &record)
+	if record.Folder != "/archive" {
+		t.Fatalf("folder of the file after the move = %q", record.Folder)
+	}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/folders?path=/docs", nil), http.StatusNotFound, nil)
+	if listing := s.listFolder(t, "/archive/2021"); len(listing.Files) != 0 {
+		t.Fatalf("files of /archive/2021 = %+v", listing.Files)
+	}
+
+	// Folders of other users are their own
+	req := httptest.NewRequest(http.MethodGet, "/v1/user/folders?path=/archive", nil)
+	req.Header.Set(testUserHeader, "bob@example.com")
+	if resp, _ := s.do(t, req); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("folder of another user: status %d", resp.StatusCode)
+	}
+
+	s.doJSON(t, httptest.NewRequest(http.MethodDelete, "/v1/user/folders?path=/archive", nil), http.StatusConflict, nil)
+	s.doJSON(t, httptest.NewRequest(http.MethodDelete, "/v1/user/folders?path=/archive&recursive=true", nil), http.StatusNoContent, nil)
+	record = services.UserFile{}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+file.ID, nil), http.StatusOK, &record)
+	if record.Folder != "" {
+		t.Fatalf("folder of the file after the removal = %q", record.Folder)
+	}
+	// The files of a removed folder are kept
+	if got := s.fetch(t, file.Hash); string(got) != "report" {
+		t.Fatalf("fetched %q", got)
+	}
+}
@@ -0,0 +1,122 @@
+package middlewares
+
+import (
+	"strings"
+	"time"
+
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GrantMiddleware lets users manage which OAuth2 clients may read which of
+// their files, and enforces those grants on the bank routes.
+type GrantMiddleware struct {
+	GrantService *services.GrantService
+	FileService  *services.FileService
+}
+
+type createGrantRequest struct {
+	ClientID  string    `json:"client_id"  bson:"client_id"  form:"client_id"  binding:"client_id"`
+	FileIDs   []string  `json:"file_ids"  bson:"file_ids"  form:"file_ids"  binding:"file_ids"`
+	Tags      []string  `json:"tags"  bson:"tags"  form:"tags"  binding:"tags"`
+	Scopes    []string  `json:"scopes"  bson:"scopes"  form:"scopes"  binding:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"  bson:"expires_at"  form:"expires_at"  binding:"expires_at"`
+}
+
+func (g *GrantMiddleware) CreateGrant(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	var request createGrantRequest
+	if err := c.BodyParser(&request); err != nil {
+		return badRequest(c, err.Error())
+	}
+
+	grant := services.AccessGrant{
+		Email:     email,
+		ClientID:  strings.TrimSpace(request.ClientID),
+		Tags:      services.NormalizeTags(request.Tags),
+		Scopes:    request.Scopes,
+		ExpiresAt: request.ExpiresAt.UTC(),
+	}
+
+	// Only files the user owns can be granted
+	for _, id := range request.FileIDs {
+		file, err := g.FileService.GetFile(email, id)
+		if err == services.ErrFileNotFound {
+			return badRequest(c, "unknown file ID "+id)
+		}
+		if err != nil {
+			return err
+		}
+		grant.FileIDs = append(grant.FileIDs, file.ID)
+	}
+
+	if err := g.GrantService.CreateGrant(&grant); err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(grant)
+}
+
+func (g *GrantMiddleware) ListGrants(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	grants, err := g.GrantService.ListGrants(email)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"grants": grants,
+	})
+}
+
+func (g *GrantMiddleware) RevokeGrant(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	err := g.GrantService.RevokeGrant(email, c.Params("id"))
+	if err == services.ErrGrantNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"code":  fiber.StatusNotFound,
+			"error": "Grant not found",
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RequireGrant only lets the request through when the introspected client
+// holds an active grant with scope on the file in the cid query parameter.
+// It must run after AuthMiddleware.Authenticate(services.PrincipalClient).
+func (g *GrantMiddleware) RequireGrant(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := GetPrincipal(c)
+
+		file, err := g.FileService.FindFile(principal.Subject, c.Query("cid"))
+		if err == services.ErrFileNotFound {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"code":  fiber.StatusForbidden,
+				"error": services.ErrAccessDenied.Error(),
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		err = g.GrantService.Authorize(principal.Subject, principal.ClientID, principal.Scopes, file, scope)
+		if err == services.ErrAccessDenied {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"code":  fiber.StatusForbidden,
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.Next()
+	}
+}
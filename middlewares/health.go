@@ -0,0 +1,81 @@
+package middlewares
+
+import (
+	"bytes"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/resilience"
+	"github.com/gofiber/fiber/v2"
+)
+
+// HealthMiddleware reports the state of the upstreams the app depends on.
+type HealthMiddleware struct {
+	Registry *resilience.Registry
+	IpfsPool *ipfs.IPFSPool
+}
+
+// Live answers as long as the process serves requests, along with the state
+// of every upstream and IPFS node.
+func (h *HealthMiddleware) Live(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":     "ok",
+		"upstreams":  h.Registry.Statuses(),
+		"ipfs_nodes": h.IpfsPool.Health(),
+	})
+}
+
+// Ready answers 503 while the circuit breaker of an upstream is open, so a
+// load balancer can route around an instance that cannot do its work. The
+// IPFS nodes each have their own upstreams, and the pool works as long as
+// one of its nodes does, so only a pool without a healthy node makes the
+// instance unavailable.
+func (h *HealthMiddleware) Ready(c *fiber.Ctx) error {
+	statuses := h.Registry.Statuses()
+	nodes := h.IpfsPool.Health()
+
+	ipfsUpstreams := make(map[string]bool)
+	for _, name := range h.IpfsPool.Upstreams() {
+		ipfsUpstreams[name] = true
+	}
+	healthyNodes := 0
+	for _, node := range nodes {
+		if node.Healthy {
+			healthyNodes++
+		}
+	}
+
+	unavailable := make([]string, 0)
+	for _, status := range statuses {
+		if status.State == resilience.StateOpen.String() && !ipfsUpstreams[status.Name] {
+			unavailable = append(unavailable, status.Name)
+		}
+	}
+	if healthyNodes == 0 {
+		unavailable = append(unavailable, "ipfs")
+	}
+
+	if len(unavailable) > 0 {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status":      "unavailable",
+			"unavailable": unavailable,
+			"upstreams":   statuses,
+			"ipfs_nodes":  nodes,
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":     "ready",
+		"upstreams":  statuses,
+		"ipfs_nodes": nodes,
+	})
+}
+
+// Metrics exposes the upstream counters in the Prometheus text format.
+func (h *HealthMiddleware) Metrics(c *fiber.Ctx) error {
+	var buf bytes.Buffer
+	if err := h.Registry.WriteMetrics(&buf); err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4")
+	return c.Status(fiber.StatusOK).Send(buf.Bytes())
+}
@@ -1,59 +1,568 @@
 package middlewares
 
 import (
+	"bufio"
 	"bytes"
-	"fmt"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"strings"
 
 	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
 	"github.com/faizainur/ipfs-api/services"
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
 )
 
 type IpfsMiddleware struct {
-	IpfsClient    *ipfs.IPFSClient
+	IpfsPool      *ipfs.IPFSPool
 	CryptoService *services.CryptoService
+	FileService   *services.FileService
+	// RemotePins also pins uploads on a remote pinning service when set
+	RemotePins *services.RemotePinService
+	// Uploads stages the resumable uploads of the tus endpoints
+	Uploads *services.UploadService
+	// Folders organises the files of users in folders
+	Folders *services.FolderService
+	// Names gives users an IPNS name pointing to their folders
+	Names *services.NameService
+	// Versions keeps the history of files
+	Versions *services.FileVersionService
+	// PinRequests, when set, keeps the CIDs tenants of the Pinning Service
+	// API asked for pinned when files are deleted
+	PinRequests *services.PinRequestService
 }
 
+// uploadResult is the outcome of one file of an upload. Files that could not
+// be stored only have a name, and the code and error they failed with.
+type uploadResult struct {
+	ID       string   `json:"id,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Hash     string   `json:"hash,omitempty"`
+	Size     int64    `json:"size,omitempty"`
+	MimeType string   `json:"mime_type,omitempty"`
+	Replicas []string `json:"replicas,omitempty"`
+	Code     int      `json:"code,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// pendingUpload is a file of an upload being encrypted on its way to IPFS.
+type pendingUpload struct {
+	// index is the position of the file in the results of the upload
+	index      int
+	name       string
+	mimeType   string
+	fileKey    services.FileKey
+	plaintext  *countingReader
+	ciphertext *countingReader
+}
+
+// UploadFile encrypts every part named "file" with its own key and adds it
+// to IPFS as its own object, or wraps them all in a directory when
+// wrap-with-directory is true. It answers with the result of each file: 200
+// when they were all stored, 207 when only some were.
 func (f *IpfsMiddleware) UploadFile(c *fiber.Ctx) error {
-	email := c.Locals("email").(string)
-	form, err := c.MultipartForm()
+	boundary := string(c.Context().Request.Header.MultipartFormBoundary())
+	if boundary == "" {
+		return fiber.NewError(fiber.StatusBadRequest, fasthttp.ErrNoMultipartForm.Error())
+	}
+
+	files := &multipartFileReader{reader: multipart.NewReader(requestBody(c), boundary), field: "file"}
+	if err := files.nextPart(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	// Options come as form values sent before the first file, or in the
+	// query string. Tags are comma separated and apply to every file.
+	tags := formOrQuery(c, files, "tags")
+	wrap := formOrQuery(c, files, "wrap-with-directory") == "true"
+
+	var results []uploadResult
+	response := fiber.Map{}
+	if wrap {
+		var directory *uploadResult
+		results, directory = f.uploadDirectory(c, files, tags)
+		if directory != nil {
+			response["directory"] = directory
+		}
+	} else {
+		results = f.uploadFiles(c, files, tags)
+	}
+	response["files"] = results
+
+	status := fiber.StatusOK
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			if failed == 0 {
+				status = result.Code
+			}
+			failed++
+		}
+	}
+	if failed > 0 && failed < len(results) {
+		status = fiber.StatusMultiStatus
+	}
+
+	return c.Status(status).JSON(response)
+}
+
+// uploadFiles adds the file parts one after the other, each in a request of
+// its own, so one that fails does not take the others with it.
+func (f *IpfsMiddleware) uploadFiles(c *fiber.Ctx, files *multipartFileReader, tags string) []uploadResult {
+	var results []uploadResult
+	for {
+		results = append(results, f.uploadPart(c, files, tags))
+
+		err := files.nextPart()
+		if err == errNoFilePart {
+			return results
+		}
+		if err != nil {
+			// Nothing past a malformed part can be read
+			return append(results, failedUpload(c, "", fiber.NewError(fiber.StatusBadRequest, err.Error())))
+		}
+	}
+}
+
+func (f *IpfsMiddleware) uploadPart(c *fiber.Ctx, files *multipartFileReader, tags string) uploadResult {
+	name := files.part.FileName()
+
+	record, replicas, err := f.storeFile(c, name, files, tags)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return failedUpload(c, name, err)
 	}
 
-	files := form.File["file"]
-	dataBuffer := new(bytes.Buffer)
-	filename := files[0].Filename
+	return uploadResult{
+		ID:       record.ID.Hex(),
+		Name:     name,
+		Hash:     record.Cid,
+		Size:     record.Size,
+		MimeType: record.MimeType,
+		Replicas: replicas,
+	}
+}
+
+// storeFile encrypts the content of r, adds it to IPFS and records it, and
+// returns the record and the nodes that stored it.
+func (f *IpfsMiddleware) storeFile(c *fiber.Ctx, name string, r io.Reader, tags string) (*services.UserFile, []string, error) {
+	upload, err := f.encryptPart(GetPrincipal(c).Subject, name, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := f.IpfsPool.UploadStream(c.Context(), name, upload.ciphertext)
+	if err != nil {
+		return nil, nil, ipfsError(err)
+	}
+
+	record, err := f.recordUpload(c, upload, resp.Hash, "", tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, resp.Replicas, nil
+}
 
-	for _, file := range files {
-		fh, err := file.Open()
+// uploadDirectory adds every file part in a single request that wraps them
+// in a directory, and returns the results of the files and the directory.
+// The directory cannot hold two files of the same name, so repeated names
+// are rejected. When the request fails, every file sent with it fails.
+func (f *IpfsMiddleware) uploadDirectory(c *fiber.Ctx, files *multipartFileReader, tags string) ([]uploadResult, *uploadResult) {
+	email := GetPrincipal(c).Subject
+
+	var results []uploadResult
+	var pending []*pendingUpload
+	seen := make(map[string]bool)
+	first := true
+
+	next := func() (string, io.Reader, error) {
+		for {
+			if !first {
+				err := files.nextPart()
+				if err == errNoFilePart {
+					return "", nil, io.EOF
+				}
+				if err != nil {
+					return "", nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+				}
+			}
+			first = false
+
+			name := files.part.FileName()
+			if seen[name] {
+				results = append(results, failedUpload(c, name, fiber.NewError(fiber.StatusBadRequest, "another file of the directory is named "+name)))
+				continue
+			}
+			seen[name] = true
+
+			upload, err := f.encryptPart(email, name, files)
+			if err != nil {
+				return "", nil, err
+			}
+			upload.index = len(results)
+			results = append(results, uploadResult{Name: name})
+			pending = append(pending, upload)
+			return name, upload.ciphertext, nil
+		}
+	}
+
+	entries, err := f.IpfsPool.UploadDirectory(c.Context(), next)
+	if err != nil {
+		for _, upload := range pending {
+			results[upload.index] = failedUpload(c, upload.name, ipfsError(err))
+		}
+		if len(pending) == 0 {
+			results = append(results, failedUpload(c, "", ipfsError(err)))
+		}
+		return results, nil
+	}
+
+	directory := entries[len(entries)-1]
+	hashes := make(map[string]string, len(entries))
+	for _, entry := range entries[:len(entries)-1] {
+		hashes[entry.Name] = entry.Hash
+	}
+
+	for _, upload := range pending {
+		record, err := f.recordUpload(c, upload, hashes[upload.name], directory.Hash, tags)
 		if err != nil {
-			panic(err)
+			results[upload.index] = failedUpload(c, upload.name, err)
+			continue
+		}
+		results[upload.index] = uploadResult{
+			ID:       record.ID.Hex(),
+			Name:     upload.name,
+			Hash:     record.Cid,
+			Size:     record.Size,
+			MimeType: record.MimeType,
+			Replicas: directory.Replicas,
 		}
-		dataBuffer.ReadFrom(fh)
 	}
 
-	encryptedFile, err := f.CryptoService.EncryptUserFile(email, dataBuffer.Bytes())
+	return results, &uploadResult{
+		Hash:     directory.Hash,
+		Replicas: directory.Replicas,
+	}
+}
+
+// encryptPart starts encrypting the content of r with a new data key,
+// wrapped with the key of email.
+func (f *IpfsMiddleware) encryptPart(email string, name string, r io.Reader) (*pendingUpload, error) {
+	// Sniff the content type from the first bytes without consuming them
+	sniffer := bufio.NewReaderSize(r, mimeSniffSize)
+	head, err := sniffer.Peek(mimeSniffSize)
+	if err != nil && err != io.EOF {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	plaintext := &countingReader{reader: sniffer}
+
+	// Every upload is sealed with its own data key, wrapped with the user key
+	dek, fileKey, err := f.CryptoService.NewFileKey(email)
 	if err != nil {
-		c.SendString(err.Error())
+		return nil, err
+	}
+
+	encryptedFile, err := f.CryptoService.EncryptFileStream(dek, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pendingUpload{
+		name:       name,
+		mimeType:   mimetype.Detect(head).String(),
+		fileKey:    fileKey,
+		plaintext:  plaintext,
+		ciphertext: &countingReader{reader: encryptedFile},
+	}, nil
+}
+
+// recordUpload stores the record of an upload added as cid, in directory if
+// it was wrapped in one, and submits it to the remote pinning service.
+func (f *IpfsMiddleware) recordUpload(c *fiber.Ctx, upload *pendingUpload, cid string, directory string, tags string) (*services.UserFile, error) {
+	principal := GetPrincipal(c)
+	record := &services.UserFile{
+		Email:          principal.Subject,
+		UserUid:        principal.UserUid(),
+		Cid:            cid,
+		Name:           upload.name,
+		MimeType:       upload.mimeType,
+		Size:           upload.plaintext.count,
+		CiphertextSize: upload.ciphertext.count,
+		Tags:           services.NormalizeTags(strings.Split(tags, ",")),
+		Directory:      directory,
+		FileKey:        upload.fileKey,
+	}
+	if f.RemotePins != nil {
+		record.RemotePin = services.NewRemotePinState()
 	}
+	if err := f.FileService.RecordUpload(record); err != nil {
+		return nil, err
+	}
+	if f.RemotePins != nil {
+		f.RemotePins.SubmitAsync(*record)
+	}
+	return record, nil
+}
 
-	resp, errUpload := f.IpfsClient.UploadFile(filename, encryptedFile)
-	if errUpload != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("%s: %s", "Error", errUpload.Error()))
+// failedUpload is the result of a file that failed with err. Unexpected
+// errors are logged and not revealed, as by ErrorHandler.
+func failedUpload(c *fiber.Ctx, name string, err error) uploadResult {
+	status, ok := errorStatus(err)
+	message := err.Error()
+	if !ok {
+		log.Printf("%s %s: %s: %s", c.Method(), c.Path(), name, err.Error())
+		message = "Internal server error"
 	}
+	return uploadResult{Name: name, Code: status, Error: message}
+}
 
-	return c.Status(fiber.StatusOK).JSON(resp)
+// formOrQuery returns the form value key sent before the current part of
+// files, or else the query parameter key.
+func formOrQuery(c *fiber.Ctx, files *multipartFileReader, key string) string {
+	if value := files.values[key]; value != "" {
+		return value
+	}
+	return c.Query(key)
 }
 
+// FetchFile sends the decrypted content of cid with the MIME type and name
+// it was uploaded with. The content is decrypted chunk by chunk as it is
+// fetched, and a single byte range only fetches the chunks that cover it.
+// The CID is the ETag, so clients revalidate with If-None-Match for free.
 func (f *IpfsMiddleware) FetchFile(c *fiber.Ctx) error {
-	email := c.Locals("email").(string)
+	email := GetPrincipal(c).Subject
 	cid := c.Query("cid")
+	if err := ipfs.ValidateCid(cid); err != nil {
+		return err
+	}
+
+	record, err := f.FileService.FindFile(email, cid)
+	if err != nil && err != services.ErrFileNotFound {
+		return err
+	}
 
-	data, err := f.IpfsClient.FetchFile(cid)
+	return f.sendFile(c, email, cid, record)
+}
+
+// sendFile sends the decrypted content of cid, described by record when
+// there is one, as FetchFile does.
+func (f *IpfsMiddleware) sendFile(c *fiber.Ctx, email string, cid string, record *services.UserFile) error {
+	etag := cidETag(cid)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	if record == nil || record.WrappedKey == "" || record.CiphertextSize == 0 {
+		return f.sendWholeFile(c, email, cid, record)
+	}
+
+	dek, err := f.CryptoService.UnwrapFileKey(email, record.FileKey)
+	if err != nil {
+		return err
+	}
+
+	headerSize := int64(services.MaxContainerHeaderSize)
+	if headerSize > record.CiphertextSize {
+		headerSize = record.CiphertextSize
+	}
+	rawHeader, err := f.IpfsPool.FetchFileRange(c.Context(), cid, 0, headerSize)
+	if err != nil {
+		return ipfsError(err)
+	}
+	header, err := services.ReadContainerHeader(bytes.NewReader(rawHeader))
+	if err != nil {
+		return err
+	}
+	container, err := f.CryptoService.OpenFileContainer(dek, header)
+	if err != nil {
+		return err
+	}
+
+	start, length, status, err := byteRange(c, etag, container.PlaintextSize(record.CiphertextSize))
+	if err != nil {
+		return err
+	}
+	setContentHeaders(c, record.Name, record.MimeType)
+	if length == 0 {
+		return c.Status(status).Send(nil)
+	}
+
+	cipherOffset, cipherLength := container.CiphertextRange(start, length)
+	if cipherOffset+cipherLength > record.CiphertextSize {
+		cipherLength = record.CiphertextSize - cipherOffset
+	}
+
+	// The body is read once the handler returned, when the request context
+	// is no longer usable. fasthttp closes the body once it is sent or the
+	// client went away, which stops the fetches still running.
+	ctx, cancel := context.WithCancel(context.Background())
+	ciphertext := f.IpfsPool.NewRangeReader(ctx, cid, cipherOffset, cipherLength)
+	c.Status(status)
+	plaintext := container.DecryptRange(ciphertext, record.CiphertextSize, start, length)
+	c.Context().SetBodyStream(streamBody{Reader: plaintext, cancel: cancel}, int(length))
+	return nil
+}
+
+// sendWholeFile fetches and decrypts the whole of cid, for files recorded
+// without their ciphertext size and files sealed with the user key itself,
+// which predate per-file keys and may have no record at all.
+func (f *IpfsMiddleware) sendWholeFile(c *fiber.Ctx, email string, cid string, record *services.UserFile) error {
+	data, err := f.IpfsPool.FetchFile(c.Context(), cid)
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	var decryptedFile []byte
+	if record == nil || record.WrappedKey == "" {
+		decryptedFile, err = f.CryptoService.DecryptUserFile(email, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		dek, err := f.CryptoService.UnwrapFileKey(email, record.FileKey)
+		if err != nil {
+			return err
+		}
+		plaintext, err := f.CryptoService.DecryptFileStream(dek, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if decryptedFile, err = ioutil.ReadAll(plaintext); err != nil {
+			return err
+		}
+	}
+
+	name, mimeType := cid, ""
+	if record != nil {
+		name, mimeType = record.Name, record.MimeType
+	}
+	if mimeType == "" {
+		mimeType = mimetype.Detect(decryptedFile).String()
+	}
+
+	start, length, status, err := byteRange(c, cidETag(cid), int64(len(decryptedFile)))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return err
+	}
+	setContentHeaders(c, name, mimeType)
+	return c.Status(status).Send(decryptedFile[start : start+length])
+}
+
+// requestBody returns the body of the request as a reader. The server
+// streams request bodies, so it is read straight from the connection instead
+// of being held in memory up front.
+func requestBody(c *fiber.Ctx) io.Reader {
+	if body := c.Context().RequestBodyStream(); body != nil {
+		return body
+	}
+	return bytes.NewReader(c.Body())
+}
+
+// CloseUnreadBody closes the connection of a request whose streamed body
+// the handlers did not read to the end, as when they reject it early.
+// fasthttp would read what is left of it as the next request otherwise.
+func CloseUnreadBody(c *fiber.Ctx) error {
+	err := c.Next()
+
+	body := c.Context().RequestBodyStream()
+	if body == nil || c.Context().Request.Header.ContentLength() == 0 {
+		return err
+	}
+	var probe [1]byte
+	if n, _ := body.Read(probe[:]); n > 0 {
+		c.Context().SetConnectionClose()
+	}
+	return err
+}
+
+// streamBody hides the type of a response body from fasthttp, which unwraps
+// an *io.LimitedReader to send the reader under it and so ignores the limit.
+// Closing it cancels the context the body is read with.
+type streamBody struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (b streamBody) Close() error {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return nil
+}
+
+// mimeSniffSize is how much of the start of a file mimetype looks at.
+const mimeSniffSize = 3072
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+var errNoFilePart = errors.New("no file found in the request")
+
+// maxFormValueSize bounds the plain form values read next to the files.
+const maxFormValueSize = 4096
+
+// multipartFileReader reads the parts named field one at a time without
+// buffering them: Read returns the content of the current part, and
+// nextPart moves on to the next one. Plain form values sent before a file
+// are collected in values.
+type multipartFileReader struct {
+	reader *multipart.Reader
+	field  string
+	part   *multipart.Part
+	values map[string]string
+	done   bool
+}
+
+func (m *multipartFileReader) nextPart() error {
+	// The multipart reader fails if asked for parts past the end
+	if m.done {
+		return errNoFilePart
+	}
+
+	m.part = nil
+	for {
+		part, err := m.reader.NextPart()
+		if err == io.EOF {
+			m.done = true
+			return errNoFilePart
+		}
+		if err != nil {
+			return err
+		}
+		if part.FormName() == m.field && part.FileName() != "" {
+			m.part = part
+			return nil
+		}
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+			if err != nil {
+				return err
+			}
+			if m.values == nil {
+				m.values = make(map[string]string)
+			}
+			m.values[part.FormName()] = string(value)
+		}
+	}
+}
+
+func (m *multipartFileReader) Read(p []byte) (int, error) {
+	if m.part == nil {
+		return 0, io.EOF
 	}
-	decryptedFile := f.CryptoService.DecryptUserFile(email, data)
-	return c.Status(fiber.StatusOK).Send(decryptedFile)
+	return m.part.Read(p)
 }
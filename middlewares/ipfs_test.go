@@ -0,0 +1,190 @@
+package middlewares
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestUploadAndFetch(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("hello world\n")
+
+	var response uploadResponse
+	req := multipartRequest(t, http.MethodPost, "/v1/user/upload", map[string]string{"tags": "Greeting, test"}, testFile{"hello.txt", data})
+	s.doJSON(t, req, http.StatusOK, &response)
+	if len(response.Files) != 1 {
+		t.Fatalf("got %d results", len(response.Files))
+	}
+	result := response.Files[0]
+	if result.ID == "" || result.Name != "hello.txt" || result.Size != int64(len(data)) {
+		t.Fatalf("result = %+v", result)
+	}
+
+	// The node only ever sees the encrypted file
+	stored, ok := s.node.Content(result.Hash)
+	if !ok || bytes.Contains(stored, data) {
+		t.Fatalf("node holds %q", stored)
+	}
+	if _, ok := s.node.IsPinned(result.Hash); !ok {
+		t.Fatal("upload is not pinned")
+	}
+
+	resp, body := s.do(t, httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid="+result.Hash, nil))
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("fetch: status %d, body %q", resp.StatusCode, body)
+	}
+	if !strings.HasPrefix(resp.Header.Get(fiber.HeaderContentType), "text/plain") {
+		t.Errorf("Content-Type = %q", resp.Header.Get(fiber.HeaderContentType))
+	}
+	if !strings.Contains(resp.Header.Get(fiber.HeaderContentDisposition), "hello.txt") {
+		t.Errorf("Content-Disposition = %q", resp.Header.Get(fiber.HeaderContentDisposition))
+	}
+	etag := resp.Header.Get(fiber.HeaderETag)
+	if etag != cidETag(result.Hash) {
+		t.Errorf("ETag = %q", etag)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid="+result.Hash, nil)
+	req.Header.Set(fiber.HeaderIfNoneMatch, etag)
+	if resp, _ := s.do(t, req); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation: status %d", resp.StatusCode)
+	}
+
+	var file services.UserFile
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+result.ID, nil), http.StatusOK, &file)
+	if file.Cid != result.Hash || strings.Join(file.Tags, ",") != "greeting,test" {
+		t.Fatalf("file = %+v", file)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/user/files/"+result.ID, nil)
+	req.Header.Set(testUserHeader, "bob@example.com")
+	if resp, _ := s.do(t, req); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("file of another user: status %d", resp.StatusCode)
+	}
+
+	s.doJSON(t, httptest.NewRequest(http.MethodDelete, "/v1/user/files/"+result.ID, nil), http.StatusNoContent, nil)
+	if _, ok := s.node.IsPinned(result.Hash); ok {
+		t.Fatal("deleted file is still pinned")
+	}
+}
+
+func TestUploadSeveralFiles(t *testing.T) {
+	s := newTestServer(t)
+
+	// The second add fails, the other files are stored all the same
+	s.node.InjectFailure("add", ipfstest.Failure{Status: http.StatusInternalServerError, Times: 1})
+	var response uploadResponse
+	req := multipartRequest(t, http.MethodPost, "/v1/user/upload", nil, testFile{"a.txt", []byte("a")}, testFile{"b.txt", []byte("b")})
+	s.doJSON(t, req, http.StatusMultiStatus, &response)
+	if len(response.Files) != 2 {
+		t.Fatalf("got %d results", len(response.Files))
+	}
+	if response.Files[0].Error == "" || response.Files[0].Code != http.StatusBadGateway {
+		t.Errorf("failed file = %+v", response.Files[0])
+	}
+	if response.Files[1].Hash == "" || !bytes.Equal(s.fetch(t, response.Files[1].Hash), []byte("b")) {
+		t.Errorf("stored file = %+v", response.Files[1])
+	}
+
+	response = uploadResponse{}
+	req = multipartRequest(t, http.MethodPost, "/v1/user/upload", map[string]string{"wrap-with-directory": "true"}, testFile{"a.txt", []byte("a")}, testFile{"b.txt", []byte("b")})
+	s.doJSON(t, req, http.StatusOK, &response)
+	if response.Directory == nil || len(response.Files) != 2 {
+		t.Fatalf("wrapped upload = %+v", response)
+	}
+	if pinType, ok := s.node.IsPinned(response.Directory.Hash); !ok || pinType != ipfs.PinTypeRecursive {
+		t.Fatalf("directory is pinned %q, %v", pinType, ok)
+	}
+	for i, name := range []string{"a", "b"} {
+		if got := s.fetch(t, response.Files[i].Hash); string(got) != name {
+			t.Errorf("file %d is %q", i, got)
+		}
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	s := newTestServer(t)
+	cid := s.upload(t, testFile{"a.txt", []byte("a")})[0].Hash
+
+	resp, _ := s.do(t, httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid=not-a-cid", nil))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid CID: status %d", resp.StatusCode)
+	}
+
+	// The RPC API stands in for a gateway that cannot be reached
+	s.node.InjectFailure(ipfstest.GatewayEndpoint, ipfstest.Failure{Drop: true})
+	if got := s.fetch(t, cid); string(got) != "a" {
+		t.Errorf("fetch through cat = %q", got)
+	}
+	s.node.InjectFailure("cat", ipfstest.Failure{Drop: true})
+	resp, body := s.do(t, httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid="+cid, nil))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unreachable node: status %d: %s", resp.StatusCode, body)
+	}
+	s.node.ClearFailures()
+
+	s.node.RemoveBlock(cid)
+	resp, _ = s.do(t, httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid="+cid, nil))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("lost content: status %d", resp.StatusCode)
+	}
+}
+
+func TestFetchRange(t *testing.T) {
+	s := newTestServer(t)
+	// Several chunks of the encrypted container
+	data := randomData(300 * 1024)
+	cid := s.upload(t, testFile{"data.bin", data})[0].Hash
+
+	tests := []struct {
+		header       string
+		status       int
+		start, end   int
+		contentRange string
+	}{
+		{"bytes=1000-1999", http.StatusPartialContent, 1000, 2000, "bytes 1000-1999/307200"},
+		{"bytes=70000-", http.StatusPartialContent, 70000, len(data), "bytes 70000-307199/307200"},
+		{"bytes=-100", http.StatusPartialContent, len(data) - 100, len(data), "bytes 307100-307199/307200"},
+		{"bytes=307000-999999", http.StatusPartialContent, 307000, len(data), "bytes 307000-307199/307200"},
+		// A suffix longer than the file is the whole file
+		{"bytes=-999999", http.StatusOK, 0, len(data), ""},
+		// Malformed and multiple ranges are ignored
+		{"bytes=abc-def", http.StatusOK, 0, len(data), ""},
+		{"bytes=10-5", http.StatusOK, 0, len(data), ""},
+		{"items=0-10", http.StatusOK, 0, len(data), ""},
+		{"bytes=0-1,5-6", http.StatusOK, 0, len(data), ""},
+		{"bytes=307200-", http.StatusRequestedRangeNotSatisfiable, 0, 0, "bytes */307200"},
+	}
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid="+cid, nil)
+			req.Header.Set(fiber.HeaderRange, test.header)
+			resp, body := s.do(t, req)
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, test.status, body)
+			}
+			if got := resp.Header.Get(fiber.HeaderContentRange); got != test.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, test.contentRange)
+			}
+			if test.status != http.StatusRequestedRangeNotSatisfiable && !bytes.Equal(body, data[test.start:test.end]) {
+				t.Errorf("got %d bytes, want bytes %d to %d", len(body), test.start, test.end)
+			}
+		})
+	}
+
+	// If-Range naming another version sends the whole file
+	req := httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid="+cid, nil)
+	req.Header.Set(fiber.HeaderRange, "bytes=0-9")
+	req.Header.Set(fiber.HeaderIfRange, `"other"`)
+	if resp, body := s.do(t, req); resp.StatusCode != http.StatusOK || len(body) != len(data) {
+		t.Errorf("If-Range mismatch: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+}
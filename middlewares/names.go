@@ -0,0 +1,37 @@
+package middlewares
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetName returns the IPNS name of the user, which points to the latest
+// version of their folders. It is created the first time it is asked for.
+func (f *IpfsMiddleware) GetName(c *fiber.Ctx) error {
+	name, err := f.Names.Get(c.Context(), GetPrincipal(c).Subject)
+	if err != nil {
+		return ipfsError(err)
+	}
+	return c.Status(fiber.StatusOK).JSON(name)
+}
+
+// ResolveName lets the fetch routes take the name query parameter instead
+// of cid: the IPNS name of the user, followed by the path of a file in their
+// folders. The name is resolved to the CID the file has now, which is set
+// as the cid query parameter for the handlers that follow.
+func (f *IpfsMiddleware) ResolveName(c *fiber.Ctx) error {
+	name := c.Query("name")
+	if name == "" {
+		return c.Next()
+	}
+	if c.Query("cid") != "" {
+		return badRequest(c, "cid and name cannot be used together")
+	}
+
+	cid, err := f.Names.Resolve(c.Context(), GetPrincipal(c).Subject, name)
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	c.Request().URI().QueryArgs().Set("cid", cid)
+	return c.Next()
+}
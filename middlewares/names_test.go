@@ -0,0 +1,44 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/faizainur/ipfs-api/services"
+)
+
+func TestFolderName(t *testing.T) {
+	s := newTestServer(t)
+	file := s.upload(t, testFile{"index.html", []byte("<h1>hi</h1>")})[0]
+	s.doJSON(t, jsonRequest(http.MethodPost, "/v1/user/folders", folderRequest{Path: "/site"}), http.StatusCreated, nil)
+	s.putInFolder(t, file.ID, "/site")
+	root := s.listFolder(t, "/").Root
+
+	var name services.UserName
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/name", nil), http.StatusOK, &name)
+	if name.Name == "" {
+		t.Fatalf("name = %+v", name)
+	}
+
+	// The name of a user who has folders already is published in the
+	// background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		published, _ := s.node.Published(name.Name)
+		if published == "/ipfs/"+root {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the node publishes %q, want /ipfs/%s", published, root)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cid, err := s.ipfs.Names.Resolve(context.Background(), testUser, name.Name+"/site/"+file.ID)
+	if err != nil || cid != file.Hash {
+		t.Fatalf("Resolve = %q, %v, want %s", cid, err, file.Hash)
+	}
+}
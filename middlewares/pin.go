@@ -0,0 +1,102 @@
+package middlewares
+
+import (
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/gofiber/fiber/v2"
+)
+
+// requireOwner stops the request unless the authenticated user uploaded the
+// CID in the :cid route parameter.
+func (f *IpfsMiddleware) requireOwner(c *fiber.Ctx) (string, bool, error) {
+	email := GetPrincipal(c).Subject
+	cid := c.Params("cid")
+
+	isOwner, err := f.FileService.IsOwner(email, cid)
+	if err != nil {
+		return cid, false, err
+	}
+	if !isOwner {
+		return cid, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"code":  fiber.StatusNotFound,
+			"error": "No uploaded file found for this CID",
+		})
+	}
+	return cid, true, nil
+}
+
+func (f *IpfsMiddleware) PinFile(c *fiber.Ctx) error {
+	cid, ok, err := f.requireOwner(c)
+	if !ok {
+		return err
+	}
+
+	pins, err := f.IpfsPool.Pin(c.Context(), cid)
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"pins": pins,
+	})
+}
+
+func (f *IpfsMiddleware) UnpinFile(c *fiber.Ctx) error {
+	cid, ok, err := f.requireOwner(c)
+	if !ok {
+		return err
+	}
+
+	pins, err := f.IpfsPool.Unpin(c.Context(), cid)
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"pins": pins,
+	})
+}
+
+func (f *IpfsMiddleware) PinStatus(c *fiber.Ctx) error {
+	cid, ok, err := f.requireOwner(c)
+	if !ok {
+		return err
+	}
+
+	status, err := f.IpfsPool.PinStatus(c.Context(), cid)
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(status)
+}
+
+// ListPins returns the node's pins restricted to the CIDs the user uploaded.
+func (f *IpfsMiddleware) ListPins(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	owned, err := f.FileService.ListCids(email)
+	if err != nil {
+		return err
+	}
+
+	pins, err := f.IpfsPool.ListPins(c.Context(), c.Query("type"))
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	ownedSet := make(map[string]bool, len(owned))
+	for _, cid := range owned {
+		ownedSet[cid] = true
+	}
+
+	result := make([]ipfs.PinInfo, 0, len(owned))
+	for _, pin := range pins {
+		if ownedSet[pin.Cid] {
+			result = append(result, pin)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"pins": result,
+	})
+}
@@ -0,0 +1,80 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+)
+
+func TestPins(t *testing.T) {
+	s := newTestServer(t)
+	cid := s.upload(t, testFile{"a.txt", []byte("a")})[0].Hash
+	// Pins of CIDs the user did not upload are not listed
+	other := s.node.Add([]byte("not uploaded through the API"), 0)
+	if _, err := s.ipfs.IpfsPool.Pin(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+
+	var list struct {
+		Pins []ipfs.PinInfo `json:"pins"`
+	}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/pins", nil), http.StatusOK, &list)
+	if len(list.Pins) != 1 || list.Pins[0].Cid != cid {
+		t.Fatalf("pins = %+v", list.Pins)
+	}
+
+	var status ipfs.PinStatus
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/pins/"+cid, nil), http.StatusOK, &status)
+	if !status.Pinned || !status.Verified || status.Type != ipfs.PinTypeRecursive {
+		t.Fatalf("status = %+v", status)
+	}
+
+	s.doJSON(t, httptest.NewRequest(http.MethodDelete, "/v1/user/pins/"+cid, nil), http.StatusOK, nil)
+	if _, ok := s.node.IsPinned(cid); ok {
+		t.Fatal("unpinned CID is still pinned")
+	}
+	status = ipfs.PinStatus{}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/pins/"+cid, nil), http.StatusOK, &status)
+	if status.Pinned {
+		t.Fatalf("status after unpin = %+v", status)
+	}
+
+	s.doJSON(t, httptest.NewRequest(http.MethodPost, "/v1/user/pins/"+cid, nil), http.StatusOK, nil)
+	if _, ok := s.node.IsPinned(cid); !ok {
+		t.Fatal("pinned CID is not pinned")
+	}
+
+	// A lost block shows in the status of the pin
+	s.node.RemoveBlock(cid)
+	status = ipfs.PinStatus{}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/pins/"+cid, nil), http.StatusOK, &status)
+	if status.Verified || len(status.BadNodes) != 1 || status.BadNodes[0] != cid {
+		t.Fatalf("status of a lost block = %+v", status)
+	}
+}
+
+func TestPinsOfOtherUsers(t *testing.T) {
+	s := newTestServer(t)
+	cid := s.upload(t, testFile{"a.txt", []byte("a")})[0].Hash
+	other := s.node.Add([]byte("not uploaded through the API"), 0)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/v1/user/pins/"+cid, nil),
+		httptest.NewRequest(http.MethodDelete, "/v1/user/pins/"+cid, nil),
+		httptest.NewRequest(http.MethodPost, "/v1/user/pins/"+other, nil),
+	} {
+		req.Header.Set(testUserHeader, "bob@example.com")
+		if resp, body := s.do(t, req); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: status %d: %s", req.Method, req.URL, resp.StatusCode, body)
+		}
+	}
+	if _, ok := s.node.IsPinned(cid); !ok {
+		t.Fatal("another user unpinned the file")
+	}
+	if _, ok := s.node.IsPinned(other); ok {
+		t.Fatal("a CID nobody uploaded got pinned")
+	}
+}
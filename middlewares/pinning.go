@@ -0,0 +1,226 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+const (
+	defaultPinListLimit = 10
+	maxPinListLimit     = 1000
+	maxPinListCids      = 10
+)
+
+// PinningMiddleware serves the IPFS Pinning Service API, so other services
+// can use our nodes as their pinning backend. Each tenant only sees its own
+// pin requests.
+type PinningMiddleware struct {
+	PinRequestService *services.PinRequestService
+	// Delegates are the multiaddrs of our nodes, sent back with every pin
+	// status so clients can connect to them and speed up the transfer
+	Delegates []string
+}
+
+// Errors answers the errors of the pinning routes with the error body of the
+// Pinning Service API instead of the one of the rest of the app.
+func (p *PinningMiddleware) Errors(c *fiber.Ctx) error {
+	err := c.Next()
+	if err == nil {
+		return nil
+	}
+
+	status, ok := errorStatus(err)
+	details := err.Error()
+	if !ok {
+		log.Printf("%s %s: %s", c.Method(), c.Path(), err.Error())
+		details = "Internal server error"
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"error": fiber.Map{
+			"reason":  pinningReason(status),
+			"details": details,
+		},
+	})
+}
+
+// pinningReason returns the reason the Pinning Service API gives for status,
+// such as NOT_FOUND. Running out of quota is INSUFFICIENT_FUNDS.
+func pinningReason(status int) string {
+	if status == fiber.StatusConflict {
+		return "INSUFFICIENT_FUNDS"
+	}
+	return strings.ToUpper(strings.ReplaceAll(utils.StatusMessage(status), " ", "_"))
+}
+
+// pinningTenant is who owns the pin requests of the principal: its tenant,
+// or else the client or user itself.
+func pinningTenant(principal *services.Principal) string {
+	switch {
+	case principal.Tenant != "":
+		return principal.Tenant
+	case principal.ClientID != "":
+		return principal.ClientID
+	}
+	return principal.Subject
+}
+
+func (p *PinningMiddleware) ListPins(c *fiber.Ctx) error {
+	query, err := pinRequestQuery(c)
+	if err != nil {
+		return err
+	}
+
+	requests, total, err := p.PinRequestService.List(c.Context(), pinningTenant(GetPrincipal(c)), query)
+	if err != nil {
+		return err
+	}
+
+	results := make([]ipfs.RemotePinStatus, 0, len(requests))
+	for i := range requests {
+		results = append(results, p.pinStatus(&requests[i]))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"count":   total,
+		"results": results,
+	})
+}
+
+func (p *PinningMiddleware) AddPin(c *fiber.Ctx) error {
+	var pin ipfs.RemotePin
+	if err := json.Unmarshal(c.Body(), &pin); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	request, err := p.PinRequestService.Create(c.Context(), pinningTenant(GetPrincipal(c)), pin)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(p.pinStatus(request))
+}
+
+func (p *PinningMiddleware) GetPin(c *fiber.Ctx) error {
+	request, err := p.PinRequestService.Get(c.Context(), pinningTenant(GetPrincipal(c)), c.Params("requestid"))
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(p.pinStatus(request))
+}
+
+func (p *PinningMiddleware) ReplacePin(c *fiber.Ctx) error {
+	var pin ipfs.RemotePin
+	if err := json.Unmarshal(c.Body(), &pin); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	request, err := p.PinRequestService.Replace(c.Context(), pinningTenant(GetPrincipal(c)), c.Params("requestid"), pin)
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(p.pinStatus(request))
+}
+
+func (p *PinningMiddleware) RemovePin(c *fiber.Ctx) error {
+	if err := p.PinRequestService.Delete(c.Context(), pinningTenant(GetPrincipal(c)), c.Params("requestid")); err != nil {
+		return ipfsError(err)
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+func (p *PinningMiddleware) pinStatus(request *services.PinRequest) ipfs.RemotePinStatus {
+	delegates := p.Delegates
+	if delegates == nil {
+		delegates = []string{}
+	}
+
+	return ipfs.RemotePinStatus{
+		RequestID: request.ID.Hex(),
+		Status:    request.Status,
+		Created:   request.Created,
+		Pin: ipfs.RemotePin{
+			Cid:     request.Cid,
+			Name:    request.Name,
+			Origins: request.Origins,
+			Meta:    request.Meta,
+		},
+		Delegates: delegates,
+		Info:      request.Info,
+	}
+}
+
+// pinRequestQuery reads the filters of GET /pins. Only pinned requests are
+// listed unless status says otherwise.
+func pinRequestQuery(c *fiber.Ctx) (services.PinRequestQuery, error) {
+	query := services.PinRequestQuery{
+		Name:     c.Query("name"),
+		Match:    c.Query("match", services.MatchExact),
+		Statuses: []string{ipfs.RemotePinPinned},
+		Limit:    defaultPinListLimit,
+	}
+
+	if value := c.Query("cid"); value != "" {
+		query.Cids = strings.Split(value, ",")
+		if len(query.Cids) > maxPinListCids {
+			return query, errInvalidQuery("cid", "at most 10 CIDs")
+		}
+	}
+	if len(query.Name) > 255 {
+		return query, errInvalidQuery("name", "at most 255 characters")
+	}
+	switch query.Match {
+	case services.MatchExact, services.MatchIgnoreCase, services.MatchPartial, services.MatchPartialIgnoreCase:
+	default:
+		return query, errInvalidQuery("match", "exact, iexact, partial or ipartial")
+	}
+
+	if value := c.Query("status"); value != "" {
+		query.Statuses = strings.Split(value, ",")
+		for _, status := range query.Statuses {
+			switch status {
+			case ipfs.RemotePinQueued, ipfs.RemotePinPinning, ipfs.RemotePinPinned, ipfs.RemotePinFailed:
+			default:
+				return query, errInvalidQuery("status", "queued, pinning, pinned or failed")
+			}
+		}
+	}
+
+	var err error
+	if query.Before, err = queryTime(c, "before"); err != nil {
+		return query, errInvalidQuery("before", "an RFC 3339 time")
+	}
+	if query.After, err = queryTime(c, "after"); err != nil {
+		return query, errInvalidQuery("after", "an RFC 3339 time")
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 || limit > maxPinListLimit {
+			return query, errInvalidQuery("limit", "between 1 and 1000")
+		}
+		query.Limit = limit
+	}
+
+	if value := c.Query("meta"); value != "" {
+		if err := json.Unmarshal([]byte(value), &query.Meta); err != nil {
+			return query, errInvalidQuery("meta", "a JSON object of strings")
+		}
+	}
+
+	return query, nil
+}
+
+func errInvalidQuery(parameter string, expected string) error {
+	return fiber.NewError(fiber.StatusBadRequest, parameter+" must be "+expected)
+}
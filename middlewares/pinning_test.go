@@ -0,0 +1,193 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+)
+
+// pinningRequest builds a request to the Pinning Service API made as the
+// client of tenant.
+func pinningRequest(method string, target string, body interface{}, client string, tenant string) *http.Request {
+	var req *http.Request
+	if body != nil {
+		req = jsonRequest(method, "/v1/pinning"+target, body)
+	} else {
+		req = httptest.NewRequest(method, "/v1/pinning"+target, nil)
+	}
+	req.Header.Set(testClientHeader, client)
+	req.Header.Set(testTenantHeader, tenant)
+	return req
+}
+
+// addPin asks for cid to be pinned as the client of tenant.
+func (s *testServer) addPin(t *testing.T, cid string, client string, tenant string) ipfs.RemotePinStatus {
+	t.Helper()
+	var status ipfs.RemotePinStatus
+	s.doJSON(t, pinningRequest(http.MethodPost, "/pins", ipfs.RemotePin{Cid: cid}, client, tenant), http.StatusAccepted, &status)
+	return status
+}
+
+// waitForPin waits until the request id of tenant is no longer queued or
+// pinning, and returns its status.
+func (s *testServer) waitForPin(t *testing.T, id string, client string, tenant string) ipfs.RemotePinStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status ipfs.RemotePinStatus
+		s.doJSON(t, pinningRequest(http.MethodGet, "/pins/"+id, nil, client, tenant), http.StatusOK, &status)
+		if status.Status != ipfs.RemotePinQueued && status.Status != ipfs.RemotePinPinning {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request %s is still %s", id, status.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pinningError checks that req fails with status and reason.
+func (s *testServer) pinningError(t *testing.T, req *http.Request, status int, reason string) {
+	t.Helper()
+	var body struct {
+		Error struct {
+			Reason  string `json:"reason"`
+			Details string `json:"details"`
+		} `json:"error"`
+	}
+	s.doJSON(t, req, status, &body)
+	if body.Error.Reason != reason || body.Error.Details == "" {
+		t.Fatalf("%s %s: error %+v, want reason %s", req.Method, req.URL, body.Error, reason)
+	}
+}
+
+func TestPinningService(t *testing.T) {
+	s := newTestServer(t)
+	first := s.node.Add([]byte("first"), 1)
+	second := s.node.Add([]byte("second"), 1)
+
+	added := s.addPin(t, first, "app", "acme")
+	if added.Status != ipfs.RemotePinQueued || added.Pin.Cid != first || added.RequestID == "" {
+		t.Fatalf("added pin = %+v", added)
+	}
+	if status := s.waitForPin(t, added.RequestID, "app", "acme"); status.Status != ipfs.RemotePinPinned {
+		t.Fatalf("status = %+v", status)
+	}
+	if _, ok := s.node.IsPinned(first); !ok {
+		t.Fatal("the node did not pin the CID")
+	}
+
+	var list struct {
+		Count   int                    `json:"count"`
+		Results []ipfs.RemotePinStatus `json:"results"`
+	}
+	s.doJSON(t, pinningRequest(http.MethodGet, "/pins", nil, "app", "acme"), http.StatusOK, &list)
+	if list.Count != 1 || len(list.Results) != 1 || list.Results[0].RequestID != added.RequestID {
+		t.Fatalf("pins = %+v", list)
+	}
+
+	var replaced ipfs.RemotePinStatus
+	s.doJSON(t, pinningRequest(http.MethodPost, "/pins/"+added.RequestID, ipfs.RemotePin{Cid: second}, "app", "acme"), http.StatusAccepted, &replaced)
+	if replaced.RequestID == added.RequestID || replaced.Pin.Cid != second {
+		t.Fatalf("replacement = %+v", replaced)
+	}
+	s.waitForPin(t, replaced.RequestID, "app", "acme")
+	if _, ok := s.node.IsPinned(first); ok {
+		t.Error("the replaced CID is still pinned")
+	}
+	s.pinningError(t, pinningRequest(http.MethodGet, "/pins/"+added.RequestID, nil, "app", "acme"), http.StatusNotFound, "NOT_FOUND")
+
+	s.doJSON(t, pinningRequest(http.MethodDelete, "/pins/"+replaced.RequestID, nil, "app", "acme"), http.StatusAccepted, nil)
+	if _, ok := s.node.IsPinned(second); ok {
+		t.Error("the CID of a removed request is still pinned")
+	}
+
+	s.pinningError(t, pinningRequest(http.MethodPost, "/pins", ipfs.RemotePin{Cid: "not-a-cid"}, "app", "acme"), http.StatusBadRequest, "BAD_REQUEST")
+	s.pinningError(t, pinningRequest(http.MethodGet, "/pins?limit=0", nil, "app", "acme"), http.StatusBadRequest, "BAD_REQUEST")
+}
+
+func TestPinningKeepsUploadsPinned(t *testing.T) {
+	s := newTestServer(t)
+	cid := s.upload(t, testFile{"a.txt", []byte("a")})[0].Hash
+
+	added := s.addPin(t, cid, "app", "acme")
+	s.waitForPin(t, added.RequestID, "app", "acme")
+	s.doJSON(t, pinningRequest(http.MethodDelete, "/pins/"+added.RequestID, nil, "app", "acme"), http.StatusAccepted, nil)
+	if _, ok := s.node.IsPinned(cid); !ok {
+		t.Fatal("removing a pin request unpinned an upload")
+	}
+}
+
+func TestPinningQuota(t *testing.T) {
+	s := newTestServer(t)
+	s.ipfs.PinRequests.DefaultQuota = 2
+	s.ipfs.PinRequests.Quotas = map[string]int64{"big": 3}
+	cids := make([]string, 4)
+	for i := range cids {
+		cids[i] = s.node.Add(randomData(16), 1)
+	}
+
+	s.addPin(t, cids[0], "app", "acme")
+	s.addPin(t, cids[1], "app", "acme")
+	s.pinningError(t, pinningRequest(http.MethodPost, "/pins", ipfs.RemotePin{Cid: cids[2]}, "app", "acme"), http.StatusConflict, "INSUFFICIENT_FUNDS")
+
+	// Quotas are per tenant, and can be raised for some
+	for _, cid := range cids[:3] {
+		s.addPin(t, cid, "app", "big")
+	}
+	s.pinningError(t, pinningRequest(http.MethodPost, "/pins", ipfs.RemotePin{Cid: cids[3]}, "app", "big"), http.StatusConflict, "INSUFFICIENT_FUNDS")
+	s.addPin(t, cids[0], "app", "other")
+}
+
+func TestPinningQuotaOfFailedRequests(t *testing.T) {
+	s := newTestServer(t)
+	s.ipfs.PinRequests.DefaultQuota = 1
+	present := s.node.Add([]byte("present"), 1)
+	missing, _, _ := ipfstest.Import([]byte("not on the node"), 1)
+
+	// A request that fails gives its place in the quota back
+	failed := s.addPin(t, missing, "app", "acme")
+	if status := s.waitForPin(t, failed.RequestID, "app", "acme"); status.Status != ipfs.RemotePinFailed || status.Info["reason"] == "" {
+		t.Fatalf("status of a missing CID = %+v", status)
+	}
+	pinned := s.addPin(t, present, "app", "acme")
+	s.waitForPin(t, pinned.RequestID, "app", "acme")
+	s.pinningError(t, pinningRequest(http.MethodPost, "/pins", ipfs.RemotePin{Cid: present}, "app", "acme"), http.StatusConflict, "INSUFFICIENT_FUNDS")
+
+	// Replacing the failed request takes a place again
+	s.pinningError(t, pinningRequest(http.MethodPost, "/pins/"+failed.RequestID, ipfs.RemotePin{Cid: present}, "app", "acme"), http.StatusConflict, "INSUFFICIENT_FUNDS")
+	// Replacing an active one keeps its place
+	s.doJSON(t, pinningRequest(http.MethodPost, "/pins/"+pinned.RequestID, ipfs.RemotePin{Cid: missing}, "app", "acme"), http.StatusAccepted, nil)
+}
+
+func TestPinningTenants(t *testing.T) {
+	s := newTestServer(t)
+	cid := s.node.Add([]byte("shared"), 1)
+
+	// Clients of a tenant share its requests
+	byTenant := s.addPin(t, cid, "app", "acme")
+	s.doJSON(t, pinningRequest(http.MethodGet, "/pins/"+byTenant.RequestID, nil, "other-app", "acme"), http.StatusOK, nil)
+	// Without a tenant, the requests belong to the client
+	s.pinningError(t, pinningRequest(http.MethodGet, "/pins/"+byTenant.RequestID, nil, "app", ""), http.StatusNotFound, "NOT_FOUND")
+	byClient := s.addPin(t, cid, "app", "")
+	s.doJSON(t, pinningRequest(http.MethodGet, "/pins/"+byClient.RequestID, nil, "app", ""), http.StatusOK, nil)
+	s.pinningError(t, pinningRequest(http.MethodGet, "/pins/"+byClient.RequestID, nil, "other-app", ""), http.StatusNotFound, "NOT_FOUND")
+
+	// and without a client, to the user
+	bySubject := s.addPin(t, cid, "", "")
+	s.doJSON(t, pinningRequest(http.MethodGet, "/pins/"+bySubject.RequestID, nil, "", ""), http.StatusOK, nil)
+	req := pinningRequest(http.MethodGet, "/pins/"+bySubject.RequestID, nil, "", "")
+	req.Header.Set(testUserHeader, "bob@example.com")
+	s.pinningError(t, req, http.StatusNotFound, "NOT_FOUND")
+
+	// Others cannot remove the requests either
+	s.pinningError(t, pinningRequest(http.MethodDelete, "/pins/"+byTenant.RequestID, nil, "app", "other"), http.StatusNotFound, "NOT_FOUND")
+	s.waitForPin(t, byTenant.RequestID, "app", "acme")
+	if _, ok := s.node.IsPinned(cid); !ok {
+		t.Fatal("the CID is not pinned")
+	}
+}
@@ -0,0 +1,233 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/faizainur/ipfs-api/cutils"
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+// testUserHeader names the user a request of a test server is made as, and
+// testClientHeader and testTenantHeader the client and tenant of requests to
+// the Pinning Service API.
+const (
+	testUserHeader   = "X-Test-User"
+	testClientHeader = "X-Test-Client"
+	testTenantHeader = "X-Test-Tenant"
+)
+
+const testUser = "alice@example.com"
+
+// testServer serves the user routes of the API in memory, backed by a fake
+// IPFS node.
+type testServer struct {
+	app  *fiber.App
+	node *ipfstest.Node
+	ipfs *IpfsMiddleware
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	node := ipfstest.NewNode()
+	t.Cleanup(node.Close)
+	pool, err := ipfs.NewPool([]ipfs.PoolNode{{Name: "a", Client: ipfs.NewClient(node.APIURL(), node.GatewayURL())}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+	keyring, err := cutils.NewKeyring(map[int][]byte{cutils.LegacyKeyVersion: masterKey}, cutils.LegacyKeyVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto := services.NewCryptoService(keyring, services.NewMemoryKeyStore())
+
+	files := services.NewMemoryFileRepository()
+	roots := services.NewMemoryFolderRepository()
+	folders := services.NewFolderService(roots, files, pool)
+	folders.Names = services.NewNameService(services.NewMemoryNameRepository(), roots, pool)
+	pinRequests := services.NewPinRequestService(services.NewMemoryPinRequestRepository(), files, pool)
+	versions := services.NewFileVersionService(services.NewMemoryFileVersionRepository(), files, pool)
+	versions.PinRequests = pinRequests
+	uploads, err := services.NewUploadService(t.TempDir(), crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	middleware := &IpfsMiddleware{
+		IpfsPool:      pool,
+		CryptoService: crypto,
+		FileService:   services.NewFileService(files),
+		Uploads:       uploads,
+		Folders:       folders,
+		Names:         folders.Names,
+		Versions:      versions,
+		PinRequests:   pinRequests,
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Server().StreamRequestBody = true
+	app.Server().DisablePreParseMultipartForm = true
+	app.Use(CloseUnreadBody)
+
+	userAuth := func(c *fiber.Ctx) error {
+		c.Locals(principalLocal, &services.Principal{
+			Subject: c.Get(testUserHeader, testUser),
+			Kind:    services.PrincipalUser,
+		})
+		return c.Next()
+	}
+
+	user := app.Group("/v1/user")
+	user.Get("/fetch", userAuth, middleware.FetchFile)
+	user.Post("/upload", userAuth, middleware.UploadFile)
+	user.Options("/uploads", middleware.UploadOptions)
+	user.Post("/uploads", userAuth, TusResumable, middleware.CreateUpload)
+	user.Head("/uploads/:id", userAuth, TusResumable, middleware.UploadStatus)
+	user.Patch("/uploads/:id", userAuth, TusResumable, middleware.PatchUpload)
+	user.Delete("/uploads/:id", userAuth, TusResumable, middleware.TerminateUpload)
+	user.Get("/files/:id", userAuth, middleware.GetFile)
+	user.Delete("/files/:id", userAuth, middleware.DeleteFile)
+	user.Put("/files/:id/folder", userAuth, middleware.PutFileInFolder)
+	user.Get("/files/:id/versions", userAuth, middleware.ListVersions)
+	user.Post("/files/:id/versions", userAuth, middleware.AddVersion)
+	user.Get("/files/:id/versions/:version", userAuth, middleware.FetchVersion)
+	user.Post("/files/:id/versions/:version/restore", userAuth, middleware.RestoreVersion)
+	user.Get("/folders", userAuth, middleware.ListFolder)
+	user.Post("/folders", userAuth, middleware.CreateFolder)
+	user.Post("/folders/move", userAuth, middleware.MoveFolder)
+	user.Delete("/folders", userAuth, middleware.DeleteFolder)
+	user.Get("/name", userAuth, middleware.GetName)
+	user.Get("/pins", userAuth, middleware.ListPins)
+	user.Get("/pins/:cid", userAuth, middleware.PinStatus)
+	user.Post("/pins/:cid", userAuth, middleware.PinFile)
+	user.Delete("/pins/:cid", userAuth, middleware.UnpinFile)
+
+	clientAuth := func(c *fiber.Ctx) error {
+		c.Locals(principalLocal, &services.Principal{
+			Subject:  c.Get(testUserHeader, testUser),
+			Kind:     services.PrincipalClient,
+			ClientID: c.Get(testClientHeader),
+			Tenant:   c.Get(testTenantHeader),
+			Scopes:   []string{services.ScopePinning},
+		})
+		return c.Next()
+	}
+
+	pinningMiddleware := &PinningMiddleware{PinRequestService: pinRequests}
+	pinning := app.Group("/v1/pinning", pinningMiddleware.Errors, clientAuth, RequireScope(services.ScopePinning))
+	pinning.Get("/pins", pinningMiddleware.ListPins)
+	pinning.Post("/pins", pinningMiddleware.AddPin)
+	pinning.Get("/pins/:requestid", pinningMiddleware.GetPin)
+	pinning.Post("/pins/:requestid", pinningMiddleware.ReplacePin)
+	pinning.Delete("/pins/:requestid", pinningMiddleware.RemovePin)
+
+	return &testServer{app: app, node: node, ipfs: middleware}
+}
+
+// do sends req and returns the response with its body read.
+func (s *testServer) do(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// doJSON sends req, checks the status of the response and decodes its body
+// into value when it is not nil.
+func (s *testServer) doJSON(t *testing.T, req *http.Request, status int, value interface{}) {
+	t.Helper()
+	resp, body := s.do(t, req)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", req.Method, req.URL, resp.StatusCode, status, body)
+	}
+	if value != nil {
+		if err := json.Unmarshal(body, value); err != nil {
+			t.Fatalf("%s %s: %v: %s", req.Method, req.URL, err, body)
+		}
+	}
+}
+
+// testFile is a file part of a multipart upload.
+type testFile struct {
+	name string
+	data []byte
+}
+
+// multipartRequest builds a request sending values, then files as parts
+// named "file".
+func multipartRequest(t *testing.T, method string, target string, values map[string]string, files ...testFile) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range values {
+		writer.WriteField(key, value)
+	}
+	for _, file := range files {
+		part, err := writer.CreateFormFile("file", file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(file.data)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(method, target, &body)
+	req.Header.Set(fiber.HeaderContentType, writer.FormDataContentType())
+	return req
+}
+
+func jsonRequest(method string, target string, value interface{}) *http.Request {
+	body, _ := json.Marshal(value)
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return req
+}
+
+type uploadResponse struct {
+	Files     []uploadResult `json:"files"`
+	Directory *uploadResult  `json:"directory"`
+}
+
+// upload uploads files as the test user and returns their results.
+func (s *testServer) upload(t *testing.T, files ...testFile) []uploadResult {
+	t.Helper()
+	var response uploadResponse
+	s.doJSON(t, multipartRequest(t, http.MethodPost, "/v1/user/upload", nil, files...), http.StatusOK, &response)
+	return response.Files
+}
+
+// fetch returns the content of cid as the test user.
+func (s *testServer) fetch(t *testing.T, cid string) []byte {
+	t.Helper()
+	resp, body := s.do(t, httptest.NewRequest(http.MethodGet, "/v1/user/fetch?cid="+cid, nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fetching %s: status %d: %s", cid, resp.StatusCode, body)
+	}
+	return body
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
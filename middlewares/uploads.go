@@ -0,0 +1,204 @@
+package middlewares
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+// tusVersion is the version of the tus resumable upload protocol the upload
+// endpoints speak, https://tus.io/protocols/resumable-upload.html.
+const tusVersion = "1.0.0"
+
+const (
+	tusExtensions     = "creation,creation-with-upload,termination,expiration"
+	offsetContentType = "application/offset+octet-stream"
+
+	// Once an upload is stored, these tell the client what it became
+	headerUploadFileID = "X-Upload-File-Id"
+	headerUploadCid    = "X-Upload-Cid"
+)
+
+// TusResumable rejects the requests of clients speaking another version of
+// tus, and marks every response with the version of the server.
+func TusResumable(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return fiber.NewError(fiber.StatusPreconditionFailed, "Tus-Resumable must be "+tusVersion)
+	}
+	return c.Next()
+}
+
+// UploadOptions describes what the upload endpoints support.
+func (f *IpfsMiddleware) UploadOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	if f.Uploads.MaxSize > 0 {
+		c.Set("Tus-Max-Size", strconv.FormatInt(f.Uploads.MaxSize, 10))
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload of Upload-Length bytes. The name
+// of the file and its tags are read from the filename and tags keys of
+// Upload-Metadata, or name for clients that send that instead. The request
+// may carry the first chunk already.
+func (f *IpfsMiddleware) CreateUpload(c *fiber.Ctx) error {
+	if c.Get("Upload-Defer-Length") != "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Defer-Length is not supported")
+	}
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Length must be a positive number")
+	}
+	metadata, err := parseUploadMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return err
+	}
+
+	session, err := f.Uploads.Create(GetPrincipal(c).Subject, length, metadata)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderLocation, strings.TrimSuffix(c.Path(), "/")+"/"+session.ID)
+
+	if c.Get(fiber.HeaderContentType) == offsetContentType || length == 0 {
+		session, err = f.appendUpload(c, session.ID, 0)
+		if session != nil {
+			setUploadHeaders(c, session)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		setUploadHeaders(c, session)
+	}
+
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// UploadStatus tells the client how much of an upload the server has, so it
+// can resume from there.
+func (f *IpfsMiddleware) UploadStatus(c *fiber.Ctx) error {
+	session, err := f.Uploads.Get(GetPrincipal(c).Subject, c.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	setUploadHeaders(c, session)
+	c.Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	if len(session.Metadata) > 0 {
+		c.Set("Upload-Metadata", formatUploadMetadata(session.Metadata))
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// PatchUpload appends a chunk at Upload-Offset. The chunk that completes
+// the upload also stores it, and the response tells the ID and CID of the
+// file. When storing fails, sending an empty chunk at the end tries again.
+func (f *IpfsMiddleware) PatchUpload(c *fiber.Ctx) error {
+	if c.Get(fiber.HeaderContentType) != offsetContentType {
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "Content-Type must be "+offsetContentType)
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Offset must be a positive number")
+	}
+
+	session, err := f.appendUpload(c, c.Params("id"), offset)
+	if session != nil {
+		setUploadHeaders(c, session)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// TerminateUpload drops an upload and what was staged of it. Files already
+// stored from it are not affected.
+func (f *IpfsMiddleware) TerminateUpload(c *fiber.Ctx) error {
+	if err := f.Uploads.Terminate(GetPrincipal(c).Subject, c.Params("id")); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// appendUpload appends the body of the request to the upload id and stores
+// the upload through the same pipeline as UploadFile once it is complete.
+func (f *IpfsMiddleware) appendUpload(c *fiber.Ctx, id string, offset int64) (*services.UploadSession, error) {
+	return f.Uploads.Append(GetPrincipal(c).Subject, id, offset, requestBody(c), func(session *services.UploadSession, plaintext io.Reader) (string, string, error) {
+		name := session.Metadata["filename"]
+		if name == "" {
+			name = session.Metadata["name"]
+		}
+		if name == "" {
+			name = session.ID
+		}
+
+		record, _, err := f.storeFile(c, name, plaintext, session.Metadata["tags"])
+		if err != nil {
+			return "", "", err
+		}
+		return record.ID.Hex(), record.Cid, nil
+	})
+}
+
+func setUploadHeaders(c *fiber.Ctx, session *services.UploadSession) {
+	c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	if session.Completed() {
+		c.Set(headerUploadFileID, session.FileID)
+		c.Set(headerUploadCid, session.Cid)
+	}
+}
+
+// parseUploadMetadata decodes Upload-Metadata, comma separated pairs of a key
+// and a base64 value, which may be left out.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	if strings.TrimSpace(header) == "" {
+		return nil, nil
+	}
+
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Upload-Metadata must be pairs of a key and a base64 value")
+		}
+
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Upload-Metadata value of "+fields[0]+" is not base64")
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
+
+func formatUploadMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		if value == "" {
+			pairs = append(pairs, key)
+			continue
+		}
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,139 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tusRequest builds a tus request carrying chunk.
+func tusRequest(method string, target string, chunk []byte) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(chunk))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if chunk != nil {
+		req.Header.Set(fiber.HeaderContentType, offsetContentType)
+	}
+	return req
+}
+
+func TestTusUpload(t *testing.T) {
+	s := newTestServer(t)
+	data := randomData(100 * 1024)
+
+	resp, _ := s.do(t, httptest.NewRequest(http.MethodOptions, "/v1/user/uploads", nil))
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Tus-Version") != tusVersion || resp.Header.Get("Tus-Extension") != tusExtensions {
+		t.Fatalf("OPTIONS: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+
+	req := tusRequest(http.MethodPost, "/v1/user/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("data.bin"))+",tags "+base64.StdEncoding.EncodeToString([]byte("tus")))
+	resp, body := s.do(t, req)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", resp.StatusCode, body)
+	}
+	location := resp.Header.Get(fiber.HeaderLocation)
+	if location == "" || resp.Header.Get("Upload-Offset") != "0" {
+		t.Fatalf("create: headers %v", resp.Header)
+	}
+
+	half := len(data) / 2
+	req = tusRequest(http.MethodPatch, location, data[:half])
+	req.Header.Set("Upload-Offset", "0")
+	resp, body = s.do(t, req)
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk: status %d, offset %q: %s", resp.StatusCode, resp.Header.Get("Upload-Offset"), body)
+	}
+
+	// A client that lost track of the offset asks for it
+	resp, _ = s.do(t, tusRequest(http.MethodHead, location, nil))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Upload-Offset") != strconv.Itoa(half) || resp.Header.Get("Upload-Length") != strconv.Itoa(len(data)) {
+		t.Fatalf("HEAD: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+
+	req = tusRequest(http.MethodPatch, location, data[half:])
+	req.Header.Set("Upload-Offset", "0")
+	if resp, _ := s.do(t, req); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("chunk at the wrong offset: status %d", resp.StatusCode)
+	}
+
+	req = tusRequest(http.MethodPatch, location, data[half:])
+	req.Header.Set("Upload-Offset", strconv.Itoa(half))
+	resp, body = s.do(t, req)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("last chunk: status %d: %s", resp.StatusCode, body)
+	}
+	fileID, cid := resp.Header.Get(headerUploadFileID), resp.Header.Get(headerUploadCid)
+	if fileID == "" || cid == "" {
+		t.Fatalf("last chunk: headers %v", resp.Header)
+	}
+
+	if got := s.fetch(t, cid); !bytes.Equal(got, data) {
+		t.Fatalf("fetched %d bytes, want the %d uploaded", len(got), len(data))
+	}
+	var file struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+fileID, nil), http.StatusOK, &file)
+	if file.Name != "data.bin" || len(file.Tags) != 1 || file.Tags[0] != "tus" {
+		t.Fatalf("file = %+v", file)
+	}
+}
+
+func TestTusCreateWithUpload(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("all at once")
+
+	req := tusRequest(http.MethodPost, "/v1/user/uploads", data)
+	req.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+	resp, body := s.do(t, req)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Upload-Offset") != strconv.Itoa(len(data)) {
+		t.Fatalf("create: status %d, headers %v: %s", resp.StatusCode, resp.Header, body)
+	}
+	if got := s.fetch(t, resp.Header.Get(headerUploadCid)); !bytes.Equal(got, data) {
+		t.Fatalf("fetched %q", got)
+	}
+}
+
+func TestTusErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/user/uploads", nil)
+	req.Header.Set("Upload-Length", "10")
+	resp, _ := s.do(t, req)
+	if resp.StatusCode != http.StatusPreconditionFailed || resp.Header.Get("Tus-Version") != tusVersion {
+		t.Errorf("without Tus-Resumable: status %d", resp.StatusCode)
+	}
+
+	req = tusRequest(http.MethodPost, "/v1/user/uploads", nil)
+	req.Header.Set("Upload-Length", "10")
+	resp, _ = s.do(t, req)
+	location := resp.Header.Get(fiber.HeaderLocation)
+
+	req = tusRequest(http.MethodPatch, location, []byte("0123456789"))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	req.Header.Set("Upload-Offset", "0")
+	if resp, _ := s.do(t, req); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("chunk of the wrong type: status %d", resp.StatusCode)
+	}
+
+	// Uploads belong to the user who created them
+	req = tusRequest(http.MethodHead, location, nil)
+	req.Header.Set(testUserHeader, "bob@example.com")
+	if resp, _ := s.do(t, req); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("upload of another user: status %d", resp.StatusCode)
+	}
+
+	if resp, _ := s.do(t, tusRequest(http.MethodDelete, location, nil)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("terminate: status %d", resp.StatusCode)
+	}
+	if resp, _ := s.do(t, tusRequest(http.MethodHead, location, nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("terminated upload: status %d", resp.StatusCode)
+	}
+}
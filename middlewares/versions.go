@@ -0,0 +1,156 @@
+package middlewares
+
+import (
+	"log"
+	"mime/multipart"
+	"strconv"
+
+	"github.com/faizainur/ipfs-api/services"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// ListVersions returns the versions of a file, newest first.
+func (f *IpfsMiddleware) ListVersions(c *fiber.Ctx) error {
+	file, err := f.FileService.GetFile(GetPrincipal(c).Subject, c.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	versions, err := f.Versions.List(c.Context(), file)
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"versions": versions,
+	})
+}
+
+// AddVersion encrypts the part named "file" and makes it the new version of
+// the file, which keeps its ID, tags, folder and grants. The file keeps its
+// name unless the part has one.
+func (f *IpfsMiddleware) AddVersion(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	file, err := f.FileService.GetFile(email, c.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	boundary := string(c.Context().Request.Header.MultipartFormBoundary())
+	if boundary == "" {
+		return fiber.NewError(fiber.StatusBadRequest, fasthttp.ErrNoMultipartForm.Error())
+	}
+	files := &multipartFileReader{reader: multipart.NewReader(requestBody(c), boundary), field: "file"}
+	if err := files.nextPart(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	name := files.part.FileName()
+	if name == "" {
+		name = file.Name
+	}
+	upload, err := f.encryptPart(email, name, files)
+	if err != nil {
+		return err
+	}
+	resp, err := f.IpfsPool.UploadStream(c.Context(), name, upload.ciphertext)
+	if err != nil {
+		return ipfsError(err)
+	}
+
+	if err := files.nextPart(); err != errNoFilePart {
+		f.unpinUpload(c, resp.Hash)
+		return badRequest(c, "a version is a single file")
+	}
+
+	version := &services.FileVersion{
+		Cid:            resp.Hash,
+		Name:           name,
+		MimeType:       upload.mimeType,
+		Size:           upload.plaintext.count,
+		CiphertextSize: upload.ciphertext.count,
+		FileKey:        upload.fileKey,
+	}
+	if err := f.Versions.Add(c.Context(), file, version); err != nil {
+		f.unpinUpload(c, resp.Hash)
+		return err
+	}
+	f.refreshFolder(c, file)
+
+	return c.Status(fiber.StatusCreated).JSON(version)
+}
+
+// FetchVersion sends the decrypted content of a version of a file, as
+// FetchFile does.
+func (f *IpfsMiddleware) FetchVersion(c *fiber.Ctx) error {
+	email := GetPrincipal(c).Subject
+
+	file, err := f.FileService.GetFile(email, c.Params("id"))
+	if err != nil {
+		return err
+	}
+	version, err := f.version(c, file)
+	if err != nil {
+		return err
+	}
+	if !version.Pinned {
+		return services.ErrVersionUnpinned
+	}
+
+	return f.sendFile(c, email, version.Cid, &services.UserFile{
+		Cid:            version.Cid,
+		Name:           version.Name,
+		MimeType:       version.MimeType,
+		Size:           version.Size,
+		CiphertextSize: version.CiphertextSize,
+		FileKey:        version.FileKey,
+	})
+}
+
+// RestoreVersion makes a new version of a file with the content of an
+// earlier one.
+func (f *IpfsMiddleware) RestoreVersion(c *fiber.Ctx) error {
+	file, err := f.FileService.GetFile(GetPrincipal(c).Subject, c.Params("id"))
+	if err != nil {
+		return err
+	}
+	version, err := f.version(c, file)
+	if err != nil {
+		return err
+	}
+
+	restored, err := f.Versions.Restore(c.Context(), file, version.Number)
+	if err != nil {
+		return err
+	}
+	f.refreshFolder(c, file)
+
+	return c.Status(fiber.StatusCreated).JSON(restored)
+}
+
+// version returns the version of file in the version path parameter.
+// Malformed numbers are reported as ErrVersionNotFound like unknown ones.
+func (f *IpfsMiddleware) version(c *fiber.Ctx, file *services.UserFile) (*services.FileVersion, error) {
+	number, err := strconv.Atoi(c.Params("version"))
+	if err != nil {
+		return nil, services.ErrVersionNotFound
+	}
+	return f.Versions.Get(c.Context(), file, number)
+}
+
+// refreshFolder points the entry of file in its folder to its new version.
+// The version is recorded by then, and the file marked for the folders
+// watcher to refresh its entry, so a failure is only logged.
+func (f *IpfsMiddleware) refreshFolder(c *fiber.Ctx, file *services.UserFile) {
+	if err := f.Folders.RefreshFile(c.Context(), file.Email, file); err != nil {
+		log.Printf("%s %s: cannot update the folder of the file: %s", c.Method(), c.Path(), err.Error())
+	}
+}
+
+// unpinUpload unpins the content of an upload that was not recorded.
+func (f *IpfsMiddleware) unpinUpload(c *fiber.Ctx, cid string) {
+	if _, err := f.IpfsPool.Unpin(c.Context(), cid); err != nil {
+		log.Printf("%s %s: cannot unpin %s: %s", c.Method(), c.Path(), cid, err.Error())
+	}
+}
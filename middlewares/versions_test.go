@@ -0,0 +1,108 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/faizainur/ipfs-api/services"
+)
+
+// addVersion uploads data as the new version of the file id.
+func (s *testServer) addVersion(t *testing.T, id string, name string, data []byte) services.FileVersion {
+	t.Helper()
+	var version services.FileVersion
+	s.doJSON(t, multipartRequest(t, http.MethodPost, "/v1/user/files/"+id+"/versions", nil, testFile{name, data}), http.StatusCreated, &version)
+	return version
+}
+
+// fetchVersion returns the content of the version number of the file id.
+func (s *testServer) fetchVersion(t *testing.T, id string, number int) []byte {
+	t.Helper()
+	resp, body := s.do(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+id+"/versions/"+strconv.Itoa(number), nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fetching version %d: status %d: %s", number, resp.StatusCode, body)
+	}
+	return body
+}
+
+func TestVersions(t *testing.T) {
+	s := newTestServer(t)
+	file := s.upload(t, testFile{"notes.txt", []byte("first draft")})[0]
+	s.doJSON(t, jsonRequest(http.MethodPost, "/v1/user/folders", folderRequest{Path: "/notes"}), http.StatusCreated, nil)
+	s.putInFolder(t, file.ID, "/notes")
+
+	second := s.addVersion(t, file.ID, "notes.txt", []byte("second draft"))
+	if second.Number != 2 || second.Previous != file.Hash || second.Name != "notes.txt" {
+		t.Fatalf("second version = %+v", second)
+	}
+
+	var record services.UserFile
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+file.ID, nil), http.StatusOK, &record)
+	if record.Cid != second.Cid || record.Version != 2 {
+		t.Fatalf("file after the new version = %+v", record)
+	}
+	if got := s.fetch(t, record.Cid); string(got) != "second draft" {
+		t.Fatalf("fetched %q", got)
+	}
+	// The folder links to the new version
+	if listing := s.listFolder(t, "/notes"); len(listing.Files) != 1 || listing.Files[0].Cid != second.Cid {
+		t.Fatalf("files of the folder = %+v", listing.Files)
+	}
+
+	var list struct {
+		Versions []services.FileVersion `json:"versions"`
+	}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+file.ID+"/versions", nil), http.StatusOK, &list)
+	if len(list.Versions) != 2 || list.Versions[0].Number != 2 || !list.Versions[0].Current || list.Versions[1].Current {
+		t.Fatalf("versions = %+v", list.Versions)
+	}
+	if got := s.fetchVersion(t, file.ID, 1); string(got) != "first draft" {
+		t.Fatalf("version 1 is %q", got)
+	}
+
+	var restored services.FileVersion
+	s.doJSON(t, httptest.NewRequest(http.MethodPost, "/v1/user/files/"+file.ID+"/versions/1/restore", nil), http.StatusCreated, &restored)
+	if restored.Number != 3 {
+		t.Fatalf("restored version = %+v", restored)
+	}
+	if got := s.fetchVersion(t, file.ID, 3); string(got) != "first draft" {
+		t.Fatalf("version 3 is %q", got)
+	}
+	if listing := s.listFolder(t, "/notes"); len(listing.Files) != 1 || listing.Files[0].Cid != restored.Cid {
+		t.Fatalf("files of the folder after the restore = %+v", listing.Files)
+	}
+
+	// Deleting the file unpins every version of it
+	s.doJSON(t, httptest.NewRequest(http.MethodDelete, "/v1/user/files/"+file.ID, nil), http.StatusNoContent, nil)
+	for _, cid := range []string{file.Hash, second.Cid, restored.Cid} {
+		if _, ok := s.node.IsPinned(cid); ok {
+			t.Errorf("%s is still pinned", cid)
+		}
+	}
+}
+
+func TestVersionErrors(t *testing.T) {
+	s := newTestServer(t)
+	file := s.upload(t, testFile{"a.txt", []byte("a")})[0]
+
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+file.ID+"/versions/2", nil), http.StatusNotFound, nil)
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+file.ID+"/versions/first", nil), http.StatusNotFound, nil)
+
+	req := multipartRequest(t, http.MethodPost, "/v1/user/files/"+file.ID+"/versions", nil, testFile{"b.txt", []byte("b")}, testFile{"c.txt", []byte("c")})
+	s.doJSON(t, req, http.StatusBadRequest, nil)
+	var list struct {
+		Versions []services.FileVersion `json:"versions"`
+	}
+	s.doJSON(t, httptest.NewRequest(http.MethodGet, "/v1/user/files/"+file.ID+"/versions", nil), http.StatusOK, &list)
+	if len(list.Versions) != 1 {
+		t.Fatalf("versions after a rejected one = %+v", list.Versions)
+	}
+
+	req = multipartRequest(t, http.MethodPost, "/v1/user/files/"+file.ID+"/versions", nil, testFile{"b.txt", []byte("b")})
+	req.Header.Set(testUserHeader, "bob@example.com")
+	if resp, _ := s.do(t, req); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("version of a file of another user: status %d", resp.StatusCode)
+	}
+}
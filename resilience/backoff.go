@@ -0,0 +1,40 @@
+package resilience
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff computes the delay before a retry. The delay doubles with every
+// attempt up to Max, and half of it is random so that clients which failed
+// together do not retry together.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+var (
+	randomMutex sync.Mutex
+	random      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay returns the delay before retry number attempt, counting from 0.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 0; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	randomMutex.Lock()
+	jitter := time.Duration(random.Int63n(int64(delay/2) + 1))
+	randomMutex.Unlock()
+
+	return delay/2 + jitter
+}
@@ -0,0 +1,125 @@
+package resilience
+
+import (
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	// StateClosed lets every call through
+	StateClosed BreakerState = iota
+	// StateOpen fails calls right away until the open timeout elapses
+	StateOpen
+	// StateHalfOpen lets a single probe through; its outcome closes or
+	// reopens the breaker
+	StateHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops calling an upstream after failureThreshold failures
+// in a row, and probes it again once openTimeout has elapsed.
+type CircuitBreaker struct {
+	failureThreshold int
+	openTimeout      time.Duration
+
+	mutex    sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		now:              time.Now,
+	}
+}
+
+// Allow reports whether a call may go through. Every allowed call must be
+// followed by Success, Failure or Cancel.
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probing = true
+		return true
+	case StateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.state = StateClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.failureThreshold {
+		b.state = StateOpen
+		b.openedAt = b.now()
+	}
+	b.probing = false
+}
+
+// Cancel ends a call that says nothing about the upstream, such as one the
+// caller gave up on.
+func (b *CircuitBreaker) Cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		// The next call will probe the upstream
+		return StateHalfOpen
+	}
+	return b.state
+}
+
+// ConsecutiveFailures returns the number of failures since the last success.
+func (b *CircuitBreaker) ConsecutiveFailures() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.failures
+}
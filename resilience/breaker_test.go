@@ -0,0 +1,122 @@
+package resilience
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock the tests move by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestBreaker(clock *fakeClock) *CircuitBreaker {
+	breaker := NewCircuitBreaker(3, time.Minute)
+	breaker.now = clock.Now
+	return breaker
+}
+
+// fail records n allowed calls that failed.
+func fail(t *testing.T, breaker *CircuitBreaker, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if !breaker.Allow() {
+			t.Fatalf("call %d was not allowed", i)
+		}
+		breaker.Failure()
+	}
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newTestBreaker(clock)
+
+	fail(t, breaker, 2)
+	if breaker.State() != StateClosed || breaker.ConsecutiveFailures() != 2 {
+		t.Fatalf("state after 2 failures = %s, %d failures", breaker.State(), breaker.ConsecutiveFailures())
+	}
+
+	// A success resets the count
+	breaker.Allow()
+	breaker.Success()
+	fail(t, breaker, 2)
+	if breaker.State() != StateClosed {
+		t.Fatal("failures before a success were counted")
+	}
+
+	fail(t, breaker, 1)
+	if breaker.State() != StateOpen {
+		t.Fatalf("state after 3 failures in a row = %s", breaker.State())
+	}
+	if breaker.Allow() {
+		t.Fatal("an open breaker let a call through")
+	}
+	clock.Advance(59 * time.Second)
+	if breaker.Allow() {
+		t.Fatal("the breaker let a call through before the open timeout")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newTestBreaker(clock)
+	fail(t, breaker, 3)
+
+	clock.Advance(time.Minute)
+	if breaker.State() != StateHalfOpen {
+		t.Fatalf("state after the open timeout = %s", breaker.State())
+	}
+	if !breaker.Allow() {
+		t.Fatal("the probe was not allowed")
+	}
+	// A single probe at a time
+	if breaker.Allow() {
+		t.Fatal("a second call went through while probing")
+	}
+
+	// A failed probe reopens the breaker for another timeout
+	breaker.Failure()
+	if breaker.State() != StateOpen || breaker.Allow() {
+		t.Fatalf("state after a failed probe = %s", breaker.State())
+	}
+
+	clock.Advance(time.Minute)
+	if !breaker.Allow() {
+		t.Fatal("the second probe was not allowed")
+	}
+	breaker.Success()
+	if breaker.State() != StateClosed || breaker.ConsecutiveFailures() != 0 {
+		t.Fatalf("state after a successful probe = %s, %d failures", breaker.State(), breaker.ConsecutiveFailures())
+	}
+	if !breaker.Allow() || !breaker.Allow() {
+		t.Fatal("a closed breaker refused calls")
+	}
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newTestBreaker(clock)
+	fail(t, breaker, 3)
+	clock.Advance(time.Minute)
+
+	if !breaker.Allow() {
+		t.Fatal("the probe was not allowed")
+	}
+	// A probe the caller gave up on lets another one through
+	breaker.Cancel()
+	if breaker.State() != StateHalfOpen || !breaker.Allow() {
+		t.Fatalf("state after a cancelled probe = %s", breaker.State())
+	}
+}
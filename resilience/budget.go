@@ -0,0 +1,76 @@
+package resilience
+
+import (
+	"sync"
+	"time"
+)
+
+// budgetWindow is the number of one second buckets a RetryBudget looks at.
+const budgetWindow = 10
+
+// RetryBudget caps retries to a ratio of the requests seen over the last
+// ten seconds, plus a small allowance so that a quiet upstream can still be
+// retried. When an upstream is down, retries stop adding to its load once
+// the budget is spent instead of multiplying it.
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mutex   sync.Mutex
+	buckets [budgetWindow]budgetBucket
+	now     func() time.Time
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+func NewRetryBudget(ratio float64, minPerSecond int) *RetryBudget {
+	return &RetryBudget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		now:          time.Now,
+	}
+}
+
+// Request records a first attempt.
+func (b *RetryBudget) Request() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.bucket().requests++
+}
+
+// Withdraw reports whether a retry fits in the budget, and counts it if so.
+func (b *RetryBudget) Withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	current := b.bucket()
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if bucket.second > current.second-budgetWindow {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	allowed := float64(b.minPerSecond*budgetWindow) + b.ratio*float64(requests)
+	if float64(retries) >= allowed {
+		return false
+	}
+	current.retries++
+	return true
+}
+
+// bucket returns the bucket of the current second, recycling a stale one.
+func (b *RetryBudget) bucket() *budgetBucket {
+	second := b.now().Unix()
+	bucket := &b.buckets[second%budgetWindow]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
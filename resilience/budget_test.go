@@ -0,0 +1,86 @@
+package resilience
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBudget(clock *fakeClock, ratio float64, minPerSecond int) *RetryBudget {
+	budget := NewRetryBudget(ratio, minPerSecond)
+	budget.now = clock.Now
+	return budget
+}
+
+// withdraw returns how many of n retries fit in budget.
+func withdraw(budget *RetryBudget, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if budget.Withdraw() {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestRetryBudgetRatio(t *testing.T) {
+	clock := newFakeClock()
+	budget := newTestBudget(clock, 0.2, 0)
+
+	if withdraw(budget, 1) != 0 {
+		t.Fatal("a retry was allowed without requests")
+	}
+	for i := 0; i < 50; i++ {
+		budget.Request()
+	}
+	if got := withdraw(budget, 20); got != 10 {
+		t.Fatalf("%d retries allowed for 50 requests, want 10", got)
+	}
+}
+
+func TestRetryBudgetMinimum(t *testing.T) {
+	clock := newFakeClock()
+	budget := newTestBudget(clock, 0.2, 1)
+
+	// A quiet upstream still gets a retry per second of the window
+	if got := withdraw(budget, 20); got != budgetWindow {
+		t.Fatalf("%d retries allowed without requests, want %d", got, budgetWindow)
+	}
+}
+
+func TestRetryBudgetWindow(t *testing.T) {
+	clock := newFakeClock()
+	budget := newTestBudget(clock, 0.5, 0)
+
+	for i := 0; i < 10; i++ {
+		budget.Request()
+	}
+	if got := withdraw(budget, 10); got != 5 {
+		t.Fatalf("%d retries allowed, want 5", got)
+	}
+
+	// Requests and retries stay in the window for ten seconds
+	clock.Advance((budgetWindow - 1) * time.Second)
+	if withdraw(budget, 1) != 0 {
+		t.Fatal("the spent budget came back within the window")
+	}
+	budget.Request()
+	budget.Request()
+	if got := withdraw(budget, 5); got != 1 {
+		t.Fatalf("%d retries allowed for 12 requests and 5 retries, want 1", got)
+	}
+
+	// Then they fall out of it
+	clock.Advance(2 * time.Second)
+	for i := 0; i < 4; i++ {
+		budget.Request()
+	}
+	if got := withdraw(budget, 10); got != 2 {
+		t.Fatalf("%d retries allowed once the first second left the window, want 2", got)
+	}
+
+	// Buckets are recycled when the clock comes around to them again
+	clock.Advance(time.Hour)
+	if withdraw(budget, 1) != 0 {
+		t.Fatal("a stale bucket was counted")
+	}
+}
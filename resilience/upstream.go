@@ -0,0 +1,250 @@
+// Package resilience keeps calls to upstream services from turning every
+// transient failure into a failed request: idempotent calls are retried with
+// backoff within a retry budget, and a circuit breaker per upstream stops
+// calling one that keeps failing.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the upstream while its circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Policy configures the retries and the circuit breaker of an upstream.
+type Policy struct {
+	// MaxAttempts counts the first attempt, 1 disables retries
+	MaxAttempts int
+	Backoff     Backoff
+	// RetryRatio and MinRetriesPerSecond size the retry budget
+	RetryRatio          float64
+	MinRetriesPerSecond int
+	// FailureThreshold failures in a row open the circuit breaker for
+	// OpenTimeout
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	// Retryable reports whether err is a failure of the upstream, as opposed
+	// to an answer it gave. Only those are retried and trip the breaker.
+	// Every error is a failure when it is nil.
+	Retryable func(err error) bool
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts:         3,
+	Backoff:             Backoff{Initial: 100 * time.Millisecond, Max: 2 * time.Second},
+	RetryRatio:          0.2,
+	MinRetriesPerSecond: 1,
+	FailureThreshold:    5,
+	OpenTimeout:         30 * time.Second,
+}
+
+// Upstream guards the calls to one upstream service. A nil *Upstream makes
+// a single unguarded attempt, so clients work without one.
+type Upstream struct {
+	name    string
+	policy  Policy
+	breaker *CircuitBreaker
+	budget  *RetryBudget
+
+	requests        int64
+	failures        int64
+	retries         int64
+	budgetExhausted int64
+	shortCircuited  int64
+}
+
+// UpstreamStatus is a snapshot of the state and counters of an Upstream.
+type UpstreamStatus struct {
+	Name                string `json:"name"`
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Requests            int64  `json:"requests"`
+	Failures            int64  `json:"failures"`
+	Retries             int64  `json:"retries"`
+	BudgetExhausted     int64  `json:"budget_exhausted"`
+	ShortCircuited      int64  `json:"short_circuited"`
+
+	state BreakerState
+}
+
+func NewUpstream(name string, policy Policy) *Upstream {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if policy.FailureThreshold < 1 {
+		policy.FailureThreshold = 1
+	}
+
+	return &Upstream{
+		name:    name,
+		policy:  policy,
+		breaker: NewCircuitBreaker(policy.FailureThreshold, policy.OpenTimeout),
+		budget:  NewRetryBudget(policy.RetryRatio, policy.MinRetriesPerSecond),
+	}
+}
+
+func (u *Upstream) Name() string {
+	return u.name
+}
+
+// Do calls fn until it succeeds, gives an answer that is not a failure of
+// the upstream, or runs out of attempts. Calls that are not idempotent are
+// attempted once, but still go through the circuit breaker.
+func (u *Upstream) Do(ctx context.Context, idempotent bool, fn func(ctx context.Context) error) error {
+	if u == nil {
+		return fn(ctx)
+	}
+
+	u.budget.Request()
+	for attempt := 0; ; attempt++ {
+		if !u.breaker.Allow() {
+			atomic.AddInt64(&u.shortCircuited, 1)
+			return fmt.Errorf("%s: %w", u.name, ErrCircuitOpen)
+		}
+
+		atomic.AddInt64(&u.requests, 1)
+		err := fn(ctx)
+		switch {
+		case err == nil:
+			u.breaker.Success()
+			return nil
+		case errors.Is(err, context.Canceled):
+			u.breaker.Cancel()
+			return err
+		case !u.isFailure(err):
+			// The upstream answered, even if with an error
+			u.breaker.Success()
+			return err
+		}
+
+		u.breaker.Failure()
+		atomic.AddInt64(&u.failures, 1)
+
+		if !idempotent || attempt+1 >= u.policy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if !u.budget.Withdraw() {
+			atomic.AddInt64(&u.budgetExhausted, 1)
+			return err
+		}
+		atomic.AddInt64(&u.retries, 1)
+
+		timer := time.NewTimer(u.policy.Backoff.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (u *Upstream) isFailure(err error) bool {
+	if u.policy.Retryable == nil {
+		return true
+	}
+	return u.policy.Retryable(err)
+}
+
+func (u *Upstream) Status() UpstreamStatus {
+	state := u.breaker.State()
+	return UpstreamStatus{
+		Name:                u.name,
+		State:               state.String(),
+		ConsecutiveFailures: u.breaker.ConsecutiveFailures(),
+		Requests:            atomic.LoadInt64(&u.requests),
+		Failures:            atomic.LoadInt64(&u.failures),
+		Retries:             atomic.LoadInt64(&u.retries),
+		BudgetExhausted:     atomic.LoadInt64(&u.budgetExhausted),
+		ShortCircuited:      atomic.LoadInt64(&u.shortCircuited),
+		state:               state,
+	}
+}
+
+// Registry holds the upstreams of the app for the health and metrics
+// endpoints.
+type Registry struct {
+	mutex     sync.RWMutex
+	upstreams map[string]*Upstream
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		upstreams: make(map[string]*Upstream),
+	}
+}
+
+// Register returns the upstream called name, creating it with policy the
+// first time.
+func (r *Registry) Register(name string, policy Policy) *Upstream {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if upstream, ok := r.upstreams[name]; ok {
+		return upstream
+	}
+	upstream := NewUpstream(name, policy)
+	r.upstreams[name] = upstream
+	return upstream
+}
+
+// Statuses returns the status of every upstream, sorted by name.
+func (r *Registry) Statuses() []UpstreamStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	statuses := make([]UpstreamStatus, 0, len(r.upstreams))
+	for _, upstream := range r.upstreams {
+		statuses = append(statuses, upstream.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+var metricDescriptions = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(UpstreamStatus) int64
+}{
+	{"upstream_requests_total", "counter", "Attempts sent to the upstream, retries included.",
+		func(s UpstreamStatus) int64 { return s.Requests }},
+	{"upstream_failures_total", "counter", "Attempts that failed because of the upstream.",
+		func(s UpstreamStatus) int64 { return s.Failures }},
+	{"upstream_retries_total", "counter", "Retries sent after a failure.",
+		func(s UpstreamStatus) int64 { return s.Retries }},
+	{"upstream_retry_budget_exhausted_total", "counter", "Retries skipped because the retry budget was spent.",
+		func(s UpstreamStatus) int64 { return s.BudgetExhausted }},
+	{"upstream_short_circuited_total", "counter", "Calls failed without an attempt because the circuit breaker was open.",
+		func(s UpstreamStatus) int64 { return s.ShortCircuited }},
+	{"upstream_circuit_state", "gauge", "State of the circuit breaker: 0 closed, 1 open, 2 half open.",
+		func(s UpstreamStatus) int64 { return int64(s.state) }},
+}
+
+// WriteMetrics writes the counters and breaker states of every upstream in
+// the Prometheus text format.
+func (r *Registry) WriteMetrics(w io.Writer) error {
+	statuses := r.Statuses()
+
+	for _, metric := range metricDescriptions {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if _, err := fmt.Fprintf(w, "%s{upstream=%q} %d\n", metric.name, status.Name, metric.value(status)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package resilience
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	errUnavailable = errors.New("upstream is unavailable")
+	errAnswer      = errors.New("upstream answered with an error")
+)
+
+func testPolicy() Policy {
+	return Policy{
+		MaxAttempts:         3,
+		Backoff:             Backoff{Initial: time.Millisecond, Max: 2 * time.Millisecond},
+		RetryRatio:          0.5,
+		MinRetriesPerSecond: 10,
+		FailureThreshold:    5,
+		OpenTimeout:         time.Hour,
+		Retryable: func(err error) bool {
+			return err == errUnavailable
+		},
+	}
+}
+
+// failing returns a call failing with err the first failures times, and
+// counting its attempts in calls.
+func failing(failures int, err error, calls *int) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		*calls++
+		if *calls <= failures {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestUpstreamRetriesIdempotentCalls(t *testing.T) {
+	upstream := NewUpstream("node", testPolicy())
+
+	calls := 0
+	if err := upstream.Do(context.Background(), true, failing(2, errUnavailable, &calls)); err != nil || calls != 3 {
+		t.Fatalf("Do = %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	if err := upstream.Do(context.Background(), true, failing(5, errUnavailable, &calls)); err != errUnavailable || calls != 3 {
+		t.Fatalf("Do = %v after %d calls, want the failure after MaxAttempts", err, calls)
+	}
+
+	status := upstream.Status()
+	if status.Requests != 6 || status.Failures != 5 || status.Retries != 4 {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestUpstreamDoesNotRetryNonIdempotentCalls(t *testing.T) {
+	upstream := NewUpstream("node", testPolicy())
+
+	calls := 0
+	if err := upstream.Do(context.Background(), false, failing(1, errUnavailable, &calls)); err != errUnavailable || calls != 1 {
+		t.Fatalf("Do = %v after %d calls, want one attempt", err, calls)
+	}
+	if status := upstream.Status(); status.Retries != 0 || status.ConsecutiveFailures != 1 {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestUpstreamDoesNotRetryAnswers(t *testing.T) {
+	upstream := NewUpstream("node", testPolicy())
+	upstream.Do(context.Background(), true, func(ctx context.Context) error { return errUnavailable })
+
+	// An error the upstream answered with is not retried and shows it is up
+	calls := 0
+	if err := upstream.Do(context.Background(), true, failing(5, errAnswer, &calls)); err != errAnswer || calls != 1 {
+		t.Fatalf("Do = %v after %d calls, want one attempt", err, calls)
+	}
+	if status := upstream.Status(); status.ConsecutiveFailures != 0 {
+		t.Fatalf("an answer left %d failures", status.ConsecutiveFailures)
+	}
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	policy := testPolicy()
+	policy.MaxAttempts = 1
+	policy.FailureThreshold = 2
+	upstream := NewUpstream("node", policy)
+	clock := newFakeClock()
+	upstream.breaker.now = clock.Now
+
+	calls := 0
+	for i := 0; i < 2; i++ {
+		upstream.Do(context.Background(), true, failing(10, errUnavailable, &calls))
+	}
+	err := upstream.Do(context.Background(), true, failing(10, errUnavailable, &calls))
+	if !errors.Is(err, ErrCircuitOpen) || calls != 2 {
+		t.Fatalf("Do with an open breaker = %v after %d calls", err, calls)
+	}
+	if status := upstream.Status(); status.State != "open" || status.ShortCircuited != 1 {
+		t.Fatalf("status = %+v", status)
+	}
+
+	clock.Advance(time.Hour)
+	calls = 0
+	if err := upstream.Do(context.Background(), true, failing(0, nil, &calls)); err != nil || calls != 1 {
+		t.Fatalf("probe = %v after %d calls", err, calls)
+	}
+	if status := upstream.Status(); status.State != "closed" {
+		t.Fatalf("state after the probe = %s", status.State)
+	}
+}
+
+func TestUpstreamRetriesStopWithTheBreaker(t *testing.T) {
+	policy := testPolicy()
+	policy.MaxAttempts = 5
+	policy.FailureThreshold = 2
+	upstream := NewUpstream("node", policy)
+
+	calls := 0
+	err := upstream.Do(context.Background(), true, failing(10, errUnavailable, &calls))
+	if !errors.Is(err, ErrCircuitOpen) || calls != 2 {
+		t.Fatalf("Do = %v after %d calls, want the breaker to stop the retries", err, calls)
+	}
+}
+
+func TestUpstreamRetryBudget(t *testing.T) {
+	policy := testPolicy()
+	policy.MaxAttempts = 10
+	policy.FailureThreshold = 100
+	policy.RetryRatio = 0
+	policy.MinRetriesPerSecond = 0
+	upstream := NewUpstream("node", policy)
+
+	calls := 0
+	if err := upstream.Do(context.Background(), true, failing(10, errUnavailable, &calls)); err != errUnavailable || calls != 1 {
+		t.Fatalf("Do = %v after %d calls, want no retry", err, calls)
+	}
+	if status := upstream.Status(); status.BudgetExhausted != 1 || status.Retries != 0 {
+		t.Fatalf("status = %+v", status)
+	}
+}
+
+func TestUpstreamContext(t *testing.T) {
+	policy := testPolicy()
+	policy.FailureThreshold = 1
+	upstream := NewUpstream("node", policy)
+
+	// A call the caller cancelled says nothing about the upstream
+	ctx, cancel := context.WithCancel(context.Background())
+	err := upstream.Do(ctx, true, func(ctx context.Context) error {
+		cancel()
+		return ctx.Err()
+	})
+	if err != context.Canceled || upstream.Status().State != "closed" {
+		t.Fatalf("Do = %v, state %s", err, upstream.Status().State)
+	}
+
+	// Nor is it retried once the context is done
+	policy.FailureThreshold = 10
+	upstream = NewUpstream("node", policy)
+	ctx, cancel = context.WithCancel(context.Background())
+	calls := 0
+	err = upstream.Do(ctx, true, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return errUnavailable
+	})
+	if err != errUnavailable || calls != 1 {
+		t.Fatalf("Do = %v after %d calls", err, calls)
+	}
+}
+
+func TestNilUpstream(t *testing.T) {
+	var upstream *Upstream
+	calls := 0
+	if err := upstream.Do(context.Background(), true, failing(1, errUnavailable, &calls)); err != errUnavailable || calls != 1 {
+		t.Fatalf("Do = %v after %d calls, want a single attempt", err, calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := Backoff{Initial: 100 * time.Millisecond, Max: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if delay := backoff.Delay(attempt); delay < max/2 || delay > max {
+				t.Fatalf("delay of attempt %d = %s, want between %s and %s", attempt, delay, max/2, max)
+			}
+		}
+	}
+	if delay := (Backoff{}).Delay(3); delay != 0 {
+		t.Fatalf("zero backoff waits %s", delay)
+	}
+}
+
+func TestRegistryMetrics(t *testing.T) {
+	registry := NewRegistry()
+	node := registry.Register("node", testPolicy())
+	if registry.Register("node", DefaultPolicy) != node {
+		t.Fatal("registering a name twice created another upstream")
+	}
+	registry.Register("auth", testPolicy())
+
+	calls := 0
+	node.Do(context.Background(), true, failing(1, errUnavailable, &calls))
+
+	statuses := registry.Statuses()
+	if len(statuses) != 2 || statuses[0].Name != "auth" || statuses[1].Requests != 2 {
+		t.Fatalf("statuses = %+v", statuses)
+	}
+
+	var metrics bytes.Buffer
+	if err := registry.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`upstream_requests_total{upstream="node"} 2`,
+		`upstream_retries_total{upstream="node"} 1`,
+		`upstream_circuit_state{upstream="auth"} 0`,
+		"# TYPE upstream_circuit_state gauge",
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, metrics.String())
+		}
+	}
+}
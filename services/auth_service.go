@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/faizainur/ipfs-api/resilience"
 	httptransport "github.com/go-openapi/runtime/client"
 	"github.com/gofiber/fiber/v2"
 	hydraClient "github.com/ory/hydra-client-go/client"
@@ -29,6 +30,12 @@ type JwtTokenValidationResponse struct {
 type AuthService struct {
 	jwtValidationUri string
 	hydraAdmin       admin.ClientService
+
+	// JwtUpstream and HydraUpstream retry and circuit break the calls to the
+	// JWT validation service and to Hydra. Calls are attempted once when
+	// unset.
+	JwtUpstream   *resilience.Upstream
+	HydraUpstream *resilience.Upstream
 }
 
 func NewAuthService(jwtValidationUri string, hydraHost string) *AuthService {
@@ -71,16 +78,25 @@ func (a *AuthService) ValidateJwt(token string) (bool, JwtTokenValidationData, e
 	if err := agent.Parse(); err != nil {
 		fmt.Println("error parse host client")
 
-		panic(err)
+		return false, JwtTokenValidationData{}, err
 	}
 
-	if err := agent.HostClient.Do(req, resp); err != nil {
+	err := a.JwtUpstream.Do(context.Background(), true, func(ctx context.Context) error {
+		if err := agent.HostClient.Do(req, resp); err != nil {
+			return err
+		}
+		if resp.StatusCode() >= fiber.StatusInternalServerError {
+			return fmt.Errorf("JWT validation service returned status %d", resp.StatusCode())
+		}
+		return nil
+	})
+	if err != nil {
 		fmt.Println("error http ")
 
 		return false, JwtTokenValidationData{}, err
 	}
 
-	err := json.Unmarshal(resp.Body(), &jsonResponse)
+	err = json.Unmarshal(resp.Body(), &jsonResponse)
 	if err != nil {
 		fmt.Println("Error json response ")
 
@@ -97,14 +113,29 @@ func (a *AuthService) ValidateJwt(token string) (bool, JwtTokenValidationData, e
 }
 
 func (a *AuthService) IntrospectTokenOauth2(token string) (bool, *models.OAuth2TokenIntrospection, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	params := admin.NewIntrospectOAuth2TokenParams()
-	params.WithContext(ctx)
-	params.SetToken(token)
-
-	responseIntrospection, err := a.hydraAdmin.IntrospectOAuth2Token(params)
+	var responseIntrospection *admin.IntrospectOAuth2TokenOK
+	var rejected error
+
+	err := a.HydraUpstream.Do(context.Background(), true, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		params := admin.NewIntrospectOAuth2TokenParams()
+		params.WithContext(ctx)
+		params.SetToken(token)
+
+		var err error
+		responseIntrospection, err = a.hydraAdmin.IntrospectOAuth2Token(params)
+		if _, unauthorized := err.(*admin.IntrospectOAuth2TokenUnauthorized); unauthorized {
+			// Hydra answered, there is no point in asking again
+			rejected = err
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		err = rejected
+	}
 	if err != nil {
 		return false, &models.OAuth2TokenIntrospection{}, err
 	}
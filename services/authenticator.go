@@ -0,0 +1,259 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+type PrincipalKind string
+
+const (
+	// PrincipalUser is an end user acting on their own files
+	PrincipalUser PrincipalKind = "user"
+	// PrincipalClient is an OAuth2 client (a bank) acting for the user in
+	// Subject
+	PrincipalClient PrincipalKind = "client"
+)
+
+var (
+	// ErrNoCredentials means the request carries no credential of the kind an
+	// authenticator handles, so the next one in the chain should be tried.
+	ErrNoCredentials = errors.New("no credentials of this kind")
+	// ErrInvalidCredentials means the credential was checked and rejected.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject is the email of the user, or of the user a client acts for
+	Subject  string                 `json:"subject"`
+	Kind     PrincipalKind          `json:"kind"`
+	ClientID string                 `json:"client_id,omitempty"`
+	Scopes   []string               `json:"scopes,omitempty"`
+	Tenant   string                 `json:"tenant,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+}
+
+func (p *Principal) UserUid() string {
+	userUid, _ := p.Claims["user_uid"].(string)
+	return userUid
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	return containsString(p.Scopes, scope)
+}
+
+// Credentials are the raw credentials found on a request.
+type Credentials struct {
+	BearerToken string
+	APIKey      string
+}
+
+// Authenticator turns credentials into a Principal. It returns
+// ErrNoCredentials when the credentials are not meant for it and
+// ErrInvalidCredentials when it rejects them; any other error means it could
+// not decide, for instance because an upstream service is down.
+type Authenticator interface {
+	Authenticate(ctx context.Context, credentials Credentials) (*Principal, error)
+}
+
+// looksLikeJwt tells JWTs apart from opaque OAuth2 access tokens, which
+// Hydra issues as two dot separated parts.
+func looksLikeJwt(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func tenantClaim(claims map[string]interface{}) string {
+	tenant, _ := claims["tenant"].(string)
+	return tenant
+}
+
+func scopeClaim(claims map[string]interface{}) []string {
+	switch value := claims["scope"].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		scopes := make([]string, 0, len(value))
+		for _, item := range value {
+			if scope, ok := item.(string); ok {
+				scopes = append(scopes, scope)
+			}
+		}
+		return scopes
+	}
+	return nil
+}
+
+// RemoteJwtAuthenticator validates user JWTs with the JWT_VALIDATION_URI
+// service.
+type RemoteJwtAuthenticator struct {
+	AuthService *AuthService
+}
+
+func (r *RemoteJwtAuthenticator) Authenticate(ctx context.Context, credentials Credentials) (*Principal, error) {
+	if credentials.BearerToken == "" || !looksLikeJwt(credentials.BearerToken) {
+		return nil, ErrNoCredentials
+	}
+
+	isValid, data, err := r.AuthService.ValidateJwt(credentials.BearerToken)
+	if err != nil {
+		return nil, err
+	}
+	if !isValid {
+		return nil, ErrInvalidCredentials
+	}
+	if data.Email == "" {
+		return nil, fmt.Errorf("%w: token has no email", ErrInvalidCredentials)
+	}
+
+	return &Principal{
+		Subject: data.Email,
+		Kind:    PrincipalUser,
+		Claims: map[string]interface{}{
+			"email":    data.Email,
+			"user_uid": data.UserUid,
+		},
+	}, nil
+}
+
+// JwksAuthenticator validates user JWTs locally with a JwtVerifier.
+type JwksAuthenticator struct {
+	Verifier *JwtVerifier
+}
+
+func (j *JwksAuthenticator) Authenticate(ctx context.Context, credentials Credentials) (*Principal, error) {
+	if credentials.BearerToken == "" || !looksLikeJwt(credentials.BearerToken) {
+		return nil, ErrNoCredentials
+	}
+
+	data, claims, err := j.Verifier.Verify(credentials.BearerToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, err.Error())
+	}
+	// The email is the subject of user principals, whatever claims are required
+	if data.Email == "" {
+		return nil, fmt.Errorf("%w: token has no email", ErrInvalidCredentials)
+	}
+
+	return &Principal{
+		Subject: data.Email,
+		Kind:    PrincipalUser,
+		Scopes:  scopeClaim(claims),
+		Tenant:  tenantClaim(claims),
+		Claims:  claims,
+	}, nil
+}
+
+// HydraAuthenticator introspects OAuth2 access tokens with Hydra. The
+// principal is the client, acting for the user in the token subject.
+type HydraAuthenticator struct {
+	AuthService *AuthService
+}
+
+func (h *HydraAuthenticator) Authenticate(ctx context.Context, credentials Credentials) (*Principal, error) {
+	if credentials.BearerToken == "" {
+		return nil, ErrNoCredentials
+	}
+
+	isActive, data, err := h.AuthService.IntrospectTokenOauth2(credentials.BearerToken)
+	if err != nil {
+		return nil, err
+	}
+	if !isActive {
+		return nil, ErrInvalidCredentials
+	}
+
+	claims := map[string]interface{}{
+		"sub":       data.Sub,
+		"client_id": data.ClientID,
+		"scope":     data.Scope,
+		"iss":       data.Iss,
+		"aud":       data.Aud,
+		"exp":       data.Exp,
+	}
+	if ext, ok := data.Ext.(map[string]interface{}); ok {
+		for key, value := range ext {
+			if _, exists := claims[key]; !exists {
+				claims[key] = value
+			}
+		}
+	}
+
+	return &Principal{
+		Subject:  data.Sub,
+		Kind:     PrincipalClient,
+		ClientID: data.ClientID,
+		Scopes:   strings.Fields(data.Scope),
+		Tenant:   tenantClaim(claims),
+		Claims:   claims,
+	}, nil
+}
+
+// StaticAPIKey is one entry of an API key file. Only the SHA-256 of the key
+// is stored.
+type StaticAPIKey struct {
+	KeySha256 string        `json:"key_sha256"`
+	Subject   string        `json:"subject"`
+	Kind      PrincipalKind `json:"kind"`
+	ClientID  string        `json:"client_id"`
+	Scopes    []string      `json:"scopes"`
+	Tenant    string        `json:"tenant"`
+}
+
+// APIKeyAuthenticator accepts the keys of a static list, sent in the
+// X-API-Key header.
+type APIKeyAuthenticator struct {
+	keys []StaticAPIKey
+}
+
+func NewAPIKeyAuthenticator(keys []StaticAPIKey) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys: keys}
+}
+
+// LoadAPIKeyAuthenticator reads a JSON array of StaticAPIKey from path.
+func LoadAPIKeyAuthenticator(path string) (*APIKeyAuthenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []StaticAPIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid API key file: %s", err.Error())
+	}
+	for _, key := range keys {
+		if key.Kind != PrincipalUser && key.Kind != PrincipalClient {
+			return nil, fmt.Errorf("API key for %s has unknown kind %q", key.Subject, key.Kind)
+		}
+	}
+	return NewAPIKeyAuthenticator(keys), nil
+}
+
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context, credentials Credentials) (*Principal, error) {
+	if credentials.APIKey == "" {
+		return nil, ErrNoCredentials
+	}
+
+	sum := sha256.Sum256([]byte(credentials.APIKey))
+	hash := []byte(hex.EncodeToString(sum[:]))
+
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare(hash, []byte(strings.ToLower(key.KeySha256))) == 1 {
+			return &Principal{
+				Subject:  key.Subject,
+				Kind:     key.Kind,
+				ClientID: key.ClientID,
+				Scopes:   key.Scopes,
+				Tenant:   key.Tenant,
+			}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
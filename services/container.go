@@ -0,0 +1,431 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted files are stored as a versioned container:
+//
+//	magic "CTNC" | version (1) | chunk size (4, BE) | key ID length (1) |
+//	key ID | nonce prefix (8) | chunk 0 | chunk 1 | ... | final chunk
+//
+// Every chunk holds ChunkSize bytes of plaintext sealed with AES-GCM, except
+// the final one which may be shorter (or empty). The nonce of chunk i is the
+// nonce prefix followed by i, and the AAD is the serialized header, i as a
+// uint64 and a final flag byte. Reordering, truncating or extending the chunk
+// sequence therefore fails authentication, and any chunk can be decrypted on
+// its own as long as the total ciphertext size is known.
+const (
+	ContainerVersion1 = 1
+
+	// DefaultChunkSize is the amount of plaintext sealed in every chunk.
+	DefaultChunkSize = 64 * 1024
+
+	// MaxContainerHeaderSize is the largest header a container can have, which
+	// is enough to read before parsing a header fetched from a remote store.
+	MaxContainerHeaderSize = 4 + 1 + 4 + 1 + 255 + containerNoncePrefixSize
+
+	maxChunkSize             = 16 * 1024 * 1024
+	containerNoncePrefixSize = 8
+)
+
+var containerMagic = []byte("CTNC")
+
+var (
+	errNotContainer       = errors.New("data is not an encrypted container")
+	errContainerCorrupted = fmt.Errorf("%w: encrypted container is truncated or corrupted", ErrDecryptionFailed)
+)
+
+type ContainerHeader struct {
+	Version     uint8
+	ChunkSize   uint32
+	KeyID       string
+	NoncePrefix []byte
+}
+
+// KeyFingerprint derives the key ID written in container headers. It lets the
+// reader check it holds the right key before trying to open any chunk.
+func KeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(append([]byte("catena key id\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (h ContainerHeader) MarshalBinary() ([]byte, error) {
+	if len(h.KeyID) > 255 {
+		return nil, fmt.Errorf("key ID is %d bytes long, the limit is 255", len(h.KeyID))
+	}
+	if len(h.NoncePrefix) != containerNoncePrefixSize {
+		return nil, fmt.Errorf("nonce prefix must be %d bytes", containerNoncePrefixSize)
+	}
+
+	buf := make([]byte, 0, MaxContainerHeaderSize)
+	buf = append(buf, containerMagic...)
+	buf = append(buf, h.Version)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], h.ChunkSize)
+	buf = append(buf, byte(len(h.KeyID)))
+	buf = append(buf, h.KeyID...)
+	buf = append(buf, h.NoncePrefix...)
+	return buf, nil
+}
+
+// ReadContainerHeader parses the header at the start of r and leaves r
+// positioned on the first chunk.
+func ReadContainerHeader(r io.Reader) (ContainerHeader, error) {
+	var header ContainerHeader
+
+	fixed := make([]byte, len(containerMagic)+1+4+1)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return header, errNotContainer
+	}
+	if !bytes.Equal(fixed[:len(containerMagic)], containerMagic) {
+		return header, errNotContainer
+	}
+
+	header.Version = fixed[4]
+	if header.Version != ContainerVersion1 {
+		return header, fmt.Errorf("unsupported container version %d", header.Version)
+	}
+
+	header.ChunkSize = binary.BigEndian.Uint32(fixed[5:9])
+	if header.ChunkSize == 0 || header.ChunkSize > maxChunkSize {
+		return header, fmt.Errorf("invalid container chunk size %d", header.ChunkSize)
+	}
+
+	rest := make([]byte, int(fixed[9])+containerNoncePrefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return header, errContainerCorrupted
+	}
+	header.KeyID = string(rest[:fixed[9]])
+	header.NoncePrefix = rest[fixed[9]:]
+
+	return header, nil
+}
+
+// IsContainer reports whether data starts with the container magic.
+func IsContainer(data []byte) bool {
+	return bytes.HasPrefix(data, containerMagic)
+}
+
+// Container seals and opens the chunks of one encrypted file.
+type Container struct {
+	Header ContainerHeader
+
+	aead      cipher.AEAD
+	rawHeader []byte
+}
+
+// NewContainer prepares a fresh container for encrypting with key.
+func NewContainer(key []byte, keyID string) (*Container, error) {
+	prefix := make([]byte, containerNoncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	return OpenContainer(key, ContainerHeader{
+		Version:     ContainerVersion1,
+		ChunkSize:   DefaultChunkSize,
+		KeyID:       keyID,
+		NoncePrefix: prefix,
+	})
+}
+
+// OpenContainer prepares an existing container, described by header, for
+// decryption with key.
+func OpenContainer(key []byte, header ContainerHeader) (*Container, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	rawHeader, err := header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Container{
+		Header:    header,
+		aead:      aead,
+		rawHeader: rawHeader,
+	}, nil
+}
+
+// HeaderSize is the number of bytes in front of the first chunk.
+func (c *Container) HeaderSize() int64 {
+	return int64(len(c.rawHeader))
+}
+
+// SealedChunkSize is the size of every chunk but the final one once sealed.
+func (c *Container) SealedChunkSize() int64 {
+	return int64(c.Header.ChunkSize) + int64(c.aead.Overhead())
+}
+
+// ChunkCount returns the number of chunks of a container whose total size,
+// header included, is ciphertextSize.
+func (c *Container) ChunkCount(ciphertextSize int64) int64 {
+	body := ciphertextSize - c.HeaderSize()
+	if body <= c.SealedChunkSize() {
+		return 1
+	}
+	return (body + c.SealedChunkSize() - 1) / c.SealedChunkSize()
+}
+
+// PlaintextSize returns the decrypted size of a container whose total size is
+// ciphertextSize.
+func (c *Container) PlaintextSize(ciphertextSize int64) int64 {
+	chunks := c.ChunkCount(ciphertextSize)
+	return ciphertextSize - c.HeaderSize() - chunks*int64(c.aead.Overhead())
+}
+
+// CiphertextRange returns the byte range of the container holding the chunks
+// that cover plaintext bytes [offset, offset+length). Only that range needs to
+// be fetched to serve the plaintext range with DecryptRange.
+func (c *Container) CiphertextRange(offset int64, length int64) (int64, int64) {
+	chunkSize := int64(c.Header.ChunkSize)
+	first := offset / chunkSize
+	last := (offset + length - 1) / chunkSize
+	if length <= 0 {
+		last = first
+	}
+
+	start := c.HeaderSize() + first*c.SealedChunkSize()
+	end := c.HeaderSize() + (last+1)*c.SealedChunkSize()
+	return start, end - start
+}
+
+func (c *Container) nonce(index uint64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, c.Header.NoncePrefix)
+	binary.BigEndian.PutUint32(nonce[containerNoncePrefixSize:], uint32(index))
+	return nonce
+}
+
+func (c *Container) aad(index uint64, final bool) []byte {
+	aad := make([]byte, len(c.rawHeader)+9)
+	copy(aad, c.rawHeader)
+	binary.BigEndian.PutUint64(aad[len(c.rawHeader):], index)
+	if final {
+		aad[len(aad)-1] = 1
+	}
+	return aad
+}
+
+func (c *Container) sealChunk(dst []byte, index uint64, final bool, plaintext []byte) []byte {
+	return c.aead.Seal(dst, c.nonce(index), plaintext, c.aad(index, final))
+}
+
+func (c *Container) openChunk(dst []byte, index uint64, final bool, ciphertext []byte) ([]byte, error) {
+	if index > uint64(^uint32(0)) {
+		return nil, errContainerCorrupted
+	}
+	plaintext, err := c.aead.Open(dst, c.nonce(index), ciphertext, c.aad(index, final))
+	if err != nil {
+		return nil, errContainerCorrupted
+	}
+	return plaintext, nil
+}
+
+// DecryptRange returns plaintext bytes [offset, offset+length) of a container
+// whose total size is ciphertextSize. src must yield the ciphertext starting at
+// the offset returned by CiphertextRange for the same plaintext range.
+func (c *Container) DecryptRange(src io.Reader, ciphertextSize int64, offset int64, length int64) io.Reader {
+	chunkSize := int64(c.Header.ChunkSize)
+	first := offset / chunkSize
+	lastChunk := c.ChunkCount(ciphertextSize) - 1
+
+	reader := &chunkDecryptReader{
+		container: c,
+		splitter:  newChunkSplitter(src, int(c.SealedChunkSize())),
+		index:     uint64(first),
+		lastIndex: lastChunk,
+		skip:      offset - first*chunkSize,
+	}
+	return io.LimitReader(reader, length)
+}
+
+// chunkSplitter cuts a reader into fixed size chunks and reports which one is
+// the last. It reads one byte ahead so a final chunk of exactly size bytes is
+// still recognised as final.
+type chunkSplitter struct {
+	src    io.Reader
+	size   int
+	buf    []byte
+	filled int
+	done   bool
+}
+
+func newChunkSplitter(src io.Reader, size int) *chunkSplitter {
+	return &chunkSplitter{
+		src:  src,
+		size: size,
+		buf:  make([]byte, size+1),
+	}
+}
+
+func (s *chunkSplitter) next() ([]byte, bool, error) {
+	if s.done {
+		return nil, true, io.EOF
+	}
+
+	n, err := io.ReadFull(s.src, s.buf[s.filled:])
+	total := s.filled + n
+
+	switch err {
+	case nil:
+		// A byte of the next chunk is already buffered, keep it for later
+		chunk := make([]byte, s.size)
+		copy(chunk, s.buf[:s.size])
+		s.buf[0] = s.buf[s.size]
+		s.filled = 1
+		return chunk, false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		s.done = true
+		return s.buf[:total], true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+type encryptReader struct {
+	container *Container
+	splitter  *chunkSplitter
+	index     uint64
+	out       []byte
+	finished  bool
+}
+
+// NewEncryptReader returns a reader producing the container form of src. Only
+// one chunk of plaintext and ciphertext is held in memory at any time.
+func NewEncryptReader(key []byte, keyID string, src io.Reader) (io.Reader, error) {
+	container, err := NewContainer(key, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(container.rawHeader))
+	copy(header, container.rawHeader)
+
+	return &encryptReader{
+		container: container,
+		splitter:  newChunkSplitter(src, int(container.Header.ChunkSize)),
+		out:       header,
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.finished {
+			return 0, io.EOF
+		}
+
+		chunk, final, err := e.splitter.next()
+		if err != nil {
+			return 0, err
+		}
+		if e.index > uint64(^uint32(0)) {
+			return 0, errors.New("file is too large for the container format")
+		}
+
+		e.out = e.container.sealChunk(e.out[:0], e.index, final, chunk)
+		e.index++
+		e.finished = final
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// chunkDecryptReader opens consecutive chunks starting at index. When the
+// position of the final chunk is known up front (lastIndex >= 0) it is checked
+// against the chunk index, otherwise the end of src marks the final chunk.
+type chunkDecryptReader struct {
+	container *Container
+	splitter  *chunkSplitter
+	index     uint64
+	lastIndex int64
+	skip      int64
+	out       []byte
+	finished  bool
+}
+
+func (d *chunkDecryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.finished {
+			return 0, io.EOF
+		}
+
+		chunk, final, err := d.splitter.next()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if d.lastIndex >= 0 {
+			final = int64(d.index) == d.lastIndex
+		}
+
+		plaintext, err := d.container.openChunk(d.out[:0], d.index, final, chunk)
+		if err != nil {
+			return 0, err
+		}
+
+		if d.skip > 0 {
+			if d.skip >= int64(len(plaintext)) {
+				return 0, errContainerCorrupted
+			}
+			plaintext = plaintext[d.skip:]
+			d.skip = 0
+		}
+
+		d.out = plaintext
+		d.index++
+		d.finished = final
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// NewDecryptReader reads a whole container from src. keyFor is called with
+// the parsed header to select the key, which lets callers pick a key by ID or
+// reject a container sealed with a key they do not expect. It returns an
+// error as soon as a chunk fails authentication or the container ends before
+// its final chunk.
+func NewDecryptReader(keyFor func(ContainerHeader) ([]byte, error), src io.Reader) (io.Reader, error) {
+	header, err := ReadContainerHeader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keyFor(header)
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := OpenContainer(key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkDecryptReader{
+		container: container,
+		splitter:  newChunkSplitter(src, int(container.SealedChunkSize())),
+		lastIndex: -1,
+	}, nil
+}
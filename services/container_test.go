@@ -0,0 +1,237 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encryptAll(t *testing.T, key []byte, plaintext []byte) []byte {
+	t.Helper()
+	reader, err := NewEncryptReader(key, KeyFingerprint(key), bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func decryptAll(key []byte, ciphertext []byte) ([]byte, error) {
+	reader, err := NewDecryptReader(func(ContainerHeader) ([]byte, error) {
+		return key, nil
+	}, bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// openTestContainer parses the header of ciphertext.
+func openTestContainer(t *testing.T, key []byte, ciphertext []byte) *Container {
+	t.Helper()
+	header, err := ReadContainerHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := OpenContainer(key, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return container
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func TestContainerRoundTrip(t *testing.T) {
+	key := testKey(t)
+	tests := []struct {
+		name   string
+		size   int
+		chunks int64
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"one chunk", DefaultChunkSize, 1},
+		{"one chunk and a byte", DefaultChunkSize + 1, 2},
+		{"several chunks", 3*DefaultChunkSize + 100, 4},
+		{"whole chunks", 4 * DefaultChunkSize, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext := randomBytes(test.size)
+			ciphertext := encryptAll(t, key, plaintext)
+			if !IsContainer(ciphertext) {
+				t.Fatal("ciphertext does not start with the magic")
+			}
+
+			got, err := decryptAll(key, ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("decrypted %d bytes, want %d", len(got), len(plaintext))
+			}
+
+			container := openTestContainer(t, key, ciphertext)
+			if got := container.ChunkCount(int64(len(ciphertext))); got != test.chunks {
+				t.Errorf("ChunkCount = %d, want %d", got, test.chunks)
+			}
+			if got := container.PlaintextSize(int64(len(ciphertext))); got != int64(test.size) {
+				t.Errorf("PlaintextSize = %d, want %d", got, test.size)
+			}
+		})
+	}
+}
+
+func TestContainerTampering(t *testing.T) {
+	key := testKey(t)
+	plaintext := randomBytes(3*DefaultChunkSize + 100)
+	ciphertext := encryptAll(t, key, plaintext)
+	container := openTestContainer(t, key, ciphertext)
+	headerSize := int(container.HeaderSize())
+	sealed := int(container.SealedChunkSize())
+
+	chunk := func(i int) []byte {
+		return ciphertext[headerSize+i*sealed : headerSize+(i+1)*sealed]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := ciphertext[:headerSize]
+
+	keyID := append([]byte(nil), ciphertext...)
+	keyID[10] ^= 1
+	noncePrefix := append([]byte(nil), ciphertext...)
+	noncePrefix[headerSize-1] ^= 1
+	flipped := append([]byte(nil), ciphertext...)
+	flipped[headerSize+sealed+5] ^= 1
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"header only", header},
+		{"truncated after the first chunk", ciphertext[:headerSize+sealed]},
+		{"truncated after the third chunk", ciphertext[:headerSize+3*sealed]},
+		{"truncated inside the final chunk", ciphertext[:len(ciphertext)-1]},
+		{"swapped chunks", join(header, chunk(1), chunk(0), ciphertext[headerSize+2*sealed:])},
+		{"repeated chunk", join(header, chunk(0), chunk(0), ciphertext[headerSize+2*sealed:])},
+		{"chunk after the final one", join(ciphertext, chunk(0))},
+		{"flipped bit", flipped},
+		{"key ID", keyID},
+		{"nonce prefix", noncePrefix},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decryptAll(key, test.ciphertext); !errors.Is(err, ErrDecryptionFailed) {
+				t.Fatalf("decrypting returned %v, want ErrDecryptionFailed", err)
+			}
+		})
+	}
+
+	if _, err := decryptAll(testKey(t), ciphertext); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("decrypting with another key returned %v", err)
+	}
+	if _, err := decryptAll(key, []byte("plain text")); err != errNotContainer {
+		t.Errorf("decrypting plaintext returned %v", err)
+	}
+}
+
+func TestContainerFinalFlag(t *testing.T) {
+	key := testKey(t)
+	container, err := NewContainer(key, KeyFingerprint(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := container.rawHeader
+	full := randomBytes(DefaultChunkSize)
+
+	// A container cut after a chunk that is not the final one
+	notFinal := container.sealChunk(append([]byte(nil), header...), 0, false, full)
+	if _, err := decryptAll(key, notFinal); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("container without a final chunk: %v", err)
+	}
+
+	// A final chunk followed by another chunk
+	final := container.sealChunk(append([]byte(nil), header...), 0, true, full)
+	extended := container.sealChunk(final, 1, true, []byte("more"))
+	if _, err := decryptAll(key, extended); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("container extended past its final chunk: %v", err)
+	}
+
+	if got, err := decryptAll(key, final); err != nil || !bytes.Equal(got, full) {
+		t.Errorf("sealed final chunk decrypts to %d bytes, %v", len(got), err)
+	}
+}
+
+func TestContainerRange(t *testing.T) {
+	key := testKey(t)
+	plaintext := randomBytes(3*DefaultChunkSize + 100)
+	ciphertext := encryptAll(t, key, plaintext)
+	container := openTestContainer(t, key, ciphertext)
+	size := int64(len(plaintext))
+
+	tests := []struct {
+		name           string
+		offset, length int64
+	}{
+		{"start of the first chunk", 0, 10},
+		{"whole first chunk", 0, DefaultChunkSize},
+		{"end of a chunk", DefaultChunkSize - 10, 10},
+		{"across a chunk boundary", DefaultChunkSize - 10, 20},
+		{"across several chunks", 100, 2*DefaultChunkSize + 50},
+		{"start of a chunk", 2 * DefaultChunkSize, 5},
+		{"final chunk", 3 * DefaultChunkSize, 100},
+		{"tail", size - 1, 1},
+		{"everything", 0, size},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, length := container.CiphertextRange(test.offset, test.length)
+			if (start-container.HeaderSize())%container.SealedChunkSize() != 0 {
+				t.Fatalf("range starts at %d, inside a chunk", start)
+			}
+			end := start + length
+			if end > int64(len(ciphertext)) {
+				end = int64(len(ciphertext))
+			}
+
+			reader := container.DecryptRange(bytes.NewReader(ciphertext[start:end]), int64(len(ciphertext)), test.offset, test.length)
+			got, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext[test.offset:test.offset+test.length]) {
+				t.Fatalf("got %d bytes, not plaintext[%d:%d]", len(got), test.offset, test.offset+test.length)
+			}
+		})
+	}
+
+	// A range whose chunks were tampered with fails like a whole container
+	start, length := container.CiphertextRange(DefaultChunkSize, 10)
+	tampered := append([]byte(nil), ciphertext[start:start+length]...)
+	tampered[0] ^= 1
+	reader := container.DecryptRange(bytes.NewReader(tampered), int64(len(ciphertext)), DefaultChunkSize, 10)
+	if _, err := io.Copy(ioutil.Discard, reader); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("decrypting a tampered range returned %v", err)
+	}
+}
@@ -1,207 +1,213 @@
 package services
 
 import (
-	"context"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"os"
-	"time"
 
 	"github.com/faizainur/ipfs-api/cutils"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type CryptoService struct {
-	secret     []byte
-	collection *mongo.Collection
+	keyring *cutils.Keyring
+	store   KeyStore
 }
 
 type UserKey struct {
-	Email string `json:"email,omitempty"  bson:"email"  form:"email"  binding:"email"`
-	Key   string `json:"key,omitempty"  bson:"key"  form:"key"  binding:"key"`
+	Email      string `json:"email,omitempty"  bson:"email"  form:"email"  binding:"email"`
+	Key        string `json:"key,omitempty"  bson:"key"  form:"key"  binding:"key"`
+	KeyVersion int    `json:"key_version,omitempty"  bson:"key_version,omitempty"  form:"key_version"  binding:"key_version"`
 }
 
-func NewCryptoService(secret []byte) *CryptoService {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	dbConfig := cutils.DbUtils{ConnectionString: os.Getenv("MONGODB_URI")}
-	client, err := dbConfig.Connect(ctx)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-
-	fmt.Println("Connected to Mongo URI")
-
-	dbCrypto := client.Database("crypto")
-	collection := dbCrypto.Collection("secret")
-
+func NewCryptoService(keyring *cutils.Keyring, store KeyStore) *CryptoService {
 	return &CryptoService{
-		secret:     secret,
-		collection: collection,
+		keyring: keyring,
+		store:   store,
 	}
 }
 
-func (c *CryptoService) AESEncrypt(key []byte, data []byte) []byte {
-	block, errChiper := aes.NewCipher(key)
-	if errChiper != nil {
-		panic(errChiper)
-	}
-
-	gcm, errGcm := cipher.NewGCM(block)
-	if errGcm != nil {
-		panic(errGcm)
+func (c *CryptoService) AESEncrypt(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
 	}
 
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err)
+		return nil, err
 	}
 	chipertext := gcm.Seal(nonce, nonce, data, nil)
 
-	return chipertext
+	return chipertext, nil
 }
 
-func (c *CryptoService) AESDecrypt(key []byte, data []byte) []byte {
-	block, errChiper := aes.NewCipher(key)
-	if errChiper != nil {
-		panic(errChiper)
+// AESDecrypt opens data sealed by AESEncrypt. It returns ErrDecryptionFailed
+// if data was sealed with another key or has been tampered with.
+func (c *CryptoService) AESDecrypt(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
 	}
 
-	gcm, errGcm := cipher.NewGCM(block)
-	if errGcm != nil {
-		panic(errGcm)
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: ciphertext is too short", ErrDecryptionFailed)
 	}
-
 	nonce := data[:gcm.NonceSize()]
 	chipertext := data[gcm.NonceSize():]
 	plaintext, err := gcm.Open(nil, nonce, chipertext, nil)
 	if err != nil {
-		panic(err)
+		return nil, ErrDecryptionFailed
 	}
-	return plaintext
+	return plaintext, nil
 }
 
-func (c *CryptoService) EncryptUserFile(email string, file []byte) ([]byte, error) {
-	// key := make([]byte, 24)
-
-	key := c.FetchDecryptedKey(email)
-	if key != nil {
-		// User key exist
-		// Encrypt file with the existing key
-		encryptedFile := c.AESEncrypt(key, file)
-		return encryptedFile, nil
-	}
-	// Key is not exist for the email
-	// Generate new user key and store the encrypted key to database
-	// Encrypted user key is encrypted using master key
-	key, err := c.GenerateUserKeyWithStoring(email)
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	encryptedFile := c.AESEncrypt(key, file)
-	return encryptedFile, nil
+	return cipher.NewGCM(block)
 }
 
-func (c *CryptoService) DecryptUserFile(email string, file []byte) []byte {
-	key := c.FetchDecryptedKey(email)
-	if key != nil {
-		// User key exist
-		// Decrypt file with the existing key
-		decryptedFile := c.AESDecrypt(key, file)
-		return decryptedFile
+func (c *CryptoService) EncryptUserFile(email string, file []byte) ([]byte, error) {
+	key, err := c.userKey(email)
+	if err != nil {
+		return nil, err
 	}
-	// Key is not exist
-	// Cannot decrypt file
-	return nil
+	return c.AESEncrypt(key, file)
 }
 
-func (c *CryptoService) FetchKey(email string) []byte {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	var data UserKey
+// userKey returns the user key of email, generating and storing one if the
+// user does not have one yet.
+func (c *CryptoService) userKey(email string) ([]byte, error) {
+	key, err := c.FetchDecryptedKey(email)
+	if err == ErrKeyNotFound {
+		// Key is not exist for the email
+		// Generate new user key and store the encrypted key to database
+		// Encrypted user key is encrypted using master key
+		return c.GenerateUserKeyWithStoring(email)
+	}
+	return key, err
+}
 
-	filter := bson.D{{"email", email}}
+// DecryptUserStream decrypts a container sealed directly with the user key.
+// Files uploaded before per-file keys were introduced are stored this way.
+func (c *CryptoService) DecryptUserStream(email string, file io.Reader) (io.Reader, error) {
+	return NewDecryptReader(func(header ContainerHeader) ([]byte, error) {
+		return c.userContainerKey(email, header)
+	}, file)
+}
 
-	errMongo := c.collection.FindOne(ctx, filter).Decode(&data)
-	if errMongo != nil {
-		// key not exist for this email
-		return nil
+func (c *CryptoService) userContainerKey(email string, header ContainerHeader) ([]byte, error) {
+	key, err := c.FetchDecryptedKey(email)
+	if err != nil {
+		return nil, err
+	}
+	if header.KeyID != KeyFingerprint(key) {
+		return nil, errDifferentKey
 	}
+	return key, nil
+}
 
-	key, err := hex.DecodeString(data.Key)
+func (c *CryptoService) DecryptUserFile(email string, file []byte) ([]byte, error) {
+	key, err := c.FetchDecryptedKey(email)
 	if err != nil {
-		panic(err)
+		// Key is not exist
+		// Cannot decrypt file
+		return nil, err
 	}
-	return key
-}
 
-func (c *CryptoService) FetchDecryptedKey(email string) []byte {
-	key := c.FetchKey(email)
-	if key == nil {
-		return nil
+	// Files uploaded through the streaming pipeline are containers
+	if IsContainer(file) {
+		reader, err := c.DecryptUserStream(email, bytes.NewReader(file))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
 	}
-	decryptedKey := c.AESDecrypt(c.secret, key)
-	return decryptedKey
+	// Decrypt file with the existing key
+	return c.AESDecrypt(key, file)
 }
 
-func (c *CryptoService) StoreKey(email string, key string) error {
-	var userKey UserKey
-
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+// FetchKey returns the wrapped user key of email and the version of the master
+// key that wrapped it.
+func (c *CryptoService) FetchKey(email string) ([]byte, int, error) {
+	ctx, cancel := repositoryContext()
 	defer cancel()
 
-	isExist, errEmailExist := c.IsEmailExist(email)
-	if errEmailExist != nil {
-		panic(errEmailExist)
+	data, err := c.store.Get(ctx, email)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	if isExist {
-		return nil
+	key, err := hex.DecodeString(data.Key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: stored key of %s is not valid hex", ErrDecryptionFailed, email)
 	}
+	return key, data.KeyVersion, nil
+}
 
-	userKey.Email = email
-	userKey.Key = key
-
-	_, err := c.collection.InsertOne(ctx, userKey)
+func (c *CryptoService) FetchDecryptedKey(email string) ([]byte, error) {
+	key, version, err := c.FetchKey(email)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	masterKey, ok := c.keyring.Key(version)
+	if !ok {
+		log.Printf("master key version %d needed for %s is not loaded", version, email)
+		return nil, fmt.Errorf("%w: master key version %d is not loaded", ErrDecryptionFailed, version)
 	}
-	return nil
+	return c.AESDecrypt(masterKey, key)
+}
+
+func (c *CryptoService) StoreKey(email string, key string, keyVersion int) (bool, error) {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	userKey := UserKey{
+		Email:      email,
+		Key:        key,
+		KeyVersion: keyVersion,
+	}
+
+	return c.store.PutIfAbsent(ctx, userKey)
 }
 
 func (c *CryptoService) GenerateUserKeyWithStoring(email string) ([]byte, error) {
 	key := cutils.GenerateKey()
 
-	encryptedKey := c.AESEncrypt(c.secret, key)
+	version, masterKey := c.keyring.Active()
+	encryptedKey, err := c.AESEncrypt(masterKey, key)
+	if err != nil {
+		return nil, err
+	}
 
 	encodedKey := hex.EncodeToString(encryptedKey)
-	err := c.StoreKey(email, string(encodedKey))
+	stored, err := c.StoreKey(email, string(encodedKey), version)
 	if err != nil {
 		return nil, err
 	}
+	if !stored {
+		// Another request created the key first, use that one
+		return c.FetchDecryptedKey(email)
+	}
 	return key, nil
 }
 
 func (c *CryptoService) IsEmailExist(email string) (bool, error) {
-	var isExist bool = false
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := repositoryContext()
 	defer cancel()
 
-	opts := options.Count().SetMaxTime(2 * time.Second)
-	count, err := c.collection.CountDocuments(ctx, bson.D{{"email", email}}, opts)
-
-	if count > 0 && err == nil {
-		isExist = true
+	_, err := c.store.Get(ctx, email)
+	if err == ErrKeyNotFound {
+		return false, nil
 	}
-
-	return isExist, err
+	return err == nil, err
 }
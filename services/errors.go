@@ -0,0 +1,17 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrKeyNotFound means the user has no key yet, so nothing of theirs can
+	// be decrypted.
+	ErrKeyNotFound = errors.New("no key found for this user")
+	// ErrDecryptionFailed means a key or a file did not authenticate: it was
+	// sealed with another key, or it is truncated or corrupted.
+	ErrDecryptionFailed = errors.New("decryption failed")
+)
+
+var errDifferentKey = fmt.Errorf("%w: file was encrypted with a different key", ErrDecryptionFailed)
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/faizainur/ipfs-api/cutils"
+)
+
+// FileKey is the envelope of the data encryption key (DEK) of one file. The
+// DEK is wrapped with the owner's user key, so sharing or revoking one file
+// only involves its own DEK, and dropping the wrapped DEK makes the file
+// unrecoverable without touching the owner's other files.
+type FileKey struct {
+	KeyID      string `json:"key_id,omitempty"  bson:"key_id,omitempty"  form:"key_id"  binding:"key_id"`
+	WrappedKey string `json:"-"  bson:"wrapped_key,omitempty"  form:"wrapped_key"  binding:"wrapped_key"`
+}
+
+// NewFileKey generates a fresh DEK for one upload of email and returns it
+// together with its wrapped form, creating the user key on first use.
+func (c *CryptoService) NewFileKey(email string) ([]byte, FileKey, error) {
+	userKey, err := c.userKey(email)
+	if err != nil {
+		return nil, FileKey{}, err
+	}
+
+	dek := cutils.GenerateKey()
+	wrappedKey, err := c.AESEncrypt(userKey, dek)
+	if err != nil {
+		return nil, FileKey{}, err
+	}
+
+	return dek, FileKey{
+		KeyID:      KeyFingerprint(dek),
+		WrappedKey: hex.EncodeToString(wrappedKey),
+	}, nil
+}
+
+// UnwrapFileKey returns the DEK of a file owned by email.
+func (c *CryptoService) UnwrapFileKey(email string, fileKey FileKey) ([]byte, error) {
+	userKey, err := c.FetchDecryptedKey(email)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := hex.DecodeString(fileKey.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrapped file key is not valid hex", ErrDecryptionFailed)
+	}
+
+	dek, err := c.AESDecrypt(userKey, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if KeyFingerprint(dek) != fileKey.KeyID {
+		return nil, fmt.Errorf("%w: file key does not match its key ID", ErrDecryptionFailed)
+	}
+	return dek, nil
+}
+
+// EncryptFileStream seals file into a container keyed with dek.
+func (c *CryptoService) EncryptFileStream(dek []byte, file io.Reader) (io.Reader, error) {
+	return NewEncryptReader(dek, KeyFingerprint(dek), file)
+}
+
+// DecryptFileStream opens a container sealed by EncryptFileStream.
+func (c *CryptoService) DecryptFileStream(dek []byte, file io.Reader) (io.Reader, error) {
+	return NewDecryptReader(func(header ContainerHeader) ([]byte, error) {
+		if header.KeyID != KeyFingerprint(dek) {
+			return nil, errDifferentKey
+		}
+		return dek, nil
+	}, file)
+}
+
+// OpenFileContainer returns the container described by header keyed with dek,
+// ready for DecryptRange.
+func (c *CryptoService) OpenFileContainer(dek []byte, header ContainerHeader) (*Container, error) {
+	if header.KeyID != KeyFingerprint(dek) {
+		return nil, errDifferentKey
+	}
+	return OpenContainer(dek, header)
+}
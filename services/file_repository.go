@@ -0,0 +1,695 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrFileNotFound = errors.New("file not found")
+
+// FileRepository stores the metadata of uploaded files. Handlers only go
+// through this interface so they do not depend on MongoDB.
+type FileRepository interface {
+	// Save inserts file, assigning it an ID, or replaces the record with the
+	// same ID.
+	Save(ctx context.Context, file *UserFile) error
+	FindByCid(ctx context.Context, email string, cid string) (*UserFile, error)
+	FindByID(ctx context.Context, email string, id primitive.ObjectID) (*UserFile, error)
+	// List returns one page of the files of email matching query, newest
+	// first, and the total number of matching files.
+	List(ctx context.Context, email string, query FileQuery) ([]UserFile, int64, error)
+	ListCids(ctx context.Context, email string) ([]string, error)
+	// CountByCid returns how many files of any user have cid.
+	CountByCid(ctx context.Context, cid string) (int64, error)
+	// CountByDirectory returns how many files of any user were uploaded in
+	// directory.
+	CountByDirectory(ctx context.Context, directory string) (int64, error)
+	// MoveFolder moves the files of email in folder, or in a folder under
+	// it, to the same place under to. folder is not the root.
+	MoveFolder(ctx context.Context, email string, folder string, to string) error
+	// ClearFolder takes the files of email in folder, or in a folder under
+	// it, out of their folder. folder is not the root.
+	ClearFolder(ctx context.Context, email string, folder string) error
+	Delete(ctx context.Context, email string, id primitive.ObjectID) error
+	// ListByRemotePinStatus returns up to limit files of any user whose
+	// remote pin has one of statuses, ordered by ID, starting after afterID.
+	ListByRemotePinStatus(ctx context.Context, statuses []string, afterID primitive.ObjectID, limit int64) ([]UserFile, error)
+	// UpdateRemotePin replaces the remote pin state of the file id, leaving
+	// the rest of the record alone. state is the state of cid, so it does
+	// nothing when the file has another CID by now.
+	UpdateRemotePin(ctx context.Context, id primitive.ObjectID, cid string, state RemotePinState) error
+	// UpdateTags replaces the tags and the update time of file, leaving the
+	// rest of the record alone.
+	UpdateTags(ctx context.Context, file *UserFile) error
+	// UpdateFolder sets the folder of file, leaving the rest of the record
+	// alone.
+	UpdateFolder(ctx context.Context, file *UserFile) error
+	// UpdateContent replaces the content of file, the fields a version sets,
+	// leaving its tags, folder and the rest of the record alone. It fails
+	// with ErrVersionConflict unless the record is still at the version
+	// before file.Version.
+	UpdateContent(ctx context.Context, file *UserFile) error
+	// ListFolderStale returns up to limit files of any user whose folder
+	// entry is stale, ordered by ID, starting after afterID.
+	ListFolderStale(ctx context.Context, afterID primitive.ObjectID, limit int64) ([]UserFile, error)
+	// ClearFolderStale marks the folder entry of the file id as up to date
+	// with cid. It does nothing when the file has another CID by now.
+	ClearFolderStale(ctx context.Context, id primitive.ObjectID, cid string) error
+}
+
+// FileQuery filters and paginates FileRepository.List.
+type FileQuery struct {
+	// Name matches files whose name contains it, ignoring case
+	Name string
+	// MimeType matches exactly, or as a prefix when it ends with "/" or "/*"
+	// ("image/*" matches every image)
+	MimeType string
+	// From and To bound the creation time, zero values are open ends
+	From time.Time
+	To   time.Time
+
+	Offset int64
+	Limit  int64
+}
+
+func (q FileQuery) mimePrefix() (string, bool) {
+	if strings.HasSuffix(q.MimeType, "/*") {
+		return strings.TrimSuffix(q.MimeType, "*"), true
+	}
+	if strings.HasSuffix(q.MimeType, "/") {
+		return q.MimeType, true
+	}
+	return q.MimeType, false
+}
+
+func (q FileQuery) matches(file UserFile) bool {
+	if q.Name != "" && !strings.Contains(strings.ToLower(file.Name), strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.MimeType != "" {
+		mimeType, isPrefix := q.mimePrefix()
+		if isPrefix && !strings.HasPrefix(file.MimeType, mimeType) {
+			return false
+		}
+		if !isPrefix && file.MimeType != mimeType {
+			return false
+		}
+	}
+	if !q.From.IsZero() && file.CreatedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && file.CreatedAt.After(q.To) {
+		return false
+	}
+	return true
+}
+
+type MongoFileRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoFileRepository(db *mongo.Database) *MongoFileRepository {
+	return &MongoFileRepository{
+		collection: db.Collection("files"),
+	}
+}
+
+// EnsureIndexes creates the indexes the queries of the repository rely on.
+func (m *MongoFileRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := m.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "cid", Value: 1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "remote_pin.status", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "cid", Value: 1}}},
+		{Keys: bson.D{{Key: "directory", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "folder", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "folder_stale", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
+
+func (m *MongoFileRepository) Save(ctx context.Context, file *UserFile) error {
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+
+	opts := options.Replace().SetUpsert(true)
+	_, err := m.collection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: file.ID}}, file, opts)
+	return err
+}
+
+func (m *MongoFileRepository) FindByCid(ctx context.Context, email string, cid string) (*UserFile, error) {
+	var file UserFile
+
+	filter := bson.D{{Key: "email", Value: email}, {Key: "cid", Value: cid}}
+	err := m.collection.FindOne(ctx, filter).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (m *MongoFileRepository) FindByID(ctx context.Context, email string, id primitive.ObjectID) (*UserFile, error) {
+	var file UserFile
+
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "email", Value: email}}
+	err := m.collection.FindOne(ctx, filter).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (m *MongoFileRepository) List(ctx context.Context, email string, query FileQuery) ([]UserFile, int64, error) {
+	filter := bson.M{"email": email}
+	if query.Name != "" {
+		filter["name"] = primitive.Regex{Pattern: regexp.QuoteMeta(query.Name), Options: "i"}
+	}
+	if query.MimeType != "" {
+		mimeType, isPrefix := query.mimePrefix()
+		if isPrefix {
+			filter["mime_type"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(mimeType)}
+		} else {
+			filter["mime_type"] = mimeType
+		}
+	}
+	if !query.From.IsZero() || !query.To.IsZero() {
+		createdAt := bson.M{}
+		if !query.From.IsZero() {
+			createdAt["$gte"] = query.From
+		}
+		if !query.To.IsZero() {
+			createdAt["$lte"] = query.To
+		}
+		filter["created_at"] = createdAt
+	}
+
+	total, err := m.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(query.Offset).
+		SetLimit(query.Limit)
+
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	files := make([]UserFile, 0)
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, 0, err
+	}
+	return files, total, nil
+}
+
+func (m *MongoFileRepository) ListCids(ctx context.Context, email string) ([]string, error) {
+	cids, err := m.collection.Distinct(ctx, "cid", bson.D{{Key: "email", Value: email}})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(cids))
+	for _, cid := range cids {
+		if value, ok := cid.(string); ok {
+			result = append(result, value)
+		}
+	}
+	return result, nil
+}
+
+func (m *MongoFileRepository) CountByCid(ctx context.Context, cid string) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{{Key: "cid", Value: cid}})
+}
+
+func (m *MongoFileRepository) CountByDirectory(ctx context.Context, directory string) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{{Key: "directory", Value: directory}})
+}
+
+func (m *MongoFileRepository) MoveFolder(ctx context.Context, email string, folder string, to string) error {
+	filter := bson.D{{Key: "email", Value: email}, {Key: "folder", Value: folderPattern(folder)}}
+
+	// The path under folder is kept, only its prefix changes
+	rest := bson.M{"$substrCP": bson.A{"$folder", utf8.RuneCountInString(folder), bson.M{"$strLenCP": "$folder"}}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{"folder": bson.M{"$concat": bson.A{to, rest}}}}}}
+
+	_, err := m.collection.UpdateMany(ctx, filter, update)
+	return err
+}
+
+func (m *MongoFileRepository) ClearFolder(ctx context.Context, email string, folder string) error {
+	filter := bson.D{{Key: "email", Value: email}, {Key: "folder", Value: folderPattern(folder)}}
+	_, err := m.collection.UpdateMany(ctx, filter, bson.M{"$unset": bson.M{"folder": ""}})
+	return err
+}
+
+// folderPattern matches folder and the folders under it.
+func folderPattern(folder string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(folder) + "(/|$)"}
+}
+
+func (m *MongoFileRepository) Delete(ctx context.Context, email string, id primitive.ObjectID) error {
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "email", Value: email}}
+	result, err := m.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+func (m *MongoFileRepository) ListByRemotePinStatus(ctx context.Context, statuses []string, afterID primitive.ObjectID, limit int64) ([]UserFile, error) {
+	filter := bson.M{
+		"remote_pin.status": bson.M{"$in": statuses},
+		"_id":               bson.M{"$gt": afterID},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]UserFile, 0)
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (m *MongoFileRepository) UpdateRemotePin(ctx context.Context, id primitive.ObjectID, cid string, state RemotePinState) error {
+	_, err := m.collection.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "cid", Value: cid}},
+		bson.M{"$set": bson.M{"remote_pin": state}},
+	)
+	return err
+}
+
+func (m *MongoFileRepository) UpdateTags(ctx context.Context, file *UserFile) error {
+	return m.update(ctx, bson.D{{Key: "_id", Value: file.ID}, {Key: "email", Value: file.Email}}, bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "tags", Value: file.Tags},
+			{Key: "updated_at", Value: file.UpdatedAt},
+		}},
+	}, ErrFileNotFound)
+}
+
+func (m *MongoFileRepository) UpdateFolder(ctx context.Context, file *UserFile) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "folder", Value: file.Folder}}}}
+	if file.Folder == "" {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: "folder", Value: ""}}}}
+	}
+	return m.update(ctx, bson.D{{Key: "_id", Value: file.ID}, {Key: "email", Value: file.Email}}, update, ErrFileNotFound)
+}
+
+func (m *MongoFileRepository) UpdateContent(ctx context.Context, file *UserFile) error {
+	// Records of files without a history have no version
+	var previous interface{} = file.Version - 1
+	if file.Version <= 2 {
+		previous = bson.D{{Key: "$in", Value: bson.A{nil, 0, 1}}}
+	}
+	filter := bson.D{{Key: "_id", Value: file.ID}, {Key: "email", Value: file.Email}, {Key: "version", Value: previous}}
+
+	set := bson.D{
+		{Key: "cid", Value: file.Cid},
+		{Key: "name", Value: file.Name},
+		{Key: "mime_type", Value: file.MimeType},
+		{Key: "plaintext_size", Value: file.Size},
+		{Key: "ciphertext_size", Value: file.CiphertextSize},
+		{Key: "version", Value: file.Version},
+		{Key: "previous", Value: file.Previous},
+		{Key: "key_id", Value: file.KeyID},
+		{Key: "wrapped_key", Value: file.WrappedKey},
+		{Key: "updated_at", Value: file.UpdatedAt},
+	}
+	unset := bson.D{}
+	if file.Directory != "" {
+		set = append(set, bson.E{Key: "directory", Value: file.Directory})
+	} else {
+		unset = append(unset, bson.E{Key: "directory", Value: ""})
+	}
+	if file.RemotePin != nil {
+		set = append(set, bson.E{Key: "remote_pin", Value: file.RemotePin})
+	} else {
+		unset = append(unset, bson.E{Key: "remote_pin", Value: ""})
+	}
+	if file.FolderStale {
+		set = append(set, bson.E{Key: "folder_stale", Value: true})
+	} else {
+		unset = append(unset, bson.E{Key: "folder_stale", Value: ""})
+	}
+
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	return m.update(ctx, filter, update, ErrVersionConflict)
+}
+
+func (m *MongoFileRepository) ListFolderStale(ctx context.Context, afterID primitive.ObjectID, limit int64) ([]UserFile, error) {
+	filter := bson.M{
+		"folder_stale": true,
+		"_id":          bson.M{"$gt": afterID},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]UserFile, 0)
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (m *MongoFileRepository) ClearFolderStale(ctx context.Context, id primitive.ObjectID, cid string) error {
+	_, err := m.collection.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}, {Key: "cid", Value: cid}},
+		bson.D{{Key: "$unset", Value: bson.D{{Key: "folder_stale", Value: ""}}}},
+	)
+	return err
+}
+
+// update applies update to the file matching filter, notFound when there is
+// none.
+func (m *MongoFileRepository) update(ctx context.Context, filter bson.D, update bson.D, notFound error) error {
+	result, err := m.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// MemoryFileRepository keeps file records in memory, for tests and for
+// running the service without a database.
+type MemoryFileRepository struct {
+	mutex sync.RWMutex
+	files map[primitive.ObjectID]UserFile
+}
+
+func NewMemoryFileRepository() *MemoryFileRepository {
+	return &MemoryFileRepository{
+		files: make(map[primitive.ObjectID]UserFile),
+	}
+}
+
+func (m *MemoryFileRepository) Save(ctx context.Context, file *UserFile) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+	m.files[file.ID] = *file
+	return nil
+}
+
+func (m *MemoryFileRepository) FindByCid(ctx context.Context, email string, cid string) (*UserFile, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, file := range m.files {
+		if file.Email == email && file.Cid == cid {
+			found := file
+			return &found, nil
+		}
+	}
+	return nil, ErrFileNotFound
+}
+
+func (m *MemoryFileRepository) FindByID(ctx context.Context, email string, id primitive.ObjectID) (*UserFile, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	file, ok := m.files[id]
+	if !ok || file.Email != email {
+		return nil, ErrFileNotFound
+	}
+	return &file, nil
+}
+
+func (m *MemoryFileRepository) List(ctx context.Context, email string, query FileQuery) ([]UserFile, int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	matched := make([]UserFile, 0)
+	for _, file := range m.files {
+		if file.Email == email && query.matches(file) {
+			matched = append(matched, file)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].ID.Hex() > matched[j].ID.Hex()
+		}
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	total := int64(len(matched))
+	start := query.Offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if query.Limit > 0 && start+query.Limit < total {
+		end = start + query.Limit
+	}
+	return matched[start:end], total, nil
+}
+
+func (m *MemoryFileRepository) ListCids(ctx context.Context, email string) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	cids := make([]string, 0)
+	for _, file := range m.files {
+		if file.Email == email && !seen[file.Cid] {
+			seen[file.Cid] = true
+			cids = append(cids, file.Cid)
+		}
+	}
+	return cids, nil
+}
+
+func (m *MemoryFileRepository) CountByCid(ctx context.Context, cid string) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var count int64
+	for _, file := range m.files {
+		if file.Cid == cid {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryFileRepository) CountByDirectory(ctx context.Context, directory string) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var count int64
+	for _, file := range m.files {
+		if file.Directory == directory {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryFileRepository) MoveFolder(ctx context.Context, email string, folder string, to string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, file := range m.files {
+		if file.Email == email && inFolder(file.Folder, folder) {
+			file.Folder = to + strings.TrimPrefix(file.Folder, folder)
+			m.files[id] = file
+		}
+	}
+	return nil
+}
+
+func (m *MemoryFileRepository) ClearFolder(ctx context.Context, email string, folder string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, file := range m.files {
+		if file.Email == email && inFolder(file.Folder, folder) {
+			file.Folder = ""
+			m.files[id] = file
+		}
+	}
+	return nil
+}
+
+func inFolder(path string, folder string) bool {
+	return path == folder || strings.HasPrefix(path, folder+"/")
+}
+
+func (m *MemoryFileRepository) Delete(ctx context.Context, email string, id primitive.ObjectID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	file, ok := m.files[id]
+	if !ok || file.Email != email {
+		return ErrFileNotFound
+	}
+	delete(m.files, id)
+	return nil
+}
+
+func (m *MemoryFileRepository) ListByRemotePinStatus(ctx context.Context, statuses []string, afterID primitive.ObjectID, limit int64) ([]UserFile, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	matched := make([]UserFile, 0)
+	for _, file := range m.files {
+		if file.RemotePin != nil && containsString(statuses, file.RemotePin.Status) && file.ID.Hex() > afterID.Hex() {
+			matched = append(matched, file)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].ID.Hex() < matched[j].ID.Hex()
+	})
+
+	if limit > 0 && int64(len(matched)) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+func (m *MemoryFileRepository) UpdateRemotePin(ctx context.Context, id primitive.ObjectID, cid string, state RemotePinState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if file, ok := m.files[id]; ok && file.Cid == cid {
+		file.RemotePin = &state
+		m.files[id] = file
+	}
+	return nil
+}
+
+func (m *MemoryFileRepository) UpdateTags(ctx context.Context, file *UserFile) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.files[file.ID]
+	if !ok || stored.Email != file.Email {
+		return ErrFileNotFound
+	}
+	stored.Tags = file.Tags
+	stored.UpdatedAt = file.UpdatedAt
+	m.files[file.ID] = stored
+	return nil
+}
+
+func (m *MemoryFileRepository) UpdateFolder(ctx context.Context, file *UserFile) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.files[file.ID]
+	if !ok || stored.Email != file.Email {
+		return ErrFileNotFound
+	}
+	stored.Folder = file.Folder
+	m.files[file.ID] = stored
+	return nil
+}
+
+func (m *MemoryFileRepository) UpdateContent(ctx context.Context, file *UserFile) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.files[file.ID]
+	if !ok || stored.Email != file.Email || versionNumber(&stored) != file.Version-1 {
+		return ErrVersionConflict
+	}
+	stored.Cid = file.Cid
+	stored.Name = file.Name
+	stored.MimeType = file.MimeType
+	stored.Size = file.Size
+	stored.CiphertextSize = file.CiphertextSize
+	stored.Directory = file.Directory
+	stored.RemotePin = file.RemotePin
+	stored.Version = file.Version
+	stored.Previous = file.Previous
+	stored.FileKey = file.FileKey
+	stored.FolderStale = file.FolderStale
+	stored.UpdatedAt = file.UpdatedAt
+	m.files[file.ID] = stored
+	return nil
+}
+
+func (m *MemoryFileRepository) ListFolderStale(ctx context.Context, afterID primitive.ObjectID, limit int64) ([]UserFile, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	matched := make([]UserFile, 0)
+	for _, file := range m.files {
+		if file.FolderStale && file.ID.Hex() > afterID.Hex() {
+			matched = append(matched, file)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].ID.Hex() < matched[j].ID.Hex()
+	})
+
+	if limit > 0 && int64(len(matched)) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+func (m *MemoryFileRepository) ClearFolderStale(ctx context.Context, id primitive.ObjectID, cid string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if file, ok := m.files[id]; ok && file.Cid == cid {
+		file.FolderStale = false
+		m.files[id] = file
+	}
+	return nil
+}
+
+func repositoryContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
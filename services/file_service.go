@@ -0,0 +1,157 @@
+package services
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FileService keeps track of what every user uploaded.
+type FileService struct {
+	repository FileRepository
+}
+
+type UserFile struct {
+	ID             primitive.ObjectID `json:"id,omitempty"  bson:"_id,omitempty"  form:"id"  binding:"id"`
+	Email          string             `json:"email,omitempty"  bson:"email"  form:"email"  binding:"email"`
+	UserUid        string             `json:"user_uid,omitempty"  bson:"user_uid"  form:"user_uid"  binding:"user_uid"`
+	Cid            string             `json:"cid,omitempty"  bson:"cid"  form:"cid"  binding:"cid"`
+	Name           string             `json:"name,omitempty"  bson:"name"  form:"name"  binding:"name"`
+	MimeType       string             `json:"mime_type,omitempty"  bson:"mime_type"  form:"mime_type"  binding:"mime_type"`
+	Size           int64              `json:"size"  bson:"plaintext_size"  form:"size"  binding:"size"`
+	CiphertextSize int64              `json:"ciphertext_size"  bson:"ciphertext_size"  form:"ciphertext_size"  binding:"ciphertext_size"`
+	Tags           []string           `json:"tags,omitempty"  bson:"tags,omitempty"  form:"tags"  binding:"tags"`
+	CreatedAt      time.Time          `json:"created_at,omitempty"  bson:"created_at"  form:"created_at"  binding:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at,omitempty"  bson:"updated_at"  form:"updated_at"  binding:"updated_at"`
+	// RemotePin tracks the copy pinned on the remote pinning service, when
+	// one is configured
+	RemotePin *RemotePinState `json:"remote_pin,omitempty"  bson:"remote_pin,omitempty"  form:"remote_pin"  binding:"remote_pin"`
+	// Directory is the CID of the directory the file was uploaded in, when it
+	// was wrapped in one. The directory is what the nodes pin.
+	Directory string `json:"directory,omitempty"  bson:"directory,omitempty"  form:"directory"  binding:"directory"`
+	// Folder is the path of the folder of the user the file was put in, if
+	// any. See FolderService.
+	Folder string `json:"folder,omitempty"  bson:"folder,omitempty"  form:"folder"  binding:"folder"`
+	// Version is the number of the current version of the file, and
+	// Previous the CID of the version it replaced. Both are unset until the
+	// file gets a second version. See FileVersionService.
+	Version  int    `json:"version,omitempty"  bson:"version,omitempty"  form:"version"  binding:"version"`
+	Previous string `json:"previous,omitempty"  bson:"previous,omitempty"  form:"previous"  binding:"previous"`
+	// FolderStale is set while the entry of the file in its folder still
+	// links to an earlier version. See FolderService.RefreshStale.
+	FolderStale bool `json:"-"  bson:"folder_stale,omitempty"  form:"-"  binding:"-"`
+
+	FileKey `bson:",inline"`
+}
+
+func NewFileService(repository FileRepository) *FileService {
+	return &FileService{
+		repository: repository,
+	}
+}
+
+// RecordUpload stores the metadata of a finished upload, including the
+// wrapped key of the file, which is what lets the pin endpoints check
+// ownership and the fetch endpoints decrypt it later on.
+func (f *FileService) RecordUpload(file *UserFile) error {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	now := time.Now().UTC()
+	if file.CreatedAt.IsZero() {
+		file.CreatedAt = now
+	}
+	file.UpdatedAt = now
+
+	return f.repository.Save(ctx, file)
+}
+
+// FindFile returns the record of cid uploaded by email, or ErrFileNotFound.
+func (f *FileService) FindFile(email string, cid string) (*UserFile, error) {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return f.repository.FindByCid(ctx, email, cid)
+}
+
+func (f *FileService) IsOwner(email string, cid string) (bool, error) {
+	_, err := f.FindFile(email, cid)
+	if err == ErrFileNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *FileService) ListCids(email string) ([]string, error) {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return f.repository.ListCids(ctx, email)
+}
+
+func (f *FileService) ListFiles(email string, query FileQuery) ([]UserFile, int64, error) {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return f.repository.List(ctx, email, query)
+}
+
+// GetFile returns the file of email with the given hex ID. Malformed IDs are
+// reported as ErrFileNotFound like unknown ones.
+func (f *FileService) GetFile(email string, id string) (*UserFile, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrFileNotFound
+	}
+
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return f.repository.FindByID(ctx, email, objectID)
+}
+
+// DeleteFile removes the record of a file. The wrapped file key goes with it,
+// so whatever copies of the ciphertext remain can no longer be decrypted.
+func (f *FileService) DeleteFile(email string, id primitive.ObjectID) error {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return f.repository.Delete(ctx, email, id)
+}
+
+// CountDirectoryFiles returns how many files of any user were uploaded in
+// directory.
+func (f *FileService) CountDirectoryFiles(directory string) (int64, error) {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return f.repository.CountByDirectory(ctx, directory)
+}
+
+// UpdateTags replaces the tags of a file. Tags are what grants given to a
+// client by tag match against.
+func (f *FileService) UpdateTags(file *UserFile, tags []string) error {
+	file.Tags = NormalizeTags(tags)
+	file.UpdatedAt = time.Now().UTC()
+
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return f.repository.UpdateTags(ctx, file)
+}
+
+// NormalizeTags trims, lowercases and deduplicates tags, dropping empty ones.
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !containsString(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
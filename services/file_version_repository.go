@@ -0,0 +1,264 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrVersionNotFound = errors.New("version not found")
+	// ErrVersionConflict means another version of the file was added at the
+	// same time. Trying again adds the version on top of the other one.
+	ErrVersionConflict = errors.New("file was versioned by another request")
+)
+
+// FileVersion is one version of a file. The record of the file holds the
+// content of its current version; the versions keep the content of every
+// version, the current one included, once the file has more than one.
+type FileVersion struct {
+	ID     primitive.ObjectID `json:"-"  bson:"_id,omitempty"`
+	FileID primitive.ObjectID `json:"file_id"  bson:"file_id"`
+	Email  string             `json:"-"  bson:"email"`
+	Number int                `json:"version"  bson:"number"`
+	Cid    string             `json:"cid"  bson:"cid"`
+	// Previous is the CID of the version this one replaced
+	Previous       string `json:"previous,omitempty"  bson:"previous,omitempty"`
+	Name           string `json:"name,omitempty"  bson:"name"`
+	MimeType       string `json:"mime_type,omitempty"  bson:"mime_type"`
+	Size           int64  `json:"size"  bson:"plaintext_size"`
+	CiphertextSize int64  `json:"ciphertext_size"  bson:"ciphertext_size"`
+	// Directory is the CID of the directory the version was uploaded in,
+	// which is what the nodes pin. Only first versions have one.
+	Directory string `json:"directory,omitempty"  bson:"directory,omitempty"`
+	// Pinned is false once the version fell out of the retention of the
+	// file and its content was unpinned
+	Pinned    bool            `json:"pinned"  bson:"pinned"`
+	Current   bool            `json:"current"  bson:"-"`
+	RemotePin *RemotePinState `json:"-"  bson:"remote_pin,omitempty"`
+	CreatedAt time.Time       `json:"created_at"  bson:"created_at"`
+
+	FileKey `bson:",inline"`
+}
+
+// FileVersionRepository stores the versions of files.
+type FileVersionRepository interface {
+	// Insert stores version, assigning it an ID. A version with the same
+	// number for the same file fails with ErrVersionConflict.
+	Insert(ctx context.Context, version *FileVersion) error
+	// List returns the versions of the file id of email, newest first.
+	List(ctx context.Context, email string, fileID primitive.ObjectID) ([]FileVersion, error)
+	Get(ctx context.Context, email string, fileID primitive.ObjectID, number int) (*FileVersion, error)
+	// UpdateRemotePin replaces the remote pin state of the version id.
+	UpdateRemotePin(ctx context.Context, id primitive.ObjectID, state *RemotePinState) error
+	// SetUnpinned marks the version id as unpinned.
+	SetUnpinned(ctx context.Context, id primitive.ObjectID) error
+	// CountPinned returns how many pinned versions of any file have cid as
+	// their CID or their directory.
+	CountPinned(ctx context.Context, cid string) (int64, error)
+	// DeleteByFile removes the versions of the file id of email.
+	DeleteByFile(ctx context.Context, email string, fileID primitive.ObjectID) error
+}
+
+type MongoFileVersionRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoFileVersionRepository(db *mongo.Database) *MongoFileVersionRepository {
+	return &MongoFileVersionRepository{
+		collection: db.Collection("file_versions"),
+	}
+}
+
+// EnsureIndexes creates the indexes the queries of the repository rely on.
+func (m *MongoFileVersionRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := m.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "file_id", Value: 1}, {Key: "number", Value: -1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "cid", Value: 1}}},
+		{Keys: bson.D{{Key: "directory", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
+
+func (m *MongoFileVersionRepository) Insert(ctx context.Context, version *FileVersion) error {
+	if version.ID.IsZero() {
+		version.ID = primitive.NewObjectID()
+	}
+
+	_, err := m.collection.InsertOne(ctx, version)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrVersionConflict
+	}
+	return err
+}
+
+func (m *MongoFileVersionRepository) List(ctx context.Context, email string, fileID primitive.ObjectID) ([]FileVersion, error) {
+	filter := bson.D{{Key: "file_id", Value: fileID}, {Key: "email", Value: email}}
+	opts := options.Find().SetSort(bson.D{{Key: "number", Value: -1}})
+
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]FileVersion, 0)
+	if err := cursor.All(ctx, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (m *MongoFileVersionRepository) Get(ctx context.Context, email string, fileID primitive.ObjectID, number int) (*FileVersion, error) {
+	var version FileVersion
+
+	filter := bson.D{{Key: "file_id", Value: fileID}, {Key: "email", Value: email}, {Key: "number", Value: number}}
+	err := m.collection.FindOne(ctx, filter).Decode(&version)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (m *MongoFileVersionRepository) UpdateRemotePin(ctx context.Context, id primitive.ObjectID, state *RemotePinState) error {
+	_, err := m.collection.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "remote_pin", Value: state}}}},
+	)
+	return err
+}
+
+func (m *MongoFileVersionRepository) SetUnpinned(ctx context.Context, id primitive.ObjectID) error {
+	_, err := m.collection.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: id}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "pinned", Value: false}}}},
+	)
+	return err
+}
+
+func (m *MongoFileVersionRepository) CountPinned(ctx context.Context, cid string) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{
+		{Key: "pinned", Value: true},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "cid", Value: cid}},
+			bson.D{{Key: "directory", Value: cid}},
+		}},
+	})
+}
+
+func (m *MongoFileVersionRepository) DeleteByFile(ctx context.Context, email string, fileID primitive.ObjectID) error {
+	_, err := m.collection.DeleteMany(ctx, bson.D{{Key: "file_id", Value: fileID}, {Key: "email", Value: email}})
+	return err
+}
+
+// MemoryFileVersionRepository keeps versions in memory, for tests and for
+// running the service without a database.
+type MemoryFileVersionRepository struct {
+	mutex    sync.RWMutex
+	versions map[primitive.ObjectID]FileVersion
+}
+
+func NewMemoryFileVersionRepository() *MemoryFileVersionRepository {
+	return &MemoryFileVersionRepository{
+		versions: make(map[primitive.ObjectID]FileVersion),
+	}
+}
+
+func (m *MemoryFileVersionRepository) Insert(ctx context.Context, version *FileVersion) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, stored := range m.versions {
+		if stored.FileID == version.FileID && stored.Number == version.Number {
+			return ErrVersionConflict
+		}
+	}
+	if version.ID.IsZero() {
+		version.ID = primitive.NewObjectID()
+	}
+	m.versions[version.ID] = *version
+	return nil
+}
+
+func (m *MemoryFileVersionRepository) List(ctx context.Context, email string, fileID primitive.ObjectID) ([]FileVersion, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	versions := make([]FileVersion, 0)
+	for _, version := range m.versions {
+		if version.FileID == fileID && version.Email == email {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number > versions[j].Number })
+	return versions, nil
+}
+
+func (m *MemoryFileVersionRepository) Get(ctx context.Context, email string, fileID primitive.ObjectID, number int) (*FileVersion, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, version := range m.versions {
+		if version.FileID == fileID && version.Email == email && version.Number == number {
+			found := version
+			return &found, nil
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
+func (m *MemoryFileVersionRepository) UpdateRemotePin(ctx context.Context, id primitive.ObjectID, state *RemotePinState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if version, ok := m.versions[id]; ok {
+		version.RemotePin = state
+		m.versions[id] = version
+	}
+	return nil
+}
+
+func (m *MemoryFileVersionRepository) SetUnpinned(ctx context.Context, id primitive.ObjectID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if version, ok := m.versions[id]; ok {
+		version.Pinned = false
+		m.versions[id] = version
+	}
+	return nil
+}
+
+func (m *MemoryFileVersionRepository) CountPinned(ctx context.Context, cid string) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var count int64
+	for _, version := range m.versions {
+		if version.Pinned && (version.Cid == cid || version.Directory == cid) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryFileVersionRepository) DeleteByFile(ctx context.Context, email string, fileID primitive.ObjectID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, version := range m.versions {
+		if version.FileID == fileID && version.Email == email {
+			delete(m.versions, id)
+		}
+	}
+	return nil
+}
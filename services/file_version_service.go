@@ -0,0 +1,340 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrVersionUnpinned means the content of a version was unpinned when it
+	// fell out of the retention of its file, and may be gone.
+	ErrVersionUnpinned = errors.New("version was unpinned")
+	// ErrInvalidVersion means a version cannot be used as asked.
+	ErrInvalidVersion = errors.New("invalid version")
+)
+
+// FileVersionService keeps the history of files. A new version replaces the
+// content of a file while its ID, and so its tags, folder and grants, stay
+// the same, and each version links to the CID of the one before it. When
+// Retention is set, the versions older than the Retention newest ones are
+// unpinned; their records stay in the history.
+type FileVersionService struct {
+	repository FileVersionRepository
+	files      FileRepository
+	pool       *ipfs.IPFSPool
+
+	// Retention is how many versions of a file stay pinned, the current one
+	// included. Zero keeps every version pinned.
+	Retention int
+	// RemotePins, when set, pins new versions on the remote pinning service
+	// and removes the remote pins of the versions that are unpinned
+	RemotePins *RemotePinService
+	// PinRequests, when set, keeps the content a tenant of the Pinning
+	// Service API asked for pinned
+	PinRequests *PinRequestService
+
+	locks stripedMutex
+}
+
+func NewFileVersionService(repository FileVersionRepository, files FileRepository, pool *ipfs.IPFSPool) *FileVersionService {
+	return &FileVersionService{
+		repository: repository,
+		files:      files,
+		pool:       pool,
+	}
+}
+
+// List returns the versions of file, newest first. A file that never had a
+// new version has its one version.
+func (s *FileVersionService) List(ctx context.Context, file *UserFile) ([]FileVersion, error) {
+	versions, err := s.repository.List(ctx, file.Email, file.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		versions = append(versions, currentVersion(file))
+	}
+
+	for i := range versions {
+		versions[i].Current = versions[i].Number == versionNumber(file)
+	}
+	return versions, nil
+}
+
+// Get returns version number of file.
+func (s *FileVersionService) Get(ctx context.Context, file *UserFile, number int) (*FileVersion, error) {
+	version, err := s.repository.Get(ctx, file.Email, file.ID, number)
+	if err == ErrVersionNotFound && number == versionNumber(file) {
+		current := currentVersion(file)
+		version, err = &current, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	version.Current = number == versionNumber(file)
+	return version, nil
+}
+
+// Add makes version, which holds the content of an upload, the current
+// version of file and updates the record of file with it. The versions
+// that fall out of the retention are unpinned.
+func (s *FileVersionService) Add(ctx context.Context, file *UserFile, version *FileVersion) error {
+	unlock := s.lock(file.ID)
+	defer unlock()
+
+	// The file may have been versioned while the content was uploaded
+	latest, err := s.files.FindByID(ctx, file.Email, file.ID)
+	if err != nil {
+		return err
+	}
+	*file = *latest
+
+	// Files get a history with their second version
+	current, err := s.repository.Get(ctx, file.Email, file.ID, versionNumber(file))
+	switch {
+	case err == ErrVersionNotFound:
+		snapshot := currentVersion(file)
+		if err := s.repository.Insert(ctx, &snapshot); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		// The remote pin is tracked on the file while the version is current
+		if err := s.repository.UpdateRemotePin(ctx, current.ID, file.RemotePin); err != nil {
+			return err
+		}
+	}
+
+	version.FileID = file.ID
+	version.Email = file.Email
+	version.Number = versionNumber(file) + 1
+	version.Previous = file.Cid
+	version.Pinned = true
+	version.Current = true
+	version.CreatedAt = time.Now().UTC()
+	if s.RemotePins != nil {
+		version.RemotePin = NewRemotePinState()
+	}
+	if err := s.repository.Insert(ctx, version); err != nil {
+		return err
+	}
+
+	file.Cid = version.Cid
+	file.Name = version.Name
+	file.MimeType = version.MimeType
+	file.Size = version.Size
+	file.CiphertextSize = version.CiphertextSize
+	file.Directory = version.Directory
+	file.RemotePin = version.RemotePin
+	file.FileKey = version.FileKey
+	file.Version = version.Number
+	file.Previous = version.Previous
+	file.UpdatedAt = version.CreatedAt
+	// The folder entry is refreshed by the caller, or else by the folders
+	// watcher
+	file.FolderStale = file.Folder != ""
+	if err := s.files.UpdateContent(ctx, file); err != nil {
+		return err
+	}
+	if s.RemotePins != nil {
+		s.RemotePins.SubmitAsync(*file)
+	}
+
+	return s.prune(ctx, file)
+}
+
+// Restore adds a new version of file with the content of version number,
+// which must still be pinned.
+func (s *FileVersionService) Restore(ctx context.Context, file *UserFile, number int) (*FileVersion, error) {
+	if number == versionNumber(file) {
+		return nil, fmt.Errorf("%w: version %d is the current version", ErrInvalidVersion, number)
+	}
+
+	old, err := s.Get(ctx, file, number)
+	if err != nil {
+		return nil, err
+	}
+	if !old.Pinned {
+		return nil, ErrVersionUnpinned
+	}
+
+	restored := &FileVersion{
+		Cid:            old.Cid,
+		Name:           old.Name,
+		MimeType:       old.MimeType,
+		Size:           old.Size,
+		CiphertextSize: old.CiphertextSize,
+		Directory:      old.Directory,
+		FileKey:        old.FileKey,
+	}
+	if err := s.Add(ctx, file, restored); err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// Remove unpins the earlier versions of file and removes its history, when
+// the file itself is deleted. The content of the current version is left to
+// the caller.
+func (s *FileVersionService) Remove(ctx context.Context, file *UserFile) error {
+	unlock := s.lock(file.ID)
+	defer unlock()
+
+	versions, err := s.repository.List(ctx, file.Email, file.ID)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{pinTarget(file.Cid, file.Directory): true}
+	if err := s.unpin(ctx, versions, keep); err != nil {
+		return err
+	}
+	return s.repository.DeleteByFile(ctx, file.Email, file.ID)
+}
+
+// prune unpins the versions of file older than the Retention newest ones.
+func (s *FileVersionService) prune(ctx context.Context, file *UserFile) error {
+	if s.Retention <= 0 {
+		return nil
+	}
+
+	versions, err := s.repository.List(ctx, file.Email, file.ID)
+	if err != nil {
+		return err
+	}
+
+	cutoff := file.Version - s.Retention
+	keep := make(map[string]bool)
+	var expired []FileVersion
+	for _, version := range versions {
+		if version.Number > cutoff {
+			keep[pinTarget(version.Cid, version.Directory)] = true
+		} else {
+			expired = append(expired, version)
+		}
+	}
+	return s.unpin(ctx, expired, keep)
+}
+
+// unpin unpins the content of the pinned versions among versions and marks
+// them unpinned. Content in keep, or that another file or version still
+// uses, stays pinned. Versions whose content cannot be unpinned are left
+// pinned, for the next prune to try again.
+func (s *FileVersionService) unpin(ctx context.Context, versions []FileVersion, keep map[string]bool) error {
+	own := make(map[string]int64)
+	for _, version := range versions {
+		if version.Pinned {
+			own[pinTarget(version.Cid, version.Directory)]++
+		}
+	}
+
+	unpinned := make(map[string]bool)
+	for _, version := range versions {
+		if !version.Pinned {
+			continue
+		}
+
+		target := pinTarget(version.Cid, version.Directory)
+		if !keep[target] && !unpinned[target] {
+			used, err := s.usedElsewhere(ctx, target, own[target])
+			if err != nil {
+				return err
+			}
+			if !used {
+				if _, err := s.pool.Unpin(ctx, target); err != nil && !ipfs.IsNotPinned(err) {
+					log.Println("Cannot unpin version", version.Number, "of file", version.FileID.Hex()+":", err.Error())
+					continue
+				}
+			}
+			unpinned[target] = true
+		}
+
+		if s.RemotePins != nil && version.RemotePin != nil {
+			if err := s.RemotePins.Remove(ctx, &UserFile{RemotePin: version.RemotePin}); err != nil {
+				log.Println("Cannot remove the remote pin of version", version.Number, "of file", version.FileID.Hex()+":", err.Error())
+			}
+		}
+		if err := s.repository.SetUnpinned(ctx, version.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usedElsewhere reports whether a file, a pinned version other than the own
+// ones being unpinned, or a pin request has target as its content.
+func (s *FileVersionService) usedElsewhere(ctx context.Context, target string, own int64) (bool, error) {
+	if s.PinRequests != nil {
+		requested, err := s.PinRequests.Requested(ctx, target)
+		if err != nil || requested {
+			return requested, err
+		}
+	}
+
+	versions, err := s.repository.CountPinned(ctx, target)
+	if err != nil {
+		return false, err
+	}
+	if versions > own {
+		return true, nil
+	}
+
+	files, err := s.files.CountByCid(ctx, target)
+	if err != nil || files > 0 {
+		return files > 0, err
+	}
+	directories, err := s.files.CountByDirectory(ctx, target)
+	return directories > 0, err
+}
+
+func (s *FileVersionService) lock(id primitive.ObjectID) func() {
+	return s.locks.lock(id.Hex())
+}
+
+// versionNumber is the number of the current version of file. Files
+// recorded before versions existed are at version 1.
+func versionNumber(file *UserFile) int {
+	if file.Version < 1 {
+		return 1
+	}
+	return file.Version
+}
+
+// currentVersion is the current version of file, as held by its record.
+// It is only stored for files that have a history, so the creation time of
+// the file is that of the version.
+func currentVersion(file *UserFile) FileVersion {
+	return FileVersion{
+		FileID:         file.ID,
+		Email:          file.Email,
+		Number:         versionNumber(file),
+		Cid:            file.Cid,
+		Previous:       file.Previous,
+		Name:           file.Name,
+		MimeType:       file.MimeType,
+		Size:           file.Size,
+		CiphertextSize: file.CiphertextSize,
+		Directory:      file.Directory,
+		Pinned:         true,
+		RemotePin:      file.RemotePin,
+		CreatedAt:      file.CreatedAt,
+		FileKey:        file.FileKey,
+	}
+}
+
+// pinTarget is what the nodes pin for content: the directory it was
+// uploaded in, if any, or else its CID.
+func pinTarget(cid string, directory string) string {
+	if directory != "" {
+		return directory
+	}
+	return cid
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FolderRoot is the CID of the MFS directory holding the folders of a user.
+// Pending is the update of the file records the change to Cid calls for,
+// until it is applied.
+type FolderRoot struct {
+	Email     string        `json:"email"  bson:"email"`
+	Cid       string        `json:"cid"  bson:"cid"`
+	Pending   *FolderUpdate `json:"pending,omitempty"  bson:"pending,omitempty"`
+	UpdatedAt time.Time     `json:"updated_at"  bson:"updated_at"`
+}
+
+// FolderUpdate moves the files of a user in Folder, or in a folder under
+// it, to the same place under To, or takes them out of their folder when
+// To is empty.
+type FolderUpdate struct {
+	Folder string `json:"folder"  bson:"folder"`
+	To     string `json:"to,omitempty"  bson:"to,omitempty"`
+}
+
+// FolderRepository stores the folder root of every user, which is what the
+// MFS of any node is brought back to before it is used for that user.
+type FolderRepository interface {
+	// Get returns the root of email, with an empty Cid when the user has
+	// no folders yet.
+	Get(ctx context.Context, email string) (FolderRoot, error)
+	// Swap sets the root of email to cid, with the pending update of the
+	// file records, if it still is previous, empty when the user had none,
+	// and reports whether it did.
+	Swap(ctx context.Context, email string, previous string, cid string, pending *FolderUpdate) (bool, error)
+	// ClearPending removes the pending update of the root of email, if the
+	// root still is cid.
+	ClearPending(ctx context.Context, email string, cid string) error
+	// ListPending returns up to limit roots of any user with a pending
+	// update.
+	ListPending(ctx context.Context, limit int64) ([]FolderRoot, error)
+	// CountByCid returns how many users have cid as their root.
+	CountByCid(ctx context.Context, cid string) (int64, error)
+}
+
+type MongoFolderRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoFolderRepository(db *mongo.Database) *MongoFolderRepository {
+	return &MongoFolderRepository{
+		collection: db.Collection("folder_roots"),
+	}
+}
+
+// EnsureIndexes creates the indexes the queries of the repository rely on.
+func (m *MongoFolderRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := m.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "cid", Value: 1}}},
+		{Keys: bson.D{{Key: "pending", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
+
+func (m *MongoFolderRepository) Get(ctx context.Context, email string) (FolderRoot, error) {
+	var root FolderRoot
+
+	err := m.collection.FindOne(ctx, bson.D{{Key: "email", Value: email}}).Decode(&root)
+	if err == mongo.ErrNoDocuments {
+		return FolderRoot{Email: email}, nil
+	}
+	return root, err
+}
+
+func (m *MongoFolderRepository) Swap(ctx context.Context, email string, previous string, cid string, pending *FolderUpdate) (bool, error) {
+	root := FolderRoot{Email: email, Cid: cid, Pending: pending, UpdatedAt: time.Now().UTC()}
+
+	if previous == "" {
+		_, err := m.collection.InsertOne(ctx, root)
+		if mongo.IsDuplicateKeyError(err) {
+			// Another request stored a root for this email first
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	filter := bson.D{{Key: "email", Value: email}, {Key: "cid", Value: previous}}
+	result, err := m.collection.ReplaceOne(ctx, filter, root)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (m *MongoFolderRepository) ClearPending(ctx context.Context, email string, cid string) error {
+	_, err := m.collection.UpdateOne(ctx,
+		bson.D{{Key: "email", Value: email}, {Key: "cid", Value: cid}},
+		bson.D{{Key: "$unset", Value: bson.D{{Key: "pending", Value: ""}}}},
+	)
+	return err
+}
+
+func (m *MongoFolderRepository) ListPending(ctx context.Context, limit int64) ([]FolderRoot, error) {
+	cursor, err := m.collection.Find(ctx,
+		bson.D{{Key: "pending", Value: bson.D{{Key: "$exists", Value: true}}}},
+		options.Find().SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := make([]FolderRoot, 0)
+	if err := cursor.All(ctx, &roots); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+func (m *MongoFolderRepository) CountByCid(ctx context.Context, cid string) (int64, error) {
+	return m.collection.CountDocuments(ctx, bson.D{{Key: "cid", Value: cid}})
+}
+
+// MemoryFolderRepository keeps folder roots in memory, for tests and for
+// running the service without a database.
+type MemoryFolderRepository struct {
+	mutex sync.RWMutex
+	roots map[string]FolderRoot
+}
+
+func NewMemoryFolderRepository() *MemoryFolderRepository {
+	return &MemoryFolderRepository{
+		roots: make(map[string]FolderRoot),
+	}
+}
+
+func (m *MemoryFolderRepository) Get(ctx context.Context, email string) (FolderRoot, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	root, ok := m.roots[email]
+	if !ok {
+		return FolderRoot{Email: email}, nil
+	}
+	return root, nil
+}
+
+func (m *MemoryFolderRepository) Swap(ctx context.Context, email string, previous string, cid string, pending *FolderUpdate) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.roots[email].Cid != previous {
+		return false, nil
+	}
+	m.roots[email] = FolderRoot{Email: email, Cid: cid, Pending: pending, UpdatedAt: time.Now().UTC()}
+	return true, nil
+}
+
+func (m *MemoryFolderRepository) ClearPending(ctx context.Context, email string, cid string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if root, ok := m.roots[email]; ok && root.Cid == cid {
+		root.Pending = nil
+		m.roots[email] = root
+	}
+	return nil
+}
+
+func (m *MemoryFolderRepository) ListPending(ctx context.Context, limit int64) ([]FolderRoot, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	roots := make([]FolderRoot, 0)
+	for _, root := range m.roots {
+		if int64(len(roots)) >= limit {
+			break
+		}
+		if root.Pending != nil {
+			roots = append(roots, root)
+		}
+	}
+	return roots, nil
+}
+
+func (m *MemoryFolderRepository) CountByCid(ctx context.Context, cid string) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var count int64
+	for _, root := range m.roots {
+		if root.Cid == cid {
+			count++
+		}
+	}
+	return count, nil
+}
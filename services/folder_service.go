@@ -0,0 +1,563 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrFolderNotFound means a folder, or the parent of a new one, does not
+	// exist.
+	ErrFolderNotFound = errors.New("folder not found")
+	// ErrFolderExists means there already is a folder where one would go.
+	ErrFolderExists = errors.New("folder already exists")
+	// ErrFolderNotEmpty means a folder with content was removed without
+	// asking for its content to go too.
+	ErrFolderNotEmpty = errors.New("folder is not empty")
+	// ErrFolderConflict means the folders of the user were changed by
+	// another request at the same time. Trying again applies the change on
+	// top of the other one.
+	ErrFolderConflict = errors.New("folders were changed by another request")
+	// ErrInvalidFolder means a folder path is malformed.
+	ErrInvalidFolder = errors.New("invalid folder")
+)
+
+// maxFolderNameLength bounds each name in a folder path, in bytes.
+const maxFolderNameLength = 255
+
+// Folder is a folder of a user. Path is relative to the folders of the
+// user, "/" being the top.
+type Folder struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Cid  string `json:"cid"`
+	// Size is the cumulative size of what the folder holds. It is left out
+	// for the folders in a listing.
+	Size int64 `json:"size,omitempty"`
+}
+
+// FolderListing is the content of a folder. Root is the CID of all the
+// folders of the user at the time of the listing.
+type FolderListing struct {
+	Folder
+	Root    string     `json:"root"`
+	Folders []Folder   `json:"folders"`
+	Files   []UserFile `json:"files"`
+}
+
+// FolderService organises the files of users in folders. Every user has a
+// directory of their own in the MFS of the IPFS nodes, in which a folder is
+// a directory and a file an entry named after the ID of its record that
+// links to its CID. The MFS of a node is local to it, so the CID of the
+// directory of every user is kept in the repository after each change, and
+// the directory is restored from it on whichever node serves the next
+// request. The CID is also pinned on the pool, so every node can get it.
+type FolderService struct {
+	repository FolderRepository
+	files      FileRepository
+	pool       *ipfs.IPFSPool
+
+	// Names, when set, points the IPNS name of a user to their new root
+	// after every change
+	Names *NameService
+
+	locks stripedMutex
+}
+
+func NewFolderService(repository FolderRepository, files FileRepository, pool *ipfs.IPFSPool) *FolderService {
+	return &FolderService{
+		repository: repository,
+		files:      files,
+		pool:       pool,
+	}
+}
+
+// List returns the folders and files in folder.
+func (s *FolderService) List(ctx context.Context, email string, folder string) (*FolderListing, error) {
+	folder, err := cleanFolder(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := s.lock(email)
+	defer unlock()
+
+	root, err := s.repository.Get(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	var stat ipfs.MfsStat
+	var entries []ipfs.MfsEntry
+	err = s.pool.Files(ctx, func(ctx context.Context, client *ipfs.IPFSClient) error {
+		dir, err := s.checkout(ctx, client, email, root.Cid)
+		if err != nil {
+			return err
+		}
+		if stat, err = client.StatPath(ctx, mfsPath(dir, folder)); err != nil {
+			return err
+		}
+		if stat.Type != ipfs.MfsTypeDirectory {
+			return ErrFolderNotFound
+		}
+		entries, err = client.ListDirectory(ctx, mfsPath(dir, folder))
+		return err
+	})
+	if err != nil {
+		return nil, folderError(err)
+	}
+
+	listing := &FolderListing{
+		Folder:  newFolder(folder, stat.Hash, stat.CumulativeSize),
+		Root:    root.Cid,
+		Folders: make([]Folder, 0),
+		Files:   make([]UserFile, 0),
+	}
+	for _, entry := range entries {
+		if entry.Type == ipfs.MfsTypeDirectory {
+			listing.Folders = append(listing.Folders, newFolder(path.Join(folder, entry.Name), entry.Hash, 0))
+			continue
+		}
+
+		// Entries whose file was deleted in the meantime are left out
+		id, err := primitive.ObjectIDFromHex(entry.Name)
+		if err != nil {
+			continue
+		}
+		file, err := s.files.FindByID(ctx, email, id)
+		if err == ErrFileNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		listing.Files = append(listing.Files, *file)
+	}
+	return listing, nil
+}
+
+// Create creates folder and the folders above it that are missing. An
+// existing folder is left as it is.
+func (s *FolderService) Create(ctx context.Context, email string, folder string) (*Folder, error) {
+	folder, err := cleanFolder(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var stat ipfs.MfsStat
+	err = s.change(ctx, email, nil, func(ctx context.Context, client *ipfs.IPFSClient, dir string) error {
+		if err := client.MakeDirectory(ctx, mfsPath(dir, folder), true); err != nil {
+			return err
+		}
+		var err error
+		stat, err = client.StatPath(ctx, mfsPath(dir, folder))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	created := newFolder(folder, stat.Hash, stat.CumulativeSize)
+	return &created, nil
+}
+
+// Move moves or renames folder to to, with everything it holds. The folder
+// above to must exist, to itself must not.
+func (s *FolderService) Move(ctx context.Context, email string, folder string, to string) error {
+	folder, err := cleanFolder(folder)
+	if err != nil {
+		return err
+	}
+	if to, err = cleanFolder(to); err != nil {
+		return err
+	}
+	if folder == "/" || to == "/" {
+		return fmt.Errorf("%w: the top folder cannot be moved", ErrInvalidFolder)
+	}
+	if inFolder(to, folder) {
+		return fmt.Errorf("%w: a folder cannot be moved into itself", ErrInvalidFolder)
+	}
+
+	update := &FolderUpdate{Folder: folder, To: to}
+	return s.change(ctx, email, update, func(ctx context.Context, client *ipfs.IPFSClient, dir string) error {
+		if err := s.checkFolder(ctx, client, mfsPath(dir, folder)); err != nil {
+			return err
+		}
+
+		// files/mv moves into a directory that exists instead of failing
+		_, err := client.StatPath(ctx, mfsPath(dir, to))
+		if err == nil {
+			return ErrFolderExists
+		}
+		if !ipfs.IsNotExist(err) {
+			return err
+		}
+		return client.MovePath(ctx, mfsPath(dir, folder), mfsPath(dir, to))
+	})
+}
+
+// Remove removes folder, which must be empty unless recursive is true. The
+// files it held are taken out of it, not deleted.
+func (s *FolderService) Remove(ctx context.Context, email string, folder string, recursive bool) error {
+	folder, err := cleanFolder(folder)
+	if err != nil {
+		return err
+	}
+	if folder == "/" {
+		return fmt.Errorf("%w: the top folder cannot be removed", ErrInvalidFolder)
+	}
+
+	return s.change(ctx, email, &FolderUpdate{Folder: folder}, func(ctx context.Context, client *ipfs.IPFSClient, dir string) error {
+		if err := s.checkFolder(ctx, client, mfsPath(dir, folder)); err != nil {
+			return err
+		}
+		if !recursive {
+			entries, err := client.ListDirectory(ctx, mfsPath(dir, folder))
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				return ErrFolderNotEmpty
+			}
+		}
+		return client.RemovePath(ctx, mfsPath(dir, folder), true)
+	})
+}
+
+// PutFile puts file in folder, taking it out of the folder it was in. An
+// empty folder only takes it out.
+func (s *FolderService) PutFile(ctx context.Context, email string, file *UserFile, folder string) error {
+	if folder != "" {
+		var err error
+		if folder, err = cleanFolder(folder); err != nil {
+			return err
+		}
+	}
+	if folder == file.Folder {
+		return nil
+	}
+
+	err := s.change(ctx, email, nil, func(ctx context.Context, client *ipfs.IPFSClient, dir string) error {
+		if file.Folder != "" {
+			err := client.RemovePath(ctx, mfsPath(dir, path.Join(file.Folder, file.ID.Hex())), false)
+			if err != nil && !ipfs.IsNotExist(err) {
+				return err
+			}
+		}
+		if folder == "" {
+			return nil
+		}
+
+		if err := s.checkFolder(ctx, client, mfsPath(dir, folder)); err != nil {
+			return err
+		}
+		return client.CopyPath(ctx, "/ipfs/"+file.Cid, mfsPath(dir, path.Join(folder, file.ID.Hex())))
+	})
+	if err != nil {
+		return err
+	}
+
+	file.Folder = folder
+	return s.files.UpdateFolder(ctx, file)
+}
+
+// RefreshFile points the entry of file in its folder to the CID file has
+// now, after it got a new version, and marks the entry up to date.
+func (s *FolderService) RefreshFile(ctx context.Context, email string, file *UserFile) error {
+	if file.Folder != "" {
+		entry := path.Join(file.Folder, file.ID.Hex())
+		err := s.change(ctx, email, nil, func(ctx context.Context, client *ipfs.IPFSClient, dir string) error {
+			err := client.RemovePath(ctx, mfsPath(dir, entry), false)
+			if err != nil && !ipfs.IsNotExist(err) {
+				return err
+			}
+			return client.CopyPath(ctx, "/ipfs/"+file.Cid, mfsPath(dir, entry))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	file.FolderStale = false
+	return s.files.ClearFolderStale(ctx, file.ID, file.Cid)
+}
+
+// RefreshStale refreshes the folder entries of the files that got a new
+// version without their entry being refreshed, batchSize files at a time.
+// Errors of single files are logged and skipped.
+func (s *FolderService) RefreshStale(ctx context.Context, batchSize int64) error {
+	var lastID primitive.ObjectID
+
+	for {
+		batch, err := s.files.ListFolderStale(ctx, lastID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			lastID = batch[i].ID
+			if err := s.RefreshFile(ctx, batch[i].Email, &batch[i]); err != nil {
+				log.Println("Cannot refresh the folder entry of file", batch[i].ID.Hex()+":", err.Error())
+			}
+		}
+
+		if int64(len(batch)) < batchSize {
+			return nil
+		}
+	}
+}
+
+// Watch applies the pending updates of file records and refreshes the stale
+// folder entries every interval until stop is closed.
+func (s *FolderService) Watch(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.ApplyPending(context.Background(), 100); err != nil {
+				log.Println("Updating the files of folders stopped:", err.Error())
+			}
+			if err := s.RefreshStale(context.Background(), 100); err != nil {
+				log.Println("Refreshing folder entries stopped:", err.Error())
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// change applies op to the directory of email, dir, on one node, then
+// records and pins the CID the directory has afterwards. The update of the
+// file records op calls for, if any, is recorded with the CID and applied
+// after it, so that it can be applied again if it is interrupted.
+func (s *FolderService) change(ctx context.Context, email string, update *FolderUpdate, op func(ctx context.Context, client *ipfs.IPFSClient, dir string) error) error {
+	unlock := s.lock(email)
+	defer unlock()
+
+	root, err := s.repository.Get(ctx, email)
+	if err != nil {
+		return err
+	}
+	// The update of an earlier change goes first, the swap below replaces it
+	if root.Pending != nil {
+		if err := s.applyPending(ctx, root); err != nil {
+			return err
+		}
+	}
+
+	var cid string
+	err = s.pool.Files(ctx, func(ctx context.Context, client *ipfs.IPFSClient) error {
+		dir, err := s.checkout(ctx, client, email, root.Cid)
+		if err != nil {
+			return err
+		}
+		if err := op(ctx, client, dir); err != nil {
+			return err
+		}
+
+		stat, err := client.StatPath(ctx, dir)
+		cid = stat.Hash
+		return err
+	})
+	if err != nil {
+		return folderError(err)
+	}
+	if cid == root.Cid {
+		return nil
+	}
+
+	if _, err := s.pool.Pin(ctx, cid); err != nil {
+		return err
+	}
+	swapped, err := s.repository.Swap(ctx, email, root.Cid, cid, update)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		s.unpin(ctx, cid)
+		return ErrFolderConflict
+	}
+
+	if root.Cid != "" {
+		s.unpin(ctx, root.Cid)
+	}
+	if s.Names != nil {
+		// The name catches up with the next change
+		if err := s.Names.Update(ctx, email, cid); err != nil {
+			log.Println("Cannot update the IPNS name of folder root", cid+":", err.Error())
+		}
+	}
+
+	if update != nil {
+		return s.applyPending(ctx, FolderRoot{Email: email, Cid: cid, Pending: update})
+	}
+	return nil
+}
+
+// applyPending applies the pending update of root to the file records, then
+// clears it. Moving or clearing a folder a second time finds no files left
+// in it, so an update that was interrupted is simply applied again.
+func (s *FolderService) applyPending(ctx context.Context, root FolderRoot) error {
+	var err error
+	if root.Pending.To != "" {
+		err = s.files.MoveFolder(ctx, root.Email, root.Pending.Folder, root.Pending.To)
+	} else {
+		err = s.files.ClearFolder(ctx, root.Email, root.Pending.Folder)
+	}
+	if err != nil {
+		return err
+	}
+	return s.repository.ClearPending(ctx, root.Email, root.Cid)
+}
+
+// ApplyPending applies the updates of the file records left pending by
+// changes that were interrupted, up to batchSize of them. Errors of single
+// users are logged and skipped.
+func (s *FolderService) ApplyPending(ctx context.Context, batchSize int64) error {
+	roots, err := s.repository.ListPending(ctx, batchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range roots {
+		if err := s.applyPendingOf(ctx, root.Email); err != nil {
+			log.Println("Cannot update the files of folder root", root.Cid+":", err.Error())
+		}
+	}
+	return nil
+}
+
+// applyPendingOf applies the pending update of the root of email, if it
+// still has one once no change is running.
+func (s *FolderService) applyPendingOf(ctx context.Context, email string) error {
+	unlock := s.lock(email)
+	defer unlock()
+
+	root, err := s.repository.Get(ctx, email)
+	if err != nil || root.Pending == nil {
+		return err
+	}
+	return s.applyPending(ctx, root)
+}
+
+// checkout makes the directory of email on the node of client hold root,
+// creating it empty when the user has no root yet, and returns its path.
+func (s *FolderService) checkout(ctx context.Context, client *ipfs.IPFSClient, email string, root string) (string, error) {
+	dir := userDirectory(email)
+
+	stat, err := client.StatPath(ctx, dir)
+	switch {
+	case err == nil && stat.Hash == root:
+		return dir, nil
+	case err == nil:
+		// Left behind by a change that was not recorded, or changed since
+		// on another node
+		if err := client.RemovePath(ctx, dir, true); err != nil {
+			return "", err
+		}
+	case !ipfs.IsNotExist(err):
+		return "", err
+	}
+
+	if root == "" {
+		return dir, client.MakeDirectory(ctx, dir, true)
+	}
+	if err := client.MakeDirectory(ctx, path.Dir(dir), true); err != nil {
+		return "", err
+	}
+	return dir, client.CopyPath(ctx, "/ipfs/"+root, dir)
+}
+
+// checkFolder returns ErrFolderNotFound unless p is a directory.
+func (s *FolderService) checkFolder(ctx context.Context, client *ipfs.IPFSClient, p string) error {
+	stat, err := client.StatPath(ctx, p)
+	if err != nil {
+		return err
+	}
+	if stat.Type != ipfs.MfsTypeDirectory {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+// unpin unpins a root no user has anymore. Users with the same folders
+// have the same root.
+func (s *FolderService) unpin(ctx context.Context, cid string) {
+	count, err := s.repository.CountByCid(ctx, cid)
+	if err != nil || count > 0 {
+		return
+	}
+	if _, err := s.pool.Unpin(ctx, cid); err != nil && !ipfs.IsNotPinned(err) {
+		log.Println("Cannot unpin folder root", cid+":", err.Error())
+	}
+}
+
+func (s *FolderService) lock(email string) func() {
+	return s.locks.lock(email)
+}
+
+// userDirectory is the MFS directory of email. It is named after a hash of
+// the address, which keeps addresses out of the MFS and of paths.
+func userDirectory(email string) string {
+	return "/users/" + userHash(email)
+}
+
+func userHash(email string) string {
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:16])
+}
+
+func mfsPath(dir string, folder string) string {
+	return path.Join(dir, folder)
+}
+
+// cleanFolder returns folder as an absolute, clean path, "/" for the top
+// folder.
+func cleanFolder(folder string) (string, error) {
+	folder = path.Clean("/" + strings.TrimSpace(folder))
+	if err := ipfs.ValidateMfsPath(folder); err != nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFolder, folder)
+	}
+	for _, name := range strings.Split(folder, "/") {
+		if len(name) > maxFolderNameLength {
+			return "", fmt.Errorf("%w: names are limited to %d bytes", ErrInvalidFolder, maxFolderNameLength)
+		}
+	}
+	return folder, nil
+}
+
+func newFolder(folder string, cid string, size int64) Folder {
+	return Folder{
+		Name: path.Base(folder),
+		Path: folder,
+		Cid:  cid,
+		Size: size,
+	}
+}
+
+// folderError turns the answers of the node about missing and existing
+// paths into the errors of the service.
+func folderError(err error) error {
+	switch {
+	case ipfs.IsNotExist(err):
+		return ErrFolderNotFound
+	case ipfs.IsExist(err):
+		return ErrFolderExists
+	}
+	return err
+}
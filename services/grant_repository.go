@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GrantRepository stores the access grants users give to OAuth2 clients.
+type GrantRepository interface {
+	Save(ctx context.Context, grant *AccessGrant) error
+	ListByOwner(ctx context.Context, email string) ([]AccessGrant, error)
+	// ListActive returns the grants of email to clientID that are neither
+	// revoked nor expired at now.
+	ListActive(ctx context.Context, email string, clientID string, now time.Time) ([]AccessGrant, error)
+	Revoke(ctx context.Context, email string, id primitive.ObjectID, now time.Time) error
+}
+
+type MongoGrantRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoGrantRepository(db *mongo.Database) *MongoGrantRepository {
+	return &MongoGrantRepository{
+		collection: db.Collection("grants"),
+	}
+}
+
+func (m *MongoGrantRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := m.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "client_id", Value: 1}, {Key: "expires_at", Value: 1}}},
+	})
+	return err
+}
+
+func (m *MongoGrantRepository) Save(ctx context.Context, grant *AccessGrant) error {
+	if grant.ID.IsZero() {
+		grant.ID = primitive.NewObjectID()
+	}
+
+	opts := options.Replace().SetUpsert(true)
+	_, err := m.collection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: grant.ID}}, grant, opts)
+	return err
+}
+
+func (m *MongoGrantRepository) ListByOwner(ctx context.Context, email string) ([]AccessGrant, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	return m.find(ctx, bson.M{"email": email}, opts)
+}
+
+func (m *MongoGrantRepository) ListActive(ctx context.Context, email string, clientID string, now time.Time) ([]AccessGrant, error) {
+	filter := bson.M{
+		"email":      email,
+		"client_id":  clientID,
+		"revoked_at": nil,
+		"expires_at": bson.M{"$gt": now},
+	}
+	return m.find(ctx, filter)
+}
+
+func (m *MongoGrantRepository) find(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]AccessGrant, error) {
+	cursor, err := m.collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make([]AccessGrant, 0)
+	if err := cursor.All(ctx, &grants); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (m *MongoGrantRepository) Revoke(ctx context.Context, email string, id primitive.ObjectID, now time.Time) error {
+	filter := bson.M{"_id": id, "email": email}
+	update := bson.M{"$set": bson.M{"revoked_at": now}}
+
+	result, err := m.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrGrantNotFound
+	}
+	return nil
+}
+
+// MemoryGrantRepository keeps grants in memory, for tests and for running
+// the service without a database.
+type MemoryGrantRepository struct {
+	mutex  sync.RWMutex
+	grants map[primitive.ObjectID]AccessGrant
+}
+
+func NewMemoryGrantRepository() *MemoryGrantRepository {
+	return &MemoryGrantRepository{
+		grants: make(map[primitive.ObjectID]AccessGrant),
+	}
+}
+
+func (m *MemoryGrantRepository) Save(ctx context.Context, grant *AccessGrant) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if grant.ID.IsZero() {
+		grant.ID = primitive.NewObjectID()
+	}
+	m.grants[grant.ID] = *grant
+	return nil
+}
+
+func (m *MemoryGrantRepository) ListByOwner(ctx context.Context, email string) ([]AccessGrant, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	grants := make([]AccessGrant, 0)
+	for _, grant := range m.grants {
+		if grant.Email == email {
+			grants = append(grants, grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].CreatedAt.After(grants[j].CreatedAt)
+	})
+	return grants, nil
+}
+
+func (m *MemoryGrantRepository) ListActive(ctx context.Context, email string, clientID string, now time.Time) ([]AccessGrant, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	grants := make([]AccessGrant, 0)
+	for _, grant := range m.grants {
+		if grant.Email == email && grant.ClientID == clientID && grant.IsActive(now) {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+func (m *MemoryGrantRepository) Revoke(ctx context.Context, email string, id primitive.ObjectID, now time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	grant, ok := m.grants[id]
+	if !ok || grant.Email != email {
+		return ErrGrantNotFound
+	}
+	grant.RevokedAt = &now
+	m.grants[id] = grant
+	return nil
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ScopeFilesRead lets a client read the content of the files it was granted.
+const ScopeFilesRead = "files:read"
+
+var GrantScopes = []string{ScopeFilesRead}
+
+var (
+	ErrGrantNotFound = errors.New("grant not found")
+	ErrAccessDenied  = errors.New("no active grant covers this request")
+	// ErrInvalidGrant means a grant to create is incomplete or malformed.
+	ErrInvalidGrant = errors.New("invalid grant")
+)
+
+// AccessGrant is the consent of a user for one OAuth2 client to access some
+// of their files, selected by ID or by tag, with the given scopes until
+// ExpiresAt.
+type AccessGrant struct {
+	ID        primitive.ObjectID   `json:"id,omitempty"  bson:"_id,omitempty"  form:"id"  binding:"id"`
+	Email     string               `json:"email,omitempty"  bson:"email"  form:"email"  binding:"email"`
+	ClientID  string               `json:"client_id,omitempty"  bson:"client_id"  form:"client_id"  binding:"client_id"`
+	FileIDs   []primitive.ObjectID `json:"file_ids,omitempty"  bson:"file_ids"  form:"file_ids"  binding:"file_ids"`
+	Tags      []string             `json:"tags,omitempty"  bson:"tags"  form:"tags"  binding:"tags"`
+	Scopes    []string             `json:"scopes,omitempty"  bson:"scopes"  form:"scopes"  binding:"scopes"`
+	ExpiresAt time.Time            `json:"expires_at,omitempty"  bson:"expires_at"  form:"expires_at"  binding:"expires_at"`
+	CreatedAt time.Time            `json:"created_at,omitempty"  bson:"created_at"  form:"created_at"  binding:"created_at"`
+	RevokedAt *time.Time           `json:"revoked_at,omitempty"  bson:"revoked_at"  form:"revoked_at"  binding:"revoked_at"`
+}
+
+func (g AccessGrant) IsActive(now time.Time) bool {
+	return g.RevokedAt == nil && g.ExpiresAt.After(now)
+}
+
+// Covers reports whether the grant gives scope on file.
+func (g AccessGrant) Covers(file *UserFile, scope string) bool {
+	if !containsString(g.Scopes, scope) {
+		return false
+	}
+	for _, id := range g.FileIDs {
+		if id == file.ID {
+			return true
+		}
+	}
+	for _, tag := range file.Tags {
+		if containsString(g.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+type GrantService struct {
+	repository GrantRepository
+}
+
+func NewGrantService(repository GrantRepository) *GrantService {
+	return &GrantService{
+		repository: repository,
+	}
+}
+
+// CreateGrant validates and stores a new grant.
+func (g *GrantService) CreateGrant(grant *AccessGrant) error {
+	if grant.ClientID == "" {
+		return fmt.Errorf("%w: client_id is required", ErrInvalidGrant)
+	}
+	if len(grant.FileIDs) == 0 && len(grant.Tags) == 0 {
+		return fmt.Errorf("%w: a grant needs at least one file ID or tag", ErrInvalidGrant)
+	}
+	if len(grant.Scopes) == 0 {
+		return fmt.Errorf("%w: a grant needs at least one scope", ErrInvalidGrant)
+	}
+	for _, scope := range grant.Scopes {
+		if !containsString(GrantScopes, scope) {
+			return fmt.Errorf("%w: unknown scope %s", ErrInvalidGrant, scope)
+		}
+	}
+
+	now := time.Now().UTC()
+	if !grant.ExpiresAt.After(now) {
+		return fmt.Errorf("%w: expires_at must be in the future", ErrInvalidGrant)
+	}
+
+	grant.ID = primitive.NilObjectID
+	grant.CreatedAt = now
+	grant.RevokedAt = nil
+
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return g.repository.Save(ctx, grant)
+}
+
+func (g *GrantService) ListGrants(email string) ([]AccessGrant, error) {
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return g.repository.ListByOwner(ctx, email)
+}
+
+func (g *GrantService) RevokeGrant(email string, id string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrGrantNotFound
+	}
+
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	return g.repository.Revoke(ctx, email, objectID, time.Now().UTC())
+}
+
+// Authorize checks that clientID may use scope on file, which belongs to
+// email. The scope must be both in the token and in an active grant.
+func (g *GrantService) Authorize(email string, clientID string, tokenScopes []string, file *UserFile, scope string) error {
+	if !containsString(tokenScopes, scope) {
+		return ErrAccessDenied
+	}
+
+	ctx, cancel := repositoryContext()
+	defer cancel()
+
+	grants, err := g.repository.ListActive(ctx, email, clientID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	for _, grant := range grants {
+		if grant.Covers(file, scope) {
+			return nil
+		}
+	}
+	return ErrAccessDenied
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	grantOwner  = "alice@example.com"
+	grantClient = "bank-app"
+)
+
+func TestAuthorize(t *testing.T) {
+	repository := NewMemoryGrantRepository()
+	grants := NewGrantService(repository)
+	tokenScopes := []string{ScopeFilesRead}
+
+	statement := &UserFile{ID: primitive.NewObjectID(), Email: grantOwner, Tags: []string{"statements"}}
+	payslip := &UserFile{ID: primitive.NewObjectID(), Email: grantOwner, Tags: []string{"payslips"}}
+	passport := &UserFile{ID: primitive.NewObjectID(), Email: grantOwner}
+
+	err := grants.CreateGrant(&AccessGrant{
+		Email:     grantOwner,
+		ClientID:  grantClient,
+		FileIDs:   []primitive.ObjectID{passport.ID},
+		Tags:      []string{"statements"},
+		Scopes:    []string{ScopeFilesRead},
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		clientID string
+		scopes   []string
+		file     *UserFile
+		allowed  bool
+	}{
+		{"file granted by tag", grantOwner, grantClient, tokenScopes, statement, true},
+		{"file granted by ID", grantOwner, grantClient, tokenScopes, passport, true},
+		{"file not granted", grantOwner, grantClient, tokenScopes, payslip, false},
+		{"other client", grantOwner, "other-app", tokenScopes, statement, false},
+		{"other owner", "bob@example.com", grantClient, tokenScopes, statement, false},
+		{"scope not in the token", grantOwner, grantClient, []string{"profile"}, statement, false},
+		{"no scopes in the token", grantOwner, grantClient, nil, passport, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := grants.Authorize(test.email, test.clientID, test.scopes, test.file, ScopeFilesRead)
+			if test.allowed && err != nil {
+				t.Fatalf("Authorize = %v, want access", err)
+			}
+			if !test.allowed && err != ErrAccessDenied {
+				t.Fatalf("Authorize = %v, want ErrAccessDenied", err)
+			}
+		})
+	}
+
+	// A scope in the token but in no grant
+	if err := grants.Authorize(grantOwner, grantClient, []string{ScopeFilesRead, "files:write"}, statement, "files:write"); err != ErrAccessDenied {
+		t.Errorf("scope of the token only: %v", err)
+	}
+}
+
+func TestAuthorizeInactiveGrants(t *testing.T) {
+	ctx := context.Background()
+	repository := NewMemoryGrantRepository()
+	grants := NewGrantService(repository)
+	file := &UserFile{ID: primitive.NewObjectID(), Email: grantOwner, Tags: []string{"statements"}}
+	tokenScopes := []string{ScopeFilesRead}
+
+	// CreateGrant refuses grants that are already expired
+	expired := &AccessGrant{
+		Email:     grantOwner,
+		ClientID:  grantClient,
+		Tags:      []string{"statements"},
+		Scopes:    []string{ScopeFilesRead},
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}
+	if err := repository.Save(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := grants.Authorize(grantOwner, grantClient, tokenScopes, file, ScopeFilesRead); err != ErrAccessDenied {
+		t.Fatalf("expired grant: %v", err)
+	}
+
+	revoked := &AccessGrant{
+		Email:     grantOwner,
+		ClientID:  grantClient,
+		Tags:      []string{"statements"},
+		Scopes:    []string{ScopeFilesRead},
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := grants.CreateGrant(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := grants.Authorize(grantOwner, grantClient, tokenScopes, file, ScopeFilesRead); err != nil {
+		t.Fatalf("active grant: %v", err)
+	}
+	if err := grants.RevokeGrant("bob@example.com", revoked.ID.Hex()); err == nil {
+		t.Fatal("another user revoked the grant")
+	}
+	if err := grants.RevokeGrant(grantOwner, revoked.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := grants.Authorize(grantOwner, grantClient, tokenScopes, file, ScopeFilesRead); err != ErrAccessDenied {
+		t.Fatalf("revoked grant: %v", err)
+	}
+}
+
+func TestCovers(t *testing.T) {
+	file := &UserFile{ID: primitive.NewObjectID(), Tags: []string{"statements", "2021"}}
+	tests := []struct {
+		name   string
+		grant  AccessGrant
+		scope  string
+		covers bool
+	}{
+		{"by ID", AccessGrant{FileIDs: []primitive.ObjectID{file.ID}, Scopes: []string{ScopeFilesRead}}, ScopeFilesRead, true},
+		{"by one of the tags", AccessGrant{Tags: []string{"2021"}, Scopes: []string{ScopeFilesRead}}, ScopeFilesRead, true},
+		{"other ID", AccessGrant{FileIDs: []primitive.ObjectID{primitive.NewObjectID()}, Scopes: []string{ScopeFilesRead}}, ScopeFilesRead, false},
+		{"other tag", AccessGrant{Tags: []string{"payslips"}, Scopes: []string{ScopeFilesRead}}, ScopeFilesRead, false},
+		{"tags are not prefixes", AccessGrant{Tags: []string{"statement"}, Scopes: []string{ScopeFilesRead}}, ScopeFilesRead, false},
+		{"scope not granted", AccessGrant{FileIDs: []primitive.ObjectID{file.ID}, Scopes: []string{ScopeFilesRead}}, "files:write", false},
+		{"no scopes", AccessGrant{FileIDs: []primitive.ObjectID{file.ID}}, ScopeFilesRead, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.grant.Covers(file, test.scope); got != test.covers {
+				t.Fatalf("Covers = %v, want %v", got, test.covers)
+			}
+		})
+	}
+}
+
+func TestCreateGrant(t *testing.T) {
+	grants := NewGrantService(NewMemoryGrantRepository())
+	valid := func() *AccessGrant {
+		return &AccessGrant{
+			Email:     grantOwner,
+			ClientID:  grantClient,
+			Tags:      []string{"statements"},
+			Scopes:    []string{ScopeFilesRead},
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+	}
+
+	invalid := map[string]func(g *AccessGrant){
+		"no client":     func(g *AccessGrant) { g.ClientID = "" },
+		"no files":      func(g *AccessGrant) { g.Tags = nil },
+		"no scopes":     func(g *AccessGrant) { g.Scopes = nil },
+		"unknown scope": func(g *AccessGrant) { g.Scopes = []string{"files:delete"} },
+		"expired":       func(g *AccessGrant) { g.ExpiresAt = time.Now().Add(-time.Second) },
+	}
+	for name, change := range invalid {
+		t.Run(name, func(t *testing.T) {
+			grant := valid()
+			change(grant)
+			if err := grants.CreateGrant(grant); !errors.Is(err, ErrInvalidGrant) {
+				t.Fatalf("CreateGrant = %v, want ErrInvalidGrant", err)
+			}
+		})
+	}
+
+	if err := grants.CreateGrant(valid()); err != nil {
+		t.Fatal(err)
+	}
+}
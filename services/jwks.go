@@ -0,0 +1,257 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// minJwksRefreshGap rate limits the refreshes triggered by unknown key IDs,
+// so tokens with made up kids cannot make us hammer the JWKS endpoint.
+const minJwksRefreshGap = 30 * time.Second
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// verificationKey is a parsed public key from a JWKS.
+type verificationKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// JwksCache holds the signing keys of a JWKS loaded from an http(s) URL or a
+// local file. Keys are refreshed in the background, and on demand when a
+// token references a key ID the cache does not know yet.
+type JwksCache struct {
+	source string
+
+	mutex sync.RWMutex
+	keys  map[string]verificationKey
+	// lastAttempt is when the set was last loaded, whether it worked or not
+	lastAttempt time.Time
+
+	// refreshing lets one on demand refresh run at a time, the requests
+	// waiting for it use what it loaded
+	refreshing sync.Mutex
+}
+
+// NewJwksCache loads source once and refreshes it every interval until stop
+// is closed. source is a URL or a path, optionally prefixed with file://.
+func NewJwksCache(source string, interval time.Duration, stop <-chan struct{}) (*JwksCache, error) {
+	cache := &JwksCache{source: source}
+	if err := cache.Refresh(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					if err := cache.Refresh(); err != nil {
+						log.Println("Cannot refresh JWKS:", err.Error())
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	return cache, nil
+}
+
+// Refresh reloads the key set. The previous keys stay in use if it fails.
+func (j *JwksCache) Refresh() error {
+	j.mutex.Lock()
+	j.lastAttempt = time.Now()
+	j.mutex.Unlock()
+
+	data, err := j.load()
+	if err != nil {
+		return err
+	}
+
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return fmt.Errorf("invalid JWKS: %s", err.Error())
+	}
+
+	keys := make(map[string]verificationKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJsonWebKey(jwk)
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %s", jwk.Kid, err.Error())
+			continue
+		}
+		if jwk.Alg != "" && jwk.Alg != key.alg {
+			log.Printf("Skipping JWKS key %q: unsupported algorithm %s", jwk.Kid, jwk.Alg)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	j.mutex.Lock()
+	j.keys = keys
+	j.mutex.Unlock()
+	return nil
+}
+
+func (j *JwksCache) load() ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return ioutil.ReadFile(strings.TrimPrefix(j.source, "file://"))
+	}
+
+	agent := fiber.AcquireAgent()
+	resp := fiber.AcquireResponse()
+
+	defer func() {
+		fiber.ReleaseResponse(resp)
+		fiber.ReleaseAgent(agent)
+	}()
+
+	agent.UserAgent("IPFS API Server")
+
+	req := agent.Request()
+	req.Header.SetMethod(fiber.MethodGet)
+	req.SetRequestURI(j.source)
+
+	if err := agent.Parse(); err != nil {
+		return nil, err
+	}
+
+	if err := agent.HostClient.DoTimeout(req, resp, 10*time.Second); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != fiber.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode())
+	}
+
+	body := make([]byte, len(resp.Body()))
+	copy(body, resp.Body())
+	return body, nil
+}
+
+// key returns the key for kid, refreshing the set once if it is unknown and
+// was not loaded, or tried to be, in the last minJwksRefreshGap.
+func (j *JwksCache) key(kid string) (verificationKey, bool) {
+	j.mutex.RLock()
+	key, ok := j.keys[kid]
+	j.mutex.RUnlock()
+	if ok {
+		return key, ok
+	}
+
+	j.refreshing.Lock()
+	defer j.refreshing.Unlock()
+
+	// The refresh this request waited for may have loaded kid
+	j.mutex.RLock()
+	key, ok = j.keys[kid]
+	stale := time.Since(j.lastAttempt) > minJwksRefreshGap
+	j.mutex.RUnlock()
+
+	if ok || !stale {
+		return key, ok
+	}
+
+	if err := j.Refresh(); err != nil {
+		log.Println("Cannot refresh JWKS:", err.Error())
+		return verificationKey{}, false
+	}
+
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	key, ok = j.keys[kid]
+	return key, ok
+}
+
+func parseJsonWebKey(jwk jsonWebKey) (verificationKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(jwk.N)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		e, err := decodeBase64URL(jwk.E)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		if len(e) > 4 {
+			return verificationKey{}, errors.New("RSA exponent is too large")
+		}
+		return verificationKey{
+			alg: "RS256",
+			key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())},
+		}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return verificationKey{}, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBase64URL(jwk.X)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		y, err := decodeBase64URL(jwk.Y)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return verificationKey{}, errors.New("EC point is not on the curve")
+		}
+		return verificationKey{alg: "ES256", key: key}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return verificationKey{}, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBase64URL(jwk.X)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return verificationKey{}, errors.New("invalid Ed25519 key size")
+		}
+		return verificationKey{alg: "EdDSA", key: ed25519.PublicKey(x)}, nil
+	default:
+		return verificationKey{}, fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
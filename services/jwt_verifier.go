@@ -0,0 +1,187 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenMalformed = errors.New("token is malformed")
+	ErrTokenSignature = errors.New("token signature is invalid")
+	ErrTokenExpired   = errors.New("token is expired")
+	ErrTokenNotYet    = errors.New("token is not valid yet")
+	ErrTokenClaims    = errors.New("token claims are invalid")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// JwtVerifier checks tokens locally against a JWKS instead of calling the
+// remote validation service.
+type JwtVerifier struct {
+	jwks *JwksCache
+
+	// Issuer and Audience are checked when not empty
+	Issuer   string
+	Audience string
+	// RequiredClaims must be present and non empty, e.g. email or user_uid
+	RequiredClaims []string
+	// Leeway absorbs clock skew on exp and nbf
+	Leeway time.Duration
+}
+
+func NewJwtVerifier(jwks *JwksCache, issuer string, audience string, requiredClaims []string) *JwtVerifier {
+	return &JwtVerifier{
+		jwks:           jwks,
+		Issuer:         issuer,
+		Audience:       audience,
+		RequiredClaims: requiredClaims,
+		Leeway:         30 * time.Second,
+	}
+}
+
+// Verify checks the signature and claims of token and returns the user data
+// the remote validation service would have returned, plus every claim.
+func (v *JwtVerifier) Verify(token string) (JwtTokenValidationData, map[string]interface{}, error) {
+	claims, err := v.verify(token)
+	if err != nil {
+		return JwtTokenValidationData{}, nil, err
+	}
+
+	email, _ := claims["email"].(string)
+	userUid, _ := claims["user_uid"].(string)
+	return JwtTokenValidationData{Email: email, UserUid: userUid}, claims, nil
+}
+
+func (v *JwtVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeJwtSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	key, ok := v.jwks.key(header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key ID %q", ErrTokenSignature, header.Kid)
+	}
+	// The algorithm is taken from the key, never from the token alone
+	if header.Alg != key.alg {
+		return nil, fmt.Errorf("%w: algorithm %q does not match the key", ErrTokenSignature, header.Alg)
+	}
+
+	signature, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	if !verifySignature(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrTokenSignature
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJwtSegment(parts[1], &claims); err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JwtVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return fmt.Errorf("%w: exp is missing", ErrTokenClaims)
+	}
+	if now.After(time.Unix(exp, 0).Add(v.Leeway)) {
+		return ErrTokenExpired
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(v.Leeway).Before(time.Unix(nbf, 0)) {
+		return ErrTokenNotYet
+	}
+
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return fmt.Errorf("%w: unexpected issuer", ErrTokenClaims)
+		}
+	}
+
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return fmt.Errorf("%w: unexpected audience", ErrTokenClaims)
+	}
+
+	for _, name := range v.RequiredClaims {
+		if value, ok := claims[name]; !ok || value == nil || value == "" {
+			return fmt.Errorf("%w: %s is missing", ErrTokenClaims, name)
+		}
+	}
+	return nil
+}
+
+func verifySignature(key verificationKey, signed []byte, signature []byte) bool {
+	switch publicKey := key.key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS encodes ES256 signatures as r||s, 32 bytes each
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(publicKey, signed, signature)
+	default:
+		return false
+	}
+}
+
+func decodeJwtSegment(segment string, value interface{}) error {
+	data, err := decodeBase64URL(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, item := range value {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://auth.example.com"
+	testAudience = "ipfs-api"
+)
+
+// signingKey is a private key of the test JWKS.
+type signingKey struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newSigningKeys(t *testing.T) (rsaKey, ecKey, edKey signingKey) {
+	t.Helper()
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingKey{"rsa", "RS256", rsaPrivate}, signingKey{"ec", "ES256", ecPrivate}, signingKey{"ed", "EdDSA", edPrivate}
+}
+
+func encodeBase64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwks returns the JSON Web Key Set publishing the public halves of keys.
+func jwks(keys ...signingKey) []byte {
+	set := jsonWebKeySet{}
+	for _, k := range keys {
+		jwk := jsonWebKey{Kid: k.kid, Use: "sig", Alg: k.alg}
+		switch public := k.key.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encodeBase64URL(public.N.Bytes())
+			jwk.E = encodeBase64URL(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.Kty = "EC"
+			jwk.Crv = "P-256"
+			jwk.X = encodeBase64URL(public.X.FillBytes(make([]byte, 32)))
+			jwk.Y = encodeBase64URL(public.Y.FillBytes(make([]byte, 32)))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = encodeBase64URL(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// signToken returns a token of claims signed with key, under header alg.
+func signToken(t *testing.T, key signingKey, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: key.kid, Typ: "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encodeBase64URL(header) + "." + encodeBase64URL(payload)
+
+	var signature []byte
+	var err error
+	digest := sha256.Sum256([]byte(signed))
+	switch private := key.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, private, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(private, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + encodeBase64URL(signature)
+}
+
+// validClaims are claims every test verifier accepts.
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":      testIssuer,
+		"aud":      testAudience,
+		"email":    "alice@example.com",
+		"user_uid": "alice",
+		"iat":      now.Unix(),
+		"nbf":      now.Unix(),
+		"exp":      now.Add(time.Hour).Unix(),
+	}
+}
+
+func newTestVerifier(t *testing.T, keys ...signingKey) *JwtVerifier {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, jwks(keys...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewJwksCache("file://"+path, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewJwtVerifier(cache, testIssuer, testAudience, []string{"email"})
+}
+
+func TestJwtVerifierAlgorithms(t *testing.T) {
+	rsaKey, ecKey, edKey := newSigningKeys(t)
+	verifier := newTestVerifier(t, rsaKey, ecKey, edKey)
+
+	for _, key := range []signingKey{rsaKey, ecKey, edKey} {
+		t.Run(key.alg, func(t *testing.T) {
+			data, claims, err := verifier.Verify(signToken(t, key, key.alg, validClaims()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Email != "alice@example.com" || data.UserUid != "alice" || claims["iss"] != testIssuer {
+				t.Fatalf("Verify = %+v, %v", data, claims)
+			}
+		})
+	}
+}
+
+func TestJwtVerifierRejectsForgedSignatures(t *testing.T) {
+	rsaKey, ecKey, edKey := newSigningKeys(t)
+	verifier := newTestVerifier(t, rsaKey, ecKey)
+	claims := validClaims()
+
+	header := func(alg string, kid string) string {
+		data, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+		return encodeBase64URL(data)
+	}
+	payload, _ := json.Marshal(claims)
+	body := encodeBase64URL(payload)
+
+	// HS256 keyed with the public key, which the attacker knows
+	hs256 := header("HS256", rsaKey.kid) + "." + body
+	mac := hmac.New(sha256.New, jwks(rsaKey))
+	mac.Write([]byte(hs256))
+	hs256 += "." + encodeBase64URL(mac.Sum(nil))
+
+	// A valid RS256 token with a flipped bit in its signature
+	valid := strings.Split(signToken(t, rsaKey, "RS256", claims), ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(valid[2])
+	signature[0] ^= 1
+	tampered := valid[0] + "." + valid[1] + "." + encodeBase64URL(signature)
+
+	// A token claiming to be signed by a known kid with another key
+	other := signToken(t, signingKey{kid: ecKey.kid, alg: "ES256", key: mustECKey(t)}, "ES256", claims)
+
+	tests := map[string]string{
+		"none":                      header("none", rsaKey.kid) + "." + body + ".",
+		"none without a kid":        header("none", "") + "." + body + ".",
+		"HS256 with the public key": hs256,
+		"ES256 on an RSA key":       signToken(t, signingKey{kid: rsaKey.kid, key: ecKey.key}, "ES256", claims),
+		"RS256 on an EC key":        signToken(t, signingKey{kid: ecKey.kid, key: rsaKey.key}, "RS256", claims),
+		"key not in the set":        signToken(t, edKey, "EdDSA", claims),
+		"tampered signature":        tampered,
+		"signed by another key":     other,
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := verifier.Verify(token); !errors.Is(err, ErrTokenSignature) && !errors.Is(err, ErrTokenMalformed) {
+				t.Fatalf("Verify = %v, want a signature error", err)
+			}
+		})
+	}
+
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!!!.e30.", header("RS256", rsaKey.kid) + ".!!!.sig"} {
+		if _, _, err := verifier.Verify(token); err == nil {
+			t.Errorf("Verify(%q) succeeded", token)
+		}
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestJwtVerifierClaims(t *testing.T) {
+	rsaKey, _, _ := newSigningKeys(t)
+	verifier := newTestVerifier(t, rsaKey)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]interface{})
+		err    error
+	}{
+		{"valid", func(map[string]interface{}) {}, nil},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() }, ErrTokenExpired},
+		{"expired within the leeway", func(c map[string]interface{}) { c["exp"] = now.Add(-10 * time.Second).Unix() }, nil},
+		{"not valid yet", func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() }, ErrTokenNotYet},
+		{"not valid yet within the leeway", func(c map[string]interface{}) { c["nbf"] = now.Add(10 * time.Second).Unix() }, nil},
+		{"without nbf", func(c map[string]interface{}) { delete(c, "nbf") }, nil},
+		{"without exp", func(c map[string]interface{}) { delete(c, "exp") }, ErrTokenClaims},
+		{"exp as a string", func(c map[string]interface{}) { c["exp"] = "tomorrow" }, ErrTokenClaims},
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, ErrTokenClaims},
+		{"without issuer", func(c map[string]interface{}) { delete(c, "iss") }, ErrTokenClaims},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "other-api" }, ErrTokenClaims},
+		{"audience list", func(c map[string]interface{}) { c["aud"] = []string{"other-api", testAudience} }, nil},
+		{"audience list without us", func(c map[string]interface{}) { c["aud"] = []string{"other-api"} }, ErrTokenClaims},
+		{"without email", func(c map[string]interface{}) { delete(c, "email") }, ErrTokenClaims},
+		{"empty email", func(c map[string]interface{}) { c["email"] = "" }, ErrTokenClaims},
+		{"null email", func(c map[string]interface{}) { c["email"] = nil }, ErrTokenClaims},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := validClaims()
+			test.change(claims)
+			_, _, err := verifier.Verify(signToken(t, rsaKey, "RS256", claims))
+			if test.err == nil && err != nil {
+				t.Fatalf("Verify = %v, want success", err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("Verify = %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	// Without a leeway, a token expired a second ago is refused
+	verifier.Leeway = 0
+	claims := validClaims()
+	claims["exp"] = now.Add(-2 * time.Second).Unix()
+	if _, _, err := verifier.Verify(signToken(t, rsaKey, "RS256", claims)); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("Verify without leeway = %v", err)
+	}
+}
+
+// jwksServer serves the key set it holds, counting the requests.
+type jwksServer struct {
+	mutex    sync.Mutex
+	keySet   []byte
+	status   int
+	delay    time.Duration
+	requests int32
+}
+
+func (s *jwksServer) set(status int, keys ...signingKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+	s.keySet = jwks(keys...)
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.requests, 1)
+	time.Sleep(s.delay)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w.WriteHeader(s.status)
+	w.Write(s.keySet)
+}
+
+// allowRefresh lets the next unknown key ID refresh the set, as if
+// minJwksRefreshGap had passed.
+func allowRefresh(cache *JwksCache) {
+	cache.mutex.Lock()
+	cache.lastAttempt = time.Now().Add(-2 * minJwksRefreshGap)
+	cache.mutex.Unlock()
+}
+
+func TestJwksRefreshOnUnknownKid(t *testing.T) {
+	rsaKey, ecKey, edKey := newSigningKeys(t)
+	keys := &jwksServer{}
+	keys.set(http.StatusOK, rsaKey)
+	server := httptest.NewServer(keys)
+	defer server.Close()
+
+	cache, err := NewJwksCache(server.URL, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewJwtVerifier(cache, testIssuer, testAudience, []string{"email"})
+	requests := func() int32 { return atomic.LoadInt32(&keys.requests) }
+
+	// The provider rotates in a key right after the set was loaded: it is
+	// picked up once the refresh gap has passed
+	keys.set(http.StatusOK, rsaKey, ecKey)
+	ecToken := signToken(t, ecKey, "ES256", validClaims())
+	if _, _, err := verifier.Verify(ecToken); !errors.Is(err, ErrTokenSignature) || requests() != 1 {
+		t.Fatalf("Verify right after loading = %v, %d requests", err, requests())
+	}
+	allowRefresh(cache)
+	if _, _, err := verifier.Verify(ecToken); err != nil || requests() != 2 {
+		t.Fatalf("Verify after the gap = %v, %d requests", err, requests())
+	}
+
+	// Known keys never refresh the set, and unknown ones only once per gap
+	for i := 0; i < 5; i++ {
+		verifier.Verify(ecToken)
+		verifier.Verify(signToken(t, edKey, "EdDSA", validClaims()))
+	}
+	if requests() != 2 {
+		t.Fatalf("%d requests for unknown key IDs within the gap", requests())
+	}
+
+	// A failed refresh is rate limited as well, and keeps the keys loaded
+	keys.set(http.StatusInternalServerError)
+	allowRefresh(cache)
+	edToken := signToken(t, edKey, "EdDSA", validClaims())
+	for i := 0; i < 5; i++ {
+		if _, _, err := verifier.Verify(edToken); !errors.Is(err, ErrTokenSignature) {
+			t.Fatalf("Verify with a failing JWKS endpoint = %v", err)
+		}
+	}
+	if requests() != 3 {
+		t.Fatalf("%d requests after a failed refresh, want 3", requests())
+	}
+	if _, _, err := verifier.Verify(ecToken); err != nil {
+		t.Fatalf("a failed refresh dropped the loaded keys: %v", err)
+	}
+}
+
+func TestJwksConcurrentRefreshes(t *testing.T) {
+	rsaKey, ecKey, _ := newSigningKeys(t)
+	keys := &jwksServer{}
+	keys.set(http.StatusOK, rsaKey)
+	server := httptest.NewServer(keys)
+	defer server.Close()
+
+	cache, err := NewJwksCache(server.URL, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewJwtVerifier(cache, testIssuer, testAudience, []string{"email"})
+
+	keys.set(http.StatusOK, rsaKey, ecKey)
+	keys.delay = 50 * time.Millisecond
+	allowRefresh(cache)
+
+	// Requests arriving while a refresh runs wait for it instead of
+	// starting their own
+	token := signToken(t, ecKey, "ES256", validClaims())
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := verifier.Verify(token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&keys.requests); got != 2 {
+		t.Fatalf("%d requests to the JWKS endpoint, want 2", got)
+	}
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// KeyStore stores the wrapped user keys, one per email. CryptoService only
+// goes through this interface so it does not depend on MongoDB.
+type KeyStore interface {
+	// Get returns the key of email, or ErrKeyNotFound.
+	Get(ctx context.Context, email string) (UserKey, error)
+	// PutIfAbsent stores key unless its email already has one, and reports
+	// whether it was stored.
+	PutIfAbsent(ctx context.Context, key UserKey) (bool, error)
+	// List returns up to query.Limit keys matching query, ordered by email.
+	List(ctx context.Context, query KeyQuery) ([]UserKey, error)
+	Delete(ctx context.Context, email string) error
+	// Rotate replaces the key of email with replacement if it is still
+	// wrappedKey, and reports whether it was replaced.
+	Rotate(ctx context.Context, email string, wrappedKey string, replacement UserKey) (bool, error)
+}
+
+// KeyQuery filters and paginates KeyStore.List.
+type KeyQuery struct {
+	// ExcludeVersion skips keys wrapped with this master key version
+	ExcludeVersion int
+	// AfterEmail only returns keys whose email sorts after it
+	AfterEmail string
+	Limit      int64
+}
+
+func (q KeyQuery) matches(key UserKey) bool {
+	if q.ExcludeVersion != 0 && key.KeyVersion == q.ExcludeVersion {
+		return false
+	}
+	return key.Email > q.AfterEmail
+}
+
+type MongoKeyStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoKeyStore(db *mongo.Database) *MongoKeyStore {
+	return &MongoKeyStore{
+		collection: db.Collection("secret"),
+	}
+}
+
+func (m *MongoKeyStore) EnsureIndexes(ctx context.Context) error {
+	_, err := m.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (m *MongoKeyStore) Get(ctx context.Context, email string) (UserKey, error) {
+	var key UserKey
+
+	err := m.collection.FindOne(ctx, bson.D{{Key: "email", Value: email}}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return key, ErrKeyNotFound
+	}
+	return key, err
+}
+
+func (m *MongoKeyStore) PutIfAbsent(ctx context.Context, key UserKey) (bool, error) {
+	filter := bson.D{{Key: "email", Value: key.Email}}
+	update := bson.M{"$setOnInsert": key}
+	opts := options.Update().SetUpsert(true)
+
+	result, err := m.collection.UpdateOne(ctx, filter, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another request stored a key for this email first
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+func (m *MongoKeyStore) List(ctx context.Context, query KeyQuery) ([]UserKey, error) {
+	filter := bson.M{"email": bson.M{"$gt": query.AfterEmail}}
+	if query.ExcludeVersion != 0 {
+		filter["key_version"] = bson.M{"$ne": query.ExcludeVersion}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "email", Value: 1}})
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]UserKey, 0)
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (m *MongoKeyStore) Delete(ctx context.Context, email string) error {
+	result, err := m.collection.DeleteOne(ctx, bson.D{{Key: "email", Value: email}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (m *MongoKeyStore) Rotate(ctx context.Context, email string, wrappedKey string, replacement UserKey) (bool, error) {
+	filter := bson.D{{Key: "email", Value: email}, {Key: "key", Value: wrappedKey}}
+	update := bson.M{"$set": bson.M{"key": replacement.Key, "key_version": replacement.KeyVersion}}
+
+	result, err := m.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// MemoryKeyStore keeps user keys in memory, for tests and for running the
+// service without a database.
+type MemoryKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]UserKey
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys: make(map[string]UserKey),
+	}
+}
+
+func (m *MemoryKeyStore) Get(ctx context.Context, email string) (UserKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	key, ok := m.keys[email]
+	if !ok {
+		return key, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (m *MemoryKeyStore) PutIfAbsent(ctx context.Context, key UserKey) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.keys[key.Email]; ok {
+		return false, nil
+	}
+	m.keys[key.Email] = key
+	return true, nil
+}
+
+func (m *MemoryKeyStore) List(ctx context.Context, query KeyQuery) ([]UserKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	keys := make([]UserKey, 0)
+	for _, key := range m.keys {
+		if query.matches(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Email < keys[j].Email
+	})
+
+	if query.Limit > 0 && int64(len(keys)) > query.Limit {
+		keys = keys[:query.Limit]
+	}
+	return keys, nil
+}
+
+func (m *MemoryKeyStore) Delete(ctx context.Context, email string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.keys[email]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(m.keys, email)
+	return nil
+}
+
+func (m *MemoryKeyStore) Rotate(ctx context.Context, email string, wrappedKey string, replacement UserKey) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key, ok := m.keys[email]
+	if !ok || key.Key != wrappedKey {
+		return false, nil
+	}
+	key.Key = replacement.Key
+	key.KeyVersion = replacement.KeyVersion
+	m.keys[email] = key
+	return true, nil
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNameNotFound means a user has no IPNS name yet, or a name is not the
+// name of the user.
+var ErrNameNotFound = errors.New("name not found")
+
+// UserName is the IPNS name of a user, which points to their folder root.
+// Key is the name of its key in the keystore of the primary node. Cid is
+// what the name should point to and PublishedCid what it was last
+// published with; they differ until the publication of Cid succeeds.
+type UserName struct {
+	Email        string    `json:"email"  bson:"email"`
+	Key          string    `json:"key"  bson:"key"`
+	Name         string    `json:"name"  bson:"name"`
+	Cid          string    `json:"cid"  bson:"cid"`
+	PublishedCid string    `json:"published_cid"  bson:"published_cid"`
+	PublishedAt  time.Time `json:"published_at"  bson:"published_at"`
+	LastError    string    `json:"last_error,omitempty"  bson:"last_error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"  bson:"created_at"`
+}
+
+// NameRepository stores the IPNS names of the users.
+type NameRepository interface {
+	// Get returns the name of email, ErrNameNotFound when the user has none.
+	Get(ctx context.Context, email string) (*UserName, error)
+	// FindByName returns the user name whose IPNS name is name.
+	FindByName(ctx context.Context, name string) (*UserName, error)
+	// Create stores name unless the user already has one, and reports
+	// whether it did.
+	Create(ctx context.Context, name *UserName) (bool, error)
+	// SetCid sets what the name of email should point to.
+	SetCid(ctx context.Context, email string, cid string) error
+	// SetPublished records the publication of the name of email with cid,
+	// or the error it failed with.
+	SetPublished(ctx context.Context, email string, cid string, publishErr error) error
+	// ListUnpublished returns up to limit names whose Cid was not published.
+	ListUnpublished(ctx context.Context, limit int64) ([]UserName, error)
+}
+
+type MongoNameRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoNameRepository(db *mongo.Database) *MongoNameRepository {
+	return &MongoNameRepository{
+		collection: db.Collection("names"),
+	}
+}
+
+// EnsureIndexes creates the indexes the queries of the repository rely on.
+func (m *MongoNameRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := m.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	return err
+}
+
+func (m *MongoNameRepository) Get(ctx context.Context, email string) (*UserName, error) {
+	return m.findOne(ctx, bson.D{{Key: "email", Value: email}})
+}
+
+func (m *MongoNameRepository) FindByName(ctx context.Context, name string) (*UserName, error) {
+	return m.findOne(ctx, bson.D{{Key: "name", Value: name}})
+}
+
+func (m *MongoNameRepository) findOne(ctx context.Context, filter bson.D) (*UserName, error) {
+	var name UserName
+
+	err := m.collection.FindOne(ctx, filter).Decode(&name)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNameNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &name, nil
+}
+
+func (m *MongoNameRepository) Create(ctx context.Context, name *UserName) (bool, error) {
+	_, err := m.collection.InsertOne(ctx, name)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *MongoNameRepository) SetCid(ctx context.Context, email string, cid string) error {
+	result, err := m.collection.UpdateOne(ctx,
+		bson.D{{Key: "email", Value: email}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "cid", Value: cid}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNameNotFound
+	}
+	return nil
+}
+
+func (m *MongoNameRepository) SetPublished(ctx context.Context, email string, cid string, publishErr error) error {
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "published_cid", Value: cid},
+			{Key: "published_at", Value: time.Now().UTC()},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "last_error", Value: ""}}},
+	}
+	if publishErr != nil {
+		update = bson.D{
+			{Key: "$set", Value: bson.D{{Key: "last_error", Value: publishErr.Error()}}},
+		}
+	}
+
+	_, err := m.collection.UpdateOne(ctx, bson.D{{Key: "email", Value: email}}, update)
+	return err
+}
+
+func (m *MongoNameRepository) ListUnpublished(ctx context.Context, limit int64) ([]UserName, error) {
+	filter := bson.D{{Key: "$expr", Value: bson.D{
+		{Key: "$ne", Value: bson.A{"$cid", "$published_cid"}},
+	}}}
+
+	cursor, err := m.collection.Find(ctx, filter, options.Find().SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]UserName, 0)
+	if err := cursor.All(ctx, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// MemoryNameRepository keeps names in memory, for tests and for running the
+// service without a database.
+type MemoryNameRepository struct {
+	mutex sync.RWMutex
+	names map[string]UserName
+}
+
+func NewMemoryNameRepository() *MemoryNameRepository {
+	return &MemoryNameRepository{
+		names: make(map[string]UserName),
+	}
+}
+
+func (m *MemoryNameRepository) Get(ctx context.Context, email string) (*UserName, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	name, ok := m.names[email]
+	if !ok {
+		return nil, ErrNameNotFound
+	}
+	return &name, nil
+}
+
+func (m *MemoryNameRepository) FindByName(ctx context.Context, ipnsName string) (*UserName, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, name := range m.names {
+		if name.Name == ipnsName {
+			found := name
+			return &found, nil
+		}
+	}
+	return nil, ErrNameNotFound
+}
+
+func (m *MemoryNameRepository) Create(ctx context.Context, name *UserName) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.names[name.Email]; ok {
+		return false, nil
+	}
+	m.names[name.Email] = *name
+	return true, nil
+}
+
+func (m *MemoryNameRepository) SetCid(ctx context.Context, email string, cid string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name, ok := m.names[email]
+	if !ok {
+		return ErrNameNotFound
+	}
+	name.Cid = cid
+	m.names[email] = name
+	return nil
+}
+
+func (m *MemoryNameRepository) SetPublished(ctx context.Context, email string, cid string, publishErr error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name, ok := m.names[email]
+	if !ok {
+		return nil
+	}
+	if publishErr != nil {
+		name.LastError = publishErr.Error()
+	} else {
+		name.PublishedCid = cid
+		name.PublishedAt = time.Now().UTC()
+		name.LastError = ""
+	}
+	m.names[email] = name
+	return nil
+}
+
+func (m *MemoryNameRepository) ListUnpublished(ctx context.Context, limit int64) ([]UserName, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	names := make([]UserName, 0)
+	for _, name := range m.names {
+		if int64(len(names)) >= limit {
+			break
+		}
+		if name.Cid != name.PublishedCid {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
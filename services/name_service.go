@@ -0,0 +1,254 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+)
+
+// ErrKeystoreMismatch means the keystore of the primary node does not hold
+// the key a name was created with, because another node became the primary
+// one. The name cannot be published until that keystore is restored on it.
+var ErrKeystoreMismatch = errors.New("ipns key is not in the keystore of the primary ipfs node")
+
+// NameService gives every user an IPNS name pointing to their folder root,
+// so that a stable address always leads to the latest version of their
+// folders and of the files in them. The keys of the names are generated in
+// the keystore of the primary node of the pool, which alone publishes them:
+// the primary node must stay the same, with its keystore kept across
+// restarts. Publishing fails with ErrKeystoreMismatch otherwise, instead of
+// publishing under another key.
+type NameService struct {
+	repository NameRepository
+	roots      FolderRepository
+	keys       *ipfs.IPFSClient
+	pool       *ipfs.IPFSPool
+
+	// Lifetime is how long a published record stays valid, the default of
+	// the node when zero. The node republishes its records before they
+	// expire.
+	Lifetime time.Duration
+
+	inflight sync.Map
+}
+
+func NewNameService(repository NameRepository, roots FolderRepository, pool *ipfs.IPFSPool) *NameService {
+	return &NameService{
+		repository: repository,
+		roots:      roots,
+		keys:       pool.Primary(),
+		pool:       pool,
+	}
+}
+
+// Get returns the name of email, creating it the first time. A name created
+// for a user who already has folders is published in the background.
+func (s *NameService) Get(ctx context.Context, email string) (*UserName, error) {
+	name, err := s.repository.Get(ctx, email)
+	if err != ErrNameNotFound {
+		return name, err
+	}
+
+	key, err := s.key(ctx, userKey(email))
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.roots.Get(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	name = &UserName{
+		Email:     email,
+		Key:       key.Name,
+		Name:      key.Id,
+		Cid:       root.Cid,
+		CreatedAt: time.Now().UTC(),
+	}
+	created, err := s.repository.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		// Another request created it first
+		return s.repository.Get(ctx, email)
+	}
+
+	if name.Cid != "" {
+		s.PublishAsync(email)
+	}
+	return name, nil
+}
+
+// Update points the name of email to cid, the new folder root of the user,
+// and publishes it in the background.
+func (s *NameService) Update(ctx context.Context, email string, cid string) error {
+	name, err := s.Get(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	if name.Cid != cid {
+		if err := s.repository.SetCid(ctx, email, cid); err != nil {
+			return err
+		}
+	}
+	if name.PublishedCid != cid {
+		s.PublishAsync(email)
+	}
+	return nil
+}
+
+// Publish publishes the name of email with the CID it should point to, until
+// the CID stops changing. A publication already running for the name picks
+// up the changes instead.
+func (s *NameService) Publish(ctx context.Context, email string) error {
+	if _, busy := s.inflight.LoadOrStore(email, true); busy {
+		return nil
+	}
+	defer s.inflight.Delete(email)
+
+	for {
+		name, err := s.repository.Get(ctx, email)
+		if err != nil {
+			return err
+		}
+		if name.Cid == "" || name.Cid == name.PublishedCid {
+			return nil
+		}
+
+		entry, err := s.keys.Publish(ctx, name.Key, name.Cid, s.Lifetime)
+		switch {
+		case ipfs.IsKeyNotFound(err):
+			err = fmt.Errorf("%w: no key %s", ErrKeystoreMismatch, name.Key)
+		case err == nil && entry.Name != name.Name:
+			err = fmt.Errorf("%w: key %s publishes %s instead of %s", ErrKeystoreMismatch, name.Key, entry.Name, name.Name)
+		}
+		if updateErr := s.repository.SetPublished(ctx, email, name.Cid, err); updateErr != nil {
+			return updateErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// PublishAsync publishes the name of email in the background, publishing
+// goes through the DHT and can take a while. PublishPending picks up the
+// ones that fail.
+func (s *NameService) PublishAsync(email string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		if err := s.Publish(ctx, email); err != nil {
+			log.Println("Cannot publish IPNS name:", err.Error())
+		}
+	}()
+}
+
+// PublishPending publishes up to batchSize names whose latest CID was not
+// published yet. Errors of single names are logged and skipped.
+func (s *NameService) PublishPending(ctx context.Context, batchSize int64) error {
+	names, err := s.repository.ListUnpublished(ctx, batchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.Publish(ctx, name.Email); err != nil {
+			log.Println("Cannot publish IPNS name", name.Name+":", err.Error())
+		}
+	}
+	return nil
+}
+
+// Watch publishes the pending names every interval until stop is closed.
+func (s *NameService) Watch(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.PublishPending(context.Background(), 100); err != nil {
+				log.Println("Publishing IPNS names stopped:", err.Error())
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Resolve returns the CID name leads to for email. name is the IPNS name of
+// the user, optionally prefixed with /ipns/, and optionally followed by the
+// path of a folder or of a file in their folders, files being named after
+// their ID. Names of other users are not found. The name is resolved from
+// the root it is recorded with, which is never older than the published one
+// and saves a lookup in the DHT.
+func (s *NameService) Resolve(ctx context.Context, email string, name string) (string, error) {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "/ipns/")
+	rest := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], path.Clean(name[i:])
+	}
+	if err := ipfs.ValidateName(name); err != nil {
+		return "", err
+	}
+
+	record, err := s.repository.FindByName(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if record.Email != email {
+		return "", ErrNameNotFound
+	}
+	if record.Cid == "" {
+		return "", fmt.Errorf("%w: %s has no folders yet", ErrNameNotFound, name)
+	}
+	if rest == "" || rest == "/" {
+		return record.Cid, nil
+	}
+
+	cid, err := s.pool.ResolvePath(ctx, "/ipfs/"+record.Cid+rest)
+	if ipfs.IsNotResolved(err) {
+		return "", ErrFileNotFound
+	}
+	return cid, err
+}
+
+// key generates the key named keyName, or returns it when an earlier
+// attempt generated it without recording it.
+func (s *NameService) key(ctx context.Context, keyName string) (ipfs.Key, error) {
+	key, err := s.keys.GenerateKey(ctx, keyName)
+	if !ipfs.IsKeyExist(err) {
+		return key, err
+	}
+
+	keys, err := s.keys.ListKeys(ctx)
+	if err != nil {
+		return ipfs.Key{}, err
+	}
+	for _, key := range keys {
+		if key.Name == keyName {
+			return key, nil
+		}
+	}
+	return ipfs.Key{}, fmt.Errorf("key %s exists but is not listed", keyName)
+}
+
+// userKey is the name of the key of email, named after the same hash as the
+// directory of the user.
+func userKey(email string) string {
+	return "user-" + userHash(email)
+}
@@ -0,0 +1,493 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrPinRequestNotFound = errors.New("pin request not found")
+
+// Ways PinRequestQuery.Name matches the name of a pin request.
+const (
+	MatchExact             = "exact"
+	MatchIgnoreCase        = "iexact"
+	MatchPartial           = "partial"
+	MatchPartialIgnoreCase = "ipartial"
+)
+
+// PinRequestRepository stores the pin requests other services send to our
+// Pinning Service API.
+type PinRequestRepository interface {
+	// Insert stores request, assigning it an ID, unless it is active and its
+	// tenant already holds quota active requests, in which case it fails
+	// with ErrQuotaExceeded. A zero quota is no limit. The check and the
+	// insert are atomic, concurrent inserts cannot overrun the quota.
+	Insert(ctx context.Context, request *PinRequest, quota int64) error
+	FindByID(ctx context.Context, tenant string, id primitive.ObjectID) (*PinRequest, error)
+	// List returns the requests of tenant matching query, newest first, and
+	// the total number of matching requests.
+	List(ctx context.Context, tenant string, query PinRequestQuery) ([]PinRequest, int64, error)
+	Delete(ctx context.Context, tenant string, id primitive.ObjectID) error
+	// CountActive returns how many requests of tenant are not failed.
+	CountActive(ctx context.Context, tenant string) (int64, error)
+	// CountActiveByCid returns how many requests of any tenant other than
+	// the one with excludeID pin cid and are not failed.
+	CountActiveByCid(ctx context.Context, cid string, excludeID primitive.ObjectID) (int64, error)
+	// ListByStatus returns up to limit requests of any tenant with one of
+	// statuses, ordered by ID, starting after afterID.
+	ListByStatus(ctx context.Context, statuses []string, afterID primitive.ObjectID, limit int64) ([]PinRequest, error)
+	// UpdateStatus sets the status and info of the request id, leaving the
+	// rest of the record alone. It never recreates a deleted request.
+	UpdateStatus(ctx context.Context, id primitive.ObjectID, status string, info map[string]string) error
+}
+
+// PinRequestQuery filters and paginates PinRequestRepository.List. Zero
+// values match everything.
+type PinRequestQuery struct {
+	Cids []string
+	Name string
+	// Match is how Name matches, one of the Match constants
+	Match    string
+	Statuses []string
+	// Before and After bound the creation time, both excluded
+	Before time.Time
+	After  time.Time
+	// Meta matches requests with all of these metadata values
+	Meta  map[string]string
+	Limit int64
+}
+
+func (q PinRequestQuery) namePattern() string {
+	switch q.Match {
+	case MatchIgnoreCase:
+		return "(?i)^" + regexp.QuoteMeta(q.Name) + "$"
+	case MatchPartial:
+		return regexp.QuoteMeta(q.Name)
+	case MatchPartialIgnoreCase:
+		return "(?i)" + regexp.QuoteMeta(q.Name)
+	}
+	return "^" + regexp.QuoteMeta(q.Name) + "$"
+}
+
+func (q PinRequestQuery) matches(request PinRequest) bool {
+	if len(q.Cids) > 0 && !containsString(q.Cids, request.Cid) {
+		return false
+	}
+	if q.Name != "" && !regexp.MustCompile(q.namePattern()).MatchString(request.Name) {
+		return false
+	}
+	if len(q.Statuses) > 0 && !containsString(q.Statuses, request.Status) {
+		return false
+	}
+	if !q.Before.IsZero() && !request.Created.Before(q.Before) {
+		return false
+	}
+	if !q.After.IsZero() && !request.Created.After(q.After) {
+		return false
+	}
+	for key, value := range q.Meta {
+		if request.Meta[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// MongoPinRequestRepository keeps, next to the requests, the number of
+// active requests of each tenant, which Insert checks the quota against and
+// updates in the same operation.
+type MongoPinRequestRepository struct {
+	collection *mongo.Collection
+	counts     *mongo.Collection
+}
+
+func NewMongoPinRequestRepository(db *mongo.Database) *MongoPinRequestRepository {
+	return &MongoPinRequestRepository{
+		collection: db.Collection("pin_requests"),
+		counts:     db.Collection("pin_request_counts"),
+	}
+}
+
+// EnsureIndexes creates the indexes the queries of the repository rely on.
+func (m *MongoPinRequestRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := m.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "created", Value: -1}}},
+		{Keys: bson.D{{Key: "cid", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	return err
+}
+
+func (m *MongoPinRequestRepository) Insert(ctx context.Context, request *PinRequest, quota int64) error {
+	if request.ID.IsZero() {
+		request.ID = primitive.NewObjectID()
+	}
+
+	active := request.Status != ipfs.RemotePinFailed
+	if active {
+		if err := m.reserve(ctx, request.Tenant, quota); err != nil {
+			return err
+		}
+	}
+
+	_, err := m.collection.InsertOne(ctx, request)
+	if err != nil && active {
+		if countErr := m.count(ctx, request.Tenant, -1); countErr != nil {
+			return countErr
+		}
+	}
+	return err
+}
+
+// reserve counts one more active request of tenant, unless it holds quota
+// of them already.
+func (m *MongoPinRequestRepository) reserve(ctx context.Context, tenant string, quota int64) error {
+	if err := m.seedCount(ctx, tenant); err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": tenant}
+	if quota > 0 {
+		filter["active"] = bson.M{"$lt": quota}
+	}
+	result, err := m.counts.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"active": 1}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return quotaExceeded(quota)
+	}
+	return nil
+}
+
+// seedCount creates the counter of tenant from its requests, the first time
+// the tenant inserts one.
+func (m *MongoPinRequestRepository) seedCount(ctx context.Context, tenant string) error {
+	err := m.counts.FindOne(ctx, bson.M{"_id": tenant}).Err()
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	active, err := m.CountActive(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	_, err = m.counts.UpdateOne(ctx,
+		bson.M{"_id": tenant},
+		bson.M{"$setOnInsert": bson.M{"active": active}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// Seeded by a concurrent insert
+		return nil
+	}
+	return err
+}
+
+// count adds delta to the active requests of tenant.
+func (m *MongoPinRequestRepository) count(ctx context.Context, tenant string, delta int64) error {
+	_, err := m.counts.UpdateOne(ctx, bson.M{"_id": tenant}, bson.M{"$inc": bson.M{"active": delta}})
+	return err
+}
+
+func (m *MongoPinRequestRepository) FindByID(ctx context.Context, tenant string, id primitive.ObjectID) (*PinRequest, error) {
+	var request PinRequest
+
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "tenant", Value: tenant}}
+	err := m.collection.FindOne(ctx, filter).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPinRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (m *MongoPinRequestRepository) List(ctx context.Context, tenant string, query PinRequestQuery) ([]PinRequest, int64, error) {
+	filter := bson.M{"tenant": tenant}
+	if len(query.Cids) > 0 {
+		filter["cid"] = bson.M{"$in": query.Cids}
+	}
+	if query.Name != "" {
+		filter["name"] = primitive.Regex{Pattern: query.namePattern()}
+	}
+	if len(query.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": query.Statuses}
+	}
+	if !query.Before.IsZero() || !query.After.IsZero() {
+		created := bson.M{}
+		if !query.Before.IsZero() {
+			created["$lt"] = query.Before
+		}
+		if !query.After.IsZero() {
+			created["$gt"] = query.After
+		}
+		filter["created"] = created
+	}
+	for key, value := range query.Meta {
+		filter["meta."+key] = value
+	}
+
+	total, err := m.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	requests := make([]PinRequest, 0)
+	if err := cursor.All(ctx, &requests); err != nil {
+		return nil, 0, err
+	}
+	return requests, total, nil
+}
+
+func (m *MongoPinRequestRepository) Delete(ctx context.Context, tenant string, id primitive.ObjectID) error {
+	var deleted PinRequest
+
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "tenant", Value: tenant}}
+	err := m.collection.FindOneAndDelete(ctx, filter).Decode(&deleted)
+	if err == mongo.ErrNoDocuments {
+		return ErrPinRequestNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if deleted.Status != ipfs.RemotePinFailed {
+		return m.count(ctx, tenant, -1)
+	}
+	return nil
+}
+
+func (m *MongoPinRequestRepository) CountActive(ctx context.Context, tenant string) (int64, error) {
+	filter := bson.M{"tenant": tenant, "status": bson.M{"$ne": ipfs.RemotePinFailed}}
+	return m.collection.CountDocuments(ctx, filter)
+}
+
+func (m *MongoPinRequestRepository) CountActiveByCid(ctx context.Context, cid string, excludeID primitive.ObjectID) (int64, error) {
+	filter := bson.M{
+		"cid":    cid,
+		"_id":    bson.M{"$ne": excludeID},
+		"status": bson.M{"$ne": ipfs.RemotePinFailed},
+	}
+	return m.collection.CountDocuments(ctx, filter)
+}
+
+func (m *MongoPinRequestRepository) ListByStatus(ctx context.Context, statuses []string, afterID primitive.ObjectID, limit int64) ([]PinRequest, error) {
+	filter := bson.M{
+		"status": bson.M{"$in": statuses},
+		"_id":    bson.M{"$gt": afterID},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]PinRequest, 0)
+	if err := cursor.All(ctx, &requests); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (m *MongoPinRequestRepository) UpdateStatus(ctx context.Context, id primitive.ObjectID, status string, info map[string]string) error {
+	update := bson.M{"$set": bson.M{
+		"status":     status,
+		"info":       info,
+		"updated_at": time.Now().UTC(),
+	}}
+	var previous PinRequest
+	err := m.collection.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: id}}, update).Decode(&previous)
+	if err == mongo.ErrNoDocuments {
+		return ErrPinRequestNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Failed requests do not count against the quota
+	wasActive, active := previous.Status != ipfs.RemotePinFailed, status != ipfs.RemotePinFailed
+	switch {
+	case wasActive && !active:
+		return m.count(ctx, previous.Tenant, -1)
+	case !wasActive && active:
+		return m.count(ctx, previous.Tenant, 1)
+	}
+	return nil
+}
+
+// MemoryPinRequestRepository keeps pin requests in memory, for tests and for
+// running the service without a database.
+type MemoryPinRequestRepository struct {
+	mutex    sync.RWMutex
+	requests map[primitive.ObjectID]PinRequest
+}
+
+func NewMemoryPinRequestRepository() *MemoryPinRequestRepository {
+	return &MemoryPinRequestRepository{
+		requests: make(map[primitive.ObjectID]PinRequest),
+	}
+}
+
+func (m *MemoryPinRequestRepository) Insert(ctx context.Context, request *PinRequest, quota int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if quota > 0 && request.Status != ipfs.RemotePinFailed {
+		var active int64
+		for _, stored := range m.requests {
+			if stored.Tenant == request.Tenant && stored.Status != ipfs.RemotePinFailed {
+				active++
+			}
+		}
+		if active >= quota {
+			return quotaExceeded(quota)
+		}
+	}
+
+	if request.ID.IsZero() {
+		request.ID = primitive.NewObjectID()
+	}
+	m.requests[request.ID] = *request
+	return nil
+}
+
+func (m *MemoryPinRequestRepository) FindByID(ctx context.Context, tenant string, id primitive.ObjectID) (*PinRequest, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	request, ok := m.requests[id]
+	if !ok || request.Tenant != tenant {
+		return nil, ErrPinRequestNotFound
+	}
+	return &request, nil
+}
+
+func (m *MemoryPinRequestRepository) List(ctx context.Context, tenant string, query PinRequestQuery) ([]PinRequest, int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	matched := make([]PinRequest, 0)
+	for _, request := range m.requests {
+		if request.Tenant == tenant && query.matches(request) {
+			matched = append(matched, request)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Created.Equal(matched[j].Created) {
+			return matched[i].ID.Hex() > matched[j].ID.Hex()
+		}
+		return matched[i].Created.After(matched[j].Created)
+	})
+
+	total := int64(len(matched))
+	if query.Limit > 0 && total > query.Limit {
+		matched = matched[:query.Limit]
+	}
+	return matched, total, nil
+}
+
+func (m *MemoryPinRequestRepository) Delete(ctx context.Context, tenant string, id primitive.ObjectID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	request, ok := m.requests[id]
+	if !ok || request.Tenant != tenant {
+		return ErrPinRequestNotFound
+	}
+	delete(m.requests, id)
+	return nil
+}
+
+func (m *MemoryPinRequestRepository) CountActive(ctx context.Context, tenant string) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var count int64
+	for _, request := range m.requests {
+		if request.Tenant == tenant && request.Status != ipfs.RemotePinFailed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryPinRequestRepository) CountActiveByCid(ctx context.Context, cid string, excludeID primitive.ObjectID) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var count int64
+	for id, request := range m.requests {
+		if request.Cid == cid && id != excludeID && request.Status != ipfs.RemotePinFailed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryPinRequestRepository) ListByStatus(ctx context.Context, statuses []string, afterID primitive.ObjectID, limit int64) ([]PinRequest, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	matched := make([]PinRequest, 0)
+	for _, request := range m.requests {
+		if containsString(statuses, request.Status) && request.ID.Hex() > afterID.Hex() {
+			matched = append(matched, request)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].ID.Hex() < matched[j].ID.Hex()
+	})
+
+	if limit > 0 && int64(len(matched)) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+func (m *MemoryPinRequestRepository) UpdateStatus(ctx context.Context, id primitive.ObjectID, status string, info map[string]string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	request, ok := m.requests[id]
+	if !ok {
+		return ErrPinRequestNotFound
+	}
+	request.Status = status
+	request.Info = info
+	request.UpdatedAt = time.Now().UTC()
+	m.requests[id] = request
+	return nil
+}
+
+func quotaExceeded(quota int64) error {
+	return fmt.Errorf("%w: all %d pins are in use", ErrQuotaExceeded, quota)
+}
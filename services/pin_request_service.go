@@ -0,0 +1,349 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrQuotaExceeded means the tenant already holds as many pins as its
+	// quota allows.
+	ErrQuotaExceeded = errors.New("pin quota exceeded")
+	// ErrInvalidPinRequest means a pin request or query is malformed.
+	ErrInvalidPinRequest = errors.New("invalid pin request")
+)
+
+// ScopePinning lets a client use the Pinning Service API.
+const ScopePinning = "pins"
+
+const (
+	// maxConcurrentPins bounds how many pin requests are pinned at once.
+	maxConcurrentPins = 16
+	// pinQueueSize bounds how many new requests wait for a worker. Requests
+	// that do not fit stay queued for Process.
+	pinQueueSize = 1024
+)
+
+// PinRequest is a request of a tenant of our Pinning Service API to keep a
+// CID pinned on our nodes. Status is one of the ipfs.RemotePin* statuses.
+type PinRequest struct {
+	ID        primitive.ObjectID `json:"requestid"  bson:"_id,omitempty"`
+	Tenant    string             `json:"-"  bson:"tenant"`
+	Cid       string             `json:"cid"  bson:"cid"`
+	Name      string             `json:"name,omitempty"  bson:"name,omitempty"`
+	Origins   []string           `json:"origins,omitempty"  bson:"origins,omitempty"`
+	Meta      map[string]string  `json:"meta,omitempty"  bson:"meta,omitempty"`
+	Status    string             `json:"status"  bson:"status"`
+	Info      map[string]string  `json:"info,omitempty"  bson:"info,omitempty"`
+	Created   time.Time          `json:"created"  bson:"created"`
+	UpdatedAt time.Time          `json:"updated_at"  bson:"updated_at"`
+}
+
+// PinRequestService serves the Pinning Service API from our own nodes. Pin
+// requests are stored, answered right away as queued, and pinned on the
+// IPFS pool in the background by a fixed number of workers.
+type PinRequestService struct {
+	repository PinRequestRepository
+	files      FileRepository
+	pool       *ipfs.IPFSPool
+
+	// DefaultQuota is how many pins a tenant may hold, zero for no limit.
+	// Quotas overrides it per tenant.
+	DefaultQuota int64
+	Quotas       map[string]int64
+
+	queue    chan PinRequest
+	inflight sync.Map
+}
+
+func NewPinRequestService(repository PinRequestRepository, files FileRepository, pool *ipfs.IPFSPool) *PinRequestService {
+	s := &PinRequestService{
+		repository: repository,
+		files:      files,
+		pool:       pool,
+		queue:      make(chan PinRequest, pinQueueSize),
+	}
+	for i := 0; i < maxConcurrentPins; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Quota returns how many pins tenant may hold, zero for no limit.
+func (s *PinRequestService) Quota(tenant string) int64 {
+	if quota, ok := s.Quotas[tenant]; ok {
+		return quota
+	}
+	return s.DefaultQuota
+}
+
+// Create stores a request of tenant to pin pin.Cid and starts pinning it.
+func (s *PinRequestService) Create(ctx context.Context, tenant string, pin ipfs.RemotePin) (*PinRequest, error) {
+	if err := validatePin(pin); err != nil {
+		return nil, err
+	}
+
+	request := newPinRequest(tenant, pin)
+	if err := s.repository.Insert(ctx, request, s.Quota(tenant)); err != nil {
+		return nil, err
+	}
+
+	s.enqueue(*request)
+	return request, nil
+}
+
+// Get returns the request of tenant with the given hex ID. Malformed IDs
+// are reported as ErrPinRequestNotFound like unknown ones.
+func (s *PinRequestService) Get(ctx context.Context, tenant string, id string) (*PinRequest, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrPinRequestNotFound
+	}
+	return s.repository.FindByID(ctx, tenant, objectID)
+}
+
+func (s *PinRequestService) List(ctx context.Context, tenant string, query PinRequestQuery) ([]PinRequest, int64, error) {
+	for key := range query.Meta {
+		if !validMetaKey(key) {
+			return nil, 0, fmt.Errorf("%w: invalid meta key %q", ErrInvalidPinRequest, key)
+		}
+	}
+	return s.repository.List(ctx, tenant, query)
+}
+
+// Replace swaps the request id of tenant for a new one pinning pin.Cid. The
+// old CID is unpinned once the new request is stored, unless something else
+// still needs it.
+func (s *PinRequestService) Replace(ctx context.Context, tenant string, id string, pin ipfs.RemotePin) (*PinRequest, error) {
+	if err := validatePin(pin); err != nil {
+		return nil, err
+	}
+
+	previous, err := s.Get(ctx, tenant, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new request takes the place of the previous one in the quota,
+	// unless the previous one failed and holds no place
+	quota := s.Quota(tenant)
+	if previous.Status != ipfs.RemotePinFailed {
+		quota = 0
+	}
+
+	request := newPinRequest(tenant, pin)
+	if err := s.repository.Insert(ctx, request, quota); err != nil {
+		return nil, err
+	}
+
+	if err := s.remove(ctx, previous); err != nil {
+		return nil, err
+	}
+
+	s.enqueue(*request)
+	return request, nil
+}
+
+// Delete removes the request id of tenant and unpins its CID, unless
+// something else still needs it.
+func (s *PinRequestService) Delete(ctx context.Context, tenant string, id string) error {
+	request, err := s.Get(ctx, tenant, id)
+	if err != nil {
+		return err
+	}
+	return s.remove(ctx, request)
+}
+
+// remove unpins the CID of request when nothing else needs it, then deletes
+// the request. The request is kept when the nodes cannot unpin it, so the
+// delete can be retried.
+func (s *PinRequestService) remove(ctx context.Context, request *PinRequest) error {
+	if err := s.unpinUnused(ctx, request.Cid, request.ID); err != nil {
+		return err
+	}
+
+	err := s.repository.Delete(ctx, request.Tenant, request.ID)
+	if err == ErrPinRequestNotFound {
+		return nil
+	}
+	return err
+}
+
+// unpinUnused unpins cid unless a pin request other than excludeID or an
+// uploaded file still needs it. Uploads are pinned under the same CIDs, and
+// a tenant must not be able to unpin the files of our users.
+func (s *PinRequestService) unpinUnused(ctx context.Context, cid string, excludeID primitive.ObjectID) error {
+	requests, err := s.repository.CountActiveByCid(ctx, cid, excludeID)
+	if err != nil {
+		return err
+	}
+	files, err := s.files.CountByCid(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if requests > 0 || files > 0 {
+		return nil
+	}
+
+	if _, err := s.pool.Unpin(ctx, cid); err != nil && !ipfs.IsNotPinned(err) {
+		return err
+	}
+	return nil
+}
+
+// Process hands the requests left queued or pinning to the workers, for
+// instance those left by a restart while they were being pinned or that did
+// not fit in the queue.
+func (s *PinRequestService) Process(ctx context.Context, batchSize int64) error {
+	var lastID primitive.ObjectID
+	statuses := []string{ipfs.RemotePinQueued, ipfs.RemotePinPinning}
+
+	for {
+		batch, err := s.repository.ListByStatus(ctx, statuses, lastID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, request := range batch {
+			lastID = request.ID
+			select {
+			case s.queue <- request:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if int64(len(batch)) < batchSize {
+			return nil
+		}
+	}
+}
+
+// Watch processes the pending requests every interval until stop is closed.
+func (s *PinRequestService) Watch(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.Process(context.Background(), 100); err != nil {
+				log.Println("Processing pin requests stopped:", err.Error())
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Requested reports whether a request of any tenant that is not failed pins
+// cid. Deleting the files of our users must not unpin those.
+func (s *PinRequestService) Requested(ctx context.Context, cid string) (bool, error) {
+	count, err := s.repository.CountActiveByCid(ctx, cid, primitive.NilObjectID)
+	return count > 0, err
+}
+
+// enqueue hands request to the workers. When they are behind, the request
+// stays queued for Process to pick up.
+func (s *PinRequestService) enqueue(request PinRequest) {
+	select {
+	case s.queue <- request:
+	default:
+	}
+}
+
+// work pins the requests of the queue, one at a time.
+func (s *PinRequestService) work() {
+	for request := range s.queue {
+		s.pin(request)
+	}
+}
+
+// pin pins the CID of request on the pool and records the outcome. When the
+// nodes cannot be reached, the request goes back to queued for Process to
+// try again.
+func (s *PinRequestService) pin(request PinRequest) {
+	if _, busy := s.inflight.LoadOrStore(request.ID, true); busy {
+		return
+	}
+	defer s.inflight.Delete(request.ID)
+
+	ctx := context.Background()
+	if err := s.repository.UpdateStatus(ctx, request.ID, ipfs.RemotePinPinning, nil); err != nil {
+		if err != ErrPinRequestNotFound {
+			log.Printf("pin request %s: %s", request.ID.Hex(), err.Error())
+		}
+		return
+	}
+
+	status, info := ipfs.RemotePinPinned, map[string]string(nil)
+	_, err := s.pool.Pin(ctx, request.Cid)
+	switch {
+	case err == nil:
+	case isUnreachable(err):
+		status = ipfs.RemotePinQueued
+		info = map[string]string{"reason": err.Error()}
+	default:
+		status = ipfs.RemotePinFailed
+		info = map[string]string{"reason": err.Error()}
+	}
+
+	err = s.repository.UpdateStatus(ctx, request.ID, status, info)
+	if err == ErrPinRequestNotFound && status == ipfs.RemotePinPinned {
+		// Deleted while it was being pinned, so nobody unpinned it yet
+		err = s.unpinUnused(ctx, request.Cid, request.ID)
+	}
+	if err != nil {
+		log.Printf("pin request %s: %s", request.ID.Hex(), err.Error())
+	}
+}
+
+func newPinRequest(tenant string, pin ipfs.RemotePin) *PinRequest {
+	now := time.Now().UTC()
+	return &PinRequest{
+		Tenant:    tenant,
+		Cid:       pin.Cid,
+		Name:      pin.Name,
+		Origins:   pin.Origins,
+		Meta:      pin.Meta,
+		Status:    ipfs.RemotePinQueued,
+		Created:   now,
+		UpdatedAt: now,
+	}
+}
+
+// validatePin checks the limits the Pinning Service API sets on a pin.
+func validatePin(pin ipfs.RemotePin) error {
+	if err := ipfs.ValidateCid(pin.Cid); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPinRequest, err.Error())
+	}
+	if len(pin.Name) > 255 {
+		return fmt.Errorf("%w: name is longer than 255 characters", ErrInvalidPinRequest)
+	}
+	if len(pin.Origins) > 20 {
+		return fmt.Errorf("%w: more than 20 origins", ErrInvalidPinRequest)
+	}
+	for key := range pin.Meta {
+		if !validMetaKey(key) {
+			return fmt.Errorf("%w: invalid meta key %q", ErrInvalidPinRequest, key)
+		}
+	}
+	return nil
+}
+
+// validMetaKey keeps metadata keys from being read as nested fields or
+// operators when they are used in a query.
+func validMetaKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, ".$")
+}
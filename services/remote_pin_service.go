@@ -0,0 +1,249 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/resilience"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RemotePinState is the state of the copy of a file pinned on the remote
+// pinning service. Status is one of the ipfs.RemotePin* statuses.
+type RemotePinState struct {
+	RequestID string    `json:"request_id,omitempty"  bson:"request_id,omitempty"`
+	Status    string    `json:"status"  bson:"status"`
+	Attempts  int       `json:"attempts"  bson:"attempts"`
+	LastError string    `json:"last_error,omitempty"  bson:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"  bson:"updated_at"`
+}
+
+// NewRemotePinState is the state of a file that has not been submitted to
+// the pinning service yet.
+func NewRemotePinState() *RemotePinState {
+	return &RemotePinState{
+		Status:    ipfs.RemotePinQueued,
+		UpdatedAt: time.Now().UTC(),
+	}
+}
+
+type ReconcileResult struct {
+	Submitted   int `json:"submitted"`
+	Refreshed   int `json:"refreshed"`
+	Resubmitted int `json:"resubmitted"`
+	GaveUp      int `json:"gave_up"`
+}
+
+// RemotePinService keeps uploads pinned on a remote pinning service as well
+// as on our own nodes, and tracks the state of each of those pins on the
+// file record.
+type RemotePinService struct {
+	client     *ipfs.RemotePinClient
+	repository FileRepository
+
+	// Origins are the multiaddrs of our nodes, given to the service so it
+	// can fetch the content from them directly
+	Origins []string
+	// MaxAttempts bounds how many times a pin is requested before it is left
+	// failed
+	MaxAttempts int
+}
+
+func NewRemotePinService(client *ipfs.RemotePinClient, repository FileRepository) *RemotePinService {
+	return &RemotePinService{
+		client:      client,
+		repository:  repository,
+		MaxAttempts: 10,
+	}
+}
+
+// Submit asks the service to pin file and stores the request on its record,
+// unless the file got another version meanwhile. A request the service
+// rejects is stored as failed, for Reconcile to request again. When the
+// service cannot be reached, the state is left as it was and the attempt is
+// not counted.
+func (r *RemotePinService) Submit(ctx context.Context, file *UserFile) error {
+	state := RemotePinState{Status: ipfs.RemotePinQueued}
+	if file.RemotePin != nil {
+		state = *file.RemotePin
+	}
+
+	status, err := r.client.Add(ctx, ipfs.RemotePin{
+		Cid:     file.Cid,
+		Name:    file.ID.Hex(),
+		Origins: r.Origins,
+	})
+	switch {
+	case err == nil:
+		state.RequestID = status.RequestID
+		state.Status = status.Status
+		state.Attempts++
+		state.LastError = ""
+	case isUnreachable(err):
+		state.LastError = err.Error()
+	default:
+		state.RequestID = ""
+		state.Status = ipfs.RemotePinFailed
+		state.Attempts++
+		state.LastError = err.Error()
+	}
+	state.UpdatedAt = time.Now().UTC()
+
+	file.RemotePin = &state
+	if updateErr := r.repository.UpdateRemotePin(ctx, file.ID, file.Cid, state); updateErr != nil {
+		return updateErr
+	}
+	return err
+}
+
+// SubmitAsync submits file in the background so the upload does not wait
+// for the pinning service. Reconcile picks up the ones that fail.
+func (r *RemotePinService) SubmitAsync(file UserFile) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := r.Submit(ctx, &file); err != nil {
+			log.Printf("remote pin: cannot submit %s: %s", file.Cid, err.Error())
+		}
+	}()
+}
+
+// Refresh polls the service for the status of the request of file and
+// stores it when it changed. A request the service no longer knows is
+// marked failed.
+func (r *RemotePinService) Refresh(ctx context.Context, file *UserFile) error {
+	if file.RemotePin == nil || file.RemotePin.RequestID == "" {
+		return nil
+	}
+	state := *file.RemotePin
+
+	status, err := r.client.Get(ctx, state.RequestID)
+	switch {
+	case ipfs.IsRemotePinNotFound(err):
+		state.Status = ipfs.RemotePinFailed
+		state.LastError = err.Error()
+	case err != nil:
+		return err
+	case status.Status == state.Status:
+		return nil
+	default:
+		state.Status = status.Status
+		state.LastError = status.Info["reason"]
+	}
+	state.UpdatedAt = time.Now().UTC()
+
+	file.RemotePin = &state
+	return r.repository.UpdateRemotePin(ctx, file.ID, file.Cid, state)
+}
+
+// Remove deletes the request of file from the service, which unpins it
+// there. Requests the service does not know are already gone.
+func (r *RemotePinService) Remove(ctx context.Context, file *UserFile) error {
+	if file.RemotePin == nil || file.RemotePin.RequestID == "" {
+		return nil
+	}
+
+	err := r.client.Delete(ctx, file.RemotePin.RequestID)
+	if ipfs.IsRemotePinNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Reconcile brings the remote pins up to date, batchSize files at a time:
+// files never submitted are submitted, the status of pending requests is
+// polled, and failed requests are replaced with new ones until MaxAttempts
+// is reached. Errors of single files are logged and skipped.
+func (r *RemotePinService) Reconcile(ctx context.Context, batchSize int64) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	pending := []string{ipfs.RemotePinQueued, ipfs.RemotePinPinning}
+	err := r.eachFile(ctx, pending, batchSize, func(file *UserFile) error {
+		if file.RemotePin.RequestID == "" {
+			result.Submitted++
+			return r.Submit(ctx, file)
+		}
+		result.Refreshed++
+		return r.Refresh(ctx, file)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	err = r.eachFile(ctx, []string{ipfs.RemotePinFailed}, batchSize, func(file *UserFile) error {
+		if file.RemotePin.Attempts >= r.MaxAttempts {
+			result.GaveUp++
+			return nil
+		}
+
+		// The failed request would otherwise stay listed on the service
+		if err := r.Remove(ctx, file); err != nil {
+			log.Printf("remote pin: cannot remove failed request of %s: %s", file.Cid, err.Error())
+		}
+		result.Resubmitted++
+		return r.Submit(ctx, file)
+	})
+	return result, err
+}
+
+// eachFile calls fn for every file whose remote pin has one of statuses.
+func (r *RemotePinService) eachFile(ctx context.Context, statuses []string, batchSize int64, fn func(file *UserFile) error) error {
+	var lastID primitive.ObjectID
+
+	for {
+		batch, err := r.repository.ListByRemotePinStatus(ctx, statuses, lastID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			file := &batch[i]
+			lastID = file.ID
+
+			if err := fn(file); err != nil {
+				log.Printf("remote pin: skipping %s: %s", file.Cid, err.Error())
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+
+		if int64(len(batch)) < batchSize {
+			return nil
+		}
+	}
+}
+
+// Watch reconciles the remote pins every interval until stop is closed.
+func (r *RemotePinService) Watch(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				result, err := r.Reconcile(context.Background(), 100)
+				if err != nil {
+					log.Println("Reconciling remote pins stopped:", err.Error())
+					continue
+				}
+				if result != (ReconcileResult{}) {
+					log.Printf("Reconciled remote pins: %+v\n", result)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// isUnreachable reports whether err means the pinning service could not be
+// reached, as opposed to an answer it gave.
+func isUnreachable(err error) bool {
+	return errors.Is(err, ipfs.ErrUpstreamUnavailable) || errors.Is(err, resilience.ErrCircuitOpen)
+}
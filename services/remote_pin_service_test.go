@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	ipfs "github.com/faizainur/ipfs-api/ipfs_client"
+	"github.com/faizainur/ipfs-api/ipfs_client/ipfstest"
+)
+
+// newRemotePinService returns a service whose pinning service accepts every
+// pin request, counting them in requests.
+func newRemotePinService(t *testing.T, repository FileRepository, requests *int32) *RemotePinService {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pin ipfs.RemotePin
+		if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(ipfs.RemotePinStatus{RequestID: "request-" + pin.Cid, Status: ipfs.RemotePinPinned, Pin: pin})
+	}))
+	t.Cleanup(server.Close)
+	return NewRemotePinService(ipfs.NewRemotePinClient(server.URL, "token"), repository)
+}
+
+func TestRemotePinSubmit(t *testing.T) {
+	ctx := context.Background()
+	files := NewMemoryFileRepository()
+	var requests int32
+	remote := newRemotePinService(t, files, &requests)
+
+	cid, _, _ := ipfstest.Import([]byte("a"), 1)
+	file := &UserFile{Email: "alice@example.com", Cid: cid, RemotePin: NewRemotePinState()}
+	if err := files.Save(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Submit(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := files.FindByID(ctx, file.Email, file.ID)
+	if stored.RemotePin == nil || stored.RemotePin.Status != ipfs.RemotePinPinned || stored.RemotePin.RequestID != "request-"+cid {
+		t.Fatalf("remote pin after Submit = %+v", stored.RemotePin)
+	}
+}
+
+func TestRemotePinSubmitOfAReplacedVersion(t *testing.T) {
+	ctx := context.Background()
+	files := NewMemoryFileRepository()
+	var requests int32
+	remote := newRemotePinService(t, files, &requests)
+
+	first, _, _ := ipfstest.Import([]byte("first"), 1)
+	file := &UserFile{Email: "alice@example.com", Cid: first, RemotePin: NewRemotePinState()}
+	if err := files.Save(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	// The reconciler read the file before its second version was stored
+	read := *file
+
+	second, _, _ := ipfstest.Import([]byte("second"), 1)
+	next := *file
+	next.Cid = second
+	next.Version = 2
+	next.RemotePin = NewRemotePinState()
+	if err := files.UpdateContent(ctx, &next); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Submit(ctx, &read); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := files.FindByID(ctx, file.Email, file.ID)
+	if stored.RemotePin == nil || stored.RemotePin.Status != ipfs.RemotePinQueued || stored.RemotePin.RequestID != "" {
+		t.Fatalf("the state of the first version was stored on the second: %+v", stored.RemotePin)
+	}
+
+	// The second version is still submitted
+	result, err := remote.Reconcile(ctx, 10)
+	if err != nil || result.Submitted != 1 {
+		t.Fatalf("Reconcile = %+v, %v", result, err)
+	}
+	stored, _ = files.FindByID(ctx, file.Email, file.ID)
+	if stored.RemotePin.RequestID != "request-"+second {
+		t.Fatalf("remote pin of the second version = %+v", stored.RemotePin)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("%d pin requests, want 2", got)
+	}
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+)
+
+type RewrapResult struct {
+	Rewrapped int `json:"rewrapped"`
+	Skipped   int `json:"skipped"`
+}
+
+// RewrapUserKeys migrates every user key that is not wrapped with the active
+// master key to it, batchSize keys at a time. Migrated keys no longer match
+// the query, so an interrupted run simply picks up where it stopped the next
+// time it is started. Keys wrapped with a version that is not in the keyring
+// are skipped and counted, as are keys that changed while being rewrapped.
+func (c *CryptoService) RewrapUserKeys(ctx context.Context, batchSize int64) (RewrapResult, error) {
+	var result RewrapResult
+	var lastEmail string
+
+	activeVersion, activeKey := c.keyring.Active()
+
+	for {
+		batch, err := c.store.List(ctx, KeyQuery{
+			ExcludeVersion: activeVersion,
+			AfterEmail:     lastEmail,
+			Limit:          batchSize,
+		})
+		if err != nil {
+			return result, err
+		}
+
+		for _, userKey := range batch {
+			lastEmail = userKey.Email
+
+			rewrapped, err := c.rewrapUserKey(userKey, activeKey)
+			if err != nil {
+				log.Printf("rewrap: skipping key of %s: %s", userKey.Email, err.Error())
+				result.Skipped++
+				continue
+			}
+
+			// Only replace the key we read, in case it changed in the meantime
+			replacement := UserKey{Email: userKey.Email, Key: rewrapped, KeyVersion: activeVersion}
+			rotated, err := c.store.Rotate(ctx, userKey.Email, userKey.Key, replacement)
+			if err != nil {
+				return result, err
+			}
+			if !rotated {
+				log.Printf("rewrap: skipping key of %s: it changed while being rewrapped", userKey.Email)
+				result.Skipped++
+				continue
+			}
+			result.Rewrapped++
+		}
+
+		if int64(len(batch)) < batchSize {
+			return result, nil
+		}
+	}
+}
+
+func (c *CryptoService) rewrapUserKey(userKey UserKey, activeKey []byte) (string, error) {
+	masterKey, ok := c.keyring.Key(userKey.KeyVersion)
+	if !ok {
+		return "", errors.New("master key version is not loaded")
+	}
+
+	wrappedKey, err := hex.DecodeString(userKey.Key)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := c.AESDecrypt(masterKey, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	rewrapped, err := c.AESEncrypt(activeKey, key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(rewrapped), nil
+}
+
+// ActiveKeyVersion returns the version of the master key wrapping new keys.
+func (c *CryptoService) ActiveKeyVersion() int {
+	version, _ := c.keyring.Active()
+	return version
+}
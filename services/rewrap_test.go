@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/faizainur/ipfs-api/cutils"
+)
+
+// failingKeyStore fails every Rotate after the first allowed ones, as a
+// database going away in the middle of a run would.
+type failingKeyStore struct {
+	*MemoryKeyStore
+	allowed int
+}
+
+func (f *failingKeyStore) Rotate(ctx context.Context, email string, wrappedKey string, replacement UserKey) (bool, error) {
+	if f.allowed == 0 {
+		return false, errors.New("connection lost")
+	}
+	f.allowed--
+	return f.MemoryKeyStore.Rotate(ctx, email, wrappedKey, replacement)
+}
+
+// racingKeyStore replaces the key of email right before it is rotated, as a
+// concurrent rewrap would.
+type racingKeyStore struct {
+	*MemoryKeyStore
+	email string
+}
+
+func (r *racingKeyStore) Rotate(ctx context.Context, email string, wrappedKey string, replacement UserKey) (bool, error) {
+	if email == r.email {
+		r.mutex.Lock()
+		key := r.keys[email]
+		key.Key = "changed"
+		r.keys[email] = key
+		r.mutex.Unlock()
+	}
+	return r.MemoryKeyStore.Rotate(ctx, email, wrappedKey, replacement)
+}
+
+func testKeyring(t *testing.T, keys map[int][]byte, active int) *cutils.Keyring {
+	t.Helper()
+	keyring, err := cutils.NewKeyring(keys, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// rotatedKeys stores count user keys wrapped with version 1 of the master
+// keys, and returns a keyring in which version 2 is active, with the
+// plaintext user keys by email.
+func rotatedKeys(t *testing.T, store KeyStore, count int) (*cutils.Keyring, map[string][]byte) {
+	t.Helper()
+	first, second := testKey(t), testKey(t)
+
+	crypto := NewCryptoService(testKeyring(t, map[int][]byte{1: first}, 1), store)
+	userKeys := make(map[string][]byte)
+	for i := 0; i < count; i++ {
+		email := fmt.Sprintf("user%02d@example.com", i)
+		key, err := crypto.GenerateUserKeyWithStoring(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userKeys[email] = key
+	}
+	return testKeyring(t, map[int][]byte{1: first, 2: second}, 2), userKeys
+}
+
+// checkUserKeys fails unless every key of userKeys is wrapped with version
+// and unwraps to the same key.
+func checkUserKeys(t *testing.T, crypto *CryptoService, store KeyStore, userKeys map[string][]byte, version int) {
+	t.Helper()
+	for email, want := range userKeys {
+		stored, err := store.Get(context.Background(), email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.KeyVersion != version {
+			t.Errorf("key of %s is wrapped with version %d, want %d", email, stored.KeyVersion, version)
+		}
+		got, err := crypto.FetchDecryptedKey(email)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("key of %s unwraps to %x, %v", email, got, err)
+		}
+	}
+}
+
+func TestRewrapUserKeys(t *testing.T) {
+	store := NewMemoryKeyStore()
+	keyring, userKeys := rotatedKeys(t, store, 5)
+	crypto := NewCryptoService(keyring, store)
+
+	result, err := crypto.RewrapUserKeys(context.Background(), 2)
+	if err != nil || result != (RewrapResult{Rewrapped: 5}) {
+		t.Fatalf("RewrapUserKeys = %+v, %v", result, err)
+	}
+	checkUserKeys(t, crypto, store, userKeys, 2)
+
+	// Keys already wrapped with the active version are left alone
+	result, err = crypto.RewrapUserKeys(context.Background(), 2)
+	if err != nil || result != (RewrapResult{}) {
+		t.Fatalf("second run = %+v, %v", result, err)
+	}
+}
+
+func TestRewrapUserKeysResumes(t *testing.T) {
+	store := NewMemoryKeyStore()
+	keyring, userKeys := rotatedKeys(t, store, 5)
+
+	interrupted := NewCryptoService(keyring, &failingKeyStore{MemoryKeyStore: store, allowed: 3})
+	result, err := interrupted.RewrapUserKeys(context.Background(), 2)
+	if err == nil || result.Rewrapped != 3 {
+		t.Fatalf("interrupted run = %+v, %v", result, err)
+	}
+
+	crypto := NewCryptoService(keyring, store)
+	result, err = crypto.RewrapUserKeys(context.Background(), 2)
+	if err != nil || result != (RewrapResult{Rewrapped: 2}) {
+		t.Fatalf("resumed run = %+v, %v", result, err)
+	}
+	checkUserKeys(t, crypto, store, userKeys, 2)
+}
+
+func TestRewrapUserKeysSkipsUnknownVersions(t *testing.T) {
+	store := NewMemoryKeyStore()
+	keyring, userKeys := rotatedKeys(t, store, 2)
+	unknown := UserKey{Email: "old@example.com", Key: "00ff", KeyVersion: 7}
+	store.PutIfAbsent(context.Background(), unknown)
+
+	crypto := NewCryptoService(keyring, store)
+	result, err := crypto.RewrapUserKeys(context.Background(), 10)
+	if err != nil || result != (RewrapResult{Rewrapped: 2, Skipped: 1}) {
+		t.Fatalf("RewrapUserKeys = %+v, %v", result, err)
+	}
+	checkUserKeys(t, crypto, store, userKeys, 2)
+	if stored, _ := store.Get(context.Background(), unknown.Email); stored != unknown {
+		t.Fatalf("key of an unknown version became %+v", stored)
+	}
+}
+
+func TestRewrapUserKeysSkipsChangedKeys(t *testing.T) {
+	store := NewMemoryKeyStore()
+	keyring, userKeys := rotatedKeys(t, store, 3)
+	changed := "user01@example.com"
+	delete(userKeys, changed)
+
+	crypto := NewCryptoService(keyring, &racingKeyStore{MemoryKeyStore: store, email: changed})
+	result, err := crypto.RewrapUserKeys(context.Background(), 10)
+	if err != nil || result != (RewrapResult{Rewrapped: 2, Skipped: 1}) {
+		t.Fatalf("RewrapUserKeys = %+v, %v", result, err)
+	}
+	checkUserKeys(t, crypto, store, userKeys, 2)
+	// The key written meanwhile is not overwritten
+	if stored, _ := store.Get(context.Background(), changed); stored.Key != "changed" || stored.KeyVersion != 1 {
+		t.Fatalf("changed key became %+v", stored)
+	}
+}
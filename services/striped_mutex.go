@@ -0,0 +1,27 @@
+package services
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// mutexStripes is how many mutexes a stripedMutex spreads its keys over.
+const mutexStripes = 64
+
+// stripedMutex serialises work on the same key with a fixed set of mutexes,
+// so that it does not grow with every key it has seen. Keys that share a
+// stripe wait on each other, so work holding the lock of one key must not
+// take the lock of another.
+type stripedMutex struct {
+	stripes [mutexStripes]sync.Mutex
+}
+
+// lock locks the stripe of key and returns the function unlocking it.
+func (m *stripedMutex) lock(key string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	mutex := &m.stripes[hash.Sum32()%mutexStripes]
+	mutex.Lock()
+	return mutex.Unlock
+}
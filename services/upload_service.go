@@ -0,0 +1,421 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUploadNotFound means there is no resumable upload with that ID for
+	// the user, or it expired.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrUploadOffsetMismatch means a chunk was sent for another offset than
+	// the one the upload reached.
+	ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+	// ErrUploadLocked means another request is writing to the upload.
+	ErrUploadLocked = errors.New("upload is being written by another request")
+	// ErrUploadTooLarge means the upload is larger than MaxSize allows.
+	ErrUploadTooLarge = errors.New("upload is too large")
+	// ErrInvalidUpload means an upload request is malformed.
+	ErrInvalidUpload = errors.New("invalid upload")
+)
+
+// UploadSession is a resumable upload. Its content is staged on local disk,
+// encrypted, until Offset reaches Length and it is stored like any other
+// upload, which sets FileID and Cid.
+type UploadSession struct {
+	ID        string            `json:"id"`
+	Email     string            `json:"email"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	FileID    string            `json:"file_id,omitempty"`
+	Cid       string            `json:"cid,omitempty"`
+
+	// The staged content is encrypted with AES-CTR from StagingIV, so chunks
+	// can be appended at any byte offset, under a key wrapped like the key of
+	// a file. FileKey keeps its wrapped form out of JSON, so it is held here.
+	StagingKeyID      string `json:"staging_key_id"`
+	StagingWrappedKey string `json:"staging_wrapped_key"`
+	StagingIV         string `json:"staging_iv"`
+}
+
+// Completed reports whether the upload has been stored.
+func (s *UploadSession) Completed() bool {
+	return s.Cid != ""
+}
+
+// CompleteFunc stores the content of a finished upload and returns the ID of
+// its file record and its CID.
+type CompleteFunc func(session *UploadSession, plaintext io.Reader) (fileID string, cid string, err error)
+
+// UploadService stages resumable uploads on local disk. Every upload is a
+// pair of files in the staging directory: <id>.info holds the session as
+// JSON and <id>.bin the content received so far, encrypted with a key
+// wrapped with the key of the user.
+type UploadService struct {
+	dir    string
+	crypto *CryptoService
+
+	// MaxSize bounds the length of an upload, zero for no limit
+	MaxSize int64
+	// Expiration is how long an upload is kept after its last chunk
+	Expiration time.Duration
+
+	locks sync.Map
+}
+
+func NewUploadService(dir string, crypto *CryptoService) (*UploadService, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &UploadService{
+		dir:        dir,
+		crypto:     crypto,
+		Expiration: 24 * time.Hour,
+	}, nil
+}
+
+// Create starts an upload of length bytes for email.
+func (u *UploadService) Create(email string, length int64, metadata map[string]string) (*UploadSession, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("%w: negative length", ErrInvalidUpload)
+	}
+	if u.MaxSize > 0 && length > u.MaxSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrUploadTooLarge, length, u.MaxSize)
+	}
+
+	_, stagingKey, err := u.crypto.NewFileKey(email)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := &UploadSession{
+		ID:                hex.EncodeToString(id),
+		Email:             email,
+		Length:            length,
+		Metadata:          metadata,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(u.Expiration),
+		StagingKeyID:      stagingKey.KeyID,
+		StagingWrappedKey: stagingKey.WrappedKey,
+		StagingIV:         hex.EncodeToString(iv),
+	}
+
+	file, err := os.OpenFile(u.path(session.ID, ".bin"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	if err := u.save(session); err != nil {
+		os.Remove(u.path(session.ID, ".bin"))
+		return nil, err
+	}
+	return session, nil
+}
+
+// Get returns the upload id of email.
+func (u *UploadService) Get(email string, id string) (*UploadSession, error) {
+	session, err := u.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.Email != email || time.Now().After(session.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	return session, nil
+}
+
+// Append writes the content of r to the upload id of email, which must be at
+// offset, and hands the upload to complete once it has all its bytes. What
+// was written is kept when r fails midway, so the client can resume from
+// there. An upload whose storage failed is retried by appending nothing at
+// its length.
+func (u *UploadService) Append(email string, id string, offset int64, r io.Reader, complete CompleteFunc) (*UploadSession, error) {
+	if _, busy := u.locks.LoadOrStore(id, true); busy {
+		return nil, ErrUploadLocked
+	}
+	defer u.locks.Delete(id)
+
+	session, err := u.Get(email, id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != session.Offset {
+		return session, fmt.Errorf("%w: the upload is at %d", ErrUploadOffsetMismatch, session.Offset)
+	}
+	if session.Completed() {
+		return session, nil
+	}
+
+	written, writeErr := u.write(session, io.LimitReader(r, session.Length-session.Offset))
+	session.Offset += written
+	if written > 0 {
+		session.ExpiresAt = time.Now().UTC().Add(u.Expiration)
+	}
+	if err := u.save(session); err != nil {
+		return nil, err
+	}
+	if writeErr != nil {
+		return session, writeErr
+	}
+
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n > 0 {
+		return session, fmt.Errorf("%w: more bytes than the length of the upload", ErrInvalidUpload)
+	}
+
+	if session.Offset < session.Length {
+		return session, nil
+	}
+	return session, u.complete(session, complete)
+}
+
+// Terminate removes the upload id of email and its staged content. An upload
+// being written cannot be terminated until the write is over.
+func (u *UploadService) Terminate(email string, id string) error {
+	if _, busy := u.locks.LoadOrStore(id, true); busy {
+		return ErrUploadLocked
+	}
+	defer u.locks.Delete(id)
+
+	if _, err := u.Get(email, id); err != nil {
+		return err
+	}
+	return u.remove(id)
+}
+
+// Expire removes the uploads that expired and returns how many there were.
+func (u *UploadService) Expire() (int, error) {
+	paths, err := filepath.Glob(filepath.Join(u.dir, "*.info"))
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	now := time.Now()
+	for _, path := range paths {
+		id := filepath.Base(path[:len(path)-len(".info")])
+		removed, err := u.expire(id, now)
+		if err != nil {
+			return expired, err
+		}
+		if removed {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// expire removes the upload id if it expired before now and is not being
+// written, and reports whether it did.
+func (u *UploadService) expire(id string, now time.Time) (bool, error) {
+	if _, busy := u.locks.LoadOrStore(id, true); busy {
+		return false, nil
+	}
+	defer u.locks.Delete(id)
+
+	session, err := u.load(id)
+	if err != nil || now.Before(session.ExpiresAt) {
+		return false, nil
+	}
+	return true, u.remove(id)
+}
+
+// Watch removes the expired uploads every interval until stop is closed.
+func (u *UploadService) Watch(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := u.Expire(); err != nil {
+					log.Println("Expiring uploads stopped:", err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// complete stores the staged content of session with complete and drops it
+// from the disk, keeping the session so the client can read the result
+// until it expires.
+func (u *UploadService) complete(session *UploadSession, complete CompleteFunc) error {
+	plaintext, err := u.open(session)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Close()
+
+	fileID, cid, err := complete(session, plaintext)
+	if err != nil {
+		return err
+	}
+
+	session.FileID, session.Cid = fileID, cid
+	if err := u.save(session); err != nil {
+		return err
+	}
+	return os.Remove(u.path(session.ID, ".bin"))
+}
+
+// write appends the content of r, encrypted, to the staged content of
+// session, which holds session.Offset bytes.
+func (u *UploadService) write(session *UploadSession, r io.Reader) (int64, error) {
+	stream, err := u.stagingStream(session, session.Offset)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(u.path(session.ID, ".bin"), os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// Bytes past the offset were written by a request that failed before
+	// saving the session, and are sent again
+	if err := file.Truncate(session.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(session.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(cipher.StreamWriter{S: stream, W: file}, r)
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+	return written, err
+}
+
+func (u *UploadService) open(session *UploadSession) (io.ReadCloser, error) {
+	stream, err := u.stagingStream(session, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(u.path(session.ID, ".bin"))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{cipher.StreamReader{S: stream, R: io.LimitReader(file, session.Length)}, file}, nil
+}
+
+// stagingStream returns the AES-CTR keystream of session positioned at
+// offset.
+func (u *UploadService) stagingStream(session *UploadSession, offset int64) (cipher.Stream, error) {
+	key, err := u.crypto.UnwrapFileKey(session.Email, FileKey{
+		KeyID:      session.StagingKeyID,
+		WrappedKey: session.StagingWrappedKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hex.DecodeString(session.StagingIV)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("%w: invalid staging IV", ErrDecryptionFailed)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The counter is the IV plus the number of blocks before the offset
+	counter := make([]byte, aes.BlockSize)
+	high, low := binary.BigEndian.Uint64(iv[:8]), binary.BigEndian.Uint64(iv[8:])
+	blocks := uint64(offset / aes.BlockSize)
+	if low+blocks < low {
+		high++
+	}
+	binary.BigEndian.PutUint64(counter[:8], high)
+	binary.BigEndian.PutUint64(counter[8:], low+blocks)
+
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream, nil
+}
+
+func (u *UploadService) load(id string) (*UploadSession, error) {
+	if decoded, err := hex.DecodeString(id); err != nil || len(decoded) != 16 {
+		return nil, ErrUploadNotFound
+	}
+
+	data, err := ioutil.ReadFile(u.path(id, ".info"))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// save writes the session to a temporary file first, so a crash never
+// leaves half of it on disk.
+func (u *UploadService) save(session *UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	temporary := u.path(session.ID, ".info.tmp")
+	if err := ioutil.WriteFile(temporary, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, u.path(session.ID, ".info"))
+}
+
+func (u *UploadService) remove(id string) error {
+	if err := os.Remove(u.path(id, ".bin")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(u.path(id, ".info")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (u *UploadService) path(id string, extension string) string {
+	return filepath.Join(u.dir, id+extension)
+}